@@ -2,6 +2,7 @@ package cmd
 
 import (
 	"github.com/spf13/cobra"
+	"github.com/steinarvk/playdough/pkg/pdadmin"
 	"github.com/steinarvk/playdough/pkg/pdclient"
 	"github.com/steinarvk/playdough/pkg/pderr"
 	"github.com/steinarvk/playdough/pkg/pdservermain"
@@ -20,6 +21,7 @@ func makeRootCmd() *cobra.Command {
 
 	rootCmd.AddCommand(makeServeCmd())
 	rootCmd.AddCommand(pdclient.MakeCobraCommandGroup())
+	rootCmd.AddCommand(pdadmin.MakeAdminCommandGroup())
 	rootCmd.AddCommand(pdtestutils.MakeTestingCommandGroup())
 
 	return rootCmd
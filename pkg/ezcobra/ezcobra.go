@@ -3,6 +3,9 @@ package ezcobra
 import (
 	"context"
 	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/spf13/cobra"
 	"github.com/steinarvk/playdough/pkg/logging"
@@ -40,3 +43,20 @@ func RunENoArgs(core func(ctx context.Context) error) func(*cobra.Command, []str
 func RunNoArgs(core func(ctx context.Context) error) func(*cobra.Command, []string) {
 	return HandleErrors(RunENoArgs(core))
 }
+
+// RunNoArgsUntilSignalled is like RunNoArgs, but cancels the context on SIGINT or
+// SIGTERM, so that long-running commands can shut down cleanly. A second signal
+// kills the process as usual.
+func RunNoArgsUntilSignalled(core func(ctx context.Context) error) func(*cobra.Command, []string) {
+	return RunNoArgs(func(ctx context.Context) error {
+		ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		go func() {
+			<-ctx.Done()
+			stop()
+		}()
+
+		return core(ctx)
+	})
+}
@@ -0,0 +1,195 @@
+package pdadmin
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/steinarvk/playdough/pkg/logging"
+	"github.com/steinarvk/playdough/pkg/pddb/userdb"
+	"github.com/steinarvk/playdough/pkg/pderr"
+	"github.com/steinarvk/playdough/pkg/pdservermain"
+	"github.com/steinarvk/playdough/proto/pdpb"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+)
+
+// Imported hashes are verified on every login, so their cost parameters are capped
+// to keep a bad row from making logins arbitrarily slow or memory-hungry.
+const (
+	maxImportedHashMemoryBytes = 256 << 20
+	maxImportedScryptP         = 16
+	maxImportedArgon2TimeCost  = 10
+)
+
+// ImportedUser is one line of the JSON lines file read by import-users.
+type ImportedUser struct {
+	Username string `json:"username"`
+
+	// One of "bcrypt", "scrypt" or "argon2".
+	Algorithm string `json:"algorithm"`
+
+	// For bcrypt, the hash in its usual "$2a$..." form, which includes the salt and cost.
+	// For the other algorithms, the base64-encoded raw hash and salt.
+	Hash string `json:"hash"`
+	Salt string `json:"salt,omitempty"`
+
+	ScryptN int `json:"scrypt_n,omitempty"`
+	ScryptR int `json:"scrypt_r,omitempty"`
+	ScryptP int `json:"scrypt_p,omitempty"`
+
+	Argon2TimeCost    int `json:"argon2_time_cost,omitempty"`
+	Argon2MemoryCost  int `json:"argon2_memory_cost,omitempty"`
+	Argon2Parallelism int `json:"argon2_parallelism,omitempty"`
+}
+
+func (u ImportedUser) decode() (*pdpb.PasswordHashingMethod, []byte, []byte, error) {
+	if u.Algorithm == "bcrypt" {
+		return &pdpb.PasswordHashingMethod{
+			Method: &pdpb.PasswordHashingMethod_Bcrypt{
+				Bcrypt: &pdpb.BcryptParams{},
+			},
+		}, []byte(u.Hash), nil, nil
+	}
+
+	hash, err := base64.StdEncoding.DecodeString(u.Hash)
+	if err != nil {
+		return nil, nil, nil, pderr.BadInput("hash is not valid base64", "hash", u.Hash)
+	}
+
+	salt, err := base64.StdEncoding.DecodeString(u.Salt)
+	if err != nil {
+		return nil, nil, nil, pderr.BadInput("salt is not valid base64", "salt", u.Salt)
+	}
+
+	switch u.Algorithm {
+	case "scrypt":
+		if u.ScryptN <= 1 || u.ScryptR <= 0 || u.ScryptP <= 0 {
+			return nil, nil, nil, pderr.Error(codes.InvalidArgument, "scrypt_n, scrypt_r and scrypt_p are required for scrypt")
+		}
+		if u.ScryptN&(u.ScryptN-1) != 0 {
+			return nil, nil, nil, pderr.BadInput("scrypt_n must be a power of two", "scrypt_n", fmt.Sprint(u.ScryptN))
+		}
+		// scrypt needs 128*N*r bytes of memory.
+		if u.ScryptR > maxImportedHashMemoryBytes/128 || u.ScryptN > maxImportedHashMemoryBytes/(128*u.ScryptR) {
+			return nil, nil, nil, pderr.BadInput(fmt.Sprintf("scrypt_n and scrypt_r must need at most %d MiB of memory", maxImportedHashMemoryBytes>>20), "scrypt_n", fmt.Sprint(u.ScryptN))
+		}
+		if u.ScryptP > maxImportedScryptP {
+			return nil, nil, nil, pderr.BadInput(fmt.Sprintf("scrypt_p must be at most %d", maxImportedScryptP), "scrypt_p", fmt.Sprint(u.ScryptP))
+		}
+		return &pdpb.PasswordHashingMethod{
+			Method: &pdpb.PasswordHashingMethod_Scrypt{
+				Scrypt: &pdpb.ScryptParams{
+					N:         uint32(u.ScryptN),
+					R:         uint32(u.ScryptR),
+					P:         uint32(u.ScryptP),
+					KeyLength: uint32(len(hash)),
+				},
+			},
+		}, hash, salt, nil
+
+	case "argon2":
+		if u.Argon2TimeCost <= 0 || u.Argon2MemoryCost <= 0 || u.Argon2Parallelism <= 0 {
+			return nil, nil, nil, pderr.Error(codes.InvalidArgument, "argon2_time_cost, argon2_memory_cost and argon2_parallelism are required for argon2")
+		}
+		if u.Argon2TimeCost > maxImportedArgon2TimeCost {
+			return nil, nil, nil, pderr.BadInput(fmt.Sprintf("argon2_time_cost must be at most %d", maxImportedArgon2TimeCost), "argon2_time_cost", fmt.Sprint(u.Argon2TimeCost))
+		}
+		// The memory cost is in KiB.
+		if u.Argon2MemoryCost > maxImportedHashMemoryBytes>>10 {
+			return nil, nil, nil, pderr.BadInput(fmt.Sprintf("argon2_memory_cost must be at most %d KiB", maxImportedHashMemoryBytes>>10), "argon2_memory_cost", fmt.Sprint(u.Argon2MemoryCost))
+		}
+		if u.Argon2Parallelism > 255 {
+			return nil, nil, nil, pderr.BadInput("argon2_parallelism must be at most 255", "argon2_parallelism", fmt.Sprint(u.Argon2Parallelism))
+		}
+		return &pdpb.PasswordHashingMethod{
+			Method: &pdpb.PasswordHashingMethod_Argon2{
+				Argon2: &pdpb.Argon2Params{
+					TimeCost:    uint32(u.Argon2TimeCost),
+					MemoryCost:  uint32(u.Argon2MemoryCost),
+					KeyLength:   uint32(len(hash)),
+					Parallelism: uint32(u.Argon2Parallelism),
+				},
+			},
+		}, hash, salt, nil
+
+	default:
+		return nil, nil, nil, pderr.BadInput("unsupported algorithm", "algorithm", u.Algorithm)
+	}
+}
+
+// ImportUsers reads users with existing password hashes, one JSON object per line,
+// and creates them all in a single transaction.
+func ImportUsers(ctx context.Context, db *sql.DB, credentials pdservermain.CredentialParams, r io.Reader) (int, error) {
+	logger := logging.FromContext(ctx)
+
+	users, err := userdb.New(db, credentials.UserDBOptions()...)
+	if err != nil {
+		return 0, err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, pderr.Unexpectedf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	scanner := bufio.NewScanner(r)
+	lineNumber := 0
+	numImported := 0
+
+	for scanner.Scan() {
+		lineNumber++
+
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		var imported ImportedUser
+		if err := json.Unmarshal([]byte(line), &imported); err != nil {
+			return 0, pderr.WrapAs(codes.InvalidArgument, fmt.Sprintf("line %d: invalid JSON", lineNumber), err)
+		}
+
+		hashingMethod, hash, salt, err := imported.decode()
+		if err != nil {
+			return 0, pderr.Wrap(fmt.Sprintf("line %d", lineNumber), err)
+		}
+
+		if _, err := users.ImportUserWithPasswordHash(ctx, tx, imported.Username, hashingMethod, hash, salt); err != nil {
+			return 0, pderr.Wrap(fmt.Sprintf("line %d (user %q)", lineNumber, imported.Username), err)
+		}
+
+		numImported++
+	}
+
+	if err := scanner.Err(); err != nil {
+		return 0, pderr.Wrap("failed to read input", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, pderr.Unexpectedf("failed to commit transaction: %v", err)
+	}
+
+	logger.Info("imported users", zap.Int("count", numImported))
+
+	return numImported, nil
+}
+
+func openInput(path string) (io.ReadCloser, error) {
+	if path == "-" {
+		return io.NopCloser(os.Stdin), nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, pderr.Wrap("failed to open input file", err)
+	}
+	return f, nil
+}
@@ -0,0 +1,41 @@
+package pdadmin
+
+import (
+	"testing"
+
+	"github.com/steinarvk/playdough/pkg/pderr"
+	"google.golang.org/grpc/codes"
+)
+
+func TestImportedUserDecodeValidatesCostParameters(t *testing.T) {
+	scrypt := func(n, r, p int) ImportedUser {
+		return ImportedUser{Username: "alice", Algorithm: "scrypt", Hash: "aGFzaA==", Salt: "c2FsdA==", ScryptN: n, ScryptR: r, ScryptP: p}
+	}
+	argon2 := func(timeCost, memoryCost, parallelism int) ImportedUser {
+		return ImportedUser{Username: "alice", Algorithm: "argon2", Hash: "aGFzaA==", Salt: "c2FsdA==", Argon2TimeCost: timeCost, Argon2MemoryCost: memoryCost, Argon2Parallelism: parallelism}
+	}
+
+	for _, tc := range []struct {
+		name string
+		user ImportedUser
+		want codes.Code
+	}{
+		{"typical scrypt", scrypt(16384, 8, 1), codes.OK},
+		{"scrypt N not a power of two", scrypt(10000, 8, 1), codes.InvalidArgument},
+		{"scrypt N of one", scrypt(1, 8, 1), codes.InvalidArgument},
+		{"scrypt needing too much memory", scrypt(1<<20, 8, 1), codes.InvalidArgument},
+		{"scrypt with huge r", scrypt(2, 1<<40, 1), codes.InvalidArgument},
+		{"scrypt with too much parallelism", scrypt(16384, 8, 1000), codes.InvalidArgument},
+		{"typical argon2", argon2(3, 64*1024, 4), codes.OK},
+		{"argon2 with too many iterations", argon2(1000, 64*1024, 4), codes.InvalidArgument},
+		{"argon2 needing too much memory", argon2(3, 1<<30, 4), codes.InvalidArgument},
+		{"argon2 parallelism overflowing a byte", argon2(3, 64*1024, 256), codes.InvalidArgument},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, _, _, err := tc.user.decode()
+			if got := pderr.CodeOf(err); got != tc.want {
+				t.Errorf("decode() = %v, want %v", err, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,247 @@
+package pdadmin
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"slices"
+	"syscall"
+
+	"github.com/spf13/cobra"
+	"github.com/steinarvk/playdough/pkg/ezcobra"
+	"github.com/steinarvk/playdough/pkg/logging"
+	"github.com/steinarvk/playdough/pkg/pdauth"
+	"github.com/steinarvk/playdough/pkg/pddb"
+	"github.com/steinarvk/playdough/pkg/pddb/userdb"
+	"github.com/steinarvk/playdough/pkg/pderr"
+	"github.com/steinarvk/playdough/pkg/pdservermain"
+	"github.com/steinarvk/playdough/pkg/pdusername"
+	"go.uber.org/zap"
+	"golang.org/x/term"
+	"google.golang.org/grpc/codes"
+)
+
+type CommonParams struct {
+	PostgresConnectionString string
+	Automigrate              bool
+	// The same as the server's, so that users created here follow its rules.
+	Credentials pdservermain.CredentialParams
+}
+
+type BootstrapAdminParams struct {
+	Username string
+	Force    bool
+}
+
+// load applies the environment and the config file shared with serve to the
+// command's flags, and loads the credential policy.
+func (p *CommonParams) load(cmd *cobra.Command) error {
+	if err := pdservermain.ApplySharedConfig(cmd.Flags()); err != nil {
+		return err
+	}
+	return p.Credentials.Load()
+}
+
+func openDatabase(ctx context.Context, params *CommonParams) (*sql.DB, error) {
+	if params.PostgresConnectionString == "" {
+		return nil, pderr.MissingRequiredFlag("--postgres_db")
+	}
+
+	db, err := sql.Open("postgres", params.PostgresConnectionString)
+	if err != nil {
+		return nil, pderr.Wrap("failed to open database connection", err)
+	}
+
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, pderr.Wrap("failed to ping database", err)
+	}
+
+	if params.Automigrate {
+		if err := pddb.RunMigrations(ctx, db); err != nil {
+			db.Close()
+			return nil, pderr.Wrap("failed to run migrations", err)
+		}
+	}
+
+	return db, nil
+}
+
+func readNewPassword(username string) (string, error) {
+	fmt.Printf("Password for new user %q: ", username)
+	passwordOnce, err := term.ReadPassword(syscall.Stdin)
+	if err != nil {
+		return "", pderr.Wrap("error reading password from stdin", err)
+	}
+	fmt.Println()
+
+	fmt.Printf("Repeat password for new user %q: ", username)
+	passwordTwice, err := term.ReadPassword(syscall.Stdin)
+	if err != nil {
+		return "", pderr.Wrap("error re-reading password from stdin", err)
+	}
+	fmt.Println()
+
+	if !bytes.Equal(passwordOnce, passwordTwice) {
+		return "", pderr.Error(codes.InvalidArgument, "passwords do not match")
+	}
+
+	return string(passwordOnce), nil
+}
+
+// BootstrapAdmin grants the admin role to a user, creating the user first if it
+// does not exist. It refuses to run if an admin already exists, unless forced.
+// The user may have a reserved name such as "admin": reserving it is what keeps
+// anyone else from registering it.
+func BootstrapAdmin(ctx context.Context, db *sql.DB, credentials pdservermain.CredentialParams, params BootstrapAdminParams) error {
+	logger := logging.FromContext(ctx)
+
+	if params.Username == "" {
+		return pderr.MissingRequiredFlag("--username")
+	}
+
+	credentials.CredentialPolicy.ReservedUsernames = slices.DeleteFunc(slices.Clone(credentials.CredentialPolicy.ReservedUsernames), func(name string) bool {
+		return pdusername.Canonical(name) == pdusername.Canonical(params.Username)
+	})
+
+	auth := pdauth.NewValidator(db)
+	users, err := userdb.New(db, credentials.UserDBOptions()...)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return pderr.Unexpectedf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	numAdmins, err := auth.CountUsersWithRole(ctx, tx, pdauth.RoleAdmin)
+	if err != nil {
+		return err
+	}
+
+	if numAdmins > 0 && !params.Force {
+		return pderr.Error(codes.FailedPrecondition, fmt.Sprintf("%d admin(s) already exist; use --force to add another", numAdmins))
+	}
+
+	err = auth.GrantRole(ctx, tx, params.Username, pdauth.RoleAdmin)
+	if pderr.CodeOf(err) == codes.NotFound {
+		logger.Info("user does not exist; creating it", zap.String("username", params.Username))
+
+		password, err := readNewPassword(params.Username)
+		if err != nil {
+			return err
+		}
+
+		if _, err := users.RegisterUserWithPassword(ctx, tx, params.Username, password); err != nil {
+			return err
+		}
+
+		err = auth.GrantRole(ctx, tx, params.Username, pdauth.RoleAdmin)
+		if err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return pderr.Unexpectedf("failed to commit transaction: %v", err)
+	}
+
+	logger.Info("bootstrapped admin user", zap.String("username", params.Username))
+
+	return nil
+}
+
+func MakeAdminCommandGroup() *cobra.Command {
+	var params CommonParams
+
+	group := &cobra.Command{
+		Use:   "admin",
+		Short: "administrative commands operating directly on the database",
+	}
+
+	group.PersistentFlags().StringVar(&params.PostgresConnectionString, "postgres_db", "", "postgres connection string")
+	group.PersistentFlags().BoolVar(&params.Automigrate, "automigrate", true, "run database migrations before running the command")
+	pdservermain.AddConfigFlag(group.PersistentFlags())
+	params.Credentials = pdservermain.DefaultCredentialParams()
+	params.Credentials.AddFlags(group.PersistentFlags())
+
+	var bootstrapParams BootstrapAdminParams
+
+	var bootstrapCmd *cobra.Command
+	bootstrapCmd = &cobra.Command{
+		Use:   "bootstrap-admin",
+		Short: "create the first admin user",
+		Run: ezcobra.RunNoArgs(func(ctx context.Context) error {
+			if err := params.load(bootstrapCmd); err != nil {
+				return err
+			}
+
+			db, err := openDatabase(ctx, &params)
+			if err != nil {
+				return err
+			}
+			defer db.Close()
+
+			return BootstrapAdmin(ctx, db, params.Credentials, bootstrapParams)
+		}),
+	}
+
+	bootstrapCmd.Flags().StringVar(&bootstrapParams.Username, "username", "", "user to make admin (created if it does not exist)")
+	bootstrapCmd.Flags().BoolVar(&bootstrapParams.Force, "force", false, "add an admin even if one already exists")
+
+	group.AddCommand(bootstrapCmd)
+
+	var importInputPath string
+
+	var importCmd *cobra.Command
+	importCmd = &cobra.Command{
+		Use:   "import-users",
+		Short: "import users with existing bcrypt, scrypt or argon2 password hashes",
+		Long: `Import users with existing password hashes from a JSON lines file, e.g.:
+
+  {"username": "alice", "algorithm": "bcrypt", "hash": "$2a$10$..."}
+  {"username": "bob", "algorithm": "scrypt", "hash": "<base64>", "salt": "<base64>", "scrypt_n": 16384, "scrypt_r": 8, "scrypt_p": 1}
+
+Imported passwords are rehashed with the active hashing method on the user's next login.`,
+		Run: ezcobra.RunNoArgs(func(ctx context.Context) error {
+			if err := params.load(importCmd); err != nil {
+				return err
+			}
+
+			if importInputPath == "" {
+				return pderr.MissingRequiredFlag("--input")
+			}
+
+			input, err := openInput(importInputPath)
+			if err != nil {
+				return err
+			}
+			defer input.Close()
+
+			db, err := openDatabase(ctx, &params)
+			if err != nil {
+				return err
+			}
+			defer db.Close()
+
+			numImported, err := ImportUsers(ctx, db, params.Credentials, input)
+			if err != nil {
+				return err
+			}
+
+			fmt.Printf("Imported %d users\n", numImported)
+			return nil
+		}),
+	}
+
+	importCmd.Flags().StringVar(&importInputPath, "input", "", "JSON lines file of users to import (- for stdin)")
+
+	group.AddCommand(importCmd)
+
+	return group
+}
@@ -0,0 +1,285 @@
+package pdauth
+
+import (
+	"context"
+	cryptorand "crypto/rand"
+	"database/sql"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+	"github.com/steinarvk/playdough/pkg/logging"
+	"github.com/steinarvk/playdough/pkg/pderr"
+	"github.com/steinarvk/playdough/pkg/pdsecret"
+	"github.com/steinarvk/playdough/pkg/pdusername"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+)
+
+type Scope string
+
+const (
+	ScopeReadBalance Scope = "read-balance"
+	ScopeTransfer    Scope = "transfer"
+	ScopeMint        Scope = "mint"
+)
+
+func AllScopes() []Scope {
+	return []Scope{
+		ScopeReadBalance,
+		ScopeTransfer,
+		ScopeMint,
+	}
+}
+
+func ParseScope(s string) (Scope, error) {
+	for _, scope := range AllScopes() {
+		if string(scope) == s {
+			return scope, nil
+		}
+	}
+	return "", pderr.BadInput("unknown scope", "scope", s)
+}
+
+const (
+	apiKeyPrefix     = "pdk"
+	apiKeySecretSize = 32
+
+	maxAPIKeyNameLength = 64
+)
+
+type APIKeyInfo struct {
+	KeyUUID        uuid.UUID
+	Name           string
+	Scopes         []Scope
+	CreationTime   time.Time
+	ExpirationTime time.Time
+	Revoked        bool
+}
+
+func scopesToStrings(scopes []Scope) []string {
+	rv := make([]string, len(scopes))
+	for i, scope := range scopes {
+		rv[i] = string(scope)
+	}
+	return rv
+}
+
+func scopesFromStrings(scopeStrings []string) []Scope {
+	rv := make([]Scope, len(scopeStrings))
+	for i, s := range scopeStrings {
+		rv[i] = Scope(s)
+	}
+	return rv
+}
+
+// CreateAPIKey creates a new API key for the given user, returning the secret key
+// string. Only a hash of the secret is stored, so it cannot be recovered later.
+func (a *AuthValidator) CreateAPIKey(ctx context.Context, tx *sql.Tx, username, name string, scopes []Scope, validDuration time.Duration) (string, *APIKeyInfo, error) {
+	logger := logging.FromContext(ctx)
+
+	if name == "" || len(name) > maxAPIKeyNameLength {
+		return "", nil, pderr.BadInput("API key name must be between 1 and 64 characters", "name", name)
+	}
+
+	if len(scopes) == 0 {
+		return "", nil, pderr.Error(codes.InvalidArgument, "API key must have at least one scope")
+	}
+
+	if validDuration <= 0 {
+		return "", nil, pderr.BadInput("API key validity must be positive", "valid_duration", validDuration.String())
+	}
+
+	secret := make([]byte, apiKeySecretSize)
+	if _, err := cryptorand.Read(secret); err != nil {
+		return "", nil, pderr.Wrap("failed to generate API key secret", err)
+	}
+
+	keyUUID, err := uuid.NewRandom()
+	if err != nil {
+		return "", nil, pderr.Wrap("failed to generate API key UUID", err)
+	}
+
+	now := time.Now()
+
+	info := &APIKeyInfo{
+		KeyUUID:        keyUUID,
+		Name:           name,
+		Scopes:         scopes,
+		CreationTime:   now,
+		ExpirationTime: now.Add(validDuration),
+	}
+
+	result, err := tx.ExecContext(
+		ctx,
+		`
+			INSERT INTO api_keys
+				(api_key_uuid,
+				 user_id,
+				 key_name,
+				 key_secret_hash,
+				 scopes,
+				 creation_timestamp,
+				 expiration_timestamp)
+			SELECT
+				$1, users.user_id, $3, $4, $5, $6, $7
+			FROM users
+			WHERE users.canonical_username = $2
+		`,
+		keyUUID, pdusername.Canonical(username), name, pdsecret.Hash(secret), pq.Array(scopesToStrings(scopes)), info.CreationTime, info.ExpirationTime,
+	)
+	if err != nil {
+		return "", nil, pderr.Wrap("failed to insert API key", err)
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return "", nil, pderr.WrapAs(codes.Internal, "failed to insert API key", err)
+	}
+	if n != 1 {
+		return "", nil, pderr.Error(codes.NotFound, "no such user")
+	}
+
+	logger.Info("created API key",
+		zap.String("username", username),
+		zap.Stringer("api_key_uuid", keyUUID),
+		zap.String("name", name),
+		zap.Strings("scopes", scopesToStrings(scopes)),
+		zap.Time("expires_at", info.ExpirationTime),
+	)
+
+	return pdsecret.Format(apiKeyPrefix, keyUUID, secret), info, nil
+}
+
+func (a *AuthValidator) ListAPIKeys(ctx context.Context, tx *sql.Tx, username string) ([]*APIKeyInfo, error) {
+	rows, err := tx.QueryContext(
+		ctx,
+		`
+			SELECT
+				api_keys.api_key_uuid,
+				api_keys.key_name,
+				api_keys.scopes,
+				api_keys.creation_timestamp,
+				api_keys.expiration_timestamp,
+				api_keys.revocation_timestamp IS NOT NULL
+			FROM api_keys
+			JOIN users ON api_keys.user_id = users.user_id
+			WHERE users.canonical_username = $1
+			ORDER BY api_keys.creation_timestamp
+		`,
+		pdusername.Canonical(username),
+	)
+	if err != nil {
+		return nil, pderr.Wrap("failed to list API keys", err)
+	}
+	defer rows.Close()
+
+	var rv []*APIKeyInfo
+
+	for rows.Next() {
+		var info APIKeyInfo
+		var scopeStrings []string
+
+		if err := rows.Scan(&info.KeyUUID, &info.Name, pq.Array(&scopeStrings), &info.CreationTime, &info.ExpirationTime, &info.Revoked); err != nil {
+			return nil, pderr.Wrap("failed to scan API key", err)
+		}
+		info.Scopes = scopesFromStrings(scopeStrings)
+
+		rv = append(rv, &info)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, pderr.Wrap("failed to list API keys", err)
+	}
+
+	return rv, nil
+}
+
+func (a *AuthValidator) RevokeAPIKey(ctx context.Context, tx *sql.Tx, username string, keyUUID uuid.UUID) error {
+	logger := logging.FromContext(ctx)
+
+	result, err := tx.ExecContext(
+		ctx,
+		`
+			UPDATE api_keys
+			SET revocation_timestamp = CURRENT_TIMESTAMP
+			FROM users
+			WHERE api_keys.user_id = users.user_id
+			  AND users.canonical_username = $1
+			  AND api_keys.api_key_uuid = $2
+			  AND api_keys.revocation_timestamp IS NULL
+		`,
+		pdusername.Canonical(username), keyUUID,
+	)
+	if err != nil {
+		return pderr.Wrap("failed to revoke API key", err)
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return pderr.Wrap("failed to revoke API key", err)
+	}
+
+	if n == 0 {
+		return pderr.Error(codes.NotFound, "no such active API key")
+	}
+
+	logger.Info("revoked API key", zap.String("username", username), zap.Stringer("api_key_uuid", keyUUID))
+
+	return nil
+}
+
+func (a *AuthValidator) validateAPIKey(ctx context.Context, apiKey string) (AuthInfo, error) {
+	keyUUID, secret, ok := pdsecret.Parse(apiKeyPrefix, apiKey)
+	if !ok {
+		return notAuthenticated, pderr.Unauthenticated("malformed API key")
+	}
+
+	var username string
+	var secretHash []byte
+	var scopeStrings []string
+	var expirationTime time.Time
+	var revoked bool
+
+	err := a.db.QueryRowContext(
+		ctx,
+		`
+			SELECT
+				users.username,
+				api_keys.key_secret_hash,
+				api_keys.scopes,
+				api_keys.expiration_timestamp,
+				api_keys.revocation_timestamp IS NOT NULL
+			FROM api_keys
+			JOIN users ON api_keys.user_id = users.user_id
+			WHERE api_keys.api_key_uuid = $1
+			  AND users.deactivation_timestamp IS NULL
+		`,
+		keyUUID,
+	).Scan(&username, &secretHash, pq.Array(&scopeStrings), &expirationTime, &revoked)
+	if err == sql.ErrNoRows {
+		return notAuthenticated, pderr.Unauthenticated("unknown API key")
+	}
+	if err != nil {
+		return notAuthenticated, pderr.Wrap("failed to look up API key", err)
+	}
+
+	if !pdsecret.Matches(secret, secretHash) {
+		return notAuthenticated, pderr.Unauthenticated("invalid API key")
+	}
+
+	if revoked {
+		return notAuthenticated, pderr.Unauthenticated("API key has been revoked")
+	}
+
+	if !time.Now().Before(expirationTime) {
+		return notAuthenticated, pderr.Unauthenticated("API key has expired")
+	}
+
+	return AuthInfo{
+		IsAuthenticated:       true,
+		AuthenticatedUsername: username,
+		Scopes:                scopesFromStrings(scopeStrings),
+		APIKeyUUID:            keyUUID,
+	}, nil
+}
@@ -0,0 +1,45 @@
+package pdauth
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/steinarvk/playdough/pkg/pderr"
+	"github.com/steinarvk/playdough/pkg/pdusername"
+)
+
+// ValidateClientCertificate authenticates a request by the name in its verified TLS
+// client certificate, which must be that of an active user. Like a password-only
+// session, it does not carry issuer rights.
+func (a *AuthValidator) ValidateClientCertificate(ctx context.Context, certificateName string) (AuthInfo, error) {
+	var username string
+
+	err := a.db.QueryRowContext(
+		ctx,
+		`
+			SELECT username
+			FROM users
+			WHERE canonical_username = $1
+			  AND deactivation_timestamp IS NULL
+		`,
+		pdusername.Canonical(certificateName),
+	).Scan(&username)
+	if err == sql.ErrNoRows {
+		return notAuthenticated, pderr.Unauthenticated("client certificate does not name an active user")
+	}
+	if err != nil {
+		return notAuthenticated, pderr.Wrap("failed to look up client certificate user", err)
+	}
+
+	roles, err := a.loadRoles(ctx, username)
+	if err != nil {
+		return notAuthenticated, err
+	}
+
+	return AuthInfo{
+		IsAuthenticated:       true,
+		AuthenticatedUsername: username,
+		Roles:                 withoutRole(roles, RoleIssuer),
+		ClientCertificate:     true,
+	}, nil
+}
@@ -26,6 +26,30 @@ const (
 type AuthInfo struct {
 	IsAuthenticated       bool
 	AuthenticatedUsername string
+	Roles                 []Role
+	Scopes                []Scope
+
+	// Set only when authenticated by an API key rather than a session token.
+	APIKeyUUID uuid.UUID
+
+	// Whether the session was established with a second factor in addition to the password.
+	SecondFactorVerified bool
+
+	// Set when authenticated by a TLS client certificate rather than a header.
+	ClientCertificate bool
+}
+
+func (a AuthInfo) HasScope(scope Scope) bool {
+	for _, granted := range a.Scopes {
+		if granted == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func (a AuthInfo) IsAPIKey() bool {
+	return a.APIKeyUUID != uuid.Nil
 }
 
 var (
@@ -42,6 +66,27 @@ type AuthValidator struct {
 	cachedAlgorithmIDs   map[string]int
 	cachedSigningKey     *SigningKey
 	cachedValidationKeys map[uuid.UUID]*SigningKey
+
+	// Protected by mu, like the caches they count lookups in.
+	keyCacheHits   uint64
+	keyCacheMisses uint64
+}
+
+// KeyCacheStats counts lookups of signing and validation keys, and how many were
+// answered from the cache rather than the database.
+type KeyCacheStats struct {
+	Hits   uint64
+	Misses uint64
+}
+
+func (a *AuthValidator) KeyCacheStats() KeyCacheStats {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return KeyCacheStats{
+		Hits:   a.keyCacheHits,
+		Misses: a.keyCacheMisses,
+	}
 }
 
 func NewValidator(db *sql.DB) *AuthValidator {
@@ -56,7 +101,9 @@ const (
 	usernamePrefix = "u:"
 )
 
-func (a *AuthValidator) IssueAuthenticatedToken(ctx context.Context, authenticatedUsername string, validDuration time.Duration) (string, error) {
+// IssueAuthenticatedToken issues a session token for a user who has logged in.
+// secondFactorVerified records whether the login included a second factor.
+func (a *AuthValidator) IssueAuthenticatedToken(ctx context.Context, authenticatedUsername string, validDuration time.Duration, secondFactorVerified bool) (string, error) {
 	key, err := a.getActiveSigningKey(ctx)
 	if err != nil {
 		return "", err
@@ -67,15 +114,25 @@ func (a *AuthValidator) IssueAuthenticatedToken(ctx context.Context, authenticat
 		return "", pderr.Unexpectedf("failed to generate token UUID")
 	}
 
+	userUUID, sessionGeneration, err := a.getSessionUser(ctx, authenticatedUsername)
+	if err != nil {
+		return "", err
+	}
+
 	issuedTime := time.Now()
 	expiresTime := issuedTime.Add(validDuration)
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
-		IssuedAt:  jwt.NewNumericDate(issuedTime),
-		ExpiresAt: jwt.NewNumericDate(expiresTime),
-		Issuer:    jwtIssuer,
-		Subject:   usernamePrefix + authenticatedUsername,
-		ID:        tokenUUID.String(),
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, sessionClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			IssuedAt:  jwt.NewNumericDate(issuedTime),
+			ExpiresAt: jwt.NewNumericDate(expiresTime),
+			Issuer:    jwtIssuer,
+			Subject:   usernamePrefix + authenticatedUsername,
+			ID:        tokenUUID.String(),
+		},
+		UserUUID:          userUUID.String(),
+		SessionGeneration: sessionGeneration,
+		SecondFactor:      secondFactorVerified,
 	})
 	token.Header["kid"] = key.KeyUUID.String()
 
@@ -92,12 +149,33 @@ func (a *AuthValidator) IssueAuthenticatedToken(ctx context.Context, authenticat
 		zap.Stringer("token_id", tokenUUID),
 		zap.Stringer("key_id", key.KeyUUID),
 		zap.String("alg", token.Method.Alg()),
+		zap.Bool("second_factor", secondFactorVerified),
 	)
 
 	return tokenString, nil
 }
 
 func (a *AuthValidator) ValidateHeader(ctx context.Context, headerValue string) (AuthInfo, error) {
+	authInfo, err := a.validateCredentials(ctx, headerValue)
+	if err != nil || !authInfo.IsAuthenticated {
+		return authInfo, err
+	}
+
+	roles, err := a.loadRoles(ctx, authInfo.AuthenticatedUsername)
+	if err != nil {
+		return notAuthenticated, err
+	}
+	authInfo.Roles = roles
+
+	// Issuer rights are too sensitive to exercise with a password alone.
+	if !authInfo.IsAPIKey() && !authInfo.SecondFactorVerified {
+		authInfo.Roles = withoutRole(authInfo.Roles, RoleIssuer)
+	}
+
+	return authInfo, nil
+}
+
+func (a *AuthValidator) validateCredentials(ctx context.Context, headerValue string) (AuthInfo, error) {
 	if headerValue == "" {
 		return notAuthenticated, nil
 	}
@@ -107,12 +185,17 @@ func (a *AuthValidator) ValidateHeader(ctx context.Context, headerValue string)
 		return notAuthenticated, pderr.Unauthenticated("malformed auth header")
 	}
 
-	if components[0] != "Bearer" {
-		return notAuthenticated, pderr.Unauthenticated("unsupported auth scheme (not Bearer)")
+	switch components[0] {
+	case "Bearer":
+		return a.validateBearerToken(ctx, components[1])
+	case "ApiKey":
+		return a.validateAPIKey(ctx, components[1])
+	default:
+		return notAuthenticated, pderr.Unauthenticated("unsupported auth scheme (not Bearer or ApiKey)")
 	}
+}
 
-	tokenString := components[1]
-
+func (a *AuthValidator) validateBearerToken(ctx context.Context, tokenString string) (AuthInfo, error) {
 	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
 		if token.Method.Alg() != activeHMACAlgorithm {
 			return nil, pderr.Unauthenticated("unsupported signing algorithm")
@@ -154,24 +237,75 @@ func (a *AuthValidator) ValidateHeader(ctx context.Context, headerValue string)
 		return notAuthenticated, pderr.Unauthenticated("missing subject")
 	}
 
-	if username, ok := strings.CutPrefix(subject, usernamePrefix); ok {
-		return AuthInfo{
-			IsAuthenticated:       true,
-			AuthenticatedUsername: username,
-		}, nil
-	} else {
+	username, ok := strings.CutPrefix(subject, usernamePrefix)
+	if !ok {
 		return notAuthenticated, pderr.Unauthenticated("invalid subject")
 	}
+
+	// Tokens issued before session generations existed have none, which is equivalent to zero.
+	var tokenGeneration int64
+	if generationValue, ok := claims["sgen"]; ok {
+		generation, ok := generationValue.(float64)
+		if !ok {
+			return notAuthenticated, pderr.Unauthenticated("invalid session generation")
+		}
+		tokenGeneration = int64(generation)
+	}
+
+	// Tokens issued before user UUIDs were included cannot be told apart from
+	// tokens of a deleted user whose name has been taken again, so they are refused.
+	userUUIDString, ok := claims["uid"].(string)
+	if !ok {
+		return notAuthenticated, pderr.Unauthenticated("session token has no user ID; log in again")
+	}
+	tokenUserUUID, err := uuid.Parse(userUUIDString)
+	if err != nil {
+		return notAuthenticated, pderr.Unauthenticated("invalid user ID")
+	}
+
+	currentUserUUID, currentGeneration, err := a.getSessionUser(ctx, username)
+	if err != nil {
+		return notAuthenticated, pderr.WrapAs(codes.Unauthenticated, "token validation failed", err)
+	}
+
+	if tokenUserUUID != currentUserUUID {
+		return notAuthenticated, pderr.Unauthenticated("session belongs to a deleted user")
+	}
+
+	if tokenGeneration != currentGeneration {
+		return notAuthenticated, pderr.Unauthenticated("session has been revoked")
+	}
+
+	secondFactor, _ := claims["sf"].(bool)
+
+	return AuthInfo{
+		IsAuthenticated:       true,
+		AuthenticatedUsername: username,
+		Scopes:                AllScopes(),
+		SecondFactorVerified:  secondFactor,
+	}, nil
 }
 
 func NewContextWithAuth(ctx context.Context, authInfo AuthInfo) context.Context {
 	return context.WithValue(ctx, contextKeyAuthInfo, authInfo)
 }
 
-func FromContext(ctx context.Context) AuthInfo {
+func FromContext(ctx context.Context) (AuthInfo, error) {
 	authInfo, ok := ctx.Value(contextKeyAuthInfo).(AuthInfo)
 	if !ok {
-		panic("no auth info in context")
+		return notAuthenticated, pderr.Error(codes.Internal, "no auth info in context")
+	}
+	return authInfo, nil
+}
+
+// AuthenticatedFromContext is like FromContext, but also fails unless the caller is authenticated.
+func AuthenticatedFromContext(ctx context.Context) (AuthInfo, error) {
+	authInfo, err := FromContext(ctx)
+	if err != nil {
+		return authInfo, err
+	}
+	if !authInfo.IsAuthenticated {
+		return authInfo, pderr.Unauthenticated("authentication required")
 	}
-	return authInfo
+	return authInfo, nil
 }
@@ -15,6 +15,9 @@ import (
 const (
 	activeHMACAlgorithm = "HS256"
 	keyActiveDuration   = 24 * time.Hour
+
+	// Arbitrary application-wide key for pg_advisory_xact_lock, held while creating signing keys.
+	signingKeyCreationLockID int64 = 0x706c6179646f7567
 )
 
 type SigningKey struct {
@@ -25,47 +28,40 @@ type SigningKey struct {
 	KeyExpirationTime time.Time
 }
 
-func (a *AuthValidator) holdingMutexGetKeyAlgorithmId(ctx context.Context, algorithmName string) (int, error) {
+func (a *AuthValidator) holdingMutexGetKeyAlgorithmId(ctx context.Context, tx *sql.Tx, algorithmName string) (int, error) {
 	rv, ok := a.cachedAlgorithmIDs[algorithmName]
 	if ok {
 		return rv, nil
 	}
 
-	var algorithmID int
-
-	err := a.db.QueryRowContext(
+	// Another replica may be inserting the same algorithm concurrently, so
+	// never fail on conflict; always re-select the winning row instead.
+	if _, err := tx.ExecContext(
 		ctx,
 		`
-			SELECT jwt_key_algorithm_id
-			FROM jwt_key_algorithms
-			WHERE algorithm_name = $1
+			INSERT INTO jwt_key_algorithms (algorithm_name)
+			VALUES ($1)
+			ON CONFLICT (algorithm_name) DO NOTHING
 		`,
 		algorithmName,
-	).Scan(&algorithmID)
-	if err == nil {
-		a.cachedAlgorithmIDs[algorithmName] = algorithmID
-		return algorithmID, nil
-	}
-
-	if err != sql.ErrNoRows {
+	); err != nil {
 		return 0, err
 	}
 
-	err = a.db.QueryRowContext(
+	var algorithmID int
+
+	if err := tx.QueryRowContext(
 		ctx,
 		`
-			INSERT INTO jwt_key_algorithms (algorithm_name)
-			VALUES ($1)
-			RETURNING
-				jwt_key_algorithm_id
+			SELECT jwt_key_algorithm_id
+			FROM jwt_key_algorithms
+			WHERE algorithm_name = $1
 		`,
 		algorithmName,
-	).Scan(&algorithmID)
-	if err != nil {
+	).Scan(&algorithmID); err != nil {
 		return 0, err
 	}
 
-	a.cachedAlgorithmIDs[algorithmName] = algorithmID
 	return algorithmID, nil
 }
 
@@ -105,8 +101,10 @@ func (a *AuthValidator) getValidationKey(ctx context.Context, keyUUID uuid.UUID)
 	defer a.mu.Unlock()
 
 	if cachedKey, ok := a.cachedValidationKeys[keyUUID]; ok {
+		a.keyCacheHits++
 		return cachedKey, nil
 	}
+	a.keyCacheMisses++
 
 	var key SigningKey
 
@@ -150,14 +148,15 @@ func (a *AuthValidator) getActiveSigningKey(ctx context.Context) (*SigningKey, e
 	return a.holdingMutexGetActiveSigningKey(ctx, now)
 }
 
-func (a *AuthValidator) holdingMutexGetActiveSigningKey(ctx context.Context, now time.Time) (*SigningKey, error) {
-	if a.cachedSigningKey != nil && a.cachedSigningKey.KeyExpirationTime.After(now) {
-		return a.cachedSigningKey, nil
-	}
+type queryRower interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
 
+// selectActiveSigningKey returns the newest unexpired signing key, or nil if there is none.
+func selectActiveSigningKey(ctx context.Context, q queryRower, now time.Time) (*SigningKey, error) {
 	var signingKey SigningKey
 
-	err := a.db.QueryRowContext(
+	err := q.QueryRowContext(
 		ctx,
 		`
 			SELECT
@@ -175,13 +174,59 @@ func (a *AuthValidator) holdingMutexGetActiveSigningKey(ctx context.Context, now
 		now,
 	).Scan(&signingKey.KeyUUID, &signingKey.KeyAlgorithmName, &signingKey.KeySecretData, &signingKey.KeyGenerationTime, &signingKey.KeyExpirationTime)
 
-	if err != nil && err != sql.ErrNoRows {
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &signingKey, nil
+}
+
+func (a *AuthValidator) holdingMutexGetActiveSigningKey(ctx context.Context, now time.Time) (*SigningKey, error) {
+	if a.cachedSigningKey != nil && a.cachedSigningKey.KeyExpirationTime.After(now) {
+		a.keyCacheHits++
+		return a.cachedSigningKey, nil
+	}
+	a.keyCacheMisses++
+
+	signingKey, err := selectActiveSigningKey(ctx, a.db, now)
+	if err != nil {
+		return nil, err
+	}
+
+	if signingKey != nil {
+		a.cachedSigningKey = signingKey
+		return signingKey, nil
+	}
+
+	// No active key exists. The mutex only protects this process, so take a
+	// transaction-scoped advisory lock to serialize key creation across all
+	// replicas, and check again once we hold it: another replica may have
+	// created a key while we were waiting.
+	tx, err := a.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock($1)`, signingKeyCreationLockID); err != nil {
+		return nil, pderr.Wrap("failed to acquire signing key creation lock", err)
+	}
+
+	signingKey, err = selectActiveSigningKey(ctx, tx, now)
+	if err != nil {
 		return nil, err
 	}
 
-	if err == nil {
-		a.cachedSigningKey = &signingKey
-		return &signingKey, nil
+	if signingKey != nil {
+		if err := tx.Commit(); err != nil {
+			return nil, err
+		}
+		a.cachedSigningKey = signingKey
+		return signingKey, nil
 	}
 
 	newSigningKey, err := a.holdingMutexGenerateSigningKey(ctx, now)
@@ -189,12 +234,12 @@ func (a *AuthValidator) holdingMutexGetActiveSigningKey(ctx context.Context, now
 		return nil, err
 	}
 
-	algoID, err := a.holdingMutexGetKeyAlgorithmId(ctx, newSigningKey.KeyAlgorithmName)
+	algoID, err := a.holdingMutexGetKeyAlgorithmId(ctx, tx, newSigningKey.KeyAlgorithmName)
 	if err != nil {
 		return nil, err
 	}
 
-	if _, err := a.db.ExecContext(
+	if _, err := tx.ExecContext(
 		ctx,
 		`
 			INSERT INTO jwt_keys (jwt_key_uuid, jwt_key_algorithm_id, key_secret_material, generation_timestamp, expiration_timestamp)
@@ -205,5 +250,11 @@ func (a *AuthValidator) holdingMutexGetActiveSigningKey(ctx context.Context, now
 		return nil, err
 	}
 
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	a.cachedAlgorithmIDs[newSigningKey.KeyAlgorithmName] = algoID
+	a.cachedSigningKey = newSigningKey
 	return newSigningKey, nil
 }
@@ -0,0 +1,76 @@
+package pdauth
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/steinarvk/playdough/pkg/pdtestutils"
+)
+
+func TestConcurrentValidatorsConvergeOnOneSigningKey(t *testing.T) {
+	db := pdtestutils.OpenTestDatabase(t)
+	ctx := context.Background()
+
+	if _, err := db.ExecContext(ctx, `INSERT INTO users (user_uuid, username, canonical_username) VALUES (gen_random_uuid(), 'alice', 'alice')`); err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+
+	const numReplicas = 8
+
+	validators := make([]*AuthValidator, numReplicas)
+	for i := range validators {
+		validators[i] = NewValidator(db)
+	}
+
+	tokens := make([]string, numReplicas)
+	errs := make([]error, numReplicas)
+
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for i, validator := range validators {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			tokens[i], errs[i] = validator.IssueAuthenticatedToken(ctx, "alice", time.Minute, false)
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("replica %d failed to issue token: %v", i, err)
+		}
+	}
+
+	var numKeys int
+	if err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM jwt_keys`).Scan(&numKeys); err != nil {
+		t.Fatalf("failed to count keys: %v", err)
+	}
+	if numKeys != 1 {
+		t.Errorf("got %d signing keys, want 1", numKeys)
+	}
+
+	var numAlgorithms int
+	if err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM jwt_key_algorithms`).Scan(&numAlgorithms); err != nil {
+		t.Fatalf("failed to count algorithms: %v", err)
+	}
+	if numAlgorithms != 1 {
+		t.Errorf("got %d key algorithms, want 1", numAlgorithms)
+	}
+
+	for i, token := range tokens {
+		validator := validators[(i+1)%numReplicas]
+		authInfo, err := validator.ValidateHeader(ctx, "Bearer "+token)
+		if err != nil {
+			t.Errorf("token from replica %d rejected by another replica: %v", i, err)
+			continue
+		}
+		if authInfo.AuthenticatedUsername != "alice" {
+			t.Errorf("token from replica %d authenticated %q, want %q", i, authInfo.AuthenticatedUsername, "alice")
+		}
+	}
+}
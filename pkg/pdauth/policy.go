@@ -0,0 +1,54 @@
+package pdauth
+
+import (
+	"strings"
+
+	"github.com/steinarvk/playdough/pkg/pderr"
+	"google.golang.org/grpc/codes"
+)
+
+// MethodPolicy declares who is allowed to call a gRPC method.
+// The zero value requires an authenticated caller.
+type MethodPolicy struct {
+	// Public methods may be called without authenticating.
+	Public bool
+
+	// If non-empty, the caller must hold at least one of these roles.
+	AnyOfRoles []Role
+
+	// API keys carry their owner's roles, but may only exercise them on methods
+	// that name a scope here, and only if the key was granted that scope. Without
+	// one, role-gated methods require a session token.
+	APIKeyScope Scope
+}
+
+func (p MethodPolicy) Authorize(authInfo AuthInfo) error {
+	if p.Public && len(p.AnyOfRoles) == 0 {
+		return nil
+	}
+
+	if !authInfo.IsAuthenticated {
+		return pderr.Unauthenticated("authentication required")
+	}
+
+	if len(p.AnyOfRoles) == 0 {
+		return nil
+	}
+
+	if authInfo.IsAPIKey() {
+		if p.APIKeyScope == "" {
+			return pderr.Error(codes.PermissionDenied, "API keys cannot be used for this method")
+		}
+		if !authInfo.HasScope(p.APIKeyScope) {
+			return pderr.Error(codes.PermissionDenied, "API key lacks the scope: "+string(p.APIKeyScope))
+		}
+	}
+
+	for _, role := range p.AnyOfRoles {
+		if authInfo.HasRole(role) {
+			return nil
+		}
+	}
+
+	return pderr.Error(codes.PermissionDenied, "requires one of the roles: "+strings.Join(rolesToStrings(p.AnyOfRoles), ", "))
+}
@@ -0,0 +1,48 @@
+package pdauth
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/steinarvk/playdough/pkg/pderr"
+	"google.golang.org/grpc/codes"
+)
+
+func TestMethodPolicyAuthorize(t *testing.T) {
+	adminOnly := MethodPolicy{AnyOfRoles: []Role{RoleAdmin}}
+	issuerOrAuditor := MethodPolicy{AnyOfRoles: []Role{RoleIssuer, RoleAuditor}}
+
+	anonymous := AuthInfo{}
+	plainUser := AuthInfo{IsAuthenticated: true, AuthenticatedUsername: "alice", Roles: []Role{RoleUser}}
+	admin := AuthInfo{IsAuthenticated: true, AuthenticatedUsername: "root", Roles: []Role{RoleAdmin, RoleUser}}
+	auditor := AuthInfo{IsAuthenticated: true, AuthenticatedUsername: "bob", Roles: []Role{RoleAuditor}}
+	adminKey := AuthInfo{IsAuthenticated: true, AuthenticatedUsername: "root", Roles: []Role{RoleAdmin, RoleUser}, Scopes: []Scope{ScopeReadBalance}, APIKeyUUID: uuid.New()}
+	mintOnly := MethodPolicy{AnyOfRoles: []Role{RoleAdmin}, APIKeyScope: ScopeMint}
+	readOnly := MethodPolicy{AnyOfRoles: []Role{RoleAdmin}, APIKeyScope: ScopeReadBalance}
+
+	for _, tc := range []struct {
+		name     string
+		policy   MethodPolicy
+		authInfo AuthInfo
+		want     codes.Code
+	}{
+		{"public policy allows anonymous", MethodPolicy{Public: true}, anonymous, codes.OK},
+		{"default policy rejects anonymous", MethodPolicy{}, anonymous, codes.Unauthenticated},
+		{"default policy allows plain user", MethodPolicy{}, plainUser, codes.OK},
+		{"admin policy rejects anonymous", adminOnly, anonymous, codes.Unauthenticated},
+		{"admin policy rejects plain user", adminOnly, plainUser, codes.PermissionDenied},
+		{"admin policy allows admin", adminOnly, admin, codes.OK},
+		{"any-of policy allows auditor", issuerOrAuditor, auditor, codes.OK},
+		{"any-of policy rejects admin", issuerOrAuditor, admin, codes.PermissionDenied},
+		{"default policy allows API key", MethodPolicy{}, adminKey, codes.OK},
+		{"admin policy rejects admin's API key", adminOnly, adminKey, codes.PermissionDenied},
+		{"scoped policy rejects API key without scope", mintOnly, adminKey, codes.PermissionDenied},
+		{"scoped policy allows API key with scope", readOnly, adminKey, codes.OK},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := pderr.CodeOf(tc.policy.Authorize(tc.authInfo)); got != tc.want {
+				t.Errorf("Authorize() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,246 @@
+package pdauth
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/steinarvk/playdough/pkg/logging"
+	"github.com/steinarvk/playdough/pkg/pderr"
+	"github.com/steinarvk/playdough/pkg/pdusername"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+)
+
+type Role string
+
+const (
+	RoleAdmin   Role = "admin"
+	RoleIssuer  Role = "issuer"
+	RoleAuditor Role = "auditor"
+	RoleUser    Role = "user"
+)
+
+func AllRoles() []Role {
+	return []Role{
+		RoleAdmin,
+		RoleIssuer,
+		RoleAuditor,
+		RoleUser,
+	}
+}
+
+func ParseRole(s string) (Role, error) {
+	for _, role := range AllRoles() {
+		if string(role) == s {
+			return role, nil
+		}
+	}
+	return "", pderr.BadInput("unknown role", "role", s)
+}
+
+func (a AuthInfo) HasRole(role Role) bool {
+	for _, held := range a.Roles {
+		if held == role {
+			return true
+		}
+	}
+	return false
+}
+
+func withoutRole(roles []Role, role Role) []Role {
+	var rv []Role
+	for _, held := range roles {
+		if held != role {
+			rv = append(rv, held)
+		}
+	}
+	return rv
+}
+
+func rolesToStrings(roles []Role) []string {
+	rv := make([]string, len(roles))
+	for i, role := range roles {
+		rv[i] = string(role)
+	}
+	return rv
+}
+
+func (a *AuthValidator) loadRoles(ctx context.Context, username string) ([]Role, error) {
+	rows, err := a.db.QueryContext(
+		ctx,
+		`
+			SELECT user_roles.role_name
+			FROM user_roles
+			JOIN users ON user_roles.user_id = users.user_id
+			WHERE users.canonical_username = $1
+			ORDER BY user_roles.role_name
+		`,
+		pdusername.Canonical(username),
+	)
+	if err != nil {
+		return nil, pderr.Wrap("failed to load roles", err)
+	}
+	defer rows.Close()
+
+	var rv []Role
+
+	for rows.Next() {
+		var roleName string
+		if err := rows.Scan(&roleName); err != nil {
+			return nil, pderr.Wrap("failed to scan role", err)
+		}
+		rv = append(rv, Role(roleName))
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, pderr.Wrap("failed to load roles", err)
+	}
+
+	return rv, nil
+}
+
+func (a *AuthValidator) GrantRole(ctx context.Context, tx *sql.Tx, username string, role Role) error {
+	logger := logging.FromContext(ctx)
+
+	var userID int
+
+	err := tx.QueryRowContext(
+		ctx,
+		`
+			SELECT user_id
+			FROM users
+			WHERE canonical_username = $1
+		`,
+		pdusername.Canonical(username),
+	).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return pderr.Error(codes.NotFound, "no such user")
+	}
+	if err != nil {
+		return pderr.Wrap("failed to look up user", err)
+	}
+
+	result, err := tx.ExecContext(
+		ctx,
+		`
+			INSERT INTO user_roles (user_id, role_name)
+			VALUES ($1, $2)
+			ON CONFLICT (user_id, role_name) DO NOTHING
+		`,
+		userID, string(role),
+	)
+	if err != nil {
+		return pderr.Wrap("failed to grant role", err)
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return pderr.Wrap("failed to grant role", err)
+	}
+
+	logger.Info("granted role", zap.String("username", username), zap.String("role", string(role)), zap.Bool("already_held", n == 0))
+
+	return nil
+}
+
+func (a *AuthValidator) RevokeRole(ctx context.Context, tx *sql.Tx, username string, role Role) error {
+	logger := logging.FromContext(ctx)
+
+	result, err := tx.ExecContext(
+		ctx,
+		`
+			DELETE FROM user_roles
+			USING users
+			WHERE user_roles.user_id = users.user_id
+			  AND users.canonical_username = $1
+			  AND user_roles.role_name = $2
+		`,
+		pdusername.Canonical(username), string(role),
+	)
+	if err != nil {
+		return pderr.Wrap("failed to revoke role", err)
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return pderr.Wrap("failed to revoke role", err)
+	}
+
+	if n == 0 {
+		return pderr.Error(codes.NotFound, "user does not hold role")
+	}
+
+	logger.Info("revoked role", zap.String("username", username), zap.String("role", string(role)))
+
+	return nil
+}
+
+// UserHasRole reports whether the user holds the role, within a transaction.
+func (a *AuthValidator) UserHasRole(ctx context.Context, tx *sql.Tx, username string, role Role) (bool, error) {
+	var held bool
+
+	if err := tx.QueryRowContext(
+		ctx,
+		`
+			SELECT EXISTS (
+				SELECT 1
+				FROM user_roles
+				JOIN users ON user_roles.user_id = users.user_id
+				WHERE users.canonical_username = $1
+				  AND user_roles.role_name = $2
+			)
+		`,
+		pdusername.Canonical(username), string(role),
+	).Scan(&held); err != nil {
+		return false, pderr.Wrap("failed to check role", err)
+	}
+
+	return held, nil
+}
+
+// LockActiveUsersWithRole returns the canonical usernames of the active (not
+// deactivated) users holding the role. Their rows stay locked until the transaction
+// ends, so that concurrent attempts to remove the last of them are serialized.
+func (a *AuthValidator) LockActiveUsersWithRole(ctx context.Context, tx *sql.Tx, role Role) ([]string, error) {
+	rows, err := tx.QueryContext(
+		ctx,
+		`
+			SELECT users.canonical_username
+			FROM user_roles
+			JOIN users ON user_roles.user_id = users.user_id
+			WHERE user_roles.role_name = $1
+			  AND users.deactivation_timestamp IS NULL
+			FOR UPDATE
+		`,
+		string(role),
+	)
+	if err != nil {
+		return nil, pderr.Wrap("failed to list users with role", err)
+	}
+	defer rows.Close()
+
+	var usernames []string
+	for rows.Next() {
+		var username string
+		if err := rows.Scan(&username); err != nil {
+			return nil, pderr.Wrap("failed to list users with role", err)
+		}
+		usernames = append(usernames, username)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, pderr.Wrap("failed to list users with role", err)
+	}
+
+	return usernames, nil
+}
+
+// CountUsersWithRole counts the active (not deactivated) users holding the role,
+// locking them as LockActiveUsersWithRole does.
+func (a *AuthValidator) CountUsersWithRole(ctx context.Context, tx *sql.Tx, role Role) (int, error) {
+	usernames, err := a.LockActiveUsersWithRole(ctx, tx, role)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(usernames), nil
+}
@@ -0,0 +1,83 @@
+package pdauth
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/steinarvk/playdough/pkg/logging"
+	"github.com/steinarvk/playdough/pkg/pderr"
+	"github.com/steinarvk/playdough/pkg/pdusername"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+)
+
+// sessionClaims are the claims of a session token. The session generation is
+// compared against the user's current one on every request, so that bumping it
+// revokes all outstanding sessions at once. The user UUID must match too, since
+// usernames are freed on deletion and may then be registered by someone else.
+type sessionClaims struct {
+	jwt.RegisteredClaims
+	UserUUID          string `json:"uid"`
+	SessionGeneration int64  `json:"sgen"`
+	SecondFactor      bool   `json:"sf,omitempty"`
+}
+
+// getSessionUser returns the UUID and current session generation of the user.
+// Deactivated users are treated as nonexistent, so that none of their sessions are valid.
+func (a *AuthValidator) getSessionUser(ctx context.Context, username string) (uuid.UUID, int64, error) {
+	var userUUID uuid.UUID
+	var generation int64
+
+	err := a.db.QueryRowContext(
+		ctx,
+		`
+			SELECT user_uuid, session_generation
+			FROM users
+			WHERE canonical_username = $1
+			  AND deactivation_timestamp IS NULL
+		`,
+		pdusername.Canonical(username),
+	).Scan(&userUUID, &generation)
+	if err == sql.ErrNoRows {
+		return uuid.Nil, 0, pderr.Error(codes.NotFound, "no such active user")
+	}
+	if err != nil {
+		return uuid.Nil, 0, pderr.Wrap("failed to look up session generation", err)
+	}
+
+	return userUUID, generation, nil
+}
+
+// RevokeSessions invalidates every session token previously issued to the user.
+// API keys are not affected.
+func (a *AuthValidator) RevokeSessions(ctx context.Context, tx *sql.Tx, username string) error {
+	logger := logging.FromContext(ctx)
+
+	result, err := tx.ExecContext(
+		ctx,
+		`
+			UPDATE users
+			SET session_generation = session_generation + 1
+			WHERE canonical_username = $1
+		`,
+		pdusername.Canonical(username),
+	)
+	if err != nil {
+		return pderr.Wrap("failed to revoke sessions", err)
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return pderr.Wrap("failed to revoke sessions", err)
+	}
+
+	if n == 0 {
+		return pderr.Error(codes.NotFound, "no such user")
+	}
+
+	logger.Info("revoked all sessions", zap.String("username", username))
+
+	return nil
+}
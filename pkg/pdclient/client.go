@@ -7,10 +7,14 @@ import (
 
 	"github.com/spf13/cobra"
 	"github.com/steinarvk/playdough/pkg/ezcobra"
+	"github.com/steinarvk/playdough/pkg/pddebug"
 	"github.com/steinarvk/playdough/pkg/pderr"
+	"github.com/steinarvk/playdough/pkg/pdtls"
 	"github.com/steinarvk/playdough/proto/pdpb"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/credentials/insecure"
 	"google.golang.org/grpc/metadata"
 	"google.golang.org/protobuf/encoding/prototext"
@@ -73,11 +77,13 @@ type CommonParams struct {
 	ServerAddress           string
 	DebugMode               bool
 	InsecureGRPCCredentials bool
+	TLS                     pdtls.ClientParams
 	RawAuthHeader           string
 }
 
 type CreateAccountParams struct {
-	Username string
+	Username   string
+	InviteCode string
 }
 
 type Subcommand struct {
@@ -120,9 +126,20 @@ func connectAndRunWithClient(ctx context.Context, commonParams *CommonParams, co
 	var opts []grpc.DialOption
 
 	if commonParams.InsecureGRPCCredentials {
+		if commonParams.TLS != (pdtls.ClientParams{}) {
+			return pderr.Error(codes.InvalidArgument, "--insecure-grpc-credentials cannot be combined with TLS flags")
+		}
+
 		client.logger.Warn("running with --insecure-grpc-credentials; don't do this in production")
 
 		opts = append(opts, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	} else {
+		tlsConfig, err := pdtls.ClientConfig(ctx, commonParams.TLS)
+		if err != nil {
+			return err
+		}
+
+		opts = append(opts, grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)))
 	}
 
 	if commonParams.RawAuthHeader != "" {
@@ -132,9 +149,18 @@ func connectAndRunWithClient(ctx context.Context, commonParams *CommonParams, co
 	opts = append(opts, grpc.WithUnaryInterceptor(func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
 		methodField := zap.String("method", method)
 
+		var header, trailer metadata.MD
+
 		if commonParams.DebugMode {
 			client.logger.Info("sending gRPC request", methodField)
 			client.maybeDebugDump(method, "request", req)
+
+			var err error
+			ctx, err = pddebug.AppendSettingsToOutgoingContext(ctx, &pdpb.RequestDebugSettings{EnableDebug: true})
+			if err != nil {
+				return pderr.Wrap("failed to attach debug settings", err)
+			}
+			opts = append(opts, grpc.Header(&header), grpc.Trailer(&trailer))
 		}
 
 		t0 := time.Now()
@@ -147,6 +173,13 @@ func connectAndRunWithClient(ctx context.Context, commonParams *CommonParams, co
 		if commonParams.DebugMode {
 			client.maybeDebugDump(method, "response", reply)
 
+			// Failed requests may send the debug info in the trailer instead of the header.
+			if debugInfo, ok := pddebug.InfoFromMetadata(metadata.Join(header, trailer)); ok {
+				client.maybeDebugDump(method, "debug info", debugInfo)
+			} else {
+				client.logger.Warn("server sent no debug info", methodField)
+			}
+
 			client.logger.Info("finished gRPC request", methodField, durationField, zap.Bool("ok", err == nil), zap.Error(err))
 		}
 
@@ -188,6 +221,9 @@ func MakeCobraCommandGroup() *cobra.Command {
 	group.PersistentFlags().StringVar(&params.ServerAddress, "server-address", "localhost:5044", "address of PlayDoughService gRPC server")
 	group.PersistentFlags().BoolVar(&params.DebugMode, "debug-dump-all", false, "dump all requests and responses for debugging")
 	group.PersistentFlags().BoolVar(&params.InsecureGRPCCredentials, "insecure-grpc-credentials", false, "use insecure credentials")
+	group.PersistentFlags().StringVar(&params.TLS.CACertFile, "ca-cert", "", "PEM CA certificates to verify the server with (default: system roots)")
+	group.PersistentFlags().StringVar(&params.TLS.CertFile, "client-cert", "", "PEM client certificate for mutual TLS")
+	group.PersistentFlags().StringVar(&params.TLS.KeyFile, "client-key", "", "PEM private key for --client-cert (default: read from --client-cert)")
 	group.PersistentFlags().StringVar(&params.RawAuthHeader, "raw-auth-header", "", "raw authorization header")
 
 	for _, subcommand := range makeSubcommands() {
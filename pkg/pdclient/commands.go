@@ -4,13 +4,17 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"os"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/spf13/cobra"
 	"github.com/steinarvk/playdough/pkg/pderr"
 	"github.com/steinarvk/playdough/proto/pdpb"
 	"golang.org/x/term"
 	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 )
 
 func makeSubcommands() []*Subcommand {
@@ -18,9 +22,95 @@ func makeSubcommands() []*Subcommand {
 		makeCreateAccountSubcommand(),
 		makeLoginSubcommand(),
 		makePingSubcommand(),
+		makeHealthSubcommand(),
+		makeCreateAPIKeySubcommand(),
+		makeListAPIKeysSubcommand(),
+		makeRevokeAPIKeySubcommand(),
+		makeGrantRoleSubcommand(),
+		makeRevokeRoleSubcommand(),
+		makeChangePasswordSubcommand(),
+		makeCreatePasswordResetTokenSubcommand(),
+		makeResetPasswordSubcommand(),
+		makeEnrollTOTPSubcommand(),
+		makeConfirmTOTPSubcommand(),
+		makeDisableTOTPSubcommand(),
+		makeGetUserSubcommand(),
+		makeSearchUsersSubcommand(),
+		makeUpdateProfileSubcommand(),
+		makeDeactivateAccountSubcommand(),
+		makeReactivateAccountSubcommand(),
+		makeDeleteAccountSubcommand(),
+		makeExportDataSubcommand(),
+		makeCreateInviteSubcommand(),
+		makeListInvitesSubcommand(),
 	}
 }
 
+// readNewPassword prompts for a password twice without echoing it, and checks that both entries match.
+func readNewPassword(prompt, repeatPrompt string) (string, error) {
+	fmt.Print(prompt)
+	passwordOnce, err := term.ReadPassword(syscall.Stdin)
+	if err != nil {
+		return "", pderr.Wrap("error reading password from stdin", err)
+	}
+	fmt.Println()
+
+	fmt.Print(repeatPrompt)
+	passwordTwice, err := term.ReadPassword(syscall.Stdin)
+	if err != nil {
+		return "", pderr.Wrap("error re-reading password from stdin", err)
+	}
+	fmt.Println()
+
+	if !bytes.Equal(passwordOnce, passwordTwice) {
+		return "", pderr.Error(codes.InvalidArgument, "passwords do not match")
+	}
+
+	if len(passwordOnce) == 0 {
+		return "", pderr.Error(codes.InvalidArgument, "password cannot be empty")
+	}
+
+	return string(passwordOnce), nil
+}
+
+// readSecondFactor prompts for a code from an authenticator app, or a recovery code
+// in its place, and returns whichever of the two was entered.
+func readSecondFactor() (string, string, error) {
+	fmt.Printf("Authentication code (or recovery code): ")
+	code, err := term.ReadPassword(syscall.Stdin)
+	if err != nil {
+		return "", "", pderr.Wrap("error reading authentication code from stdin", err)
+	}
+	fmt.Println()
+
+	return splitSecondFactor(strings.TrimSpace(string(code)))
+}
+
+func splitSecondFactor(code string) (string, string, error) {
+	if code == "" {
+		return "", "", pderr.Error(codes.InvalidArgument, "authentication code cannot be empty")
+	}
+
+	for _, c := range code {
+		if c < '0' || c > '9' {
+			return "", code, nil
+		}
+	}
+
+	return code, "", nil
+}
+
+func readCurrentPassword() (string, error) {
+	fmt.Printf("Current password: ")
+	password, err := term.ReadPassword(syscall.Stdin)
+	if err != nil {
+		return "", pderr.Wrap("error reading password from stdin", err)
+	}
+	fmt.Println()
+
+	return string(password), nil
+}
+
 func makeCreateAccountSubcommand() *Subcommand {
 	cmd := cobra.Command{
 		Use:   "create-account",
@@ -29,6 +119,7 @@ func makeCreateAccountSubcommand() *Subcommand {
 
 	var params CreateAccountParams
 	cmd.Flags().StringVar(&params.Username, "username", "", "username of the account to create")
+	cmd.Flags().StringVar(&params.InviteCode, "invite-code", "", "invite code from an existing user (required by invite-only servers)")
 
 	return &Subcommand{
 		Command: &cmd,
@@ -36,33 +127,15 @@ func makeCreateAccountSubcommand() *Subcommand {
 			if params.Username == "" {
 				return pderr.MissingRequiredFlag("--username")
 			}
-			fmt.Printf("Password for new user %q: ", params.Username)
-			passwordOnce, err := term.ReadPassword(syscall.Stdin)
+			password, err := readNewPassword(fmt.Sprintf("Password for new user %q: ", params.Username), fmt.Sprintf("Repeat password for new user %q: ", params.Username))
 			if err != nil {
-				return pderr.Wrap("error reading password from stdin", err)
-			}
-			fmt.Println()
-
-			fmt.Printf("Repeat password for new user %q: ", params.Username)
-			passwordTwice, err := term.ReadPassword(syscall.Stdin)
-			if err != nil {
-				return pderr.Wrap("error re-reading password from stdin", err)
-			}
-			fmt.Println()
-
-			if !bytes.Equal(passwordOnce, passwordTwice) {
-				return pderr.Error(codes.InvalidArgument, "passwords do not match")
-			}
-
-			if len(passwordOnce) == 0 {
-				return pderr.Error(codes.InvalidArgument, "password cannot be empty")
+				return err
 			}
 
-			password := string(passwordOnce)
-
 			req := &pdpb.CreateAccountRequest{
-				Username: params.Username,
-				Password: password,
+				Username:   params.Username,
+				Password:   password,
+				InviteCode: params.InviteCode,
 			}
 
 			if _, err := client.grpcClient.CreateAccount(client.OutgoingContext(ctx), req); err != nil {
@@ -100,6 +173,36 @@ func makePingSubcommand() *Subcommand {
 	}
 }
 
+func makeHealthSubcommand() *Subcommand {
+	cmd := cobra.Command{
+		Use:   "health",
+		Short: "query the standard gRPC health service; fails unless the server is SERVING",
+	}
+
+	var service string
+	cmd.Flags().StringVar(&service, "service", "", "service to check (default: the server as a whole)")
+
+	return &Subcommand{
+		Command: &cmd,
+		Core: func(ctx context.Context, client *Client) error {
+			req := &healthpb.HealthCheckRequest{
+				Service: service,
+			}
+			resp, err := healthpb.NewHealthClient(client.conn).Check(client.OutgoingContext(ctx), req)
+			if err != nil {
+				return err
+			}
+
+			fmt.Printf("Status: %s\n", resp.Status)
+
+			if resp.Status != healthpb.HealthCheckResponse_SERVING {
+				return pderr.Error(codes.Unavailable, "server is not serving")
+			}
+			return nil
+		},
+	}
+}
+
 func makeLoginSubcommand() *Subcommand {
 	cmd := cobra.Command{
 		Use:   "login",
@@ -137,9 +240,794 @@ func makeLoginSubcommand() *Subcommand {
 				return err
 			}
 
-			fmt.Printf("Session token: %s\n", resp.SessionToken)
+			sessionToken := resp.SessionToken
+
+			if resp.SecondFactorRequired {
+				totpCode, recoveryCode, err := readSecondFactor()
+				if err != nil {
+					return err
+				}
+
+				secondFactorReq := &pdpb.LoginSecondFactorRequest{
+					Challenge:    resp.SecondFactorChallenge,
+					TotpCode:     totpCode,
+					RecoveryCode: recoveryCode,
+				}
+
+				secondFactorResp, err := client.grpcClient.LoginSecondFactor(client.OutgoingContext(ctx), secondFactorReq)
+				if err != nil {
+					return err
+				}
+
+				sessionToken = secondFactorResp.SessionToken
+			}
+
+			fmt.Printf("Session token: %s\n", sessionToken)
 
 			return err
 		},
 	}
 }
+
+func formatAPIKeyInfo(info *pdpb.ApiKeyInfo) string {
+	status := "active"
+	if info.Revoked {
+		status = "revoked"
+	} else if info.ExpirationTime.AsTime().Before(time.Now()) {
+		status = "expired"
+	}
+
+	return fmt.Sprintf("%s\t%s\t%s\texpires %s\t%s", info.ApiKeyUuid, info.Name, strings.Join(info.Scopes, ","), info.ExpirationTime.AsTime().Format(time.RFC3339), status)
+}
+
+func makeCreateAPIKeySubcommand() *Subcommand {
+	cmd := cobra.Command{
+		Use:   "create-api-key",
+		Short: "create a scoped API key for bots and integrations",
+	}
+
+	var name string
+	var scopes []string
+	var validFor time.Duration
+	cmd.Flags().StringVar(&name, "name", "", "name of the API key")
+	cmd.Flags().StringSliceVar(&scopes, "scope", nil, "scopes to grant (read-balance, transfer, mint)")
+	cmd.Flags().DurationVar(&validFor, "valid-for", 0, "how long the API key is valid (default 90 days)")
+
+	return &Subcommand{
+		Command: &cmd,
+		Core: func(ctx context.Context, client *Client) error {
+			if name == "" {
+				return pderr.MissingRequiredFlag("--name")
+			}
+			if len(scopes) == 0 {
+				return pderr.MissingRequiredFlag("--scope")
+			}
+
+			req := &pdpb.CreateApiKeyRequest{
+				Name:                 name,
+				Scopes:               scopes,
+				ValidDurationSeconds: int64(validFor / time.Second),
+			}
+
+			resp, err := client.grpcClient.CreateApiKey(client.OutgoingContext(ctx), req)
+			if err != nil {
+				return err
+			}
+
+			fmt.Printf("API key: %s\n", resp.ApiKey)
+			fmt.Printf("This key will not be shown again. Use it with the header \"Authorization: ApiKey <key>\".\n")
+			fmt.Println(formatAPIKeyInfo(resp.Info))
+
+			return nil
+		},
+	}
+}
+
+func makeListAPIKeysSubcommand() *Subcommand {
+	cmd := cobra.Command{
+		Use:   "list-api-keys",
+		Short: "list your API keys",
+	}
+
+	return &Subcommand{
+		Command: &cmd,
+		Core: func(ctx context.Context, client *Client) error {
+			resp, err := client.grpcClient.ListApiKeys(client.OutgoingContext(ctx), &pdpb.ListApiKeysRequest{})
+			if err != nil {
+				return err
+			}
+
+			for _, info := range resp.ApiKeys {
+				fmt.Println(formatAPIKeyInfo(info))
+			}
+
+			return nil
+		},
+	}
+}
+
+func makeRevokeAPIKeySubcommand() *Subcommand {
+	cmd := cobra.Command{
+		Use:   "revoke-api-key",
+		Short: "revoke one of your API keys",
+	}
+
+	var keyUUID string
+	cmd.Flags().StringVar(&keyUUID, "uuid", "", "UUID of the API key to revoke")
+
+	return &Subcommand{
+		Command: &cmd,
+		Core: func(ctx context.Context, client *Client) error {
+			if keyUUID == "" {
+				return pderr.MissingRequiredFlag("--uuid")
+			}
+
+			req := &pdpb.RevokeApiKeyRequest{
+				ApiKeyUuid: keyUUID,
+			}
+
+			if _, err := client.grpcClient.RevokeApiKey(client.OutgoingContext(ctx), req); err != nil {
+				return err
+			}
+
+			fmt.Printf("Revoked API key %s\n", keyUUID)
+
+			return nil
+		},
+	}
+}
+
+func makeGrantRoleSubcommand() *Subcommand {
+	cmd := cobra.Command{
+		Use:   "grant-role",
+		Short: "grant a role to a user (admin only)",
+	}
+
+	var username, role string
+	cmd.Flags().StringVar(&username, "username", "", "user to grant the role to")
+	cmd.Flags().StringVar(&role, "role", "", "role to grant (admin, issuer, auditor, user)")
+
+	return &Subcommand{
+		Command: &cmd,
+		Core: func(ctx context.Context, client *Client) error {
+			if username == "" {
+				return pderr.MissingRequiredFlag("--username")
+			}
+			if role == "" {
+				return pderr.MissingRequiredFlag("--role")
+			}
+
+			req := &pdpb.GrantRoleRequest{
+				Username: username,
+				Role:     role,
+			}
+
+			if _, err := client.grpcClient.GrantRole(client.OutgoingContext(ctx), req); err != nil {
+				return err
+			}
+
+			fmt.Printf("Granted role %q to user %q\n", role, username)
+
+			return nil
+		},
+	}
+}
+
+func makeRevokeRoleSubcommand() *Subcommand {
+	cmd := cobra.Command{
+		Use:   "revoke-role",
+		Short: "revoke a role from a user (admin only)",
+	}
+
+	var username, role string
+	cmd.Flags().StringVar(&username, "username", "", "user to revoke the role from")
+	cmd.Flags().StringVar(&role, "role", "", "role to revoke (admin, issuer, auditor, user)")
+
+	return &Subcommand{
+		Command: &cmd,
+		Core: func(ctx context.Context, client *Client) error {
+			if username == "" {
+				return pderr.MissingRequiredFlag("--username")
+			}
+			if role == "" {
+				return pderr.MissingRequiredFlag("--role")
+			}
+
+			req := &pdpb.RevokeRoleRequest{
+				Username: username,
+				Role:     role,
+			}
+
+			if _, err := client.grpcClient.RevokeRole(client.OutgoingContext(ctx), req); err != nil {
+				return err
+			}
+
+			fmt.Printf("Revoked role %q from user %q\n", role, username)
+
+			return nil
+		},
+	}
+}
+
+func makeChangePasswordSubcommand() *Subcommand {
+	cmd := cobra.Command{
+		Use:   "change-password",
+		Short: "change your password, logging out all existing sessions",
+	}
+
+	return &Subcommand{
+		Command: &cmd,
+		Core: func(ctx context.Context, client *Client) error {
+			currentPassword, err := readCurrentPassword()
+			if err != nil {
+				return err
+			}
+
+			newPassword, err := readNewPassword("New password: ", "Repeat new password: ")
+			if err != nil {
+				return err
+			}
+
+			req := &pdpb.ChangePasswordRequest{
+				CurrentPassword: currentPassword,
+				NewPassword:     newPassword,
+			}
+
+			resp, err := client.grpcClient.ChangePassword(client.OutgoingContext(ctx), req)
+			if err != nil {
+				return err
+			}
+
+			fmt.Printf("Password changed; all existing sessions have been logged out.\n")
+			fmt.Printf("Session token: %s\n", resp.SessionToken)
+
+			return nil
+		},
+	}
+}
+
+func makeCreatePasswordResetTokenSubcommand() *Subcommand {
+	cmd := cobra.Command{
+		Use:   "create-password-reset-token",
+		Short: "create a single-use password reset token for a user (admin only)",
+	}
+
+	var username string
+	var validFor time.Duration
+	cmd.Flags().StringVar(&username, "username", "", "user whose password may be reset with the token")
+	cmd.Flags().DurationVar(&validFor, "valid-for", 0, "how long the token is valid (default 24 hours)")
+
+	return &Subcommand{
+		Command: &cmd,
+		Core: func(ctx context.Context, client *Client) error {
+			if username == "" {
+				return pderr.MissingRequiredFlag("--username")
+			}
+
+			req := &pdpb.CreatePasswordResetTokenRequest{
+				Username:             username,
+				ValidDurationSeconds: int64(validFor / time.Second),
+			}
+
+			resp, err := client.grpcClient.CreatePasswordResetToken(client.OutgoingContext(ctx), req)
+			if err != nil {
+				return err
+			}
+
+			fmt.Printf("Password reset token: %s\n", resp.ResetToken)
+			fmt.Printf("This token will not be shown again. It can be used once, until %s.\n", resp.ExpirationTime.AsTime().Format(time.RFC3339))
+
+			return nil
+		},
+	}
+}
+
+func makeResetPasswordSubcommand() *Subcommand {
+	cmd := cobra.Command{
+		Use:   "reset-password",
+		Short: "set a new password using a password reset token",
+	}
+
+	var token string
+	cmd.Flags().StringVar(&token, "token", "", "password reset token issued by an admin")
+
+	return &Subcommand{
+		Command: &cmd,
+		Core: func(ctx context.Context, client *Client) error {
+			if token == "" {
+				return pderr.MissingRequiredFlag("--token")
+			}
+
+			newPassword, err := readNewPassword("New password: ", "Repeat new password: ")
+			if err != nil {
+				return err
+			}
+
+			req := &pdpb.ResetPasswordRequest{
+				ResetToken:  token,
+				NewPassword: newPassword,
+			}
+
+			resp, err := client.grpcClient.ResetPassword(client.OutgoingContext(ctx), req)
+			if err != nil {
+				return err
+			}
+
+			fmt.Printf("Password reset for user %q; log in with the new password.\n", resp.Username)
+
+			return nil
+		},
+	}
+}
+
+func makeEnrollTOTPSubcommand() *Subcommand {
+	cmd := cobra.Command{
+		Use:   "enroll-totp",
+		Short: "start enabling two-factor authentication with an authenticator app",
+	}
+
+	return &Subcommand{
+		Command: &cmd,
+		Core: func(ctx context.Context, client *Client) error {
+			resp, err := client.grpcClient.EnrollTotp(client.OutgoingContext(ctx), &pdpb.EnrollTotpRequest{})
+			if err != nil {
+				return err
+			}
+
+			fmt.Printf("Add this to your authenticator app:\n\n  %s\n\n", resp.OtpauthUri)
+			fmt.Printf("or enter the secret by hand: %s\n\n", resp.Secret)
+			fmt.Printf("Then run confirm-totp with a code from the app to enable two-factor authentication.\n")
+
+			return nil
+		},
+	}
+}
+
+func makeConfirmTOTPSubcommand() *Subcommand {
+	cmd := cobra.Command{
+		Use:   "confirm-totp",
+		Short: "finish enabling two-factor authentication",
+	}
+
+	var code string
+	cmd.Flags().StringVar(&code, "code", "", "current code from the authenticator app")
+
+	return &Subcommand{
+		Command: &cmd,
+		Core: func(ctx context.Context, client *Client) error {
+			if code == "" {
+				return pderr.MissingRequiredFlag("--code")
+			}
+
+			req := &pdpb.ConfirmTotpRequest{
+				TotpCode: code,
+			}
+
+			resp, err := client.grpcClient.ConfirmTotp(client.OutgoingContext(ctx), req)
+			if err != nil {
+				return err
+			}
+
+			fmt.Printf("Two-factor authentication enabled. Keep these recovery codes somewhere safe;\n")
+			fmt.Printf("each can be used once in place of a code if you lose your authenticator app.\n\n")
+			for _, recoveryCode := range resp.RecoveryCodes {
+				fmt.Printf("  %s\n", recoveryCode)
+			}
+
+			return nil
+		},
+	}
+}
+
+func makeDisableTOTPSubcommand() *Subcommand {
+	cmd := cobra.Command{
+		Use:   "disable-totp",
+		Short: "disable two-factor authentication, logging out all existing sessions",
+	}
+
+	return &Subcommand{
+		Command: &cmd,
+		Core: func(ctx context.Context, client *Client) error {
+			totpCode, recoveryCode, err := readSecondFactor()
+			if err != nil {
+				return err
+			}
+
+			req := &pdpb.DisableTotpRequest{
+				TotpCode:     totpCode,
+				RecoveryCode: recoveryCode,
+			}
+
+			if _, err := client.grpcClient.DisableTotp(client.OutgoingContext(ctx), req); err != nil {
+				return err
+			}
+
+			fmt.Printf("Two-factor authentication disabled; all existing sessions have been logged out.\n")
+
+			return nil
+		},
+	}
+}
+
+func formatUserProfile(user *pdpb.UserProfile) string {
+	return fmt.Sprintf("%s\t%s\t%s", user.UserUuid, user.Username, user.DisplayName)
+}
+
+func makeGetUserSubcommand() *Subcommand {
+	cmd := cobra.Command{
+		Use:   "get-user",
+		Short: "look up a user by username or UUID",
+	}
+
+	var username, userUUID string
+	cmd.Flags().StringVar(&username, "username", "", "username to look up")
+	cmd.Flags().StringVar(&userUUID, "uuid", "", "user UUID to look up")
+
+	return &Subcommand{
+		Command: &cmd,
+		Core: func(ctx context.Context, client *Client) error {
+			req := &pdpb.GetUserRequest{}
+
+			switch {
+			case username != "" && userUUID != "":
+				return pderr.Error(codes.InvalidArgument, "only one of --username and --uuid may be given")
+			case username != "":
+				req.Lookup = &pdpb.GetUserRequest_Username{Username: username}
+			case userUUID != "":
+				req.Lookup = &pdpb.GetUserRequest_UserUuid{UserUuid: userUUID}
+			default:
+				return pderr.MissingRequiredFlag("--username or --uuid")
+			}
+
+			resp, err := client.grpcClient.GetUser(client.OutgoingContext(ctx), req)
+			if err != nil {
+				return err
+			}
+
+			user := resp.User
+			fmt.Printf("UUID:         %s\n", user.UserUuid)
+			fmt.Printf("Username:     %s\n", user.Username)
+			fmt.Printf("Display name: %s\n", user.DisplayName)
+			fmt.Printf("Avatar URL:   %s\n", user.AvatarUrl)
+			fmt.Printf("Member since: %s\n", user.CreationTime.AsTime().Format(time.RFC3339))
+			if user.Bio != "" {
+				fmt.Printf("\n%s\n", user.Bio)
+			}
+
+			return nil
+		},
+	}
+}
+
+func makeSearchUsersSubcommand() *Subcommand {
+	cmd := cobra.Command{
+		Use:   "search-users",
+		Short: "find users whose usernames start with a prefix",
+	}
+
+	var prefix, pageToken string
+	var pageSize int
+	cmd.Flags().StringVar(&prefix, "prefix", "", "username prefix to search for")
+	cmd.Flags().IntVar(&pageSize, "page-size", 0, "maximum number of results (default 20)")
+	cmd.Flags().StringVar(&pageToken, "page-token", "", "page token from a previous search, to continue it")
+
+	return &Subcommand{
+		Command: &cmd,
+		Core: func(ctx context.Context, client *Client) error {
+			req := &pdpb.SearchUsersRequest{
+				UsernamePrefix: prefix,
+				PageSize:       int32(pageSize),
+				PageToken:      pageToken,
+			}
+
+			resp, err := client.grpcClient.SearchUsers(client.OutgoingContext(ctx), req)
+			if err != nil {
+				return err
+			}
+
+			for _, user := range resp.Users {
+				fmt.Println(formatUserProfile(user))
+			}
+
+			if resp.NextPageToken != "" {
+				fmt.Printf("More results: --page-token=%s\n", resp.NextPageToken)
+			}
+
+			return nil
+		},
+	}
+}
+
+func makeUpdateProfileSubcommand() *Subcommand {
+	cmd := cobra.Command{
+		Use:   "update-profile",
+		Short: "change your display name, avatar URL or bio",
+	}
+
+	var displayName, avatarURL, bio string
+	cmd.Flags().StringVar(&displayName, "display-name", "", "new display name")
+	cmd.Flags().StringVar(&avatarURL, "avatar-url", "", "new avatar URL (https)")
+	cmd.Flags().StringVar(&bio, "bio", "", "new bio")
+
+	return &Subcommand{
+		Command: &cmd,
+		Core: func(ctx context.Context, client *Client) error {
+			req := &pdpb.UpdateProfileRequest{}
+
+			// Only send the flags that were given, so that e.g. --bio="" clears the bio
+			// while leaving the other fields alone.
+			if cmd.Flags().Changed("display-name") {
+				req.DisplayName = &displayName
+			}
+			if cmd.Flags().Changed("avatar-url") {
+				req.AvatarUrl = &avatarURL
+			}
+			if cmd.Flags().Changed("bio") {
+				req.Bio = &bio
+			}
+
+			if req.DisplayName == nil && req.AvatarUrl == nil && req.Bio == nil {
+				return pderr.MissingRequiredFlag("--display-name, --avatar-url or --bio")
+			}
+
+			resp, err := client.grpcClient.UpdateProfile(client.OutgoingContext(ctx), req)
+			if err != nil {
+				return err
+			}
+
+			fmt.Println(formatUserProfile(resp.User))
+
+			return nil
+		},
+	}
+}
+
+func makeDeactivateAccountSubcommand() *Subcommand {
+	cmd := cobra.Command{
+		Use:   "deactivate-account",
+		Short: "deactivate your account, or another user's with --username (admin only)",
+	}
+
+	var username string
+	cmd.Flags().StringVar(&username, "username", "", "user to deactivate (admin only; default is yourself)")
+
+	return &Subcommand{
+		Command: &cmd,
+		Core: func(ctx context.Context, client *Client) error {
+			if username != "" {
+				req := &pdpb.AdminDeactivateUserRequest{
+					Username: username,
+				}
+				if _, err := client.grpcClient.AdminDeactivateUser(client.OutgoingContext(ctx), req); err != nil {
+					return err
+				}
+
+				fmt.Printf("Deactivated user %q\n", username)
+				return nil
+			}
+
+			currentPassword, err := readCurrentPassword()
+			if err != nil {
+				return err
+			}
+
+			req := &pdpb.DeactivateAccountRequest{
+				CurrentPassword: currentPassword,
+			}
+			if _, err := client.grpcClient.DeactivateAccount(client.OutgoingContext(ctx), req); err != nil {
+				return err
+			}
+
+			fmt.Printf("Your account has been deactivated; an admin can reactivate it.\n")
+			return nil
+		},
+	}
+}
+
+func makeReactivateAccountSubcommand() *Subcommand {
+	cmd := cobra.Command{
+		Use:   "reactivate-account",
+		Short: "reactivate a deactivated user (admin only)",
+	}
+
+	var username string
+	cmd.Flags().StringVar(&username, "username", "", "user to reactivate")
+
+	return &Subcommand{
+		Command: &cmd,
+		Core: func(ctx context.Context, client *Client) error {
+			if username == "" {
+				return pderr.MissingRequiredFlag("--username")
+			}
+
+			req := &pdpb.AdminReactivateUserRequest{
+				Username: username,
+			}
+			if _, err := client.grpcClient.AdminReactivateUser(client.OutgoingContext(ctx), req); err != nil {
+				return err
+			}
+
+			fmt.Printf("Reactivated user %q\n", username)
+			return nil
+		},
+	}
+}
+
+func makeDeleteAccountSubcommand() *Subcommand {
+	cmd := cobra.Command{
+		Use:   "delete-account",
+		Short: "irreversibly delete your account, or another user's with --username (admin only)",
+	}
+
+	var username string
+	var confirmed bool
+	cmd.Flags().StringVar(&username, "username", "", "user to delete (admin only; default is yourself)")
+	cmd.Flags().BoolVar(&confirmed, "yes-really-delete", false, "confirm that the deletion cannot be undone")
+
+	return &Subcommand{
+		Command: &cmd,
+		Core: func(ctx context.Context, client *Client) error {
+			if !confirmed {
+				return pderr.MissingRequiredFlag("--yes-really-delete")
+			}
+
+			if username != "" {
+				req := &pdpb.AdminDeleteUserRequest{
+					Username: username,
+				}
+				resp, err := client.grpcClient.AdminDeleteUser(client.OutgoingContext(ctx), req)
+				if err != nil {
+					return err
+				}
+
+				fmt.Printf("Deleted user %q; it is now known as %q\n", username, resp.DeletedUsername)
+				return nil
+			}
+
+			currentPassword, err := readCurrentPassword()
+			if err != nil {
+				return err
+			}
+
+			req := &pdpb.DeleteAccountRequest{
+				CurrentPassword: currentPassword,
+			}
+			if _, err := client.grpcClient.DeleteAccount(client.OutgoingContext(ctx), req); err != nil {
+				return err
+			}
+
+			fmt.Printf("Your account has been deleted.\n")
+			return nil
+		},
+	}
+}
+
+func makeExportDataSubcommand() *Subcommand {
+	cmd := cobra.Command{
+		Use:   "export-data",
+		Short: "export everything stored about your account, or another user's with --username (admin only), as JSON",
+	}
+
+	var username, outputPath string
+	cmd.Flags().StringVar(&username, "username", "", "user whose data to export (admin only; default is yourself)")
+	cmd.Flags().StringVar(&outputPath, "output", "", "file to write the JSON to (default stdout)")
+
+	return &Subcommand{
+		Command: &cmd,
+		Core: func(ctx context.Context, client *Client) error {
+			var data string
+
+			if username != "" {
+				resp, err := client.grpcClient.AdminExportUserData(client.OutgoingContext(ctx), &pdpb.AdminExportUserDataRequest{Username: username})
+				if err != nil {
+					return err
+				}
+				data = resp.Json
+			} else {
+				resp, err := client.grpcClient.ExportAccountData(client.OutgoingContext(ctx), &pdpb.ExportAccountDataRequest{})
+				if err != nil {
+					return err
+				}
+				data = resp.Json
+			}
+
+			if outputPath == "" {
+				fmt.Println(data)
+				return nil
+			}
+
+			if err := os.WriteFile(outputPath, []byte(data+"\n"), 0600); err != nil {
+				return pderr.Wrap("failed to write export", err)
+			}
+
+			return nil
+		},
+	}
+}
+
+func formatInviteInfo(info *pdpb.InviteInfo) string {
+	status := "active"
+	if info.UseCount >= info.MaxUses {
+		status = "used up"
+	} else if info.ExpirationTime.AsTime().Before(time.Now()) {
+		status = "expired"
+	}
+
+	invited := "-"
+	if len(info.InvitedUsernames) > 0 {
+		invited = strings.Join(info.InvitedUsernames, ",")
+	}
+
+	return fmt.Sprintf("%s\tby %s\tused %d/%d\texpires %s\t%s\tinvited %s", info.InviteUuid, info.CreatedByUsername, info.UseCount, info.MaxUses, info.ExpirationTime.AsTime().Format(time.RFC3339), status, invited)
+}
+
+func makeCreateInviteSubcommand() *Subcommand {
+	cmd := cobra.Command{
+		Use:   "create-invite",
+		Short: "create an invite code that lets others register",
+	}
+
+	var maxUses int
+	var validFor time.Duration
+	cmd.Flags().IntVar(&maxUses, "max-uses", 1, "how many accounts may be registered with the code")
+	cmd.Flags().DurationVar(&validFor, "valid-for", 0, "how long the code is valid (default 7 days)")
+
+	return &Subcommand{
+		Command: &cmd,
+		Core: func(ctx context.Context, client *Client) error {
+			req := &pdpb.CreateInviteRequest{
+				MaxUses:              int32(maxUses),
+				ValidDurationSeconds: int64(validFor / time.Second),
+			}
+			resp, err := client.grpcClient.CreateInvite(client.OutgoingContext(ctx), req)
+			if err != nil {
+				return err
+			}
+
+			fmt.Printf("Invite code: %s\n", resp.InviteCode)
+			fmt.Printf("This code will not be shown again. Use it with \"create-account --invite-code <code>\".\n")
+			fmt.Println(formatInviteInfo(resp.Info))
+
+			return nil
+		},
+	}
+}
+
+func makeListInvitesSubcommand() *Subcommand {
+	cmd := cobra.Command{
+		Use:   "list-invites",
+		Short: "list your invites and who registered with them, or everyone's with --all (admin only)",
+	}
+
+	var all bool
+	var createdBy string
+	cmd.Flags().BoolVar(&all, "all", false, "list everyone's invites (admin only)")
+	cmd.Flags().StringVar(&createdBy, "created-by", "", "list the invites created by this user (admin only)")
+
+	return &Subcommand{
+		Command: &cmd,
+		Core: func(ctx context.Context, client *Client) error {
+			var invites []*pdpb.InviteInfo
+
+			if all || createdBy != "" {
+				resp, err := client.grpcClient.AdminListInvites(client.OutgoingContext(ctx), &pdpb.AdminListInvitesRequest{CreatedByUsername: createdBy})
+				if err != nil {
+					return err
+				}
+				invites = resp.Invites
+			} else {
+				resp, err := client.grpcClient.ListInvites(client.OutgoingContext(ctx), &pdpb.ListInvitesRequest{})
+				if err != nil {
+					return err
+				}
+				invites = resp.Invites
+			}
+
+			for _, info := range invites {
+				fmt.Println(formatInviteInfo(info))
+			}
+
+			return nil
+		},
+	}
+}
@@ -0,0 +1,396 @@
+package loginthrottle
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/steinarvk/playdough/pkg/logging"
+	"github.com/steinarvk/playdough/pkg/pderr"
+	"github.com/steinarvk/playdough/pkg/pdusername"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+)
+
+// Policy controls how failed login attempts for a single key are throttled.
+type Policy struct {
+	// Number of failures tolerated before any backoff applies.
+	FreeAttempts int
+	// Delay after the first failure beyond the free attempts; doubles with each further failure.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+
+	// Once this many failures accumulate, the key is locked out for LockoutDuration.
+	// Zero disables lockout.
+	LockoutThreshold int
+	LockoutDuration  time.Duration
+
+	// Failures are forgotten once no further failure has occurred for this long.
+	FailureWindow time.Duration
+}
+
+type Params struct {
+	PerUsername Policy
+	PerIP       Policy
+}
+
+func DefaultParams() Params {
+	return Params{
+		PerUsername: Policy{
+			FreeAttempts:     3,
+			BaseDelay:        time.Second,
+			MaxDelay:         5 * time.Minute,
+			LockoutThreshold: 10,
+			LockoutDuration:  30 * time.Minute,
+			FailureWindow:    24 * time.Hour,
+		},
+		PerIP: Policy{
+			FreeAttempts:     20,
+			BaseDelay:        time.Second,
+			MaxDelay:         5 * time.Minute,
+			LockoutThreshold: 100,
+			LockoutDuration:  time.Hour,
+			FailureWindow:    time.Hour,
+		},
+	}
+}
+
+// BlockDuration returns how long further attempts are blocked after the given number of consecutive failures.
+func (p Policy) BlockDuration(failures int) time.Duration {
+	if p.LockoutThreshold > 0 && failures >= p.LockoutThreshold {
+		return p.LockoutDuration
+	}
+
+	if failures <= p.FreeAttempts {
+		return 0
+	}
+
+	delay := p.BaseDelay
+	for i := p.FreeAttempts + 1; i < failures && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+
+	if delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+
+	return delay
+}
+
+type Throttle struct {
+	db     *sql.DB
+	params Params
+	now    func() time.Time
+}
+
+func New(db *sql.DB, params Params) *Throttle {
+	return &Throttle{
+		db:     db,
+		params: params,
+		now:    time.Now,
+	}
+}
+
+type keyKind int
+
+const (
+	usernameKey keyKind = iota
+	ipKey
+)
+
+type throttleKey struct {
+	kind  keyKind
+	value string
+}
+
+func (k throttleKey) String() string {
+	switch k.kind {
+	case usernameKey:
+		return "username:" + k.value
+	default:
+		return "ip:" + k.value
+	}
+}
+
+func (t *Throttle) policy(k throttleKey) Policy {
+	switch k.kind {
+	case usernameKey:
+		return t.params.PerUsername
+	default:
+		return t.params.PerIP
+	}
+}
+
+// Usernames are keyed by canonical form, so that varying the case of a username
+// does not get around the throttle.
+func usernameThrottleKey(username string) throttleKey {
+	return throttleKey{kind: usernameKey, value: pdusername.Canonical(username)}
+}
+
+func keysFor(username, clientIP string) []throttleKey {
+	rv := []throttleKey{usernameThrottleKey(username)}
+	if clientIP != "" {
+		rv = append(rv, throttleKey{kind: ipKey, value: clientIP})
+	}
+	return rv
+}
+
+type failureState struct {
+	failureCount int
+	firstFailure time.Time
+	lastFailure  time.Time
+	blockedUntil time.Time
+}
+
+// lockFailureState reads the failure record for a key, locking it until the
+// transaction ends. It returns sql.ErrNoRows if there is no record.
+func lockFailureState(ctx context.Context, tx *sql.Tx, key throttleKey) (failureState, error) {
+	var state failureState
+
+	err := tx.QueryRowContext(
+		ctx,
+		`
+			SELECT failure_count, first_failure_timestamp, last_failure_timestamp, blocked_until_timestamp
+			FROM login_failures
+			WHERE throttle_key = $1
+			FOR UPDATE
+		`,
+		key.String(),
+	).Scan(&state.failureCount, &state.firstFailure, &state.lastFailure, &state.blockedUntil)
+
+	return state, err
+}
+
+func updateFailureState(ctx context.Context, tx *sql.Tx, key throttleKey, state failureState) error {
+	_, err := tx.ExecContext(
+		ctx,
+		`
+			UPDATE login_failures
+			SET failure_count = $2,
+			    first_failure_timestamp = $3,
+			    last_failure_timestamp = $4,
+			    blocked_until_timestamp = $5
+			WHERE throttle_key = $1
+		`,
+		key.String(), state.failureCount, state.firstFailure, state.lastFailure, state.blockedUntil,
+	)
+	return err
+}
+
+func (t *Throttle) blockedError(ctx context.Context, key throttleKey, state failureState, now time.Time) error {
+	retryAfter := state.blockedUntil.Sub(now)
+	policy := t.policy(key)
+
+	logging.FromContext(ctx).Warn("login attempt throttled",
+		zap.String("throttle_key", key.String()),
+		zap.Int("failure_count", state.failureCount),
+		zap.Duration("retry_after", retryAfter),
+	)
+
+	if key.kind == usernameKey && policy.LockoutThreshold > 0 && state.failureCount >= policy.LockoutThreshold {
+		return pderr.ErrorWithDetails(codes.Unauthenticated, "account temporarily locked due to repeated login failures", pderr.RetryInfo(retryAfter))
+	}
+
+	return pderr.ResourceExhausted("too many failed login attempts; try again later", retryAfter)
+}
+
+// Attempt returns an error if login attempts for this username or client IP are
+// currently blocked, and otherwise records the attempt as a failure. Counting it
+// up front means concurrent guesses cannot all get past the throttle before any of
+// them is recorded; once the credentials turn out to be correct, call Release.
+// It should be called before doing any expensive password hashing.
+func (t *Throttle) Attempt(ctx context.Context, username, clientIP string) error {
+	now := t.now()
+
+	tx, err := t.db.BeginTx(ctx, nil)
+	if err != nil {
+		return pderr.Wrap("failed to check login throttle", err)
+	}
+	defer tx.Rollback()
+
+	keys := keysFor(username, clientIP)
+	states := make([]failureState, len(keys))
+
+	for i, key := range keys {
+		if _, err := tx.ExecContext(
+			ctx,
+			`
+				INSERT INTO login_failures
+					(throttle_key,
+					 failure_count,
+					 first_failure_timestamp,
+					 last_failure_timestamp,
+					 blocked_until_timestamp)
+				VALUES
+					($1, 0, $2, $2, $2)
+				ON CONFLICT (throttle_key) DO NOTHING
+			`,
+			key.String(), now,
+		); err != nil {
+			return pderr.Wrap("failed to check login throttle", err)
+		}
+
+		state, err := lockFailureState(ctx, tx, key)
+		if err != nil {
+			return pderr.Wrap("failed to check login throttle", err)
+		}
+
+		if now.Before(state.blockedUntil) {
+			return t.blockedError(ctx, key, state, now)
+		}
+
+		states[i] = state
+	}
+
+	for i, key := range keys {
+		policy := t.policy(key)
+		state := states[i]
+
+		if state.lastFailure.Before(now.Add(-policy.FailureWindow)) {
+			state.failureCount = 0
+			state.firstFailure = now
+		}
+		state.failureCount++
+		state.lastFailure = now
+
+		if blockDuration := policy.BlockDuration(state.failureCount); blockDuration > 0 {
+			state.blockedUntil = now.Add(blockDuration)
+		}
+
+		if err := updateFailureState(ctx, tx, key, state); err != nil {
+			return pderr.Wrap("failed to record login attempt", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return pderr.Wrap("failed to record login attempt", err)
+	}
+
+	return nil
+}
+
+// Release takes back an attempt recorded by Attempt that turned out not to be a
+// failure, either because the credentials were correct or because verification
+// failed for some unrelated reason.
+func (t *Throttle) Release(ctx context.Context, username, clientIP string) error {
+	now := t.now()
+
+	tx, err := t.db.BeginTx(ctx, nil)
+	if err != nil {
+		return pderr.Wrap("failed to release login attempt", err)
+	}
+	defer tx.Rollback()
+
+	for _, key := range keysFor(username, clientIP) {
+		state, err := lockFailureState(ctx, tx, key)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return pderr.Wrap("failed to release login attempt", err)
+		}
+
+		if state.failureCount > 0 {
+			state.failureCount--
+		}
+
+		// Any block still in force was imposed by this attempt or by later ones,
+		// which remain counted.
+		if blockedUntil := now.Add(t.policy(key).BlockDuration(state.failureCount)); blockedUntil.Before(state.blockedUntil) {
+			state.blockedUntil = blockedUntil
+		}
+
+		if err := updateFailureState(ctx, tx, key, state); err != nil {
+			return pderr.Wrap("failed to release login attempt", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return pderr.Wrap("failed to release login attempt", err)
+	}
+
+	return nil
+}
+
+// RecordSuccess clears the failure history of a username after a successful login.
+// Per-IP history is deliberately kept, so that a single valid account cannot be used
+// to reset the throttle for guesses against other accounts.
+func (t *Throttle) RecordSuccess(ctx context.Context, username string) error {
+	if _, err := t.db.ExecContext(
+		ctx,
+		`
+			DELETE FROM login_failures
+			WHERE throttle_key = $1
+		`,
+		usernameThrottleKey(username).String(),
+	); err != nil {
+		return pderr.Wrap("failed to clear login failures", err)
+	}
+
+	return nil
+}
+
+// ForgetUsername clears the failure history of a username as part of tx. It is for
+// deleting a user, so that whoever registers the name next starts afresh.
+func ForgetUsername(ctx context.Context, tx *sql.Tx, username string) error {
+	if _, err := tx.ExecContext(
+		ctx,
+		`
+			DELETE FROM login_failures
+			WHERE throttle_key = $1
+		`,
+		usernameThrottleKey(username).String(),
+	); err != nil {
+		return pderr.Wrap("failed to clear login failures", err)
+	}
+
+	return nil
+}
+
+func (t *Throttle) cleanup(ctx context.Context) (int64, error) {
+	now := t.now()
+
+	oldestWindow := t.params.PerUsername.FailureWindow
+	if t.params.PerIP.FailureWindow > oldestWindow {
+		oldestWindow = t.params.PerIP.FailureWindow
+	}
+
+	result, err := t.db.ExecContext(
+		ctx,
+		`
+			DELETE FROM login_failures
+			WHERE last_failure_timestamp < $1
+			  AND blocked_until_timestamp < $2
+		`,
+		now.Add(-oldestWindow), now,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// RunCleanup periodically deletes expired failure records until the context is cancelled.
+func (t *Throttle) RunCleanup(ctx context.Context, interval time.Duration) {
+	logger := logging.FromContext(ctx)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			n, err := t.cleanup(ctx)
+			if err != nil {
+				logger.Warn("failed to clean up login failure records", zap.Error(err))
+				continue
+			}
+			if n > 0 {
+				logger.Info("cleaned up login failure records", zap.Int64("deleted", n))
+			}
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package loginthrottle
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/steinarvk/playdough/pkg/pderr"
+	"github.com/steinarvk/playdough/pkg/pdtestutils"
+	"google.golang.org/grpc/codes"
+)
+
+func TestBlockDuration(t *testing.T) {
+	policy := Policy{
+		FreeAttempts:     3,
+		BaseDelay:        time.Second,
+		MaxDelay:         10 * time.Second,
+		LockoutThreshold: 10,
+		LockoutDuration:  time.Hour,
+	}
+
+	for _, tc := range []struct {
+		failures int
+		want     time.Duration
+	}{
+		{0, 0},
+		{3, 0},
+		{4, time.Second},
+		{5, 2 * time.Second},
+		{6, 4 * time.Second},
+		{7, 8 * time.Second},
+		{8, 10 * time.Second},
+		{9, 10 * time.Second},
+		{10, time.Hour},
+		{1000, time.Hour},
+	} {
+		if got := policy.BlockDuration(tc.failures); got != tc.want {
+			t.Errorf("BlockDuration(%d) = %v, want %v", tc.failures, got, tc.want)
+		}
+	}
+}
+
+func TestBlockDurationWithoutLockout(t *testing.T) {
+	policy := Policy{
+		FreeAttempts: 1,
+		BaseDelay:    time.Second,
+		MaxDelay:     time.Minute,
+	}
+
+	if got := policy.BlockDuration(1 << 20); got != time.Minute {
+		t.Errorf("BlockDuration(huge) = %v, want %v", got, time.Minute)
+	}
+}
+
+func TestUsernameKeysIgnoreCase(t *testing.T) {
+	if a, b := keysFor("Alice", "")[0].String(), keysFor("aLiCe", "10.0.0.1")[0].String(); a != b {
+		t.Errorf("username keys %q and %q differ", a, b)
+	}
+}
+
+func TestConcurrentAttemptsCannotExceedFreeAttempts(t *testing.T) {
+	params := DefaultParams()
+	params.PerUsername.FreeAttempts = 2
+	params.PerUsername.BaseDelay = time.Hour
+	params.PerUsername.MaxDelay = time.Hour
+
+	throttle := New(pdtestutils.OpenTestDatabase(t), params)
+	ctx := context.Background()
+
+	const attempts = 10
+	errs := make([]error, attempts)
+
+	var wg sync.WaitGroup
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = throttle.Attempt(ctx, "alice", "")
+		}(i)
+	}
+	wg.Wait()
+
+	allowed := 0
+	for _, err := range errs {
+		switch pderr.CodeOf(err) {
+		case codes.OK:
+			allowed++
+		case codes.ResourceExhausted:
+		default:
+			t.Fatalf("Attempt() = %v", err)
+		}
+	}
+
+	// The attempt that exceeds the free ones is still made, but blocks any after it.
+	if want := params.PerUsername.FreeAttempts + 1; allowed != want {
+		t.Errorf("%d concurrent attempts allowed, want %d", allowed, want)
+	}
+}
+
+func TestReleaseTakesBackAttempt(t *testing.T) {
+	params := DefaultParams()
+	params.PerUsername.FreeAttempts = 1
+	params.PerUsername.BaseDelay = time.Hour
+	params.PerUsername.MaxDelay = time.Hour
+
+	throttle := New(pdtestutils.OpenTestDatabase(t), params)
+	ctx := context.Background()
+
+	for i := 0; i < 5; i++ {
+		if err := throttle.Attempt(ctx, "alice", "10.0.0.1"); err != nil {
+			t.Fatalf("attempt %d: Attempt() = %v", i, err)
+		}
+		if err := throttle.Release(ctx, "alice", "10.0.0.1"); err != nil {
+			t.Fatalf("attempt %d: Release() = %v", i, err)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := throttle.Attempt(ctx, "alice", "10.0.0.1"); err != nil {
+			t.Fatalf("failed attempt %d: Attempt() = %v", i, err)
+		}
+	}
+
+	if err := throttle.Attempt(ctx, "alice", "10.0.0.1"); pderr.CodeOf(err) != codes.ResourceExhausted {
+		t.Errorf("Attempt() after two failures = %v, want ResourceExhausted", err)
+	}
+}
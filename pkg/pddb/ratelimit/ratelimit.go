@@ -0,0 +1,200 @@
+// Package ratelimit limits request rates with token buckets, keyed by
+// authenticated username or, for unauthenticated requests, by client IP.
+// Buckets are kept in memory, or in Postgres so that replicas share them.
+package ratelimit
+
+import (
+	"context"
+	"database/sql"
+	"math"
+	"time"
+
+	"github.com/steinarvk/playdough/pkg/logging"
+	"github.com/steinarvk/playdough/pkg/pderr"
+	"github.com/steinarvk/playdough/pkg/pdusername"
+	"go.uber.org/zap"
+)
+
+// Limit configures a token bucket.
+type Limit struct {
+	// Tokens added per second. Zero disables the limit.
+	Rate float64
+	// Maximum number of tokens, i.e. the largest burst allowed after a quiet period.
+	Burst float64
+}
+
+func (l Limit) enabled() bool {
+	return l.Rate > 0
+}
+
+// fillDuration is how long an empty bucket takes to fill up.
+func (l Limit) fillDuration() time.Duration {
+	return time.Duration(l.Burst / l.Rate * float64(time.Second))
+}
+
+// refill returns the tokens in a bucket after elapsed time has passed.
+func (l Limit) refill(tokens float64, elapsed time.Duration) float64 {
+	if elapsed < 0 {
+		elapsed = 0
+	}
+	return math.Min(l.Burst, tokens+l.Rate*elapsed.Seconds())
+}
+
+// retryAfter is how long it takes until the bucket holds enough tokens.
+func (l Limit) retryAfter(tokens, cost float64) time.Duration {
+	return time.Duration((cost - tokens) / l.Rate * float64(time.Second))
+}
+
+type Params struct {
+	PerUser Limit
+	PerIP   Limit
+	// Cost of each method in tokens, by full gRPC method name. Methods not
+	// listed cost DefaultCost. Costs above a bucket's burst are capped to it.
+	MethodCosts map[string]float64
+	DefaultCost float64
+	// Keep buckets in Postgres rather than in memory.
+	Shared bool
+}
+
+func DefaultParams() Params {
+	return Params{
+		PerUser:     Limit{Rate: 10, Burst: 50},
+		PerIP:       Limit{Rate: 5, Burst: 30},
+		MethodCosts: map[string]float64{},
+		DefaultCost: 1,
+	}
+}
+
+// store takes tokens from buckets.
+type store interface {
+	// take removes cost tokens from the bucket if it holds enough. Otherwise it
+	// returns how long until it will.
+	take(ctx context.Context, key string, limit Limit, cost float64, now time.Time) (bool, time.Duration, error)
+	// cleanup forgets buckets that have not been touched for longer than maxAge,
+	// and which must therefore be full.
+	cleanup(ctx context.Context, now time.Time, maxAge time.Duration) (int64, error)
+}
+
+type Limiter struct {
+	params Params
+	store  store
+	now    func() time.Time
+}
+
+func New(db *sql.DB, params Params) *Limiter {
+	var s store = newMemoryStore()
+	if params.Shared {
+		s = &postgresStore{db: db}
+	}
+
+	return &Limiter{
+		params: params,
+		store:  s,
+		now:    time.Now,
+	}
+}
+
+// Usernames are keyed by canonical form, so that varying the case of a username
+// does not get around the limit.
+func userBucketKey(username string) string {
+	return "user:" + pdusername.Canonical(username)
+}
+
+func (l *Limiter) cost(fullMethod string) float64 {
+	if cost, ok := l.params.MethodCosts[fullMethod]; ok {
+		return cost
+	}
+	return l.params.DefaultCost
+}
+
+// Allow takes tokens for a call to the method from the bucket of the user or, if
+// the request is unauthenticated, of the client IP. It returns ResourceExhausted,
+// with the time to wait as retry info, if the bucket is empty.
+//
+// If the shared store fails, the request is allowed, so that rate limiting never
+// makes an outage worse.
+func (l *Limiter) Allow(ctx context.Context, fullMethod, username, clientIP string) error {
+	logger := logging.FromContext(ctx)
+
+	var key string
+	var limit Limit
+	switch {
+	case username != "":
+		key, limit = userBucketKey(username), l.params.PerUser
+	case clientIP != "":
+		key, limit = "ip:"+clientIP, l.params.PerIP
+	default:
+		return nil
+	}
+
+	cost := math.Min(l.cost(fullMethod), limit.Burst)
+	if !limit.enabled() || cost <= 0 {
+		return nil
+	}
+
+	allowed, retryAfter, err := l.store.take(ctx, key, limit, cost, l.now())
+	if err != nil {
+		logger.Warn("failed to check rate limit; allowing request", zap.String("rate_limit_key", key), zap.Error(err))
+		return nil
+	}
+
+	if !allowed {
+		logger.Warn("request rate limited",
+			zap.String("rate_limit_key", key),
+			zap.Float64("cost", cost),
+			zap.Duration("retry_after", retryAfter),
+		)
+		return pderr.ResourceExhausted("rate limit exceeded; try again later", retryAfter)
+	}
+
+	return nil
+}
+
+// ForgetUser deletes the shared bucket of a username as part of tx. It is for
+// deleting a user, so that whoever registers the name next starts afresh. Buckets
+// kept in memory are not affected; they are refilled soon enough.
+func ForgetUser(ctx context.Context, tx *sql.Tx, username string) error {
+	if _, err := tx.ExecContext(
+		ctx,
+		`
+			DELETE FROM rate_limit_buckets
+			WHERE bucket_key = $1
+		`,
+		userBucketKey(username),
+	); err != nil {
+		return pderr.Wrap("failed to delete rate limit bucket", err)
+	}
+
+	return nil
+}
+
+// RunCleanup periodically forgets full buckets until the context is cancelled.
+func (l *Limiter) RunCleanup(ctx context.Context, interval time.Duration) {
+	logger := logging.FromContext(ctx)
+
+	var maxAge time.Duration
+	for _, limit := range []Limit{l.params.PerUser, l.params.PerIP} {
+		if limit.enabled() && limit.fillDuration() > maxAge {
+			maxAge = limit.fillDuration()
+		}
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			n, err := l.store.cleanup(ctx, l.now(), maxAge)
+			if err != nil {
+				logger.Warn("failed to clean up rate limit buckets", zap.Error(err))
+				continue
+			}
+			if n > 0 {
+				logger.Info("cleaned up rate limit buckets", zap.Int64("deleted", n))
+			}
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/steinarvk/playdough/pkg/pderr"
+	"github.com/steinarvk/playdough/pkg/pdtestutils"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+)
+
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	return c.t
+}
+
+func newTestLimiter(t *testing.T, shared bool) (*Limiter, *fakeClock) {
+	params := Params{
+		PerUser:     Limit{Rate: 1, Burst: 3},
+		PerIP:       Limit{Rate: 0.5, Burst: 2},
+		MethodCosts: map[string]float64{"/expensive": 10, "/free": 0},
+		DefaultCost: 1,
+		Shared:      shared,
+	}
+
+	var limiter *Limiter
+	if shared {
+		limiter = New(pdtestutils.OpenTestDatabase(t), params)
+	} else {
+		limiter = New(nil, params)
+	}
+
+	clock := &fakeClock{t: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)}
+	limiter.now = clock.now
+	return limiter, clock
+}
+
+func retryDelayOf(t *testing.T, err error) time.Duration {
+	t.Helper()
+
+	if code := pderr.CodeOf(err); code != codes.ResourceExhausted {
+		t.Fatalf("got %v (code %v), want ResourceExhausted", err, code)
+	}
+	for _, detail := range pderr.AsPDError(err).GRPCStatus().Details() {
+		if info, ok := detail.(*errdetails.RetryInfo); ok {
+			return info.RetryDelay.AsDuration()
+		}
+	}
+	t.Fatalf("error %v has no retry info", err)
+	return 0
+}
+
+func testBuckets(t *testing.T, shared bool) {
+	ctx := context.Background()
+	limiter, clock := newTestLimiter(t, shared)
+
+	for i := 0; i < 3; i++ {
+		if err := limiter.Allow(ctx, "/cheap", "Alice", "10.0.0.1"); err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+	}
+
+	if got := retryDelayOf(t, limiter.Allow(ctx, "/cheap", "alice", "10.0.0.2")); got != time.Second {
+		t.Errorf("retry delay = %v, want %v", got, time.Second)
+	}
+
+	// Free methods are never limited.
+	if err := limiter.Allow(ctx, "/free", "alice", ""); err != nil {
+		t.Errorf("free method was limited: %v", err)
+	}
+
+	// Other users and anonymous clients have their own buckets.
+	if err := limiter.Allow(ctx, "/cheap", "bob", ""); err != nil {
+		t.Errorf("other user was limited: %v", err)
+	}
+	if err := limiter.Allow(ctx, "/cheap", "", "10.0.0.1"); err != nil {
+		t.Errorf("anonymous client was limited: %v", err)
+	}
+
+	clock.t = clock.t.Add(1500 * time.Millisecond)
+	if err := limiter.Allow(ctx, "/cheap", "alice", ""); err != nil {
+		t.Errorf("bucket was not refilled: %v", err)
+	}
+
+	// Costs above the burst are capped, so expensive methods need a full bucket
+	// rather than being impossible to call.
+	if got := retryDelayOf(t, limiter.Allow(ctx, "/expensive", "alice", "")); got != 2500*time.Millisecond {
+		t.Errorf("retry delay = %v, want %v", got, 2500*time.Millisecond)
+	}
+
+	clock.t = clock.t.Add(time.Hour)
+	if err := limiter.Allow(ctx, "/expensive", "alice", ""); err != nil {
+		t.Errorf("expensive method was limited with a full bucket: %v", err)
+	}
+}
+
+func TestBuckets(t *testing.T) {
+	testBuckets(t, false)
+}
+
+func TestSharedBuckets(t *testing.T) {
+	testBuckets(t, true)
+}
+
+func TestCleanupForgetsFullBuckets(t *testing.T) {
+	ctx := context.Background()
+	limiter, clock := newTestLimiter(t, false)
+
+	if err := limiter.Allow(ctx, "/cheap", "alice", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, _ := limiter.store.cleanup(ctx, clock.t.Add(time.Second), 4*time.Second); n != 0 {
+		t.Errorf("cleanup deleted %d buckets, want 0", n)
+	}
+	if n, _ := limiter.store.cleanup(ctx, clock.t.Add(5*time.Second), 4*time.Second); n != 1 {
+		t.Errorf("cleanup deleted %d buckets, want 1", n)
+	}
+}
@@ -0,0 +1,127 @@
+package ratelimit
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"time"
+
+	"github.com/steinarvk/playdough/pkg/pderr"
+)
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+type memoryStore struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		buckets: map[string]*bucket{},
+	}
+}
+
+func (m *memoryStore) take(ctx context.Context, key string, limit Limit, cost float64, now time.Time) (bool, time.Duration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	b, ok := m.buckets[key]
+	if !ok {
+		b = &bucket{tokens: limit.Burst, updated: now}
+		m.buckets[key] = b
+	}
+
+	if now.After(b.updated) {
+		b.tokens = limit.refill(b.tokens, now.Sub(b.updated))
+		b.updated = now
+	}
+
+	if b.tokens < cost {
+		return false, limit.retryAfter(b.tokens, cost), nil
+	}
+
+	b.tokens -= cost
+	return true, 0, nil
+}
+
+func (m *memoryStore) cleanup(ctx context.Context, now time.Time, maxAge time.Duration) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var n int64
+	for key, b := range m.buckets {
+		if now.Sub(b.updated) > maxAge {
+			delete(m.buckets, key)
+			n++
+		}
+	}
+	return n, nil
+}
+
+type postgresStore struct {
+	db *sql.DB
+}
+
+func (p *postgresStore) take(ctx context.Context, key string, limit Limit, cost float64, now time.Time) (bool, time.Duration, error) {
+	// Refills and takes in one statement, so that concurrent requests on any
+	// replica cannot both spend the same tokens. Replica clocks may disagree a
+	// little, so time never runs backwards for a bucket.
+	err := p.db.QueryRowContext(
+		ctx,
+		`
+			INSERT INTO rate_limit_buckets AS buckets
+				(bucket_key, tokens, updated_timestamp)
+			VALUES
+				($1, $2::DOUBLE PRECISION - $4::DOUBLE PRECISION, $5)
+			ON CONFLICT (bucket_key) DO UPDATE SET
+				tokens = LEAST($2::DOUBLE PRECISION, buckets.tokens + $3::DOUBLE PRECISION * GREATEST(0, EXTRACT(EPOCH FROM ($5::TIMESTAMP - buckets.updated_timestamp))::DOUBLE PRECISION)) - $4::DOUBLE PRECISION,
+				updated_timestamp = GREATEST(buckets.updated_timestamp, $5::TIMESTAMP)
+			WHERE LEAST($2::DOUBLE PRECISION, buckets.tokens + $3::DOUBLE PRECISION * GREATEST(0, EXTRACT(EPOCH FROM ($5::TIMESTAMP - buckets.updated_timestamp))::DOUBLE PRECISION)) >= $4::DOUBLE PRECISION
+			RETURNING tokens
+		`,
+		key, limit.Burst, limit.Rate, cost, now,
+	).Scan(new(float64))
+	if err == nil {
+		return true, 0, nil
+	}
+	if err != sql.ErrNoRows {
+		return false, 0, pderr.Wrap("failed to take rate limit tokens", err)
+	}
+
+	// The bucket exists but holds too few tokens.
+	var tokens float64
+	var updated time.Time
+	if err := p.db.QueryRowContext(
+		ctx,
+		`
+			SELECT tokens, updated_timestamp
+			FROM rate_limit_buckets
+			WHERE bucket_key = $1
+		`,
+		key,
+	).Scan(&tokens, &updated); err != nil {
+		return false, 0, pderr.Wrap("failed to read rate limit bucket", err)
+	}
+
+	return false, limit.retryAfter(limit.refill(tokens, now.Sub(updated)), cost), nil
+}
+
+func (p *postgresStore) cleanup(ctx context.Context, now time.Time, maxAge time.Duration) (int64, error) {
+	result, err := p.db.ExecContext(
+		ctx,
+		`
+			DELETE FROM rate_limit_buckets
+			WHERE updated_timestamp < $1
+		`,
+		now.Add(-maxAge),
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
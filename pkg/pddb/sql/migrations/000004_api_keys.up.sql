@@ -0,0 +1,13 @@
+CREATE TABLE api_keys (
+    api_key_id SERIAL PRIMARY KEY,
+    api_key_uuid UUID NOT NULL UNIQUE,
+    user_id INTEGER NOT NULL REFERENCES users(user_id) ON DELETE CASCADE,
+    key_name TEXT NOT NULL,
+    key_secret_hash BYTEA NOT NULL,
+    scopes TEXT[] NOT NULL,
+    creation_timestamp TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    expiration_timestamp TIMESTAMP NOT NULL,
+    revocation_timestamp TIMESTAMP
+);
+
+CREATE INDEX api_keys_user_id_idx ON api_keys(user_id);
\ No newline at end of file
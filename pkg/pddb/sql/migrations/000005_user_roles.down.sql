@@ -0,0 +1,3 @@
+DROP INDEX user_roles_role_name_idx;
+
+DROP TABLE user_roles;
\ No newline at end of file
@@ -0,0 +1,12 @@
+CREATE TABLE user_roles (
+    user_role_id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(user_id) ON DELETE CASCADE,
+    role_name TEXT NOT NULL CHECK (role_name IN ('admin', 'issuer', 'auditor', 'user')),
+    grant_timestamp TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (user_id, role_name)
+);
+
+CREATE INDEX user_roles_role_name_idx ON user_roles(role_name);
+
+INSERT INTO user_roles (user_id, role_name)
+SELECT user_id, 'user' FROM users;
\ No newline at end of file
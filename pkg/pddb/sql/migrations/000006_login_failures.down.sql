@@ -0,0 +1,3 @@
+DROP INDEX login_failures_last_failure_timestamp_idx;
+
+DROP TABLE login_failures;
\ No newline at end of file
@@ -0,0 +1,9 @@
+CREATE TABLE login_failures (
+    throttle_key TEXT PRIMARY KEY,
+    failure_count INTEGER NOT NULL,
+    first_failure_timestamp TIMESTAMP NOT NULL,
+    last_failure_timestamp TIMESTAMP NOT NULL,
+    blocked_until_timestamp TIMESTAMP NOT NULL
+);
+
+CREATE INDEX login_failures_last_failure_timestamp_idx ON login_failures(last_failure_timestamp);
\ No newline at end of file
@@ -0,0 +1,5 @@
+DROP INDEX password_reset_tokens_user_id_idx;
+
+DROP TABLE password_reset_tokens;
+
+ALTER TABLE users DROP COLUMN session_generation;
\ No newline at end of file
@@ -0,0 +1,14 @@
+ALTER TABLE users ADD COLUMN session_generation INTEGER NOT NULL DEFAULT 0;
+
+CREATE TABLE password_reset_tokens (
+    password_reset_token_id SERIAL PRIMARY KEY,
+    password_reset_token_uuid UUID NOT NULL UNIQUE,
+    user_id INTEGER NOT NULL REFERENCES users(user_id) ON DELETE CASCADE,
+    created_by_user_id INTEGER REFERENCES users(user_id) ON DELETE SET NULL,
+    token_secret_hash BYTEA NOT NULL,
+    creation_timestamp TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    expiration_timestamp TIMESTAMP NOT NULL,
+    used_timestamp TIMESTAMP
+);
+
+CREATE INDEX password_reset_tokens_user_id_idx ON password_reset_tokens(user_id);
\ No newline at end of file
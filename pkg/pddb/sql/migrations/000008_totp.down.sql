@@ -0,0 +1,9 @@
+DROP INDEX login_challenges_user_id_idx;
+
+DROP TABLE login_challenges;
+
+DROP INDEX totp_recovery_codes_user_id_idx;
+
+DROP TABLE totp_recovery_codes;
+
+DROP TABLE totp_credentials;
\ No newline at end of file
@@ -0,0 +1,30 @@
+CREATE TABLE totp_credentials (
+    totp_credential_id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(user_id) ON DELETE CASCADE UNIQUE,
+    totp_secret BYTEA NOT NULL,
+    creation_timestamp TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    confirmation_timestamp TIMESTAMP,
+    last_used_counter BIGINT NOT NULL DEFAULT 0
+);
+
+CREATE TABLE totp_recovery_codes (
+    totp_recovery_code_id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(user_id) ON DELETE CASCADE,
+    code_hash BYTEA NOT NULL,
+    creation_timestamp TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    used_timestamp TIMESTAMP
+);
+
+CREATE INDEX totp_recovery_codes_user_id_idx ON totp_recovery_codes(user_id);
+
+CREATE TABLE login_challenges (
+    login_challenge_id SERIAL PRIMARY KEY,
+    login_challenge_uuid UUID NOT NULL UNIQUE,
+    user_id INTEGER NOT NULL REFERENCES users(user_id) ON DELETE CASCADE,
+    challenge_secret_hash BYTEA NOT NULL,
+    creation_timestamp TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    expiration_timestamp TIMESTAMP NOT NULL,
+    used_timestamp TIMESTAMP
+);
+
+CREATE INDEX login_challenges_user_id_idx ON login_challenges(user_id);
\ No newline at end of file
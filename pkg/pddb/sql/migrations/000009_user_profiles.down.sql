@@ -0,0 +1,5 @@
+DROP INDEX users_username_prefix_idx;
+
+ALTER TABLE users DROP COLUMN bio;
+ALTER TABLE users DROP COLUMN avatar_url;
+ALTER TABLE users DROP COLUMN display_name;
\ No newline at end of file
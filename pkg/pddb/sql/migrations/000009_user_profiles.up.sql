@@ -0,0 +1,5 @@
+ALTER TABLE users ADD COLUMN display_name TEXT NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN avatar_url TEXT NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN bio TEXT NOT NULL DEFAULT '';
+
+CREATE INDEX users_username_prefix_idx ON users(username text_pattern_ops);
\ No newline at end of file
@@ -0,0 +1,2 @@
+ALTER TABLE users DROP COLUMN deletion_timestamp;
+ALTER TABLE users DROP COLUMN deactivation_timestamp;
\ No newline at end of file
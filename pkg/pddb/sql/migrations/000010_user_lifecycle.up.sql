@@ -0,0 +1,2 @@
+ALTER TABLE users ADD COLUMN deactivation_timestamp TIMESTAMP;
+ALTER TABLE users ADD COLUMN deletion_timestamp TIMESTAMP;
\ No newline at end of file
@@ -0,0 +1,6 @@
+DROP INDEX users_canonical_username_prefix_idx;
+DROP INDEX users_canonical_username_key;
+
+CREATE INDEX users_username_prefix_idx ON users(username text_pattern_ops);
+
+ALTER TABLE users DROP COLUMN canonical_username;
\ No newline at end of file
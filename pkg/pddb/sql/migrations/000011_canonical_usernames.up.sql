@@ -0,0 +1,42 @@
+-- lower() gives the canonical form (pdusername.Canonical) only of ASCII
+-- usernames, so refuse to migrate if there are any others: their canonical
+-- forms, and the collisions between them, can only be computed in Go.
+DO $$
+DECLARE
+    collisions TEXT;
+    non_ascii TEXT;
+BEGIN
+    SELECT string_agg(username, ', ' ORDER BY user_creation_timestamp)
+    INTO non_ascii
+    FROM users
+    WHERE username ~ '[^ -~]';
+
+    IF non_ascii IS NOT NULL THEN
+        RAISE EXCEPTION 'usernames with non-ASCII characters must be renamed before migrating: %', non_ascii
+            USING HINT = 'Rename them to ASCII-only usernames, e.g. with UPDATE users SET username = ... WHERE username = ...';
+    END IF;
+
+    SELECT string_agg(usernames, '; ')
+    INTO collisions
+    FROM (
+        SELECT string_agg(username, ', ' ORDER BY user_creation_timestamp) AS usernames
+        FROM users
+        GROUP BY lower(username)
+        HAVING COUNT(*) > 1
+    ) AS colliding;
+
+    IF collisions IS NOT NULL THEN
+        RAISE EXCEPTION 'usernames differing only by case must be renamed before migrating: %', collisions
+            USING HINT = 'Rename all but one account in each group, e.g. with UPDATE users SET username = ... WHERE username = ...';
+    END IF;
+END
+$$;
+
+ALTER TABLE users ADD COLUMN canonical_username TEXT;
+UPDATE users SET canonical_username = lower(username);
+ALTER TABLE users ALTER COLUMN canonical_username SET NOT NULL;
+
+CREATE UNIQUE INDEX users_canonical_username_key ON users(canonical_username);
+
+DROP INDEX users_username_prefix_idx;
+CREATE INDEX users_canonical_username_prefix_idx ON users(canonical_username text_pattern_ops);
\ No newline at end of file
@@ -0,0 +1,5 @@
+DROP INDEX invite_redemptions_invite_code_id_idx;
+DROP INDEX invite_codes_created_by_user_id_idx;
+
+DROP TABLE invite_redemptions;
+DROP TABLE invite_codes;
\ No newline at end of file
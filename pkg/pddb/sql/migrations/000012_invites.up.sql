@@ -0,0 +1,21 @@
+CREATE TABLE invite_codes (
+    invite_code_id SERIAL PRIMARY KEY,
+    invite_uuid UUID NOT NULL UNIQUE,
+    created_by_user_id INTEGER NOT NULL REFERENCES users(user_id) ON DELETE CASCADE,
+    invite_secret_hash BYTEA NOT NULL,
+    max_uses INTEGER NOT NULL,
+    use_count INTEGER NOT NULL DEFAULT 0,
+    creation_timestamp TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    expiration_timestamp TIMESTAMP NOT NULL
+);
+
+CREATE INDEX invite_codes_created_by_user_id_idx ON invite_codes(created_by_user_id);
+
+CREATE TABLE invite_redemptions (
+    invite_redemption_id SERIAL PRIMARY KEY,
+    invite_code_id INTEGER NOT NULL REFERENCES invite_codes(invite_code_id) ON DELETE CASCADE,
+    invited_user_id INTEGER NOT NULL REFERENCES users(user_id) ON DELETE CASCADE UNIQUE,
+    redemption_timestamp TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX invite_redemptions_invite_code_id_idx ON invite_redemptions(invite_code_id);
\ No newline at end of file
@@ -0,0 +1,3 @@
+DROP INDEX rate_limit_buckets_updated_timestamp_idx;
+
+DROP TABLE rate_limit_buckets;
\ No newline at end of file
@@ -0,0 +1,7 @@
+CREATE TABLE rate_limit_buckets (
+    bucket_key TEXT PRIMARY KEY,
+    tokens DOUBLE PRECISION NOT NULL,
+    updated_timestamp TIMESTAMP NOT NULL
+);
+
+CREATE INDEX rate_limit_buckets_updated_timestamp_idx ON rate_limit_buckets(updated_timestamp);
\ No newline at end of file
@@ -0,0 +1,120 @@
+package pddb
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"time"
+)
+
+// WithDeadlineTimeouts returns a connector whose transactions, when begun with a
+// context that has a deadline, set Postgres' statement_timeout and
+// idle_in_transaction_session_timeout to the time remaining. Cancelling the
+// context already cancels a running query, but only while the client is around to
+// ask; this way the server also gives up, and releases the transaction's locks,
+// once nobody is waiting for the result.
+//
+// The wrapped driver's connections must implement the context-aware driver
+// interfaces, as lib/pq's do.
+func WithDeadlineTimeouts(connector driver.Connector) driver.Connector {
+	return deadlineConnector{connector}
+}
+
+// Postgres treats a timeout of zero as no timeout, so a deadline that has just
+// passed must still give a positive one.
+const minTransactionTimeout = time.Millisecond
+
+func transactionTimeoutStatement(timeout time.Duration) string {
+	if timeout < minTransactionTimeout {
+		timeout = minTransactionTimeout
+	}
+	ms := (timeout + time.Millisecond - 1) / time.Millisecond
+	return fmt.Sprintf("SET LOCAL statement_timeout = %d; SET LOCAL idle_in_transaction_session_timeout = %d", ms, ms)
+}
+
+type deadlineConnector struct {
+	driver.Connector
+}
+
+func (c deadlineConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return deadlineConn{conn}, nil
+}
+
+type deadlineConn struct {
+	driver.Conn
+}
+
+func (c deadlineConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	beginner, ok := c.Conn.(driver.ConnBeginTx)
+	if !ok {
+		return nil, fmt.Errorf("driver connection does not support BeginTx")
+	}
+
+	tx, err := beginner.BeginTx(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return tx, nil
+	}
+
+	execer, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		return tx, nil
+	}
+
+	if _, err := execer.ExecContext(ctx, transactionTimeoutStatement(time.Until(deadline)), nil); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	return tx, nil
+}
+
+func (c deadlineConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if queryer, ok := c.Conn.(driver.QueryerContext); ok {
+		return queryer.QueryContext(ctx, query, args)
+	}
+	return nil, driver.ErrSkip
+}
+
+func (c deadlineConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if execer, ok := c.Conn.(driver.ExecerContext); ok {
+		return execer.ExecContext(ctx, query, args)
+	}
+	return nil, driver.ErrSkip
+}
+
+func (c deadlineConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	if preparer, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		return preparer.PrepareContext(ctx, query)
+	}
+	return c.Conn.Prepare(query)
+}
+
+func (c deadlineConn) Ping(ctx context.Context) error {
+	if pinger, ok := c.Conn.(driver.Pinger); ok {
+		return pinger.Ping(ctx)
+	}
+	return nil
+}
+
+func (c deadlineConn) ResetSession(ctx context.Context) error {
+	if resetter, ok := c.Conn.(driver.SessionResetter); ok {
+		return resetter.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c deadlineConn) IsValid() bool {
+	if validator, ok := c.Conn.(driver.Validator); ok {
+		return validator.IsValid()
+	}
+	return true
+}
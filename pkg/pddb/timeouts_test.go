@@ -0,0 +1,95 @@
+package pddb
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/steinarvk/playdough/pkg/pderr"
+)
+
+type fakeConnector struct {
+	conn *fakeConn
+}
+
+func (c fakeConnector) Connect(context.Context) (driver.Conn, error) { return c.conn, nil }
+func (fakeConnector) Driver() driver.Driver                          { return nil }
+
+type fakeConn struct {
+	statements []string
+}
+
+func (*fakeConn) Prepare(string) (driver.Stmt, error) { return nil, errors.New("not supported") }
+func (*fakeConn) Close() error                        { return nil }
+func (*fakeConn) Begin() (driver.Tx, error)           { return nil, errors.New("not supported") }
+func (*fakeConn) Commit() error                       { return nil }
+func (*fakeConn) Rollback() error                     { return nil }
+
+func (c *fakeConn) BeginTx(context.Context, driver.TxOptions) (driver.Tx, error) {
+	c.statements = append(c.statements, "BEGIN")
+	return c, nil
+}
+
+func (c *fakeConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	c.statements = append(c.statements, query)
+	return driver.RowsAffected(0), nil
+}
+
+func TestTransactionsWithDeadlinesSetTimeouts(t *testing.T) {
+	conn := &fakeConn{}
+	db := sql.OpenDB(WithDeadlineTimeouts(fakeConnector{conn}))
+	defer db.Close()
+
+	tx, err := db.BeginTx(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx.Rollback()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	tx, err = db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx.Rollback()
+
+	if len(conn.statements) != 3 {
+		t.Fatalf("executed %q, want two BEGINs and one SET", conn.statements)
+	}
+
+	var statementTimeout, idleTimeout int
+	if _, err := fmt.Sscanf(conn.statements[2], "SET LOCAL statement_timeout = %d; SET LOCAL idle_in_transaction_session_timeout = %d", &statementTimeout, &idleTimeout); err != nil {
+		t.Fatalf("unexpected statement %q: %v", conn.statements[2], err)
+	}
+	if statementTimeout <= 59000 || statementTimeout > 60000 || idleTimeout != statementTimeout {
+		t.Errorf("timeouts = %dms and %dms, want just under a minute", statementTimeout, idleTimeout)
+	}
+
+	if got, want := transactionTimeoutStatement(-time.Second), "SET LOCAL statement_timeout = 1; SET LOCAL idle_in_transaction_session_timeout = 1"; got != want {
+		t.Errorf("expired deadline gives %q, want %q", got, want)
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want bool
+	}{
+		{&pq.Error{Code: "40001"}, true},
+		{&pq.Error{Code: "40P01"}, true},
+		{pderr.Wrap("failed to register user", &pq.Error{Code: "40P01"}), true},
+		{&pq.Error{Code: "23505"}, false},
+		{errors.New("40001"), false},
+		{nil, false},
+	} {
+		if got := IsRetryable(tc.err); got != tc.want {
+			t.Errorf("IsRetryable(%v) = %v, want %v", tc.err, got, tc.want)
+		}
+	}
+}
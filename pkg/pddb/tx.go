@@ -0,0 +1,81 @@
+package pddb
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"math/rand"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/steinarvk/playdough/pkg/logging"
+	"github.com/steinarvk/playdough/pkg/pderr"
+	"go.uber.org/zap"
+)
+
+const (
+	maxTxAttempts = 4
+
+	// The delay before the first retry; it doubles with each further one, with jitter
+	// so that the transactions that conflicted do not simply collide again.
+	txRetryBaseDelay = 10 * time.Millisecond
+)
+
+// IsRetryable reports whether an error is a serialization failure or a deadlock,
+// after which the whole transaction may succeed if run again.
+func IsRetryable(err error) bool {
+	var pgerr *pq.Error
+	if !errors.As(err, &pgerr) {
+		return false
+	}
+
+	switch pgerr.Code {
+	case "40001", "40P01":
+		return true
+	default:
+		return false
+	}
+}
+
+// InTx runs fn in a transaction and commits it. If the transaction fails with a
+// serialization failure or deadlock, it is rolled back and fn is run again in a
+// new one, so fn must not have side effects outside the transaction.
+func InTx(ctx context.Context, db *sql.DB, opts *sql.TxOptions, fn func(tx *sql.Tx) error) error {
+	logger := logging.FromContext(ctx)
+
+	delay := txRetryBaseDelay
+	for attempt := 1; ; attempt++ {
+		err := runTx(ctx, db, opts, fn)
+		if err == nil || !IsRetryable(err) || attempt >= maxTxAttempts {
+			return err
+		}
+
+		jitteredDelay := delay/2 + time.Duration(rand.Int63n(int64(delay)))
+		logger.Warn("retrying transaction", zap.Int("attempt", attempt), zap.Duration("delay", jitteredDelay), zap.Error(err))
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(jitteredDelay):
+		}
+		delay *= 2
+	}
+}
+
+func runTx(ctx context.Context, db *sql.DB, opts *sql.TxOptions, fn func(tx *sql.Tx) error) error {
+	tx, err := db.BeginTx(ctx, opts)
+	if err != nil {
+		return pderr.Unexpectedf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return pderr.Unexpectedf("failed to commit transaction: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,248 @@
+package userdb
+
+import (
+	"context"
+	cryptorand "crypto/rand"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+	"github.com/steinarvk/playdough/pkg/logging"
+	"github.com/steinarvk/playdough/pkg/pderr"
+	"github.com/steinarvk/playdough/pkg/pdsecret"
+	"github.com/steinarvk/playdough/pkg/pdusername"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+)
+
+const (
+	inviteCodePrefix     = "pdi"
+	inviteCodeSecretSize = 16
+)
+
+var errInvalidInviteCode = pderr.Error(codes.PermissionDenied, "invalid, expired or used up invite code")
+
+type Invite struct {
+	InviteUUID        uuid.UUID
+	CreatedByUsername string
+	MaxUses           int
+	UseCount          int
+	CreationTime      time.Time
+	ExpirationTime    time.Time
+	// The accounts registered with the invite, oldest first.
+	InvitedUsernames []string
+}
+
+// CreateInvite creates an invite code that can be used to register up to maxUses
+// accounts. Only a hash of the code is stored, so the code cannot be recovered later.
+func (u *UserDB) CreateInvite(ctx context.Context, tx *sql.Tx, createdByUsername string, maxUses int, validDuration time.Duration) (string, *Invite, error) {
+	logger := logging.FromContext(ctx)
+
+	if maxUses <= 0 {
+		return "", nil, pderr.BadInput("invite use count must be positive", "max_uses", fmt.Sprint(maxUses))
+	}
+	if validDuration <= 0 {
+		return "", nil, pderr.BadInput("invite validity must be positive", "valid_duration", validDuration.String())
+	}
+
+	secret := make([]byte, inviteCodeSecretSize)
+	if _, err := cryptorand.Read(secret); err != nil {
+		return "", nil, pderr.Wrap("failed to generate invite code secret", err)
+	}
+
+	inviteUUID, err := uuid.NewRandom()
+	if err != nil {
+		return "", nil, pderr.Wrap("failed to generate invite UUID", err)
+	}
+
+	rv := &Invite{
+		InviteUUID:       inviteUUID,
+		MaxUses:          maxUses,
+		ExpirationTime:   u.now().Add(validDuration),
+		InvitedUsernames: []string{},
+	}
+
+	err = tx.QueryRowContext(
+		ctx,
+		`
+			INSERT INTO invite_codes
+				(invite_uuid,
+				 created_by_user_id,
+				 invite_secret_hash,
+				 max_uses,
+				 expiration_timestamp)
+			SELECT
+				$1,
+				users.user_id,
+				$3,
+				$4,
+				$5
+			FROM users
+			WHERE users.canonical_username = $2
+			  AND users.deactivation_timestamp IS NULL
+			RETURNING
+				(SELECT username FROM users WHERE user_id = created_by_user_id),
+				creation_timestamp
+		`,
+		inviteUUID, pdusername.Canonical(createdByUsername), pdsecret.Hash(secret), maxUses, rv.ExpirationTime,
+	).Scan(&rv.CreatedByUsername, &rv.CreationTime)
+	if err == sql.ErrNoRows {
+		return "", nil, pderr.Error(codes.NotFound, "no such active user")
+	}
+	if err != nil {
+		return "", nil, pderr.Wrap("failed to insert invite code", err)
+	}
+
+	logger.Info("created invite code",
+		zap.String("created_by", rv.CreatedByUsername),
+		zap.Stringer("invite_uuid", inviteUUID),
+		zap.Int("max_uses", maxUses),
+		zap.Time("expires_at", rv.ExpirationTime),
+	)
+
+	return pdsecret.Format(inviteCodePrefix, inviteUUID, secret), rv, nil
+}
+
+// RegisterUserWithInvite is like RegisterUserWithPassword, but also uses up one
+// use of the invite code and records who invited the new user.
+func (u *UserDB) RegisterUserWithInvite(ctx context.Context, tx *sql.Tx, inviteCode, username, password string) (*User, error) {
+	logger := logging.FromContext(ctx)
+
+	inviteUUID, secret, ok := pdsecret.Parse(inviteCodePrefix, inviteCode)
+	if !ok {
+		return nil, errInvalidInviteCode
+	}
+
+	var inviteCodeID int
+	var secretHash []byte
+	var maxUses, useCount int
+	var expirationTime time.Time
+	var createdByUsername string
+	var creatorActive bool
+
+	err := tx.QueryRowContext(
+		ctx,
+		`
+			SELECT
+				invite_codes.invite_code_id,
+				invite_codes.invite_secret_hash,
+				invite_codes.max_uses,
+				invite_codes.use_count,
+				invite_codes.expiration_timestamp,
+				users.username,
+				users.deactivation_timestamp IS NULL
+			FROM invite_codes
+			JOIN users ON invite_codes.created_by_user_id = users.user_id
+			WHERE invite_codes.invite_uuid = $1
+			FOR UPDATE OF invite_codes
+		`,
+		inviteUUID,
+	).Scan(&inviteCodeID, &secretHash, &maxUses, &useCount, &expirationTime, &createdByUsername, &creatorActive)
+	if err == sql.ErrNoRows {
+		return nil, errInvalidInviteCode
+	}
+	if err != nil {
+		return nil, pderr.Wrap("failed to look up invite code", err)
+	}
+
+	if !pdsecret.Matches(secret, secretHash) {
+		return nil, errInvalidInviteCode
+	}
+
+	// Invites from users who have since been deactivated or deleted are void.
+	if useCount >= maxUses || !u.now().Before(expirationTime) || !creatorActive {
+		logger.Info("rejected used up, expired or orphaned invite code", zap.Stringer("invite_uuid", inviteUUID))
+		return nil, errInvalidInviteCode
+	}
+
+	user, err := u.RegisterUserWithPassword(ctx, tx, username, password)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.ExecContext(
+		ctx,
+		`
+			UPDATE invite_codes
+			SET use_count = use_count + 1
+			WHERE invite_code_id = $1
+		`,
+		inviteCodeID,
+	); err != nil {
+		return nil, pderr.Wrap("failed to use up invite code", err)
+	}
+
+	if _, err := tx.ExecContext(
+		ctx,
+		`
+			INSERT INTO invite_redemptions
+				(invite_code_id, invited_user_id)
+			SELECT $1, users.user_id
+			FROM users
+			WHERE users.user_uuid = $2
+		`,
+		inviteCodeID, user.UserUUID,
+	); err != nil {
+		return nil, pderr.Wrap("failed to record invite redemption", err)
+	}
+
+	logger.Info("registered user with invite",
+		zap.String("username", user.Username),
+		zap.String("invited_by", createdByUsername),
+		zap.Stringer("invite_uuid", inviteUUID),
+	)
+
+	return user, nil
+}
+
+// ListInvites lists invites, newest first, with the accounts registered with each.
+// If createdByUsername is empty, it lists everyone's invites.
+func (u *UserDB) ListInvites(ctx context.Context, tx *sql.Tx, createdByUsername string) ([]*Invite, error) {
+	rows, err := tx.QueryContext(
+		ctx,
+		`
+			SELECT
+				invite_codes.invite_uuid,
+				creator.username,
+				invite_codes.max_uses,
+				invite_codes.use_count,
+				invite_codes.creation_timestamp,
+				invite_codes.expiration_timestamp,
+				COALESCE(
+					array_agg(invited.username ORDER BY invite_redemptions.redemption_timestamp)
+						FILTER (WHERE invited.username IS NOT NULL),
+					'{}'
+				)
+			FROM invite_codes
+			JOIN users AS creator ON invite_codes.created_by_user_id = creator.user_id
+			LEFT JOIN invite_redemptions ON invite_codes.invite_code_id = invite_redemptions.invite_code_id
+			LEFT JOIN users AS invited ON invite_redemptions.invited_user_id = invited.user_id
+			WHERE $1 = '' OR creator.canonical_username = $1
+			GROUP BY invite_codes.invite_code_id, creator.username
+			ORDER BY invite_codes.creation_timestamp DESC
+		`,
+		pdusername.Canonical(createdByUsername),
+	)
+	if err != nil {
+		return nil, pderr.Wrap("failed to list invites", err)
+	}
+	defer rows.Close()
+
+	var rv []*Invite
+
+	for rows.Next() {
+		var invite Invite
+		if err := rows.Scan(&invite.InviteUUID, &invite.CreatedByUsername, &invite.MaxUses, &invite.UseCount, &invite.CreationTime, &invite.ExpirationTime, pq.Array(&invite.InvitedUsernames)); err != nil {
+			return nil, pderr.Wrap("failed to scan invite", err)
+		}
+		rv = append(rv, &invite)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, pderr.Wrap("failed to list invites", err)
+	}
+
+	return rv, nil
+}
@@ -0,0 +1,466 @@
+package userdb
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+	"github.com/steinarvk/playdough/pkg/logging"
+	"github.com/steinarvk/playdough/pkg/pddb/loginthrottle"
+	"github.com/steinarvk/playdough/pkg/pddb/ratelimit"
+	"github.com/steinarvk/playdough/pkg/pderr"
+	"github.com/steinarvk/playdough/pkg/pdusername"
+	"github.com/steinarvk/playdough/proto/pdpb"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/protobuf/proto"
+)
+
+// Deleted users keep their row, so that anything referring to them (such as
+// ledger entries) stays intact, but their username is replaced by a pseudonym
+// with this prefix. New usernames may not use it.
+const deletedUsernamePrefix = "deleted_"
+
+var errAccountDeactivated = pderr.Error(codes.PermissionDenied, "account is deactivated")
+
+// DeactivateUser blocks the user from logging in or using existing credentials,
+// while keeping all their data. It can be undone with ReactivateUser.
+func (u *UserDB) DeactivateUser(ctx context.Context, tx *sql.Tx, username string) error {
+	logger := logging.FromContext(ctx)
+
+	result, err := tx.ExecContext(
+		ctx,
+		`
+			UPDATE users
+			SET deactivation_timestamp = CURRENT_TIMESTAMP
+			WHERE canonical_username = $1
+			  AND deactivation_timestamp IS NULL
+		`,
+		pdusername.Canonical(username),
+	)
+	if err != nil {
+		return pderr.Wrap("failed to deactivate user", err)
+	}
+
+	if n, err := result.RowsAffected(); err != nil || n != 1 {
+		return pderr.Error(codes.NotFound, "no such active user")
+	}
+
+	logger.Info("deactivated user", zap.String("username", username))
+
+	return nil
+}
+
+func (u *UserDB) ReactivateUser(ctx context.Context, tx *sql.Tx, username string) error {
+	logger := logging.FromContext(ctx)
+
+	result, err := tx.ExecContext(
+		ctx,
+		`
+			UPDATE users
+			SET deactivation_timestamp = NULL
+			WHERE canonical_username = $1
+			  AND deactivation_timestamp IS NOT NULL
+			  AND deletion_timestamp IS NULL
+		`,
+		pdusername.Canonical(username),
+	)
+	if err != nil {
+		return pderr.Wrap("failed to reactivate user", err)
+	}
+
+	if n, err := result.RowsAffected(); err != nil || n != 1 {
+		return pderr.Error(codes.NotFound, "no such deactivated user")
+	}
+
+	logger.Info("reactivated user", zap.String("username", username))
+
+	return nil
+}
+
+// DeleteUser irreversibly deletes the user's personal data and credentials. The
+// users row itself is kept, deactivated and with a pseudonymous username, so that
+// records referring to the user remain consistent. Returns the pseudonym.
+func (u *UserDB) DeleteUser(ctx context.Context, tx *sql.Tx, username string) (string, error) {
+	logger := logging.FromContext(ctx)
+
+	var userID int
+	var userUUID uuid.UUID
+
+	err := tx.QueryRowContext(
+		ctx,
+		`
+			SELECT user_id, user_uuid
+			FROM users
+			WHERE canonical_username = $1
+			  AND deletion_timestamp IS NULL
+			FOR UPDATE
+		`,
+		pdusername.Canonical(username),
+	).Scan(&userID, &userUUID)
+	if err == sql.ErrNoRows {
+		return "", errNoSuchUser
+	}
+	if err != nil {
+		return "", pderr.Wrap("failed to look up user", err)
+	}
+
+	// Deterministic, so that the same user always gets the same pseudonym.
+	pseudonym := deletedUsernamePrefix + hex.EncodeToString(userUUID[:12])
+
+	for _, table := range []string{
+		"password_credentials",
+		"password_reset_tokens",
+		"totp_credentials",
+		"totp_recovery_codes",
+		"login_challenges",
+		"api_keys",
+		"user_roles",
+	} {
+		// The table names are constants, so this is not an injection risk.
+		if _, err := tx.ExecContext(ctx, `DELETE FROM `+table+` WHERE user_id = $1`, userID); err != nil {
+			return "", pderr.Wrap("failed to delete from "+table, err)
+		}
+	}
+
+	// Throttling state is keyed by username rather than user, and would otherwise
+	// pass to whoever registers the name next.
+	if err := loginthrottle.ForgetUsername(ctx, tx, username); err != nil {
+		return "", err
+	}
+	if err := ratelimit.ForgetUser(ctx, tx, username); err != nil {
+		return "", err
+	}
+
+	if _, err := tx.ExecContext(
+		ctx,
+		`
+			UPDATE users
+			SET
+				username = $2,
+				canonical_username = $3,
+				display_name = '',
+				avatar_url = '',
+				bio = '',
+				session_generation = session_generation + 1,
+				deactivation_timestamp = COALESCE(deactivation_timestamp, CURRENT_TIMESTAMP),
+				deletion_timestamp = CURRENT_TIMESTAMP
+			WHERE user_id = $1
+		`,
+		userID, pseudonym, pdusername.Canonical(pseudonym),
+	); err != nil {
+		return "", pderr.Wrap("failed to pseudonymize user", err)
+	}
+
+	logger.Info("deleted user", zap.String("username", username), zap.String("pseudonym", pseudonym))
+
+	return pseudonym, nil
+}
+
+type ExportedAPIKey struct {
+	UUID           uuid.UUID `json:"uuid"`
+	Name           string    `json:"name"`
+	Scopes         []string  `json:"scopes"`
+	CreationTime   time.Time `json:"creation_time"`
+	ExpirationTime time.Time `json:"expiration_time"`
+	Revoked        bool      `json:"revoked"`
+}
+
+type ExportedPasswordResetToken struct {
+	CreationTime   time.Time  `json:"creation_time"`
+	ExpirationTime time.Time  `json:"expiration_time"`
+	UsedTime       *time.Time `json:"used_time,omitempty"`
+}
+
+type ExportedPassword struct {
+	HashingAlgorithm string    `json:"hashing_algorithm"`
+	LastChangedTime  time.Time `json:"last_changed_time"`
+}
+
+type ExportedInvite struct {
+	UUID             uuid.UUID `json:"uuid"`
+	MaxUses          int       `json:"max_uses"`
+	CreationTime     time.Time `json:"creation_time"`
+	ExpirationTime   time.Time `json:"expiration_time"`
+	InvitedUsernames []string  `json:"invited_usernames"`
+}
+
+type ExportedSecondFactor struct {
+	Enabled               bool        `json:"enabled"`
+	ConfirmationTime      *time.Time  `json:"confirmation_time,omitempty"`
+	UnusedRecoveryCodes   int         `json:"unused_recovery_codes"`
+	UsedRecoveryCodeTimes []time.Time `json:"used_recovery_code_times,omitempty"`
+}
+
+// UserDataExport is everything stored about a user, except secrets and hashes of
+// secrets, which are described rather than included.
+type UserDataExport struct {
+	UUID             uuid.UUID  `json:"uuid"`
+	Username         string     `json:"username"`
+	DisplayName      string     `json:"display_name"`
+	AvatarURL        string     `json:"avatar_url"`
+	Bio              string     `json:"bio"`
+	CreationTime     time.Time  `json:"creation_time"`
+	DeactivationTime *time.Time `json:"deactivation_time,omitempty"`
+	InvitedBy        string     `json:"invited_by,omitempty"`
+
+	Roles               []string                     `json:"roles"`
+	Password            *ExportedPassword            `json:"password,omitempty"`
+	SecondFactor        *ExportedSecondFactor        `json:"second_factor,omitempty"`
+	APIKeys             []ExportedAPIKey             `json:"api_keys"`
+	PasswordResetTokens []ExportedPasswordResetToken `json:"password_reset_tokens"`
+	Invites             []ExportedInvite             `json:"invites"`
+}
+
+func hashingAlgorithmName(method *pdpb.PasswordHashingMethod) string {
+	switch method.Method.(type) {
+	case *pdpb.PasswordHashingMethod_Argon2:
+		return "argon2id"
+	case *pdpb.PasswordHashingMethod_Bcrypt:
+		return "bcrypt"
+	case *pdpb.PasswordHashingMethod_Scrypt:
+		return "scrypt"
+	default:
+		return "unknown"
+	}
+}
+
+// ExportUserData collects everything stored about the user.
+func (u *UserDB) ExportUserData(ctx context.Context, tx *sql.Tx, username string) (*UserDataExport, error) {
+	var rv UserDataExport
+	var userID int
+	var deactivationTime sql.NullTime
+
+	err := tx.QueryRowContext(
+		ctx,
+		`
+			SELECT
+				user_id,
+				user_uuid,
+				username,
+				display_name,
+				avatar_url,
+				bio,
+				user_creation_timestamp,
+				deactivation_timestamp
+			FROM users
+			WHERE canonical_username = $1
+			  AND deletion_timestamp IS NULL
+		`,
+		pdusername.Canonical(username),
+	).Scan(&userID, &rv.UUID, &rv.Username, &rv.DisplayName, &rv.AvatarURL, &rv.Bio, &rv.CreationTime, &deactivationTime)
+	if err == sql.ErrNoRows {
+		return nil, errNoSuchUser
+	}
+	if err != nil {
+		return nil, pderr.Wrap("failed to look up user", err)
+	}
+	if deactivationTime.Valid {
+		rv.DeactivationTime = &deactivationTime.Time
+	}
+
+	if err := tx.QueryRowContext(
+		ctx,
+		`
+			SELECT COALESCE(array_agg(role_name ORDER BY role_name), '{}')
+			FROM user_roles
+			WHERE user_id = $1
+		`,
+		userID,
+	).Scan(pq.Array(&rv.Roles)); err != nil {
+		return nil, pderr.Wrap("failed to export roles", err)
+	}
+
+	var hashingMethodBytes []byte
+	var password ExportedPassword
+	err = tx.QueryRowContext(
+		ctx,
+		`
+			SELECT hashing_method, password_hashing_timestamp
+			FROM password_credentials
+			WHERE user_id = $1
+		`,
+		userID,
+	).Scan(&hashingMethodBytes, &password.LastChangedTime)
+	switch {
+	case err == sql.ErrNoRows:
+	case err != nil:
+		return nil, pderr.Wrap("failed to export password credentials", err)
+	default:
+		hashingMethod := &pdpb.PasswordHashingMethod{}
+		if err := proto.Unmarshal(hashingMethodBytes, hashingMethod); err != nil {
+			return nil, pderr.Wrap("failed to unmarshal password hashing method", err)
+		}
+		password.HashingAlgorithm = hashingAlgorithmName(hashingMethod)
+		rv.Password = &password
+	}
+
+	var confirmationTime sql.NullTime
+	err = tx.QueryRowContext(
+		ctx,
+		`
+			SELECT confirmation_timestamp
+			FROM totp_credentials
+			WHERE user_id = $1
+		`,
+		userID,
+	).Scan(&confirmationTime)
+	switch {
+	case err == sql.ErrNoRows:
+	case err != nil:
+		return nil, pderr.Wrap("failed to export TOTP credentials", err)
+	default:
+		secondFactor := &ExportedSecondFactor{Enabled: confirmationTime.Valid}
+		if confirmationTime.Valid {
+			secondFactor.ConfirmationTime = &confirmationTime.Time
+		}
+
+		recoveryCodeRows, err := tx.QueryContext(
+			ctx,
+			`
+				SELECT used_timestamp
+				FROM totp_recovery_codes
+				WHERE user_id = $1
+				ORDER BY used_timestamp
+			`,
+			userID,
+		)
+		if err != nil {
+			return nil, pderr.Wrap("failed to export recovery codes", err)
+		}
+		defer recoveryCodeRows.Close()
+
+		for recoveryCodeRows.Next() {
+			var usedTime sql.NullTime
+			if err := recoveryCodeRows.Scan(&usedTime); err != nil {
+				return nil, pderr.Wrap("failed to scan recovery code", err)
+			}
+			if usedTime.Valid {
+				secondFactor.UsedRecoveryCodeTimes = append(secondFactor.UsedRecoveryCodeTimes, usedTime.Time)
+			} else {
+				secondFactor.UnusedRecoveryCodes++
+			}
+		}
+		if err := recoveryCodeRows.Err(); err != nil {
+			return nil, pderr.Wrap("failed to export recovery codes", err)
+		}
+
+		rv.SecondFactor = secondFactor
+	}
+
+	apiKeyRows, err := tx.QueryContext(
+		ctx,
+		`
+			SELECT
+				api_key_uuid,
+				key_name,
+				scopes,
+				creation_timestamp,
+				expiration_timestamp,
+				revocation_timestamp IS NOT NULL
+			FROM api_keys
+			WHERE user_id = $1
+			ORDER BY creation_timestamp
+		`,
+		userID,
+	)
+	if err != nil {
+		return nil, pderr.Wrap("failed to export API keys", err)
+	}
+	defer apiKeyRows.Close()
+
+	rv.APIKeys = []ExportedAPIKey{}
+	for apiKeyRows.Next() {
+		var key ExportedAPIKey
+		if err := apiKeyRows.Scan(&key.UUID, &key.Name, pq.Array(&key.Scopes), &key.CreationTime, &key.ExpirationTime, &key.Revoked); err != nil {
+			return nil, pderr.Wrap("failed to scan API key", err)
+		}
+		rv.APIKeys = append(rv.APIKeys, key)
+	}
+	if err := apiKeyRows.Err(); err != nil {
+		return nil, pderr.Wrap("failed to export API keys", err)
+	}
+
+	resetTokenRows, err := tx.QueryContext(
+		ctx,
+		`
+			SELECT creation_timestamp, expiration_timestamp, used_timestamp
+			FROM password_reset_tokens
+			WHERE user_id = $1
+			ORDER BY creation_timestamp
+		`,
+		userID,
+	)
+	if err != nil {
+		return nil, pderr.Wrap("failed to export password reset tokens", err)
+	}
+	defer resetTokenRows.Close()
+
+	rv.PasswordResetTokens = []ExportedPasswordResetToken{}
+	for resetTokenRows.Next() {
+		var token ExportedPasswordResetToken
+		var usedTime sql.NullTime
+		if err := resetTokenRows.Scan(&token.CreationTime, &token.ExpirationTime, &usedTime); err != nil {
+			return nil, pderr.Wrap("failed to scan password reset token", err)
+		}
+		if usedTime.Valid {
+			token.UsedTime = &usedTime.Time
+		}
+		rv.PasswordResetTokens = append(rv.PasswordResetTokens, token)
+	}
+	if err := resetTokenRows.Err(); err != nil {
+		return nil, pderr.Wrap("failed to export password reset tokens", err)
+	}
+
+	err = tx.QueryRowContext(
+		ctx,
+		`
+			SELECT inviter.username
+			FROM invite_redemptions
+			JOIN invite_codes ON invite_redemptions.invite_code_id = invite_codes.invite_code_id
+			JOIN users AS inviter ON invite_codes.created_by_user_id = inviter.user_id
+			WHERE invite_redemptions.invited_user_id = $1
+		`,
+		userID,
+	).Scan(&rv.InvitedBy)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, pderr.Wrap("failed to export inviter", err)
+	}
+
+	invites, err := u.ListInvites(ctx, tx, rv.Username)
+	if err != nil {
+		return nil, err
+	}
+
+	rv.Invites = []ExportedInvite{}
+	for _, invite := range invites {
+		rv.Invites = append(rv.Invites, ExportedInvite{
+			UUID:             invite.InviteUUID,
+			MaxUses:          invite.MaxUses,
+			CreationTime:     invite.CreationTime,
+			ExpirationTime:   invite.ExpirationTime,
+			InvitedUsernames: invite.InvitedUsernames,
+		})
+	}
+
+	return &rv, nil
+}
+
+// ExportUserDataJSON is like ExportUserData, but returns indented JSON.
+func (u *UserDB) ExportUserDataJSON(ctx context.Context, tx *sql.Tx, username string) ([]byte, error) {
+	export, err := u.ExportUserData(ctx, tx, username)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := json.MarshalIndent(export, "", "  ")
+	if err != nil {
+		return nil, pderr.Wrap("failed to marshal user data", err)
+	}
+
+	return data, nil
+}
@@ -0,0 +1,224 @@
+package userdb
+
+import (
+	"context"
+	cryptorand "crypto/rand"
+	"database/sql"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/steinarvk/playdough/pkg/logging"
+	"github.com/steinarvk/playdough/pkg/pderr"
+	"github.com/steinarvk/playdough/pkg/pdsecret"
+	"github.com/steinarvk/playdough/pkg/pdusername"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	passwordResetTokenPrefix     = "pdr"
+	passwordResetTokenSecretSize = 32
+)
+
+var errInvalidPasswordResetToken = pderr.Unauthenticated("invalid or expired password reset token")
+
+// SetPassword replaces the user's password, creating password credentials if the
+// user has none. It does not check the old password; callers must have done so.
+func (u *UserDB) SetPassword(ctx context.Context, tx *sql.Tx, username, password string) error {
+	logger := logging.FromContext(ctx)
+
+	if err := u.CheckValidPassword(password); err != nil {
+		return err
+	}
+
+	creds, err := u.newPasswordCredentials(password)
+	if err != nil {
+		return err
+	}
+
+	hashingMethodBytes, err := proto.Marshal(creds.hashingMethod)
+	if err != nil {
+		return pderr.Wrap("failed to marshal password hashing method", err)
+	}
+
+	result, err := tx.ExecContext(
+		ctx,
+		`
+			INSERT INTO password_credentials
+				(user_id,
+				 hashing_method,
+				 password_hash,
+				 password_salt)
+			SELECT
+				users.user_id, $2, $3, $4
+			FROM users
+			WHERE users.canonical_username = $1
+			ON CONFLICT (user_id) DO UPDATE SET
+				hashing_method = EXCLUDED.hashing_method,
+				password_hash = EXCLUDED.password_hash,
+				password_salt = EXCLUDED.password_salt,
+				password_hashing_timestamp = CURRENT_TIMESTAMP
+		`,
+		pdusername.Canonical(username), hashingMethodBytes, creds.hashedPassword, creds.salt,
+	)
+	if err != nil {
+		return pderr.Wrap("failed to update password credentials", err)
+	}
+
+	if n, err := result.RowsAffected(); err != nil || n != 1 {
+		return pderr.Error(codes.NotFound, "no such user")
+	}
+
+	logger.Info("changed password", zap.String("username", username))
+
+	return nil
+}
+
+// CreatePasswordResetToken creates a single-use token that allows setting a new
+// password for the user without knowing the old one. Only a hash of the secret is
+// stored, so the token cannot be recovered later.
+func (u *UserDB) CreatePasswordResetToken(ctx context.Context, tx *sql.Tx, username, createdByUsername string, validDuration time.Duration) (string, time.Time, error) {
+	logger := logging.FromContext(ctx)
+
+	if validDuration <= 0 {
+		return "", time.Time{}, pderr.BadInput("password reset token validity must be positive", "valid_duration", validDuration.String())
+	}
+
+	secret := make([]byte, passwordResetTokenSecretSize)
+	if _, err := cryptorand.Read(secret); err != nil {
+		return "", time.Time{}, pderr.Wrap("failed to generate password reset token secret", err)
+	}
+
+	tokenUUID, err := uuid.NewRandom()
+	if err != nil {
+		return "", time.Time{}, pderr.Wrap("failed to generate password reset token UUID", err)
+	}
+
+	expirationTime := u.now().Add(validDuration)
+
+	result, err := tx.ExecContext(
+		ctx,
+		`
+			INSERT INTO password_reset_tokens
+				(password_reset_token_uuid,
+				 user_id,
+				 created_by_user_id,
+				 token_secret_hash,
+				 expiration_timestamp)
+			SELECT
+				$1,
+				users.user_id,
+				(SELECT creator.user_id FROM users AS creator WHERE creator.canonical_username = $3),
+				$4,
+				$5
+			FROM users
+			WHERE users.canonical_username = $2
+		`,
+		tokenUUID, pdusername.Canonical(username), pdusername.Canonical(createdByUsername), pdsecret.Hash(secret), expirationTime,
+	)
+	if err != nil {
+		return "", time.Time{}, pderr.Wrap("failed to insert password reset token", err)
+	}
+
+	if n, err := result.RowsAffected(); err != nil || n != 1 {
+		return "", time.Time{}, pderr.Error(codes.NotFound, "no such user")
+	}
+
+	logger.Info("created password reset token",
+		zap.String("username", username),
+		zap.String("created_by", createdByUsername),
+		zap.Stringer("password_reset_token_uuid", tokenUUID),
+		zap.Time("expires_at", expirationTime),
+	)
+
+	return pdsecret.Format(passwordResetTokenPrefix, tokenUUID, secret), expirationTime, nil
+}
+
+// ResetPasswordWithToken uses up a password reset token to set a new password,
+// returning the user whose password was reset. Any other outstanding reset tokens
+// for the same user are invalidated as well.
+func (u *UserDB) ResetPasswordWithToken(ctx context.Context, tx *sql.Tx, token, newPassword string) (*User, error) {
+	logger := logging.FromContext(ctx)
+
+	tokenUUID, secret, ok := pdsecret.Parse(passwordResetTokenPrefix, token)
+	if !ok {
+		return nil, errInvalidPasswordResetToken
+	}
+
+	if err := u.CheckValidPassword(newPassword); err != nil {
+		return nil, err
+	}
+
+	var rv User
+	var userID int
+	var secretHash []byte
+	var expirationTime time.Time
+	var used bool
+	var deactivated bool
+
+	err := tx.QueryRowContext(
+		ctx,
+		`
+			SELECT
+				users.user_id,
+				users.user_uuid,
+				users.username,
+				password_reset_tokens.token_secret_hash,
+				password_reset_tokens.expiration_timestamp,
+				password_reset_tokens.used_timestamp IS NOT NULL,
+				users.deactivation_timestamp IS NOT NULL
+			FROM password_reset_tokens
+			JOIN users ON password_reset_tokens.user_id = users.user_id
+			WHERE password_reset_tokens.password_reset_token_uuid = $1
+			FOR UPDATE OF password_reset_tokens
+		`,
+		tokenUUID,
+	).Scan(&userID, &rv.UserUUID, &rv.Username, &secretHash, &expirationTime, &used, &deactivated)
+	if err == sql.ErrNoRows {
+		return nil, errInvalidPasswordResetToken
+	}
+	if err != nil {
+		return nil, pderr.Wrap("failed to look up password reset token", err)
+	}
+
+	if !pdsecret.Matches(secret, secretHash) {
+		return nil, errInvalidPasswordResetToken
+	}
+
+	if used || !u.now().Before(expirationTime) {
+		logger.Info("rejected used or expired password reset token",
+			zap.String("username", rv.Username),
+			zap.Stringer("password_reset_token_uuid", tokenUUID),
+		)
+		return nil, errInvalidPasswordResetToken
+	}
+
+	if deactivated {
+		return nil, errAccountDeactivated
+	}
+
+	if _, err := tx.ExecContext(
+		ctx,
+		`
+			UPDATE password_reset_tokens
+			SET used_timestamp = CURRENT_TIMESTAMP
+			WHERE user_id = $1
+			  AND used_timestamp IS NULL
+		`,
+		userID,
+	); err != nil {
+		return nil, pderr.Wrap("failed to mark password reset token as used", err)
+	}
+
+	if err := u.SetPassword(ctx, tx, rv.Username, newPassword); err != nil {
+		return nil, err
+	}
+
+	logger.Info("reset password with token",
+		zap.String("username", rv.Username),
+		zap.Stringer("password_reset_token_uuid", tokenUUID),
+	)
+
+	return &rv, nil
+}
@@ -0,0 +1,261 @@
+package userdb
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"github.com/steinarvk/playdough/pkg/logging"
+	"github.com/steinarvk/playdough/pkg/pderr"
+	"github.com/steinarvk/playdough/pkg/pdusername"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+)
+
+const (
+	maxDisplayNameLength = 64
+	maxAvatarURLLength   = 2048
+	maxBioLength         = 1000
+
+	DefaultSearchPageSize = 20
+	MaxSearchPageSize     = 100
+)
+
+type Profile struct {
+	DisplayName string
+	AvatarURL   string
+	Bio         string
+}
+
+// ProfileUpdate holds the profile fields to change; nil fields are left as they are.
+type ProfileUpdate struct {
+	DisplayName *string
+	AvatarURL   *string
+	Bio         *string
+}
+
+var errNoSuchUser = pderr.Error(codes.NotFound, "no such user")
+
+func hasControlCharacters(s string, allowNewlines bool) bool {
+	for _, r := range s {
+		if r == '\n' && allowNewlines {
+			continue
+		}
+		if unicode.IsControl(r) {
+			return true
+		}
+	}
+	return false
+}
+
+func checkValidProfile(profile Profile) error {
+	var violations []pderr.FieldViolation
+
+	if !utf8.ValidString(profile.DisplayName) || utf8.RuneCountInString(profile.DisplayName) > maxDisplayNameLength || hasControlCharacters(profile.DisplayName, false) {
+		violations = append(violations, pderr.FieldViolation{
+			Field:       "display_name",
+			Description: fmt.Sprintf("must be at most %d characters without control characters", maxDisplayNameLength),
+		})
+	}
+
+	if profile.AvatarURL != "" {
+		parsed, err := url.Parse(profile.AvatarURL)
+		if err != nil || len(profile.AvatarURL) > maxAvatarURLLength || parsed.Scheme != "https" || parsed.Host == "" {
+			violations = append(violations, pderr.FieldViolation{
+				Field:       "avatar_url",
+				Description: fmt.Sprintf("must be an https URL of at most %d characters", maxAvatarURLLength),
+			})
+		}
+	}
+
+	if !utf8.ValidString(profile.Bio) || utf8.RuneCountInString(profile.Bio) > maxBioLength || hasControlCharacters(profile.Bio, true) {
+		violations = append(violations, pderr.FieldViolation{
+			Field:       "bio",
+			Description: fmt.Sprintf("must be at most %d characters without control characters", maxBioLength),
+		})
+	}
+
+	if len(violations) > 0 {
+		return pderr.InvalidFields("invalid profile", violations...)
+	}
+
+	return nil
+}
+
+const selectUserColumns = `
+	SELECT
+		users.user_uuid,
+		users.username,
+		users.display_name,
+		users.avatar_url,
+		users.bio,
+		users.user_creation_timestamp,
+		users.deactivation_timestamp IS NOT NULL,
+		users.deletion_timestamp IS NOT NULL
+	FROM users
+`
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanUser(row rowScanner) (*User, error) {
+	var rv User
+	if err := row.Scan(&rv.UserUUID, &rv.Username, &rv.Profile.DisplayName, &rv.Profile.AvatarURL, &rv.Profile.Bio, &rv.CreationTime, &rv.Deactivated, &rv.Deleted); err != nil {
+		return nil, err
+	}
+	return &rv, nil
+}
+
+func (u *UserDB) FetchUserByUsername(ctx context.Context, tx *sql.Tx, username string) (*User, error) {
+	rv, err := scanUser(tx.QueryRowContext(ctx, selectUserColumns+`WHERE users.canonical_username = $1`, pdusername.Canonical(username)))
+	if err == sql.ErrNoRows {
+		return nil, errNoSuchUser
+	}
+	if err != nil {
+		return nil, pderr.Wrap("failed to fetch user by username", err)
+	}
+
+	return rv, nil
+}
+
+func (u *UserDB) FetchUserByUUID(ctx context.Context, tx *sql.Tx, userUUID uuid.UUID) (*User, error) {
+	rv, err := scanUser(tx.QueryRowContext(ctx, selectUserColumns+`WHERE users.user_uuid = $1`, userUUID))
+	if err == sql.ErrNoRows {
+		return nil, errNoSuchUser
+	}
+	if err != nil {
+		return nil, pderr.Wrap("failed to fetch user by UUID", err)
+	}
+
+	return rv, nil
+}
+
+func escapeLikePattern(s string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+	return replacer.Replace(s)
+}
+
+func encodeSearchPageToken(lastCanonicalUsername string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(lastCanonicalUsername))
+}
+
+func decodeSearchPageToken(pageToken string) (string, error) {
+	lastCanonicalUsername, err := base64.RawURLEncoding.DecodeString(pageToken)
+	if err != nil {
+		return "", pderr.BadInput("invalid page token", "page_token", pageToken)
+	}
+	return string(lastCanonicalUsername), nil
+}
+
+// SearchUsers returns active users whose usernames start with the prefix, ignoring
+// case, in canonical username order. If there may be more results, it also returns a token for the next page.
+func (u *UserDB) SearchUsers(ctx context.Context, tx *sql.Tx, prefix string, pageSize int, pageToken string) ([]*User, string, error) {
+	if pageSize <= 0 {
+		pageSize = DefaultSearchPageSize
+	}
+	if pageSize > MaxSearchPageSize {
+		pageSize = MaxSearchPageSize
+	}
+
+	var afterUsername string
+	if pageToken != "" {
+		var err error
+		afterUsername, err = decodeSearchPageToken(pageToken)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	rows, err := tx.QueryContext(
+		ctx,
+		selectUserColumns+`
+			WHERE users.canonical_username LIKE $1 ESCAPE '\'
+			  AND users.canonical_username > $2
+			  AND users.deactivation_timestamp IS NULL
+			ORDER BY users.canonical_username
+			LIMIT $3
+		`,
+		escapeLikePattern(pdusername.Canonical(prefix))+"%", afterUsername, pageSize+1,
+	)
+	if err != nil {
+		return nil, "", pderr.Wrap("failed to search users", err)
+	}
+	defer rows.Close()
+
+	var rv []*User
+
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, "", pderr.Wrap("failed to scan user", err)
+		}
+		rv = append(rv, user)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, "", pderr.Wrap("failed to search users", err)
+	}
+
+	var nextPageToken string
+	if len(rv) > pageSize {
+		rv = rv[:pageSize]
+		nextPageToken = encodeSearchPageToken(pdusername.Canonical(rv[pageSize-1].Username))
+	}
+
+	return rv, nextPageToken, nil
+}
+
+// UpdateProfile applies the given changes to the user's profile and returns the updated user.
+func (u *UserDB) UpdateProfile(ctx context.Context, tx *sql.Tx, username string, update ProfileUpdate) (*User, error) {
+	logger := logging.FromContext(ctx)
+
+	user, err := u.FetchUserByUsername(ctx, tx, username)
+	if err != nil {
+		return nil, err
+	}
+	if user.Deactivated {
+		return nil, errAccountDeactivated
+	}
+
+	profile := user.Profile
+	if update.DisplayName != nil {
+		profile.DisplayName = strings.TrimSpace(*update.DisplayName)
+	}
+	if update.AvatarURL != nil {
+		profile.AvatarURL = strings.TrimSpace(*update.AvatarURL)
+	}
+	if update.Bio != nil {
+		profile.Bio = strings.TrimSpace(*update.Bio)
+	}
+
+	if err := checkValidProfile(profile); err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.ExecContext(
+		ctx,
+		`
+			UPDATE users
+			SET
+				display_name = $2,
+				avatar_url = $3,
+				bio = $4
+			WHERE canonical_username = $1
+		`,
+		pdusername.Canonical(username), profile.DisplayName, profile.AvatarURL, profile.Bio,
+	); err != nil {
+		return nil, pderr.Wrap("failed to update profile", err)
+	}
+
+	logger.Info("updated profile", zap.String("username", username))
+
+	user.Profile = profile
+	return user, nil
+}
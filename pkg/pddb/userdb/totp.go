@@ -0,0 +1,471 @@
+package userdb
+
+import (
+	"context"
+	cryptorand "crypto/rand"
+	"database/sql"
+	"encoding/base32"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/steinarvk/playdough/pkg/logging"
+	"github.com/steinarvk/playdough/pkg/pderr"
+	"github.com/steinarvk/playdough/pkg/pdsecret"
+	"github.com/steinarvk/playdough/pkg/pdtotp"
+	"github.com/steinarvk/playdough/pkg/pdusername"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+)
+
+const (
+	totpIssuer = "playdough"
+	// Number of time steps on either side of the current one in which a code is still accepted.
+	totpSkew = 1
+
+	numRecoveryCodes   = 10
+	recoveryCodeSize   = 10
+	recoveryCodeGroups = 4
+
+	loginChallengePrefix        = "pdc"
+	loginChallengeSecretSize    = 32
+	loginChallengeValidDuration = 5 * time.Minute
+)
+
+var (
+	errInvalidSecondFactor = pderr.Unauthenticated("invalid authentication code")
+	errInvalidChallenge    = pderr.Unauthenticated("invalid or expired login challenge")
+
+	recoveryCodeEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+)
+
+// TOTPEnrollment is returned when a user starts enrolling an authenticator app.
+type TOTPEnrollment struct {
+	URI    string
+	Secret string
+}
+
+// LoginChallenge is the pending second step of a login with two-factor authentication.
+type LoginChallenge struct {
+	ChallengeUUID uuid.UUID
+	User          User
+}
+
+func generateRecoveryCode() (string, error) {
+	raw := make([]byte, recoveryCodeSize)
+	if _, err := cryptorand.Read(raw); err != nil {
+		return "", err
+	}
+
+	encoded := strings.ToLower(recoveryCodeEncoding.EncodeToString(raw))
+
+	groupSize := len(encoded) / recoveryCodeGroups
+	var groups []string
+	for i := 0; i < len(encoded); i += groupSize {
+		groups = append(groups, encoded[i:min(i+groupSize, len(encoded))])
+	}
+
+	return strings.Join(groups, "-"), nil
+}
+
+// normalizeRecoveryCode makes recovery codes insensitive to case, dashes and spaces.
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	code = strings.ReplaceAll(code, "-", "")
+	code = strings.ReplaceAll(code, " ", "")
+	return code
+}
+
+func hashRecoveryCode(code string) []byte {
+	return pdsecret.Hash([]byte(normalizeRecoveryCode(code)))
+}
+
+// HasSecondFactor reports whether the user has a confirmed authenticator app.
+func (u *UserDB) HasSecondFactor(ctx context.Context, tx *sql.Tx, username string) (bool, error) {
+	var enabled bool
+
+	if err := tx.QueryRowContext(
+		ctx,
+		`
+			SELECT EXISTS (
+				SELECT 1
+				FROM totp_credentials
+				JOIN users ON totp_credentials.user_id = users.user_id
+				WHERE users.canonical_username = $1
+				  AND totp_credentials.confirmation_timestamp IS NOT NULL
+			)
+		`,
+		pdusername.Canonical(username),
+	).Scan(&enabled); err != nil {
+		return false, pderr.Wrap("failed to check for second factor", err)
+	}
+
+	return enabled, nil
+}
+
+// EnrollTOTP generates a new TOTP secret for the user. It has no effect on logins
+// until confirmed with ConfirmTOTP; enrolling again before that replaces the secret.
+func (u *UserDB) EnrollTOTP(ctx context.Context, tx *sql.Tx, username string) (*TOTPEnrollment, error) {
+	logger := logging.FromContext(ctx)
+
+	enabled, err := u.HasSecondFactor(ctx, tx, username)
+	if err != nil {
+		return nil, err
+	}
+	if enabled {
+		return nil, pderr.Error(codes.FailedPrecondition, "two-factor authentication is already enabled")
+	}
+
+	secret, err := pdtotp.GenerateSecret()
+	if err != nil {
+		return nil, pderr.Wrap("failed to generate TOTP secret", err)
+	}
+
+	result, err := tx.ExecContext(
+		ctx,
+		`
+			INSERT INTO totp_credentials
+				(user_id, totp_secret)
+			SELECT
+				users.user_id, $2
+			FROM users
+			WHERE users.canonical_username = $1
+			ON CONFLICT (user_id) DO UPDATE SET
+				totp_secret = EXCLUDED.totp_secret,
+				creation_timestamp = CURRENT_TIMESTAMP,
+				last_used_counter = 0
+		`,
+		pdusername.Canonical(username), secret,
+	)
+	if err != nil {
+		return nil, pderr.Wrap("failed to insert TOTP credentials", err)
+	}
+
+	if n, err := result.RowsAffected(); err != nil || n != 1 {
+		return nil, pderr.Error(codes.NotFound, "no such user")
+	}
+
+	logger.Info("started TOTP enrolment", zap.String("username", username))
+
+	return &TOTPEnrollment{
+		URI:    pdtotp.URI(totpIssuer, username, secret),
+		Secret: pdtotp.EncodeSecret(secret),
+	}, nil
+}
+
+// ConfirmTOTP enables two-factor authentication once the user proves their
+// authenticator app works, and returns a fresh set of recovery codes.
+func (u *UserDB) ConfirmTOTP(ctx context.Context, tx *sql.Tx, username, code string) ([]string, error) {
+	logger := logging.FromContext(ctx)
+
+	var userID int
+	var secret []byte
+	var confirmed bool
+
+	err := tx.QueryRowContext(
+		ctx,
+		`
+			SELECT
+				users.user_id,
+				totp_credentials.totp_secret,
+				totp_credentials.confirmation_timestamp IS NOT NULL
+			FROM totp_credentials
+			JOIN users ON totp_credentials.user_id = users.user_id
+			WHERE users.canonical_username = $1
+			FOR UPDATE OF totp_credentials
+		`,
+		pdusername.Canonical(username),
+	).Scan(&userID, &secret, &confirmed)
+	if err == sql.ErrNoRows || (err == nil && confirmed) {
+		return nil, pderr.Error(codes.FailedPrecondition, "no pending two-factor enrolment")
+	}
+	if err != nil {
+		return nil, pderr.Wrap("failed to look up TOTP credentials", err)
+	}
+
+	counter, ok := pdtotp.Validate(secret, code, u.now(), totpSkew)
+	if !ok {
+		return nil, errInvalidSecondFactor
+	}
+
+	if _, err := tx.ExecContext(
+		ctx,
+		`
+			UPDATE totp_credentials
+			SET
+				confirmation_timestamp = CURRENT_TIMESTAMP,
+				last_used_counter = $2
+			WHERE user_id = $1
+		`,
+		userID, counter,
+	); err != nil {
+		return nil, pderr.Wrap("failed to confirm TOTP credentials", err)
+	}
+
+	recoveryCodes, err := u.replaceRecoveryCodes(ctx, tx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Info("enabled two-factor authentication", zap.String("username", username))
+
+	return recoveryCodes, nil
+}
+
+func (u *UserDB) replaceRecoveryCodes(ctx context.Context, tx *sql.Tx, userID int) ([]string, error) {
+	if _, err := tx.ExecContext(
+		ctx,
+		`
+			DELETE FROM totp_recovery_codes
+			WHERE user_id = $1
+		`,
+		userID,
+	); err != nil {
+		return nil, pderr.Wrap("failed to delete old recovery codes", err)
+	}
+
+	var rv []string
+
+	for i := 0; i < numRecoveryCodes; i++ {
+		code, err := generateRecoveryCode()
+		if err != nil {
+			return nil, pderr.Wrap("failed to generate recovery code", err)
+		}
+
+		if _, err := tx.ExecContext(
+			ctx,
+			`
+				INSERT INTO totp_recovery_codes
+					(user_id, code_hash)
+				VALUES
+					($1, $2)
+			`,
+			userID, hashRecoveryCode(code),
+		); err != nil {
+			return nil, pderr.Wrap("failed to insert recovery code", err)
+		}
+
+		rv = append(rv, code)
+	}
+
+	return rv, nil
+}
+
+// VerifySecondFactor checks either a TOTP code or a recovery code for a user with
+// two-factor authentication enabled. Each code is accepted at most once.
+func (u *UserDB) VerifySecondFactor(ctx context.Context, tx *sql.Tx, username, totpCode, recoveryCode string) error {
+	logger := logging.FromContext(ctx)
+
+	var userID int
+	var secret []byte
+	var lastUsedCounter int64
+
+	err := tx.QueryRowContext(
+		ctx,
+		`
+			SELECT
+				users.user_id,
+				totp_credentials.totp_secret,
+				totp_credentials.last_used_counter
+			FROM totp_credentials
+			JOIN users ON totp_credentials.user_id = users.user_id
+			WHERE users.canonical_username = $1
+			  AND totp_credentials.confirmation_timestamp IS NOT NULL
+			FOR UPDATE OF totp_credentials
+		`,
+		pdusername.Canonical(username),
+	).Scan(&userID, &secret, &lastUsedCounter)
+	if err == sql.ErrNoRows {
+		return pderr.Error(codes.FailedPrecondition, "two-factor authentication is not enabled")
+	}
+	if err != nil {
+		return pderr.Wrap("failed to look up TOTP credentials", err)
+	}
+
+	switch {
+	case totpCode != "":
+		counter, ok := pdtotp.Validate(secret, totpCode, u.now(), totpSkew)
+		if !ok || counter <= lastUsedCounter {
+			return errInvalidSecondFactor
+		}
+
+		if _, err := tx.ExecContext(
+			ctx,
+			`
+				UPDATE totp_credentials
+				SET last_used_counter = $2
+				WHERE user_id = $1
+			`,
+			userID, counter,
+		); err != nil {
+			return pderr.Wrap("failed to update TOTP credentials", err)
+		}
+
+	case recoveryCode != "":
+		result, err := tx.ExecContext(
+			ctx,
+			`
+				UPDATE totp_recovery_codes
+				SET used_timestamp = CURRENT_TIMESTAMP
+				WHERE user_id = $1
+				  AND code_hash = $2
+				  AND used_timestamp IS NULL
+			`,
+			userID, hashRecoveryCode(recoveryCode),
+		)
+		if err != nil {
+			return pderr.Wrap("failed to use recovery code", err)
+		}
+
+		if n, err := result.RowsAffected(); err != nil || n == 0 {
+			return errInvalidSecondFactor
+		}
+
+		logger.Info("used recovery code", zap.String("username", username))
+
+	default:
+		return pderr.Error(codes.InvalidArgument, "an authentication code or recovery code is required")
+	}
+
+	return nil
+}
+
+// DisableTOTP turns off two-factor authentication and deletes the recovery codes.
+// Callers should first have the user prove possession with VerifySecondFactor.
+func (u *UserDB) DisableTOTP(ctx context.Context, tx *sql.Tx, username string) error {
+	logger := logging.FromContext(ctx)
+
+	if _, err := tx.ExecContext(
+		ctx,
+		`
+			DELETE FROM totp_recovery_codes
+			USING users
+			WHERE totp_recovery_codes.user_id = users.user_id
+			  AND users.canonical_username = $1
+		`,
+		pdusername.Canonical(username),
+	); err != nil {
+		return pderr.Wrap("failed to delete recovery codes", err)
+	}
+
+	if _, err := tx.ExecContext(
+		ctx,
+		`
+			DELETE FROM totp_credentials
+			USING users
+			WHERE totp_credentials.user_id = users.user_id
+			  AND users.canonical_username = $1
+		`,
+		pdusername.Canonical(username),
+	); err != nil {
+		return pderr.Wrap("failed to delete TOTP credentials", err)
+	}
+
+	logger.Info("disabled two-factor authentication", zap.String("username", username))
+
+	return nil
+}
+
+// CreateLoginChallenge records that the user has passed the password step of a
+// login, returning a short-lived token with which to complete the second step.
+func (u *UserDB) CreateLoginChallenge(ctx context.Context, tx *sql.Tx, username string) (string, error) {
+	secret := make([]byte, loginChallengeSecretSize)
+	if _, err := cryptorand.Read(secret); err != nil {
+		return "", pderr.Wrap("failed to generate login challenge secret", err)
+	}
+
+	challengeUUID, err := uuid.NewRandom()
+	if err != nil {
+		return "", pderr.Wrap("failed to generate login challenge UUID", err)
+	}
+
+	result, err := tx.ExecContext(
+		ctx,
+		`
+			INSERT INTO login_challenges
+				(login_challenge_uuid,
+				 user_id,
+				 challenge_secret_hash,
+				 expiration_timestamp)
+			SELECT
+				$1, users.user_id, $3, $4
+			FROM users
+			WHERE users.canonical_username = $2
+		`,
+		challengeUUID, pdusername.Canonical(username), pdsecret.Hash(secret), u.now().Add(loginChallengeValidDuration),
+	)
+	if err != nil {
+		return "", pderr.Wrap("failed to insert login challenge", err)
+	}
+
+	if n, err := result.RowsAffected(); err != nil || n != 1 {
+		return "", pderr.Error(codes.NotFound, "no such user")
+	}
+
+	return pdsecret.Format(loginChallengePrefix, challengeUUID, secret), nil
+}
+
+// LookupLoginChallenge returns the pending login challenge for a token, failing
+// if it is unknown, expired or already used.
+func (u *UserDB) LookupLoginChallenge(ctx context.Context, tx *sql.Tx, challenge string) (*LoginChallenge, error) {
+	challengeUUID, secret, ok := pdsecret.Parse(loginChallengePrefix, challenge)
+	if !ok {
+		return nil, errInvalidChallenge
+	}
+
+	rv := LoginChallenge{ChallengeUUID: challengeUUID}
+
+	var secretHash []byte
+	var expirationTime time.Time
+	var used bool
+
+	err := tx.QueryRowContext(
+		ctx,
+		`
+			SELECT
+				users.user_uuid,
+				users.username,
+				login_challenges.challenge_secret_hash,
+				login_challenges.expiration_timestamp,
+				login_challenges.used_timestamp IS NOT NULL
+			FROM login_challenges
+			JOIN users ON login_challenges.user_id = users.user_id
+			WHERE login_challenges.login_challenge_uuid = $1
+			FOR UPDATE OF login_challenges
+		`,
+		challengeUUID,
+	).Scan(&rv.User.UserUUID, &rv.User.Username, &secretHash, &expirationTime, &used)
+	if err == sql.ErrNoRows {
+		return nil, errInvalidChallenge
+	}
+	if err != nil {
+		return nil, pderr.Wrap("failed to look up login challenge", err)
+	}
+
+	if !pdsecret.Matches(secret, secretHash) {
+		return nil, errInvalidChallenge
+	}
+
+	if used || !u.now().Before(expirationTime) {
+		return nil, errInvalidChallenge
+	}
+
+	return &rv, nil
+}
+
+// CompleteLoginChallenge marks a login challenge as used, so that it cannot be used again.
+func (u *UserDB) CompleteLoginChallenge(ctx context.Context, tx *sql.Tx, challenge *LoginChallenge) error {
+	if _, err := tx.ExecContext(
+		ctx,
+		`
+			UPDATE login_challenges
+			SET used_timestamp = CURRENT_TIMESTAMP
+			WHERE login_challenge_uuid = $1
+		`,
+		challenge.ChallengeUUID,
+	); err != nil {
+		return pderr.Wrap("failed to complete login challenge", err)
+	}
+
+	return nil
+}
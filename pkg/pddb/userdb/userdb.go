@@ -1,64 +1,185 @@
 package userdb
 
 import (
-	"bytes"
 	"context"
 	cryptorand "crypto/rand"
+	"crypto/subtle"
 	"database/sql"
+	"fmt"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/lib/pq"
 	"github.com/steinarvk/playdough/pkg/logging"
 	"github.com/steinarvk/playdough/pkg/pderr"
+	"github.com/steinarvk/playdough/pkg/pdusername"
 	"github.com/steinarvk/playdough/proto/pdpb"
 	"go.uber.org/zap"
 	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/scrypt"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/protobuf/proto"
 )
 
 type UserDB struct {
-	db *sql.DB
+	db                  *sql.DB
+	activeHashingMethod *pdpb.PasswordHashingMethod
+	credentialPolicy    *credentialPolicy
+	now                 func() time.Time
 }
 
 type User struct {
 	UserUUID uuid.UUID
 	Username string
+
+	// Only populated when fetching users, not when authenticating them.
+	Profile      Profile
+	CreationTime time.Time
+	Deactivated  bool
+	Deleted      bool
+}
+
+type Option func(*UserDB) error
+
+// WithArgon2Params sets the parameters used to hash new passwords. Existing hashes
+// using other parameters are transparently rehashed on the next successful login.
+func WithArgon2Params(params Argon2Params) Option {
+	return func(u *UserDB) error {
+		if err := params.Validate(); err != nil {
+			return err
+		}
+		u.activeHashingMethod = argon2HashingMethod(params)
+		return nil
+	}
 }
 
-func New(db *sql.DB) *UserDB {
-	return &UserDB{
-		db: db,
+// WithCredentialPolicy sets the rules for new usernames and passwords.
+func WithCredentialPolicy(policy CredentialPolicy) Option {
+	return func(u *UserDB) error {
+		compiled, err := compileCredentialPolicy(policy)
+		if err != nil {
+			return err
+		}
+		u.credentialPolicy = compiled
+		return nil
 	}
 }
 
+func New(db *sql.DB, options ...Option) (*UserDB, error) {
+	defaultPolicy, err := compileCredentialPolicy(DefaultCredentialPolicy())
+	if err != nil {
+		return nil, err
+	}
+
+	rv := &UserDB{
+		db:                  db,
+		activeHashingMethod: argon2HashingMethod(DefaultArgon2Params()),
+		credentialPolicy:    defaultPolicy,
+		now:                 time.Now,
+	}
+
+	for _, opt := range options {
+		if err := opt(rv); err != nil {
+			return nil, err
+		}
+	}
+
+	return rv, nil
+}
+
 var (
-	argon2Parallelism = 1
+	// Parallelism used by Argon2 hashes whose stored parameters predate the parallelism field.
+	legacyArgon2Parallelism uint32 = 1
 
 	saltSize = 16
 )
 
-func getActivePasswordHashingMethod() *pdpb.PasswordHashingMethod {
+type Argon2Params struct {
+	TimeCost    uint32
+	MemoryCost  uint32
+	KeyLength   uint32
+	Parallelism uint32
+}
+
+func DefaultArgon2Params() Argon2Params {
+	return Argon2Params{
+		TimeCost:    2,
+		MemoryCost:  64 * 1024,
+		KeyLength:   32,
+		Parallelism: 1,
+	}
+}
+
+func (p Argon2Params) Validate() error {
+	if p.TimeCost < 1 {
+		return pderr.BadInput("argon2 time cost must be at least 1", "time_cost", fmt.Sprint(p.TimeCost))
+	}
+	if p.Parallelism < 1 || p.Parallelism > 255 {
+		return pderr.BadInput("argon2 parallelism must be between 1 and 255", "parallelism", fmt.Sprint(p.Parallelism))
+	}
+	if p.MemoryCost < 8*p.Parallelism {
+		return pderr.BadInput("argon2 memory cost must be at least 8 KiB per degree of parallelism", "memory_cost", fmt.Sprint(p.MemoryCost))
+	}
+	if p.KeyLength < 16 {
+		return pderr.BadInput("argon2 key length must be at least 16 bytes", "key_length", fmt.Sprint(p.KeyLength))
+	}
+	return nil
+}
+
+func argon2HashingMethod(params Argon2Params) *pdpb.PasswordHashingMethod {
 	return &pdpb.PasswordHashingMethod{
 		Method: &pdpb.PasswordHashingMethod_Argon2{
 			Argon2: &pdpb.Argon2Params{
-				TimeCost:   2,
-				MemoryCost: 64 * 1024,
-				KeyLength:  32,
+				TimeCost:    params.TimeCost,
+				MemoryCost:  params.MemoryCost,
+				KeyLength:   params.KeyLength,
+				Parallelism: params.Parallelism,
 			},
 		},
 	}
 }
 
+// needsRehash reports whether a password hashed with the stored method should be
+// rehashed with the active one. A stored Argon2 parallelism of zero predates the
+// field and means legacyArgon2Parallelism.
+func needsRehash(stored, active *pdpb.PasswordHashingMethod) bool {
+	if argon2 := stored.GetArgon2(); argon2 != nil && argon2.Parallelism == 0 {
+		normalized := proto.Clone(stored).(*pdpb.PasswordHashingMethod)
+		normalized.GetArgon2().Parallelism = legacyArgon2Parallelism
+		stored = normalized
+	}
+
+	return !proto.Equal(stored, active)
+}
+
 func hashPasswordArgon2(password string, salt []byte, params *pdpb.Argon2Params) ([]byte, error) {
-	hashedPassword := argon2.IDKey([]byte(password), salt, params.TimeCost, params.MemoryCost, uint8(argon2Parallelism), params.KeyLength)
+	parallelism := params.Parallelism
+	if parallelism == 0 {
+		parallelism = legacyArgon2Parallelism
+	}
+
+	hashedPassword := argon2.IDKey([]byte(password), salt, params.TimeCost, params.MemoryCost, uint8(parallelism), params.KeyLength)
 	return hashedPassword, nil
 }
 
+func hashPasswordScrypt(password string, salt []byte, params *pdpb.ScryptParams) ([]byte, error) {
+	return scrypt.Key([]byte(password), salt, int(params.N), int(params.R), int(params.P), int(params.KeyLength))
+}
+
+// hashPasswordBcrypt ignores the salt: bcrypt generates its own and embeds it in the hash.
+func hashPasswordBcrypt(password string, params *pdpb.BcryptParams) ([]byte, error) {
+	return bcrypt.GenerateFromPassword([]byte(password), int(params.Cost))
+}
+
 func hashPassword(password string, salt []byte, method *pdpb.PasswordHashingMethod) ([]byte, error) {
 	switch method := method.Method.(type) {
 	case *pdpb.PasswordHashingMethod_Argon2:
 		return hashPasswordArgon2(password, salt, method.Argon2)
+	case *pdpb.PasswordHashingMethod_Scrypt:
+		return hashPasswordScrypt(password, salt, method.Scrypt)
+	case *pdpb.PasswordHashingMethod_Bcrypt:
+		return hashPasswordBcrypt(password, method.Bcrypt)
 	default:
 		return nil, pderr.Unexpectedf("unsupported password hashing method")
 	}
@@ -73,39 +194,107 @@ func isUniqueViolation(err error, constraintName string) bool {
 	return pgerr.Code == pq.ErrorCode("23505") && pgerr.Constraint == constraintName
 }
 
+// NormalizeUsername returns the form in which the username is stored.
+func (u *UserDB) NormalizeUsername(username string) string {
+	return u.credentialPolicy.normalizeUsername(username)
+}
+
+// CheckValidUsername checks a normalized username against the credential policy.
+func (u *UserDB) CheckValidUsername(username string) error {
+	return u.credentialPolicy.checkValidUsername(username)
+}
+
+// CheckValidPassword checks a new password against the credential policy.
+func (u *UserDB) CheckValidPassword(password string) error {
+	return u.credentialPolicy.checkValidPassword(password)
+}
+
 func (u *UserDB) RegisterUserWithPassword(ctx context.Context, tx *sql.Tx, username, password string) (*User, error) {
 	logger := logging.FromContext(ctx)
 
-	if err := CheckValidUsername(username); err != nil {
+	username = u.NormalizeUsername(username)
+
+	if err := u.CheckValidUsername(username); err != nil {
 		return nil, err
 	}
 
-	if err := CheckValidPassword(password); err != nil {
+	if err := u.CheckValidPassword(password); err != nil {
 		return nil, err
 	}
 
 	logger.Info("registering user", zap.String("username", username))
 
-	hashingMethod := getActivePasswordHashingMethod()
+	creds, err := u.newPasswordCredentials(password)
+	if err != nil {
+		return nil, err
+	}
 
-	hashingMethodBytes, err := proto.Marshal(hashingMethod)
+	user, err := u.insertUserWithCredentials(ctx, tx, username, creds)
 	if err != nil {
-		return nil, pderr.Wrap("failed to marshal password hashing method", err)
+		return nil, err
 	}
 
-	salt := make([]byte, saltSize)
-	if _, err := cryptorand.Read(salt); err != nil {
-		return nil, pderr.Wrap("failed to generate salt", err)
+	logger.Info("successfully registered user", zap.String("username", username))
+
+	return user, nil
+}
+
+// ImportUserWithPasswordHash creates a user with an existing password hash, e.g. one
+// imported from another system. The hash is upgraded to the active hashing method the
+// next time the user logs in.
+func (u *UserDB) ImportUserWithPasswordHash(ctx context.Context, tx *sql.Tx, username string, hashingMethod *pdpb.PasswordHashingMethod, hashedPassword, salt []byte) (*User, error) {
+	logger := logging.FromContext(ctx)
+
+	username = u.NormalizeUsername(username)
+
+	if err := u.CheckValidUsername(username); err != nil {
+		return nil, err
 	}
 
-	userUUID, err := uuid.NewRandom()
+	if len(hashedPassword) == 0 {
+		return nil, pderr.BadInput("missing password hash", "username", username)
+	}
+
+	switch method := hashingMethod.Method.(type) {
+	case *pdpb.PasswordHashingMethod_Bcrypt:
+		cost, err := bcrypt.Cost(hashedPassword)
+		if err != nil {
+			return nil, pderr.BadInput("invalid bcrypt hash", "username", username)
+		}
+		method.Bcrypt = &pdpb.BcryptParams{Cost: uint32(cost)}
+		// bcrypt embeds its salt in the hash, but the column is not nullable.
+		salt = []byte{}
+	case *pdpb.PasswordHashingMethod_Scrypt, *pdpb.PasswordHashingMethod_Argon2:
+		if len(salt) == 0 {
+			return nil, pderr.BadInput("missing password salt", "username", username)
+		}
+	default:
+		return nil, pderr.BadInput("unsupported password hashing method", "username", username)
+	}
+
+	user, err := u.insertUserWithCredentials(ctx, tx, username, &passwordCredentials{
+		hashingMethod:  hashingMethod,
+		hashedPassword: hashedPassword,
+		salt:           salt,
+	})
 	if err != nil {
-		return nil, pderr.Wrap("failed to generate user UUID", err)
+		return nil, err
+	}
+
+	logger.Info("imported user with existing password hash", zap.String("username", username))
+
+	return user, nil
+}
+
+func (u *UserDB) insertUserWithCredentials(ctx context.Context, tx *sql.Tx, username string, creds *passwordCredentials) (*User, error) {
+	hashingMethodBytes, err := proto.Marshal(creds.hashingMethod)
+	if err != nil {
+		return nil, pderr.Wrap("failed to marshal password hashing method", err)
 	}
 
-	hashedPassword, err := hashPassword(password, salt, hashingMethod)
+	userUUID, err := uuid.NewRandom()
 	if err != nil {
-		return nil, pderr.Wrap("failed to hash password", err)
+		return nil, pderr.Wrap("failed to generate user UUID", err)
 	}
 
 	var userID int
@@ -114,15 +303,15 @@ func (u *UserDB) RegisterUserWithPassword(ctx context.Context, tx *sql.Tx, usern
 		ctx,
 		`
 			INSERT INTO users
-				(user_uuid, username)
+				(user_uuid, username, canonical_username)
 			VALUES
-				($1, $2)
+				($1, $2, $3)
 			RETURNING user_id
 		`,
-		userUUID, username,
+		userUUID, username, pdusername.Canonical(username),
 	).Scan(&userID); err != nil {
-		if isUniqueViolation(err, "users_username_key") {
-			return nil, pderr.Error(codes.AlreadyExists, "username already exists")
+		if isUniqueViolation(err, "users_canonical_username_key") || isUniqueViolation(err, "users_username_key") {
+			return nil, errUsernameExists
 		}
 		return nil, pderr.Wrap("failed to insert user", err)
 	}
@@ -138,12 +327,23 @@ func (u *UserDB) RegisterUserWithPassword(ctx context.Context, tx *sql.Tx, usern
 			VALUES
 				($1, $2, $3, $4)
 		`,
-		userID, hashingMethodBytes, hashedPassword, salt,
+		userID, hashingMethodBytes, creds.hashedPassword, creds.salt,
 	); err != nil {
 		return nil, pderr.Wrap("failed to insert password credentials", err)
 	}
 
-	logger.Info("successfully registered user", zap.String("username", username))
+	if _, err := tx.ExecContext(
+		ctx,
+		`
+			INSERT INTO user_roles
+				(user_id, role_name)
+			VALUES
+				($1, 'user')
+		`,
+		userID,
+	); err != nil {
+		return nil, pderr.Wrap("failed to insert default role", err)
+	}
 
 	return &User{
 		UserUUID: userUUID,
@@ -151,64 +351,183 @@ func (u *UserDB) RegisterUserWithPassword(ctx context.Context, tx *sql.Tx, usern
 	}, nil
 }
 
+type passwordCredentials struct {
+	hashingMethod  *pdpb.PasswordHashingMethod
+	hashedPassword []byte
+	salt           []byte
+}
+
+var (
+	errInvalidCredentials = pderr.Unauthenticated("invalid username or password")
+	errUsernameExists     = pderr.Error(codes.AlreadyExists, "username already exists")
+
+	dummyPasswordSalt = make([]byte, saltSize)
+)
+
+// newPasswordCredentials hashes a password with a fresh salt using the active hashing method.
+func (u *UserDB) newPasswordCredentials(password string) (*passwordCredentials, error) {
+	salt := make([]byte, saltSize)
+	if _, err := cryptorand.Read(salt); err != nil {
+		return nil, pderr.Wrap("failed to generate salt", err)
+	}
+
+	hashedPassword, err := hashPassword(password, salt, u.activeHashingMethod)
+	if err != nil {
+		return nil, pderr.Wrap("failed to hash password", err)
+	}
+
+	return &passwordCredentials{
+		hashingMethod:  u.activeHashingMethod,
+		hashedPassword: hashedPassword,
+		salt:           salt,
+	}, nil
+}
+
+// checkPassword reports whether the password matches the stored credentials.
+// If creds is nil (the user does not exist or has no password), it spends the same
+// hashing effort against a dummy salt and reports a mismatch, so that callers cannot
+// tell these cases apart by timing.
+func (u *UserDB) checkPassword(password string, creds *passwordCredentials) (bool, error) {
+	if creds == nil {
+		if _, err := hashPassword(password, dummyPasswordSalt, u.activeHashingMethod); err != nil {
+			return false, err
+		}
+		return false, nil
+	}
+
+	// bcrypt hashes are randomly salted on creation, so they can only be compared by bcrypt itself.
+	if _, ok := creds.hashingMethod.Method.(*pdpb.PasswordHashingMethod_Bcrypt); ok {
+		err := bcrypt.CompareHashAndPassword(creds.hashedPassword, []byte(password))
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+
+	newlyHashedPassword, err := hashPassword(password, creds.salt, creds.hashingMethod)
+	if err != nil {
+		return false, err
+	}
+
+	return subtle.ConstantTimeCompare(newlyHashedPassword, creds.hashedPassword) == 1, nil
+}
+
+// AuthenticateByPassword returns the user if the password is correct. Unknown users,
+// users without a password and wrong passwords all fail with the same Unauthenticated
+// error after roughly the same amount of work.
 func (u *UserDB) AuthenticateByPassword(ctx context.Context, tx *sql.Tx, username, password string) (*User, error) {
 	logger := logging.FromContext(ctx)
+
+	username = u.NormalizeUsername(username)
 	logger.Info("attempting to authenticate user by password", zap.String("username", username))
 
 	var rv User
 
+	var userID int
+	var deactivated bool
 	var hashingMethodBytes []byte
 	var hashedPassword []byte
 	var passwordSalt []byte
 
-	if err := tx.QueryRowContext(
+	var creds *passwordCredentials
+
+	err := tx.QueryRowContext(
 		ctx,
 		`
 			SELECT
+				users.user_id,
 				users.user_uuid,
 				users.username,
+				users.deactivation_timestamp IS NOT NULL,
 				password_credentials.hashing_method,
 				password_credentials.password_hash,
 				password_credentials.password_salt
 			FROM users
 			LEFT JOIN password_credentials ON users.user_id = password_credentials.user_id
-			WHERE users.username = $1
+			WHERE users.canonical_username = $1
 		`,
-		username,
-	).Scan(&rv.UserUUID, &rv.Username, &hashingMethodBytes, &hashedPassword, &passwordSalt); err != nil {
+		pdusername.Canonical(username),
+	).Scan(&userID, &rv.UserUUID, &rv.Username, &deactivated, &hashingMethodBytes, &hashedPassword, &passwordSalt)
+
+	switch {
+	case err == sql.ErrNoRows:
+		logger.Info("password authentication for unknown user", zap.String("username", username))
+
+	case err != nil:
 		return nil, pderr.Wrap("failed to fetch user by username", err)
-	}
 
-	hashingMethod := &pdpb.PasswordHashingMethod{}
-	if err := proto.Unmarshal(hashingMethodBytes, hashingMethod); err != nil {
-		return nil, pderr.Wrap("failed to unmarshal password hashing method", err)
+	case hashedPassword == nil:
+		logger.Info("password authentication for user without password credentials", zap.String("username", username))
+
+	default:
+		hashingMethod := &pdpb.PasswordHashingMethod{}
+		if err := proto.Unmarshal(hashingMethodBytes, hashingMethod); err != nil {
+			return nil, pderr.Wrap("failed to unmarshal password hashing method", err)
+		}
+
+		creds = &passwordCredentials{
+			hashingMethod:  hashingMethod,
+			hashedPassword: hashedPassword,
+			salt:           passwordSalt,
+		}
 	}
 
-	newlyHashedPassword, err := hashPassword(password, passwordSalt, hashingMethod)
+	ok, err := u.checkPassword(password, creds)
 	if err != nil {
 		return nil, pderr.Wrap("failed to hash password", err)
 	}
 
-	if !bytes.Equal(newlyHashedPassword, hashedPassword) {
-		return nil, pderr.Error(codes.Unauthenticated, "password mismatch")
+	if !ok {
+		return nil, errInvalidCredentials
+	}
+
+	// Only revealed to someone who knows the password.
+	if deactivated {
+		logger.Info("password authentication for deactivated user", zap.String("username", rv.Username))
+		return nil, errAccountDeactivated
+	}
+
+	if needsRehash(creds.hashingMethod, u.activeHashingMethod) {
+		if err := u.rehashPassword(ctx, tx, userID, password); err != nil {
+			return nil, err
+		}
+		logger.Info("rehashed password with active hashing method", zap.String("username", rv.Username))
 	}
 
 	return &rv, nil
 }
 
-func (u *UserDB) FetchUserByUsername(ctx context.Context, tx *sql.Tx, username string) (*User, error) {
-	var rv User
+// rehashPassword replaces a user's password credentials with a hash made using the
+// active hashing method. The password must already have been verified.
+func (u *UserDB) rehashPassword(ctx context.Context, tx *sql.Tx, userID int, password string) error {
+	creds, err := u.newPasswordCredentials(password)
+	if err != nil {
+		return err
+	}
 
-	if err := tx.QueryRowContext(
+	hashingMethodBytes, err := proto.Marshal(creds.hashingMethod)
+	if err != nil {
+		return pderr.Wrap("failed to marshal password hashing method", err)
+	}
+
+	if _, err := tx.ExecContext(
 		ctx,
 		`
-			SELECT user_uuid, username
-			FROM users
-			WHERE username = $1
+			UPDATE password_credentials
+			SET
+				hashing_method = $2,
+				password_hash = $3,
+				password_salt = $4,
+				password_hashing_timestamp = CURRENT_TIMESTAMP
+			WHERE user_id = $1
 		`,
-	).Scan(&rv.UserUUID, &rv.Username); err != nil {
-		return nil, pderr.Wrap("failed to fetch user by username", err)
+		userID, hashingMethodBytes, creds.hashedPassword, creds.salt,
+	); err != nil {
+		return pderr.Wrap("failed to update password credentials", err)
 	}
 
-	return &rv, nil
+	return nil
 }
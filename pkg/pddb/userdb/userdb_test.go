@@ -0,0 +1,814 @@
+package userdb
+
+import (
+	"context"
+	"crypto/sha1"
+	"database/sql"
+	"encoding/base32"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/steinarvk/playdough/pkg/pderr"
+	"github.com/steinarvk/playdough/pkg/pdtestutils"
+	"github.com/steinarvk/playdough/pkg/pdtotp"
+	"github.com/steinarvk/playdough/proto/pdpb"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/scrypt"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+func newForTesting(t *testing.T, db *sql.DB, options ...Option) *UserDB {
+	t.Helper()
+
+	u, err := New(db, options...)
+	if err != nil {
+		t.Fatalf("failed to create UserDB: %v", err)
+	}
+	return u
+}
+
+func makeTestCredentials(t *testing.T, u *UserDB, password string) *passwordCredentials {
+	t.Helper()
+
+	creds, err := u.newPasswordCredentials(password)
+	if err != nil {
+		t.Fatalf("failed to hash password: %v", err)
+	}
+	return creds
+}
+
+func TestCheckPassword(t *testing.T) {
+	u := newForTesting(t, nil)
+	creds := makeTestCredentials(t, u, "correct horse")
+
+	for _, tc := range []struct {
+		name     string
+		password string
+		creds    *passwordCredentials
+		want     bool
+	}{
+		{"correct password", "correct horse", creds, true},
+		{"wrong password", "battery staple", creds, false},
+		{"no credentials", "correct horse", nil, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := u.checkPassword(tc.password, tc.creds)
+			if err != nil {
+				t.Fatalf("checkPassword() failed: %v", err)
+			}
+			if got != tc.want {
+				t.Errorf("checkPassword() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestCheckPasswordImportedHashes(t *testing.T) {
+	u := newForTesting(t, nil)
+
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("correct horse"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	scryptParams := &pdpb.ScryptParams{N: 1024, R: 8, P: 1, KeyLength: 32}
+	scryptSalt := []byte("some salt")
+	scryptHash, err := scrypt.Key([]byte("correct horse"), scryptSalt, 1024, 8, 1, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, creds := range []*passwordCredentials{
+		{
+			hashingMethod:  &pdpb.PasswordHashingMethod{Method: &pdpb.PasswordHashingMethod_Bcrypt{Bcrypt: &pdpb.BcryptParams{Cost: uint32(bcrypt.MinCost)}}},
+			hashedPassword: bcryptHash,
+		},
+		{
+			hashingMethod:  &pdpb.PasswordHashingMethod{Method: &pdpb.PasswordHashingMethod_Scrypt{Scrypt: scryptParams}},
+			hashedPassword: scryptHash,
+			salt:           scryptSalt,
+		},
+	} {
+		if ok, err := u.checkPassword("correct horse", creds); err != nil || !ok {
+			t.Errorf("checkPassword(correct, %v) = %v, %v; want true", creds.hashingMethod, ok, err)
+		}
+		if ok, err := u.checkPassword("battery staple", creds); err != nil || ok {
+			t.Errorf("checkPassword(wrong, %v) = %v, %v; want false", creds.hashingMethod, ok, err)
+		}
+	}
+}
+
+func medianDuration(f func()) time.Duration {
+	const iterations = 5
+
+	durations := make([]time.Duration, iterations)
+	for i := range durations {
+		t0 := time.Now()
+		f()
+		durations[i] = time.Since(t0)
+	}
+
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+	return durations[iterations/2]
+}
+
+func TestCheckPasswordTakesSimilarTimeWithoutCredentials(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping timing test in short mode")
+	}
+
+	u := newForTesting(t, nil)
+	creds := makeTestCredentials(t, u, "correct horse")
+
+	withCredentials := medianDuration(func() { u.checkPassword("battery staple", creds) })
+	withoutCredentials := medianDuration(func() { u.checkPassword("battery staple", nil) })
+
+	ratio := float64(withoutCredentials) / float64(withCredentials)
+	if ratio < 0.5 || ratio > 2 {
+		t.Errorf("checking without credentials took %v, but with credentials took %v; should be similar", withoutCredentials, withCredentials)
+	}
+}
+
+func TestAuthenticateByPasswordFailuresAreIndistinguishable(t *testing.T) {
+	db := pdtestutils.OpenTestDatabase(t)
+	ctx := context.Background()
+	udb := newForTesting(t, db)
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	if _, err := udb.RegisterUserWithPassword(ctx, tx, "alice", "correct horse"); err != nil {
+		t.Fatalf("failed to register user: %v", err)
+	}
+
+	if _, err := tx.ExecContext(ctx, `INSERT INTO users (user_uuid, username, canonical_username) VALUES ($1, 'bob', 'bob')`, uuid.New()); err != nil {
+		t.Fatalf("failed to insert user without password: %v", err)
+	}
+
+	if _, err := udb.AuthenticateByPassword(ctx, tx, "alice", "correct horse"); err != nil {
+		t.Fatalf("authentication with correct password failed: %v", err)
+	}
+
+	var messages []string
+	var durations []time.Duration
+
+	for _, tc := range []struct {
+		name     string
+		username string
+		password string
+	}{
+		{"wrong password", "alice", "battery staple"},
+		{"unknown user", "mallory", "battery staple"},
+		{"user without password", "bob", "battery staple"},
+	} {
+		t0 := time.Now()
+		_, err := udb.AuthenticateByPassword(ctx, tx, tc.username, tc.password)
+		durations = append(durations, time.Since(t0))
+
+		if code := pderr.CodeOf(err); code != codes.Unauthenticated {
+			t.Errorf("%s: got code %v, want %v (error: %v)", tc.name, code, codes.Unauthenticated, err)
+			continue
+		}
+		messages = append(messages, err.Error())
+	}
+
+	for i := 1; i < len(messages); i++ {
+		if messages[i] != messages[0] {
+			t.Errorf("failure messages differ: %q vs %q", messages[i], messages[0])
+		}
+	}
+
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+	if !testing.Short() && durations[len(durations)-1] > 3*durations[0] {
+		t.Errorf("authentication failure durations vary too much: %v", durations)
+	}
+}
+
+func TestSuccessfulLoginRehashesWithActiveParams(t *testing.T) {
+	db := pdtestutils.OpenTestDatabase(t)
+	ctx := context.Background()
+
+	oldParams := Argon2Params{TimeCost: 1, MemoryCost: 8 * 1024, KeyLength: 16, Parallelism: 1}
+	newParams := Argon2Params{TimeCost: 1, MemoryCost: 16 * 1024, KeyLength: 32, Parallelism: 2}
+
+	oldUDB := newForTesting(t, db, WithArgon2Params(oldParams))
+	newUDB := newForTesting(t, db, WithArgon2Params(newParams))
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	if _, err := oldUDB.RegisterUserWithPassword(ctx, tx, "alice", "correct horse"); err != nil {
+		t.Fatalf("failed to register user: %v", err)
+	}
+
+	if _, err := newUDB.AuthenticateByPassword(ctx, tx, "alice", "correct horse"); err != nil {
+		t.Fatalf("authentication failed: %v", err)
+	}
+
+	var hashingMethodBytes []byte
+	if err := tx.QueryRowContext(ctx, `SELECT hashing_method FROM password_credentials`).Scan(&hashingMethodBytes); err != nil {
+		t.Fatalf("failed to read credentials: %v", err)
+	}
+
+	stored := &pdpb.PasswordHashingMethod{}
+	if err := proto.Unmarshal(hashingMethodBytes, stored); err != nil {
+		t.Fatalf("failed to unmarshal hashing method: %v", err)
+	}
+	if !proto.Equal(stored, argon2HashingMethod(newParams)) {
+		t.Errorf("stored hashing method is %v, want %v", stored, argon2HashingMethod(newParams))
+	}
+
+	if _, err := newUDB.AuthenticateByPassword(ctx, tx, "alice", "correct horse"); err != nil {
+		t.Errorf("authentication after rehash failed: %v", err)
+	}
+}
+
+func TestLegacyArgon2ParallelismDoesNotForceRehash(t *testing.T) {
+	params := Argon2Params{TimeCost: 1, MemoryCost: 8 * 1024, KeyLength: 16, Parallelism: legacyArgon2Parallelism}
+
+	legacy := argon2HashingMethod(params)
+	legacy.GetArgon2().Parallelism = 0
+
+	if needsRehash(legacy, argon2HashingMethod(params)) {
+		t.Errorf("legacy hash with parallelism 0 needs rehash under parallelism %d", legacyArgon2Parallelism)
+	}
+	if legacy.GetArgon2().Parallelism != 0 {
+		t.Errorf("needsRehash modified the stored hashing method")
+	}
+
+	params.Parallelism = 2
+	if !needsRehash(legacy, argon2HashingMethod(params)) {
+		t.Errorf("legacy hash does not need rehash under parallelism 2")
+	}
+}
+
+func TestImportedBcryptUserIsMovedToArgon2OnLogin(t *testing.T) {
+	db := pdtestutils.OpenTestDatabase(t)
+	ctx := context.Background()
+	udb := newForTesting(t, db)
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("correct horse"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bcryptMethod := &pdpb.PasswordHashingMethod{Method: &pdpb.PasswordHashingMethod_Bcrypt{}}
+	if _, err := udb.ImportUserWithPasswordHash(ctx, tx, "alice", bcryptMethod, bcryptHash, nil); err != nil {
+		t.Fatalf("failed to import user: %v", err)
+	}
+
+	if _, err := udb.AuthenticateByPassword(ctx, tx, "alice", "correct horse"); err != nil {
+		t.Fatalf("authentication with imported hash failed: %v", err)
+	}
+
+	var hashingMethodBytes []byte
+	if err := tx.QueryRowContext(ctx, `SELECT hashing_method FROM password_credentials`).Scan(&hashingMethodBytes); err != nil {
+		t.Fatalf("failed to read credentials: %v", err)
+	}
+
+	stored := &pdpb.PasswordHashingMethod{}
+	if err := proto.Unmarshal(hashingMethodBytes, stored); err != nil {
+		t.Fatalf("failed to unmarshal hashing method: %v", err)
+	}
+	if stored.GetArgon2() == nil {
+		t.Errorf("stored hashing method is %v, want argon2", stored)
+	}
+}
+
+func TestPasswordResetTokenIsSingleUse(t *testing.T) {
+	db := pdtestutils.OpenTestDatabase(t)
+	ctx := context.Background()
+	udb := newForTesting(t, db)
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	if _, err := udb.RegisterUserWithPassword(ctx, tx, "alice", "correct horse"); err != nil {
+		t.Fatalf("failed to register user: %v", err)
+	}
+
+	token, _, err := udb.CreatePasswordResetToken(ctx, tx, "alice", "", time.Hour)
+	if err != nil {
+		t.Fatalf("failed to create password reset token: %v", err)
+	}
+
+	if _, err := udb.ResetPasswordWithToken(ctx, tx, token, "battery staple"); err != nil {
+		t.Fatalf("failed to reset password: %v", err)
+	}
+
+	if _, err := udb.AuthenticateByPassword(ctx, tx, "alice", "battery staple"); err != nil {
+		t.Errorf("authentication with new password failed: %v", err)
+	}
+	if _, err := udb.AuthenticateByPassword(ctx, tx, "alice", "correct horse"); pderr.CodeOf(err) != codes.Unauthenticated {
+		t.Errorf("authentication with old password: got %v, want Unauthenticated", err)
+	}
+
+	if _, err := udb.ResetPasswordWithToken(ctx, tx, token, "another password"); pderr.CodeOf(err) != codes.Unauthenticated {
+		t.Errorf("reusing password reset token: got %v, want Unauthenticated", err)
+	}
+}
+
+func TestTOTPEnrolmentAndVerification(t *testing.T) {
+	db := pdtestutils.OpenTestDatabase(t)
+	ctx := context.Background()
+	udb := newForTesting(t, db)
+
+	now := time.Unix(1700000000, 0)
+	udb.now = func() time.Time { return now }
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	if _, err := udb.RegisterUserWithPassword(ctx, tx, "alice", "correct horse"); err != nil {
+		t.Fatalf("failed to register user: %v", err)
+	}
+
+	enrollment, err := udb.EnrollTOTP(ctx, tx, "alice")
+	if err != nil {
+		t.Fatalf("failed to enroll: %v", err)
+	}
+
+	secret, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(enrollment.Secret)
+	if err != nil {
+		t.Fatalf("failed to decode secret %q: %v", enrollment.Secret, err)
+	}
+
+	if enabled, err := udb.HasSecondFactor(ctx, tx, "alice"); err != nil || enabled {
+		t.Errorf("HasSecondFactor() before confirmation = %v, %v; want false", enabled, err)
+	}
+
+	recoveryCodes, err := udb.ConfirmTOTP(ctx, tx, "alice", pdtotp.Code(secret, now))
+	if err != nil {
+		t.Fatalf("failed to confirm: %v", err)
+	}
+	if len(recoveryCodes) != numRecoveryCodes {
+		t.Errorf("got %d recovery codes, want %d", len(recoveryCodes), numRecoveryCodes)
+	}
+
+	if enabled, err := udb.HasSecondFactor(ctx, tx, "alice"); err != nil || !enabled {
+		t.Errorf("HasSecondFactor() after confirmation = %v, %v; want true", enabled, err)
+	}
+
+	// The code used for confirmation must not be accepted again.
+	if err := udb.VerifySecondFactor(ctx, tx, "alice", pdtotp.Code(secret, now), ""); pderr.CodeOf(err) != codes.Unauthenticated {
+		t.Errorf("replayed code: got %v, want Unauthenticated", err)
+	}
+
+	now = now.Add(pdtotp.Period)
+	if err := udb.VerifySecondFactor(ctx, tx, "alice", pdtotp.Code(secret, now), ""); err != nil {
+		t.Errorf("fresh code rejected: %v", err)
+	}
+
+	if err := udb.VerifySecondFactor(ctx, tx, "alice", "", strings.ToUpper(recoveryCodes[0])); err != nil {
+		t.Errorf("recovery code rejected: %v", err)
+	}
+	if err := udb.VerifySecondFactor(ctx, tx, "alice", "", recoveryCodes[0]); pderr.CodeOf(err) != codes.Unauthenticated {
+		t.Errorf("reused recovery code: got %v, want Unauthenticated", err)
+	}
+}
+
+func TestCheckValidProfile(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		profile Profile
+		wantOK  bool
+	}{
+		{"empty", Profile{}, true},
+		{"typical", Profile{DisplayName: "Alice", AvatarURL: "https://example.com/a.png", Bio: "Hello.\nI like dough."}, true},
+		{"plain http avatar", Profile{AvatarURL: "http://example.com/a.png"}, false},
+		{"avatar without host", Profile{AvatarURL: "https:///a.png"}, false},
+		{"control character in display name", Profile{DisplayName: "Al\x07ice"}, false},
+		{"newline in display name", Profile{DisplayName: "Al\nice"}, false},
+		{"long display name", Profile{DisplayName: strings.Repeat("é", maxDisplayNameLength+1)}, false},
+		{"long bio", Profile{Bio: strings.Repeat("x", maxBioLength+1)}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := checkValidProfile(tc.profile)
+			if gotOK := err == nil; gotOK != tc.wantOK {
+				t.Errorf("checkValidProfile() = %v, want ok=%v", err, tc.wantOK)
+			}
+			if err != nil && pderr.CodeOf(err) != codes.InvalidArgument {
+				t.Errorf("checkValidProfile() = %v, want InvalidArgument", err)
+			}
+		})
+	}
+}
+
+func TestCheckValidProfileReportsEveryViolation(t *testing.T) {
+	err := checkValidProfile(Profile{
+		DisplayName: "Al\x07ice",
+		AvatarURL:   "http://secret.example.com/a.png",
+		Bio:         strings.Repeat("x", maxBioLength+1),
+	})
+	if n := fieldViolationCount(t, err); n != 3 {
+		t.Errorf("checkValidProfile() = %v, want 3 field violations", err)
+	}
+	if strings.Contains(status.Convert(err).Proto().String(), "secret") {
+		t.Errorf("checkValidProfile() = %v, which echoes the rejected value", err)
+	}
+}
+
+func fieldViolationCount(t *testing.T, err error) int {
+	t.Helper()
+
+	st, ok := status.FromError(err)
+	if !ok || st.Code() != codes.InvalidArgument {
+		t.Fatalf("got %v, want InvalidArgument", err)
+	}
+	for _, detail := range st.Details() {
+		if br, ok := detail.(*errdetails.BadRequest); ok {
+			return len(br.FieldViolations)
+		}
+	}
+	t.Fatalf("error %v has no BadRequest details", err)
+	return 0
+}
+
+func TestDefaultCredentialPolicyUsernames(t *testing.T) {
+	udb := newForTesting(t, nil)
+
+	for _, tc := range []struct {
+		username string
+		wantOK   bool
+	}{
+		{"alice", true},
+		{"Alice_99", true},
+		{"ab", false},
+		{strings.Repeat("a", 33), false},
+		{"al ice", false},
+		{"al-ice", false},
+		{"ålice", false},
+		{"admin", false},
+		{"Admin", false},
+		{"deleted_0123abcd", false},
+	} {
+		err := udb.CheckValidUsername(udb.NormalizeUsername(tc.username))
+		if gotOK := err == nil; gotOK != tc.wantOK {
+			t.Errorf("CheckValidUsername(%q) = %v, want ok=%v", tc.username, err, tc.wantOK)
+		}
+	}
+
+	if got := udb.NormalizeUsername("ａｌｉｃｅ"); got != "alice" {
+		t.Errorf("NormalizeUsername() = %q, want full-width letters folded to %q", got, "alice")
+	}
+}
+
+func TestCredentialPolicyUsernameCharsets(t *testing.T) {
+	policy := DefaultCredentialPolicy()
+	policy.UsernameCharset = UsernameCharsetUnicode
+	policy.ReservedUsernames = []string{"gatekeeper"}
+	udb := newForTesting(t, nil, WithCredentialPolicy(policy))
+
+	for _, username := range []string{"ålice", "al-ice.b", "admin"} {
+		if err := udb.CheckValidUsername(username); err != nil {
+			t.Errorf("CheckValidUsername(%q) = %v, want ok", username, err)
+		}
+	}
+	for _, username := range []string{"al ice", "al@ice", "GateKeeper"} {
+		if err := udb.CheckValidUsername(username); err == nil {
+			t.Errorf("CheckValidUsername(%q) succeeded, want error", username)
+		}
+	}
+}
+
+func TestCredentialPolicyPasswords(t *testing.T) {
+	breachedFile := filepath.Join(t.TempDir(), "breached.txt")
+	breachedSHA1 := sha1.Sum([]byte("Tr0ub4dor&3"))
+	breachedContents := "Password123!\n" + strings.ToUpper(hex.EncodeToString(breachedSHA1[:])) + ":4211\n"
+	if err := os.WriteFile(breachedFile, []byte(breachedContents), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	policy := DefaultCredentialPolicy()
+	policy.MinPasswordLength = 10
+	policy.MaxPasswordLength = 20
+	policy.MinPasswordCharacterClasses = 3
+	policy.BreachedPasswordsFile = breachedFile
+	udb := newForTesting(t, nil, WithCredentialPolicy(policy))
+
+	for _, tc := range []struct {
+		password       string
+		wantViolations int
+	}{
+		{"correct Horse battery", 1},
+		{"correct horse battery", 2},
+		{"Correct horse 9", 0},
+		{"ææææææææææ1Æ", 0},
+		{"Short1!", 1},
+		{"short", 2},
+		{"Password123!", 1},
+		{"Tr0ub4dor&3", 1},
+	} {
+		err := udb.CheckValidPassword(tc.password)
+		if tc.wantViolations == 0 {
+			if err != nil {
+				t.Errorf("CheckValidPassword(%q) = %v, want ok", tc.password, err)
+			}
+			continue
+		}
+		if got := fieldViolationCount(t, err); got != tc.wantViolations {
+			t.Errorf("CheckValidPassword(%q) = %v with %d violations, want %d", tc.password, err, got, tc.wantViolations)
+		}
+		if strings.Contains(err.Error(), tc.password) {
+			t.Errorf("CheckValidPassword(%q) error %q echoes the password", tc.password, err)
+		}
+	}
+}
+
+func TestInvalidCredentialPolicyIsRejected(t *testing.T) {
+	policy := DefaultCredentialPolicy()
+	policy.UsernameCharset = "emoji"
+	policy.MinPasswordLength = 0
+
+	_, err := New(nil, WithCredentialPolicy(policy))
+	if got := fieldViolationCount(t, err); got != 2 {
+		t.Errorf("New() = %v with %d violations, want 2", err, got)
+	}
+
+	policy = DefaultCredentialPolicy()
+	policy.BreachedPasswordsFile = filepath.Join(t.TempDir(), "missing.txt")
+	if _, err := New(nil, WithCredentialPolicy(policy)); err == nil {
+		t.Errorf("New() with missing breached passwords file succeeded")
+	}
+}
+
+func TestLoadCredentialPolicyFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.yaml")
+	contents := "min_username_length: 5\nusername_charset: ascii-extended\nreserved_usernames: [boss]\n"
+	if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	policy, err := LoadCredentialPolicyFile(path, DefaultCredentialPolicy())
+	if err != nil {
+		t.Fatalf("failed to load policy: %v", err)
+	}
+
+	want := DefaultCredentialPolicy()
+	want.MinUsernameLength = 5
+	want.UsernameCharset = UsernameCharsetASCIIExtended
+	want.ReservedUsernames = []string{"boss"}
+
+	if policy.MinUsernameLength != want.MinUsernameLength || policy.MaxUsernameLength != want.MaxUsernameLength || policy.UsernameCharset != want.UsernameCharset || strings.Join(policy.ReservedUsernames, ",") != "boss" || policy.MinPasswordLength != want.MinPasswordLength {
+		t.Errorf("loaded policy %+v, want %+v", policy, want)
+	}
+}
+
+func TestUsernamesAreCaseInsensitive(t *testing.T) {
+	db := pdtestutils.OpenTestDatabase(t)
+	ctx := context.Background()
+	udb := newForTesting(t, db)
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	if _, err := udb.RegisterUserWithPassword(ctx, tx, "Alice", "password123"); err != nil {
+		t.Fatalf("failed to register user: %v", err)
+	}
+
+	_, err = udb.RegisterUserWithPassword(ctx, tx, "alice", "password123")
+	if pderr.CodeOf(err) != codes.AlreadyExists {
+		t.Errorf("registering alice after Alice = %v, want AlreadyExists", err)
+	}
+
+	for _, username := range []string{"Alice", "alice", "ALICE", "ａｌｉｃｅ"} {
+		user, err := udb.AuthenticateByPassword(ctx, tx, username, "password123")
+		if err != nil {
+			t.Errorf("AuthenticateByPassword(%q) failed: %v", username, err)
+			continue
+		}
+		if user.Username != "Alice" {
+			t.Errorf("AuthenticateByPassword(%q) returned username %q, want display form %q", username, user.Username, "Alice")
+		}
+
+		fetched, err := udb.FetchUserByUsername(ctx, tx, username)
+		if err != nil || fetched.Username != "Alice" {
+			t.Errorf("FetchUserByUsername(%q) = %+v, %v; want Alice", username, fetched, err)
+		}
+	}
+}
+
+func TestSearchUsersPaginates(t *testing.T) {
+	db := pdtestutils.OpenTestDatabase(t)
+	ctx := context.Background()
+	udb := newForTesting(t, db)
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	for _, username := range []string{"bob_1", "bob_2", "bob_3", "bobx", "carol"} {
+		if _, err := tx.ExecContext(ctx, `INSERT INTO users (user_uuid, username, canonical_username) VALUES ($1, $2, $2)`, uuid.New(), username); err != nil {
+			t.Fatalf("failed to insert user %q: %v", username, err)
+		}
+	}
+
+	var got []string
+	pageToken := ""
+	for {
+		users, nextPageToken, err := udb.SearchUsers(ctx, tx, "bob_", 2, pageToken)
+		if err != nil {
+			t.Fatalf("SearchUsers() failed: %v", err)
+		}
+		for _, user := range users {
+			got = append(got, user.Username)
+		}
+		if nextPageToken == "" {
+			break
+		}
+		pageToken = nextPageToken
+	}
+
+	want := []string{"bob_1", "bob_2", "bob_3"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("SearchUsers() returned %v, want %v", got, want)
+	}
+}
+
+func TestDeactivationAndDeletion(t *testing.T) {
+	db := pdtestutils.OpenTestDatabase(t)
+	ctx := context.Background()
+	udb := newForTesting(t, db)
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	user, err := udb.RegisterUserWithPassword(ctx, tx, "alice", "correct horse")
+	if err != nil {
+		t.Fatalf("failed to register user: %v", err)
+	}
+
+	if err := udb.DeactivateUser(ctx, tx, "alice"); err != nil {
+		t.Fatalf("failed to deactivate user: %v", err)
+	}
+	if _, err := udb.AuthenticateByPassword(ctx, tx, "alice", "correct horse"); pderr.CodeOf(err) != codes.PermissionDenied {
+		t.Errorf("login while deactivated: got %v, want PermissionDenied", err)
+	}
+
+	export, err := udb.ExportUserData(ctx, tx, "alice")
+	if err != nil {
+		t.Fatalf("failed to export user data: %v", err)
+	}
+	if export.DeactivationTime == nil || export.Password == nil || export.Password.HashingAlgorithm != "argon2id" {
+		t.Errorf("unexpected export: %+v", export)
+	}
+
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO login_failures (throttle_key, failure_count, first_failure_timestamp, last_failure_timestamp, blocked_until_timestamp)
+		VALUES ('username:alice', 10, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP + INTERVAL '1 hour')
+	`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO rate_limit_buckets (bucket_key, tokens, updated_timestamp)
+		VALUES ('user:alice', 0, CURRENT_TIMESTAMP)
+	`); err != nil {
+		t.Fatal(err)
+	}
+
+	pseudonym, err := udb.DeleteUser(ctx, tx, "Alice")
+	if err != nil {
+		t.Fatalf("failed to delete user: %v", err)
+	}
+	if !strings.HasPrefix(pseudonym, deletedUsernamePrefix) || udb.CheckValidUsername(pseudonym) == nil {
+		t.Errorf("pseudonym %q should be a reserved username", pseudonym)
+	}
+
+	deleted, err := udb.FetchUserByUUID(ctx, tx, user.UserUUID)
+	if err != nil {
+		t.Fatalf("deleted user row is gone: %v", err)
+	}
+	if !deleted.Deleted || deleted.Username != pseudonym {
+		t.Errorf("deleted user is %+v, want deleted with username %q", deleted, pseudonym)
+	}
+
+	var numCredentials int
+	if err := tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM password_credentials`).Scan(&numCredentials); err != nil {
+		t.Fatal(err)
+	}
+	if numCredentials != 0 {
+		t.Errorf("deleted user still has %d password credentials", numCredentials)
+	}
+
+	var numThrottleRows int
+	if err := tx.QueryRowContext(ctx, `
+		SELECT (SELECT COUNT(*) FROM login_failures WHERE throttle_key = 'username:alice')
+		     + (SELECT COUNT(*) FROM rate_limit_buckets WHERE bucket_key = 'user:alice')
+	`).Scan(&numThrottleRows); err != nil {
+		t.Fatal(err)
+	}
+	if numThrottleRows != 0 {
+		t.Errorf("login throttle and rate limit state of deleted user was kept")
+	}
+
+	if _, err := udb.RegisterUserWithPassword(ctx, tx, "alice", "battery staple"); err != nil {
+		t.Errorf("username of deleted user could not be reused: %v", err)
+	}
+}
+
+func TestInviteCodes(t *testing.T) {
+	db := pdtestutils.OpenTestDatabase(t)
+	ctx := context.Background()
+	udb := newForTesting(t, db)
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	if _, err := udb.RegisterUserWithPassword(ctx, tx, "alice", "correct horse"); err != nil {
+		t.Fatalf("failed to register user: %v", err)
+	}
+
+	code, _, err := udb.CreateInvite(ctx, tx, "alice", 2, time.Hour)
+	if err != nil {
+		t.Fatalf("failed to create invite: %v", err)
+	}
+
+	if _, err := udb.RegisterUserWithInvite(ctx, tx, code+"x", "mallory", "correct horse"); pderr.CodeOf(err) != codes.PermissionDenied {
+		t.Errorf("registering with a wrong invite code: got %v, want PermissionDenied", err)
+	}
+
+	for _, username := range []string{"bob", "carol"} {
+		if _, err := udb.RegisterUserWithInvite(ctx, tx, code, username, "correct horse"); err != nil {
+			t.Fatalf("failed to register %q with invite: %v", username, err)
+		}
+	}
+
+	if _, err := udb.RegisterUserWithInvite(ctx, tx, code, "dave", "correct horse"); pderr.CodeOf(err) != codes.PermissionDenied {
+		t.Errorf("registering with a used up invite: got %v, want PermissionDenied", err)
+	}
+
+	invites, err := udb.ListInvites(ctx, tx, "alice")
+	if err != nil {
+		t.Fatalf("failed to list invites: %v", err)
+	}
+	if len(invites) != 1 || invites[0].UseCount != 2 || strings.Join(invites[0].InvitedUsernames, ",") != "bob,carol" {
+		t.Errorf("unexpected invites: %+v", invites)
+	}
+
+	export, err := udb.ExportUserData(ctx, tx, "bob")
+	if err != nil {
+		t.Fatalf("failed to export user data: %v", err)
+	}
+	if export.InvitedBy != "alice" {
+		t.Errorf("bob was invited by %q, want alice", export.InvitedBy)
+	}
+
+	expiringCode, _, err := udb.CreateInvite(ctx, tx, "alice", 1, time.Hour)
+	if err != nil {
+		t.Fatalf("failed to create invite: %v", err)
+	}
+	udb.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	if _, err := udb.RegisterUserWithInvite(ctx, tx, expiringCode, "erin", "correct horse"); pderr.CodeOf(err) != codes.PermissionDenied {
+		t.Errorf("registering with an expired invite: got %v, want PermissionDenied", err)
+	}
+	udb.now = time.Now
+
+	orphanedCode, _, err := udb.CreateInvite(ctx, tx, "alice", 1, time.Hour)
+	if err != nil {
+		t.Fatalf("failed to create invite: %v", err)
+	}
+	if err := udb.DeactivateUser(ctx, tx, "alice"); err != nil {
+		t.Fatalf("failed to deactivate user: %v", err)
+	}
+	if _, err := udb.RegisterUserWithInvite(ctx, tx, orphanedCode, "frank", "correct horse"); pderr.CodeOf(err) != codes.PermissionDenied {
+		t.Errorf("registering with an invite from a deactivated user: got %v, want PermissionDenied", err)
+	}
+}
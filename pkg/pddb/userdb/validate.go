@@ -1,31 +1,304 @@
 package userdb
 
 import (
-	"regexp"
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/steinarvk/playdough/pkg/pderr"
-	"google.golang.org/grpc/codes"
+	"github.com/steinarvk/playdough/pkg/pdusername"
+	"golang.org/x/text/unicode/norm"
+	"gopkg.in/yaml.v3"
 )
 
-var (
-	validUsernameRE = regexp.MustCompile(`^[a-zA-Z0-9_]{3,32}$`)
+// UsernameCharset selects which characters usernames may contain.
+type UsernameCharset string
+
+const (
+	// ASCII letters, digits and underscores.
+	UsernameCharsetASCII UsernameCharset = "ascii"
+	// ASCII letters, digits, underscores, hyphens and dots.
+	UsernameCharsetASCIIExtended UsernameCharset = "ascii-extended"
+	// Letters and digits in any script, underscores, hyphens and dots.
+	UsernameCharsetUnicode UsernameCharset = "unicode"
 )
 
-func CheckValidUsername(username string) error {
-	if !validUsernameRE.MatchString(username) {
-		return pderr.Error(codes.InvalidArgument, "invalid username")
+// CredentialPolicy controls which usernames and passwords are accepted for new
+// accounts and password changes. Existing accounts are not affected.
+type CredentialPolicy struct {
+	MinUsernameLength int             `yaml:"min_username_length"`
+	MaxUsernameLength int             `yaml:"max_username_length"`
+	UsernameCharset   UsernameCharset `yaml:"username_charset"`
+	// Compared by canonical form, see pdusername.Canonical.
+	ReservedUsernames []string `yaml:"reserved_usernames"`
+	// Apply Unicode NFKC normalization to usernames, so that e.g. full-width
+	// letters cannot be used to imitate another user.
+	NormalizeUsernames bool `yaml:"normalize_usernames"`
+
+	MinPasswordLength int `yaml:"min_password_length"`
+	MaxPasswordLength int `yaml:"max_password_length"`
+	// How many of the classes lowercase, uppercase, digits and other characters a password must contain.
+	MinPasswordCharacterClasses int `yaml:"min_password_character_classes"`
+	// A file of known breached passwords to refuse: one per line, either in plain
+	// text or as SHA-1 hex digests (optionally followed by ":count", as published
+	// by Have I Been Pwned).
+	BreachedPasswordsFile string `yaml:"breached_passwords_file"`
+}
+
+func DefaultCredentialPolicy() CredentialPolicy {
+	return CredentialPolicy{
+		MinUsernameLength: 3,
+		MaxUsernameLength: 32,
+		UsernameCharset:   UsernameCharsetASCII,
+		ReservedUsernames: []string{
+			"admin",
+			"administrator",
+			"root",
+			"system",
+			"playdough",
+			"support",
+			"security",
+		},
+		NormalizeUsernames: true,
+
+		MinPasswordLength: 8,
+		// Hashing very long passwords is an easy way to waste server time.
+		MaxPasswordLength: 1024,
+	}
+}
+
+func (p CredentialPolicy) Validate() error {
+	var violations []pderr.FieldViolation
+
+	if p.MinUsernameLength < 1 || p.MaxUsernameLength < p.MinUsernameLength {
+		violations = append(violations, pderr.FieldViolation{Field: "max_username_length", Description: "username length bounds must satisfy 1 <= min <= max"})
+	}
+
+	switch p.UsernameCharset {
+	case UsernameCharsetASCII, UsernameCharsetASCIIExtended, UsernameCharsetUnicode:
+	default:
+		violations = append(violations, pderr.FieldViolation{Field: "username_charset", Description: fmt.Sprintf("unknown username charset %q (want ascii, ascii-extended or unicode)", p.UsernameCharset)})
+	}
+
+	if p.MinPasswordLength < 1 || p.MaxPasswordLength < p.MinPasswordLength {
+		violations = append(violations, pderr.FieldViolation{Field: "max_password_length", Description: "password length bounds must satisfy 1 <= min <= max"})
+	}
+
+	if p.MinPasswordCharacterClasses < 0 || p.MinPasswordCharacterClasses > numPasswordCharacterClasses {
+		violations = append(violations, pderr.FieldViolation{Field: "min_password_character_classes", Description: "must be between 0 and 4"})
+	}
+
+	if len(violations) > 0 {
+		return pderr.InvalidFields("invalid credential policy", violations...)
 	}
 
 	return nil
 }
 
-var (
-	minPasswordLength = 8
-)
+// LoadCredentialPolicyFile reads a YAML credential policy. Settings missing from
+// the file keep their values from base.
+func LoadCredentialPolicyFile(path string, base CredentialPolicy) (CredentialPolicy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return base, pderr.Wrap("failed to read credential policy file", err)
+	}
+
+	rv := base
+	if err := yaml.Unmarshal(data, &rv); err != nil {
+		return base, pderr.Wrap("failed to parse credential policy file", err)
+	}
+
+	return rv, nil
+}
+
+// credentialPolicy is a validated CredentialPolicy, ready for use.
+type credentialPolicy struct {
+	CredentialPolicy
+
+	reservedUsernames map[string]bool
+	breachedPasswords map[[sha1.Size]byte]bool
+}
+
+func compileCredentialPolicy(policy CredentialPolicy) (*credentialPolicy, error) {
+	if err := policy.Validate(); err != nil {
+		return nil, err
+	}
+
+	rv := &credentialPolicy{
+		CredentialPolicy:  policy,
+		reservedUsernames: map[string]bool{},
+	}
+
+	for _, name := range policy.ReservedUsernames {
+		rv.reservedUsernames[pdusername.Canonical(name)] = true
+	}
+
+	if policy.BreachedPasswordsFile != "" {
+		breached, err := loadBreachedPasswords(policy.BreachedPasswordsFile)
+		if err != nil {
+			return nil, err
+		}
+		rv.breachedPasswords = breached
+	}
+
+	return rv, nil
+}
+
+func loadBreachedPasswords(path string) (map[[sha1.Size]byte]bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, pderr.Wrap("failed to open breached passwords file", err)
+	}
+	defer f.Close()
+
+	rv := map[[sha1.Size]byte]bool{}
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" {
+			continue
+		}
+
+		hexDigest, _, _ := strings.Cut(line, ":")
+		if digest, err := hex.DecodeString(hexDigest); err == nil && len(digest) == sha1.Size {
+			rv[[sha1.Size]byte(digest)] = true
+			continue
+		}
+
+		rv[sha1.Sum([]byte(line))] = true
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, pderr.Wrap("failed to read breached passwords file", err)
+	}
+
+	return rv, nil
+}
+
+func (p *credentialPolicy) normalizeUsername(username string) string {
+	if p.NormalizeUsernames {
+		return norm.NFKC.String(username)
+	}
+	return username
+}
+
+func (p *credentialPolicy) isAllowedUsernameRune(r rune) bool {
+	if r == '_' {
+		return true
+	}
+
+	switch p.UsernameCharset {
+	case UsernameCharsetASCII:
+		return r < utf8.RuneSelf && (unicode.IsLetter(r) || unicode.IsDigit(r))
+	case UsernameCharsetASCIIExtended:
+		return r < utf8.RuneSelf && (unicode.IsLetter(r) || unicode.IsDigit(r) || r == '-' || r == '.')
+	default:
+		return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '-' || r == '.'
+	}
+}
+
+// checkValidUsername checks an already normalized username.
+func (p *credentialPolicy) checkValidUsername(username string) error {
+	var violations []pderr.FieldViolation
+
+	length := utf8.RuneCountInString(username)
+	if !utf8.ValidString(username) || length < p.MinUsernameLength || length > p.MaxUsernameLength {
+		violations = append(violations, pderr.FieldViolation{
+			Field:       "username",
+			Description: fmt.Sprintf("must be between %d and %d characters", p.MinUsernameLength, p.MaxUsernameLength),
+		})
+	}
+
+	for _, r := range username {
+		if !p.isAllowedUsernameRune(r) {
+			violations = append(violations, pderr.FieldViolation{
+				Field:       "username",
+				Description: fmt.Sprintf("contains disallowed character %q (allowed: %s)", r, p.UsernameCharset),
+			})
+			break
+		}
+	}
+
+	canonical := pdusername.Canonical(username)
+	if p.reservedUsernames[canonical] || strings.HasPrefix(canonical, deletedUsernamePrefix) {
+		violations = append(violations, pderr.FieldViolation{
+			Field:       "username",
+			Description: "is reserved",
+		})
+	}
+
+	if len(violations) > 0 {
+		return pderr.InvalidFields(fmt.Sprintf("invalid username %q", username), violations...)
+	}
+
+	return nil
+}
+
+const numPasswordCharacterClasses = 4
+
+func passwordCharacterClasses(password string) int {
+	var lower, upper, digit, other bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			other = true
+		}
+	}
+
+	n := 0
+	for _, present := range []bool{lower, upper, digit, other} {
+		if present {
+			n++
+		}
+	}
+	return n
+}
+
+func (p *credentialPolicy) checkValidPassword(password string) error {
+	var violations []pderr.FieldViolation
+
+	length := utf8.RuneCountInString(password)
+	if length < p.MinPasswordLength {
+		violations = append(violations, pderr.FieldViolation{
+			Field:       "password",
+			Description: fmt.Sprintf("must be at least %d characters", p.MinPasswordLength),
+		})
+	}
+	if length > p.MaxPasswordLength {
+		violations = append(violations, pderr.FieldViolation{
+			Field:       "password",
+			Description: fmt.Sprintf("must be at most %d characters", p.MaxPasswordLength),
+		})
+	}
+
+	if passwordCharacterClasses(password) < p.MinPasswordCharacterClasses {
+		violations = append(violations, pderr.FieldViolation{
+			Field:       "password",
+			Description: fmt.Sprintf("must contain at least %d of: lowercase letters, uppercase letters, digits, other characters", p.MinPasswordCharacterClasses),
+		})
+	}
+
+	if p.breachedPasswords[sha1.Sum([]byte(password))] {
+		violations = append(violations, pderr.FieldViolation{
+			Field:       "password",
+			Description: "appears in a list of breached passwords",
+		})
+	}
 
-func CheckValidPassword(password string) error {
-	if len(password) < minPasswordLength {
-		return pderr.Error(codes.InvalidArgument, "password too short")
+	if len(violations) > 0 {
+		return pderr.InvalidFields("password does not meet the password policy", violations...)
 	}
 
 	return nil
@@ -0,0 +1,68 @@
+// Package pddebug carries RequestDebugSettings and ResponseDebugInfo between client
+// and server as binary gRPC metadata.
+package pddebug
+
+import (
+	"context"
+
+	"github.com/steinarvk/playdough/proto/pdpb"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// Binary metadata keys must end in -bin; gRPC base64-encodes their values on the wire.
+	RequestSettingsHeader = "playdough-debug-settings-bin"
+	ResponseInfoHeader    = "playdough-debug-info-bin"
+)
+
+func lastValue(md metadata.MD, key string) []byte {
+	values := md.Get(key)
+	if len(values) == 0 {
+		return nil
+	}
+	return []byte(values[len(values)-1])
+}
+
+// SettingsFromMetadata returns the request's debug settings. Missing or malformed
+// settings are treated as the defaults, i.e. debugging disabled.
+func SettingsFromMetadata(md metadata.MD) *pdpb.RequestDebugSettings {
+	rv := &pdpb.RequestDebugSettings{}
+	if data := lastValue(md, RequestSettingsHeader); data != nil {
+		if err := proto.Unmarshal(data, rv); err != nil {
+			return &pdpb.RequestDebugSettings{}
+		}
+	}
+	return rv
+}
+
+// AppendSettingsToOutgoingContext attaches debug settings to an outgoing request.
+func AppendSettingsToOutgoingContext(ctx context.Context, settings *pdpb.RequestDebugSettings) (context.Context, error) {
+	data, err := proto.Marshal(settings)
+	if err != nil {
+		return nil, err
+	}
+	return metadata.AppendToOutgoingContext(ctx, RequestSettingsHeader, string(data)), nil
+}
+
+func InfoMetadata(info *pdpb.ResponseDebugInfo) (metadata.MD, error) {
+	data, err := proto.Marshal(info)
+	if err != nil {
+		return nil, err
+	}
+	return metadata.Pairs(ResponseInfoHeader, string(data)), nil
+}
+
+// InfoFromMetadata returns the debug info in response metadata, if there is any.
+func InfoFromMetadata(md metadata.MD) (*pdpb.ResponseDebugInfo, bool) {
+	data := lastValue(md, ResponseInfoHeader)
+	if data == nil {
+		return nil, false
+	}
+
+	rv := &pdpb.ResponseDebugInfo{}
+	if err := proto.Unmarshal(data, rv); err != nil {
+		return nil, false
+	}
+	return rv, true
+}
@@ -2,10 +2,16 @@ package pderr
 
 import (
 	"fmt"
+	"net/http"
 	"os"
+	"strings"
+	"time"
 
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/protoadapt"
+	"google.golang.org/protobuf/types/known/durationpb"
 )
 
 type PDError interface {
@@ -46,6 +52,7 @@ type genericError struct {
 	code       codes.Code
 	message    string
 	wrappedErr error
+	details    []protoadapt.MessageV1
 }
 
 func (g genericError) Error() string {
@@ -61,7 +68,16 @@ func (g genericError) Unwrap() error {
 }
 
 func (g genericError) GRPCStatus() *status.Status {
-	return status.New(g.ErrorCode(), g.Error())
+	st := status.New(g.ErrorCode(), g.Error())
+	if len(g.details) == 0 {
+		return st
+	}
+
+	withDetails, err := st.WithDetails(g.details...)
+	if err != nil {
+		return st
+	}
+	return withDetails
 }
 
 func AsPDError(err error) PDError {
@@ -88,6 +104,33 @@ func Error(code codes.Code, message string) error {
 	}
 }
 
+// ErrorWithDetails is like Error, but attaches details to the gRPC status.
+func ErrorWithDetails(code codes.Code, message string, details ...protoadapt.MessageV1) error {
+	return genericError{
+		code:       code,
+		message:    message,
+		wrappedErr: nil,
+		details:    details,
+	}
+}
+
+func RetryInfo(retryDelay time.Duration) *errdetails.RetryInfo {
+	return &errdetails.RetryInfo{
+		RetryDelay: durationpb.New(retryDelay),
+	}
+}
+
+func ResourceExhausted(message string, retryDelay time.Duration) error {
+	return ErrorWithDetails(codes.ResourceExhausted, message, RetryInfo(retryDelay))
+}
+
+func detailsOf(err error) []protoadapt.MessageV1 {
+	if g, ok := err.(genericError); ok {
+		return g.details
+	}
+	return nil
+}
+
 func CodeOf(err error) codes.Code {
 	if err == nil {
 		return codes.OK
@@ -96,6 +139,36 @@ func CodeOf(err error) codes.Code {
 	return code
 }
 
+// HTTPStatus returns the HTTP status code corresponding to a gRPC code.
+func HTTPStatus(code codes.Code) int {
+	switch code {
+	case codes.OK:
+		return http.StatusOK
+	case codes.Canceled:
+		return 499 // Client Closed Request, a de facto standard.
+	case codes.InvalidArgument, codes.FailedPrecondition, codes.OutOfRange:
+		return http.StatusBadRequest
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.AlreadyExists, codes.Aborted:
+		return http.StatusConflict
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.Unimplemented:
+		return http.StatusNotImplemented
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
 func UnknownError(message string) error {
 	return Error(codes.Unknown, message)
 }
@@ -112,8 +185,44 @@ func Unexpectedf(format string, args ...any) error {
 	return AsPDError(fmt.Errorf(format, args...))
 }
 
+// FieldViolation describes why a single input field is invalid.
+type FieldViolation struct {
+	Field       string
+	Description string
+}
+
+func badRequestDetails(violations []FieldViolation) *errdetails.BadRequest {
+	rv := &errdetails.BadRequest{}
+	for _, v := range violations {
+		rv.FieldViolations = append(rv.FieldViolations, &errdetails.BadRequest_FieldViolation{
+			Field:       v.Field,
+			Description: v.Description,
+		})
+	}
+	return rv
+}
+
 func BadInput(message string, inputName string, inputValue string) error {
-	return Error(codes.InvalidArgument, fmt.Sprintf("bad input: %s, invalid value for %q was %q", message, inputName, inputValue))
+	return ErrorWithDetails(
+		codes.InvalidArgument,
+		fmt.Sprintf("bad input: %s, invalid value for %q was %q", message, inputName, inputValue),
+		badRequestDetails([]FieldViolation{{Field: inputName, Description: message}}),
+	)
+}
+
+// InvalidFields is like BadInput, but reports any number of violations and does not
+// echo the offending values, so that it is also suitable for e.g. passwords.
+func InvalidFields(message string, violations ...FieldViolation) error {
+	descriptions := make([]string, len(violations))
+	for i, v := range violations {
+		descriptions[i] = v.Description
+	}
+
+	return ErrorWithDetails(
+		codes.InvalidArgument,
+		fmt.Sprintf("bad input: %s: %s", message, strings.Join(descriptions, "; ")),
+		badRequestDetails(violations),
+	)
 }
 
 func MissingRequiredFlag(flagName string) error {
@@ -140,6 +249,7 @@ func WrapAs(code codes.Code, messagePrefix string, err error) error {
 		code:       code,
 		message:    fmt.Sprintf("%s: %s", messagePrefix, err.Error()),
 		wrappedErr: err,
+		details:    detailsOf(err),
 	}
 }
 
@@ -0,0 +1,198 @@
+package pdgateway
+
+import (
+	"encoding/json"
+
+	"github.com/steinarvk/playdough/pkg/pderr"
+	statuspb "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+type schema = map[string]any
+
+// Well-known types have special JSON mappings rather than the generic one.
+var wellKnownSchemas = map[protoreflect.FullName]schema{
+	(&timestamppb.Timestamp{}).ProtoReflect().Descriptor().FullName(): {"type": "string", "format": "date-time"},
+	(&durationpb.Duration{}).ProtoReflect().Descriptor().FullName():   {"type": "string", "pattern": `^-?[0-9]+(\.[0-9]+)?s$`},
+	(&fieldmaskpb.FieldMask{}).ProtoReflect().Descriptor().FullName(): {"type": "string"},
+	(&emptypb.Empty{}).ProtoReflect().Descriptor().FullName():         {"type": "object"},
+	(&structpb.Struct{}).ProtoReflect().Descriptor().FullName():       {"type": "object", "additionalProperties": true},
+	(&structpb.Value{}).ProtoReflect().Descriptor().FullName():        {},
+	(&anypb.Any{}).ProtoReflect().Descriptor().FullName(): {
+		"type":                 "object",
+		"properties":           schema{"@type": schema{"type": "string"}},
+		"additionalProperties": true,
+	},
+}
+
+func schemaRef(name protoreflect.FullName) schema {
+	return schema{"$ref": "#/components/schemas/" + string(name)}
+}
+
+// schemaBuilder collects the schemas of messages and enums, following references.
+type schemaBuilder struct {
+	schemas schema
+}
+
+func (b *schemaBuilder) scalarSchema(field protoreflect.FieldDescriptor) schema {
+	switch field.Kind() {
+	case protoreflect.BoolKind:
+		return schema{"type": "boolean"}
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind:
+		return schema{"type": "integer", "format": "int32"}
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind:
+		return schema{"type": "integer", "format": "int64", "minimum": 0}
+	// The JSON mapping encodes 64-bit integers as strings, since they cannot be
+	// represented exactly as JavaScript numbers.
+	case protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+		return schema{"type": "string", "format": "int64"}
+	case protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		return schema{"type": "string", "format": "uint64"}
+	case protoreflect.FloatKind:
+		return schema{"type": "number", "format": "float"}
+	case protoreflect.DoubleKind:
+		return schema{"type": "number", "format": "double"}
+	case protoreflect.StringKind:
+		return schema{"type": "string"}
+	case protoreflect.BytesKind:
+		return schema{"type": "string", "format": "byte"}
+	case protoreflect.EnumKind:
+		return b.enumSchema(field.Enum())
+	default:
+		return b.messageSchema(field.Message())
+	}
+}
+
+func (b *schemaBuilder) fieldSchema(field protoreflect.FieldDescriptor) schema {
+	switch {
+	case field.IsMap():
+		return schema{"type": "object", "additionalProperties": b.scalarSchema(field.MapValue())}
+	case field.IsList():
+		return schema{"type": "array", "items": b.scalarSchema(field)}
+	default:
+		return b.scalarSchema(field)
+	}
+}
+
+func (b *schemaBuilder) enumSchema(enum protoreflect.EnumDescriptor) schema {
+	name := enum.FullName()
+
+	if _, ok := b.schemas[string(name)]; !ok {
+		var values []string
+		for i := 0; i < enum.Values().Len(); i++ {
+			values = append(values, string(enum.Values().Get(i).Name()))
+		}
+		b.schemas[string(name)] = schema{"type": "string", "enum": values}
+	}
+
+	return schemaRef(name)
+}
+
+func (b *schemaBuilder) messageSchema(message protoreflect.MessageDescriptor) schema {
+	name := message.FullName()
+
+	if wellKnown, ok := wellKnownSchemas[name]; ok {
+		return wellKnown
+	}
+
+	if _, ok := b.schemas[string(name)]; ok {
+		return schemaRef(name)
+	}
+
+	properties := schema{}
+	rv := schema{"type": "object", "properties": properties}
+	// Registered before the fields are visited, so that recursive messages terminate.
+	b.schemas[string(name)] = rv
+
+	for i := 0; i < message.Fields().Len(); i++ {
+		field := message.Fields().Get(i)
+		properties[field.JSONName()] = b.fieldSchema(field)
+	}
+
+	return schemaRef(name)
+}
+
+// OpenAPI returns an OpenAPI 3 document describing the JSON mapping of the
+// service's unary methods, served under pathPrefix.
+func OpenAPI(serviceDesc *grpc.ServiceDesc, pathPrefix string) ([]byte, error) {
+	desc, err := protoregistry.GlobalFiles.FindDescriptorByName(protoreflect.FullName(serviceDesc.ServiceName))
+	if err != nil {
+		return nil, pderr.Wrap("failed to find service descriptor", err)
+	}
+
+	service, ok := desc.(protoreflect.ServiceDescriptor)
+	if !ok {
+		return nil, pderr.Error(codes.Internal, "not a service: "+serviceDesc.ServiceName)
+	}
+
+	builder := &schemaBuilder{schemas: schema{}}
+	errorResponse := schema{
+		"description": "An error, as a google.rpc.Status.",
+		"content": schema{
+			"application/json": schema{"schema": builder.messageSchema((&statuspb.Status{}).ProtoReflect().Descriptor())},
+		},
+	}
+
+	paths := schema{}
+	for _, methodDesc := range serviceDesc.Methods {
+		method := service.Methods().ByName(protoreflect.Name(methodDesc.MethodName))
+		if method == nil {
+			return nil, pderr.Error(codes.Internal, "no descriptor for method "+methodDesc.MethodName)
+		}
+
+		paths[pathPrefix+methodDesc.MethodName] = schema{
+			"post": schema{
+				"operationId": methodDesc.MethodName,
+				"requestBody": schema{
+					"required": true,
+					"content": schema{
+						"application/json": schema{"schema": builder.messageSchema(method.Input())},
+					},
+				},
+				"responses": schema{
+					"200": schema{
+						"description": "OK",
+						"content": schema{
+							"application/json": schema{"schema": builder.messageSchema(method.Output())},
+						},
+					},
+					"default": errorResponse,
+				},
+			},
+		}
+	}
+
+	doc := schema{
+		"openapi": "3.0.3",
+		"info": schema{
+			"title":   serviceDesc.ServiceName,
+			"version": "v1",
+		},
+		"paths": paths,
+		"components": schema{
+			"schemas": builder.schemas,
+			"securitySchemes": schema{
+				"bearer": schema{"type": "http", "scheme": "bearer"},
+			},
+		},
+		// Authentication is optional at this level; methods that require it fail
+		// with 401 without it.
+		"security": []schema{{}, {"bearer": []string{}}},
+	}
+
+	rv, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return nil, pderr.Wrap("failed to marshal OpenAPI document", err)
+	}
+
+	return rv, nil
+}
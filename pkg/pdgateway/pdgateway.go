@@ -0,0 +1,251 @@
+// Package pdgateway serves a gRPC service as JSON over HTTP, for clients that
+// cannot speak gRPC. Each unary method is served at POST /v1/<Method>, taking and
+// returning the protobuf JSON mapping of its request and response messages.
+//
+// Requests are dispatched in-process to the service's method handlers through the
+// same interceptor as gRPC requests, so authentication, authorization and logging
+// behave identically on both.
+package pdgateway
+
+import (
+	"context"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+
+	"github.com/steinarvk/playdough/pkg/pderr"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	methodPathPrefix = "/v1/"
+	openAPIPath      = "/openapi.json"
+
+	// The same as gRPC's default maximum received message size.
+	maxRequestBodySize = 4 << 20
+
+	// HTTP headers with this prefix are passed to and from the service as gRPC
+	// metadata, as with grpc-gateway. Values of binary (-bin) keys are base64.
+	metadataHeaderPrefix = "Grpc-Metadata-"
+)
+
+// Headers passed to the service as gRPC metadata under their own names.
+var forwardedHeaders = []string{"authorization", "traceparent"}
+
+var marshalOptions = protojson.MarshalOptions{
+	EmitUnpopulated: true,
+}
+
+type Gateway struct {
+	serviceName string
+	impl        any
+	interceptor grpc.UnaryServerInterceptor
+	methods     map[string]grpc.MethodDesc
+	openAPI     []byte
+}
+
+// New returns a gateway for the service implementation impl, described by
+// serviceDesc. The interceptor, if not nil, is applied to every request.
+func New(serviceDesc *grpc.ServiceDesc, impl any, interceptor grpc.UnaryServerInterceptor) (*Gateway, error) {
+	openAPI, err := OpenAPI(serviceDesc, methodPathPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	rv := &Gateway{
+		serviceName: serviceDesc.ServiceName,
+		impl:        impl,
+		interceptor: interceptor,
+		methods:     map[string]grpc.MethodDesc{},
+		openAPI:     openAPI,
+	}
+
+	for _, method := range serviceDesc.Methods {
+		rv.methods[method.MethodName] = method
+	}
+
+	return rv, nil
+}
+
+func writeJSON(w http.ResponseWriter, httpStatus int, msg proto.Message) {
+	data, err := marshalOptions.Marshal(msg)
+	if err != nil {
+		httpStatus = http.StatusInternalServerError
+		data = []byte(`{"code":13,"message":"failed to marshal response"}`)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(httpStatus)
+	w.Write(data)
+}
+
+// writeError writes the error as a google.rpc.Status, details included.
+func writeError(w http.ResponseWriter, err error) {
+	st := status.Convert(err)
+
+	if st.Code() == codes.Unauthenticated {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+	}
+
+	writeJSON(w, pderr.HTTPStatus(st.Code()), st.Proto())
+}
+
+// incomingMetadata translates HTTP request headers into gRPC metadata.
+func incomingMetadata(header http.Header) (metadata.MD, error) {
+	md := metadata.MD{}
+
+	for _, key := range forwardedHeaders {
+		if value := header.Get(key); value != "" {
+			md.Append(key, value)
+		}
+	}
+
+	for name, values := range header {
+		key, ok := strings.CutPrefix(name, metadataHeaderPrefix)
+		if !ok {
+			continue
+		}
+		key = strings.ToLower(key)
+
+		for _, value := range values {
+			if strings.HasSuffix(key, "-bin") {
+				decoded, err := base64.StdEncoding.DecodeString(value)
+				if err != nil {
+					return nil, pderr.BadInput("malformed base64 in binary metadata header", name, value)
+				}
+				value = string(decoded)
+			}
+			md.Append(key, value)
+		}
+	}
+
+	return md, nil
+}
+
+// writeMetadataHeaders translates gRPC metadata set by the service into HTTP response headers.
+func writeMetadataHeaders(w http.ResponseWriter, md metadata.MD) {
+	for key, values := range md {
+		for _, value := range values {
+			if strings.HasSuffix(key, "-bin") {
+				value = base64.StdEncoding.EncodeToString([]byte(value))
+			}
+			w.Header().Add(metadataHeaderPrefix+key, value)
+		}
+	}
+}
+
+// serverTransportStream collects the metadata that handlers and interceptors set
+// with grpc.SetHeader and friends, which would otherwise fail outside of gRPC.
+type serverTransportStream struct {
+	method string
+
+	mu     sync.Mutex
+	header metadata.MD
+}
+
+func (s *serverTransportStream) Method() string {
+	return s.method
+}
+
+func (s *serverTransportStream) SetHeader(md metadata.MD) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.header = metadata.Join(s.header, md)
+	return nil
+}
+
+func (s *serverTransportStream) SendHeader(md metadata.MD) error {
+	return s.SetHeader(md)
+}
+
+// SetTrailer merges trailers into the headers, as HTTP responses are not streamed.
+func (s *serverTransportStream) SetTrailer(md metadata.MD) error {
+	return s.SetHeader(md)
+}
+
+// incomingContext makes the context look like that of a gRPC request from the
+// same client with the same metadata.
+func incomingContext(r *http.Request, md metadata.MD, stream *serverTransportStream) context.Context {
+	ctx := metadata.NewIncomingContext(r.Context(), md)
+	ctx = grpc.NewContextWithServerTransportStream(ctx, stream)
+
+	if addrPort, err := netip.ParseAddrPort(r.RemoteAddr); err == nil {
+		ctx = peer.NewContext(ctx, &peer.Peer{Addr: net.TCPAddrFromAddrPort(addrPort)})
+	}
+
+	return ctx
+}
+
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == openAPIPath {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(g.openAPI)
+		return
+	}
+
+	method, ok := g.methods[strings.TrimPrefix(r.URL.Path, methodPathPrefix)]
+	if !ok || !strings.HasPrefix(r.URL.Path, methodPathPrefix) {
+		writeError(w, pderr.Error(codes.NotFound, "no such method"))
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		writeJSON(w, http.StatusMethodNotAllowed, status.New(codes.InvalidArgument, "method not allowed; use POST").Proto())
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestBodySize))
+	if err != nil {
+		writeError(w, pderr.WrapAs(codes.InvalidArgument, "failed to read request body", err))
+		return
+	}
+
+	decode := func(req any) error {
+		if len(body) == 0 {
+			return nil
+		}
+		if err := protojson.Unmarshal(body, req.(proto.Message)); err != nil {
+			return pderr.WrapAs(codes.InvalidArgument, "malformed JSON request", err)
+		}
+		return nil
+	}
+
+	md, err := incomingMetadata(r.Header)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	stream := &serverTransportStream{method: "/" + g.serviceName + "/" + method.MethodName}
+
+	resp, err := method.Handler(g.impl, incomingContext(r, md, stream), decode, g.interceptor)
+
+	stream.mu.Lock()
+	writeMetadataHeaders(w, stream.header)
+	stream.mu.Unlock()
+
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, resp.(proto.Message))
+}
@@ -0,0 +1,187 @@
+package pdgateway
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/steinarvk/playdough/pkg/pderr"
+	"github.com/steinarvk/playdough/pkg/pdpeer"
+	"github.com/steinarvk/playdough/proto/pdpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+)
+
+type fakeService struct {
+	pdpb.UnimplementedPlaydoughServiceServer
+}
+
+func (fakeService) Ping(ctx context.Context, req *pdpb.PingRequest) (*pdpb.PingResponse, error) {
+	return &pdpb.PingResponse{EchoResponse: req.Echo}, nil
+}
+
+func (fakeService) GetUser(ctx context.Context, req *pdpb.GetUserRequest) (*pdpb.GetUserResponse, error) {
+	return nil, pderr.BadInput("no such user", "username", req.GetUsername())
+}
+
+func newTestServer(t *testing.T) (*httptest.Server, *[]string) {
+	t.Helper()
+
+	var seen []string
+	interceptor := func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		md, _ := metadata.FromIncomingContext(ctx)
+		seen = append(seen, info.FullMethod+" "+strings.Join(md["authorization"], ",")+" "+pdpeer.ClientIP(ctx))
+		if echo := md.Get("echo-bin"); len(echo) > 0 {
+			if err := grpc.SetHeader(ctx, metadata.Pairs("echo-bin", echo[0]+"!")); err != nil {
+				return nil, err
+			}
+		}
+		return handler(ctx, req)
+	}
+
+	gateway, err := New(&pdpb.PlaydoughService_ServiceDesc, fakeService{}, interceptor)
+	if err != nil {
+		t.Fatalf("New() failed: %v", err)
+	}
+
+	server := httptest.NewServer(gateway)
+	t.Cleanup(server.Close)
+
+	return server, &seen
+}
+
+func post(t *testing.T, url, authHeader, body string) (int, map[string]any) {
+	t.Helper()
+
+	req, err := http.NewRequest(http.MethodPost, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if authHeader != "" {
+		req.Header.Set("Authorization", authHeader)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var rv map[string]any
+	if err := json.Unmarshal(data, &rv); err != nil {
+		t.Fatalf("response is not a JSON object: %q", data)
+	}
+
+	return resp.StatusCode, rv
+}
+
+func TestGatewayCallsMethodsThroughInterceptor(t *testing.T) {
+	server, seen := newTestServer(t)
+
+	status, body := post(t, server.URL+"/v1/Ping", "Bearer xyz", `{"echo": "hello"}`)
+	if status != http.StatusOK || body["echoResponse"] != "hello" {
+		t.Errorf("Ping = %d %v, want 200 with echoResponse hello", status, body)
+	}
+
+	want := pdpb.PlaydoughService_Ping_FullMethodName + " Bearer xyz 127.0.0.1"
+	if len(*seen) != 1 || (*seen)[0] != want {
+		t.Errorf("interceptor saw %q, want [%q]", *seen, want)
+	}
+}
+
+func TestGatewayTranslatesErrors(t *testing.T) {
+	server, _ := newTestServer(t)
+
+	for _, tc := range []struct {
+		name       string
+		path       string
+		body       string
+		wantStatus int
+		wantCode   codes.Code
+	}{
+		{"error from handler", "/v1/GetUser", `{"username": "nobody"}`, http.StatusBadRequest, codes.InvalidArgument},
+		{"unimplemented method", "/v1/Login", `{}`, http.StatusNotImplemented, codes.Unimplemented},
+		{"unknown method", "/v1/NoSuchMethod", `{}`, http.StatusNotFound, codes.NotFound},
+		{"malformed JSON", "/v1/Ping", `{"echo": `, http.StatusBadRequest, codes.InvalidArgument},
+		{"unknown field", "/v1/Ping", `{"nonsense": 1}`, http.StatusBadRequest, codes.InvalidArgument},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			status, body := post(t, server.URL+tc.path, "", tc.body)
+			if status != tc.wantStatus {
+				t.Errorf("status = %d, want %d (body %v)", status, tc.wantStatus, body)
+			}
+			if code, _ := body["code"].(float64); codes.Code(code) != tc.wantCode {
+				t.Errorf("code = %v, want %v (body %v)", body["code"], tc.wantCode, body)
+			}
+		})
+	}
+
+	_, body := post(t, server.URL+"/v1/GetUser", "", `{"username": "nobody"}`)
+	if details, _ := body["details"].([]any); len(details) != 1 {
+		t.Errorf("error details were not passed through: %v", body)
+	}
+}
+
+func TestOpenAPIDocument(t *testing.T) {
+	server, _ := newTestServer(t)
+
+	resp, err := http.Get(server.URL + "/openapi.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var doc struct {
+		Paths      map[string]any `json:"paths"`
+		Components struct {
+			Schemas map[string]any `json:"schemas"`
+		} `json:"components"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		t.Fatalf("failed to decode OpenAPI document: %v", err)
+	}
+
+	for _, method := range pdpb.PlaydoughService_ServiceDesc.Methods {
+		if _, ok := doc.Paths["/v1/"+method.MethodName]; !ok {
+			t.Errorf("OpenAPI document has no path for %s", method.MethodName)
+		}
+	}
+
+	for _, name := range []string{"playdoughpb.PingRequest", "google.rpc.Status"} {
+		if _, ok := doc.Components.Schemas[name]; !ok {
+			t.Errorf("OpenAPI document has no schema for %s", name)
+		}
+	}
+}
+
+func TestGatewayPassesBinaryMetadata(t *testing.T) {
+	server, _ := newTestServer(t)
+
+	req, err := http.NewRequest(http.MethodPost, server.URL+"/v1/Ping", strings.NewReader(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Grpc-Metadata-Echo-Bin", base64.StdEncoding.EncodeToString([]byte("\x00hi")))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	got, err := base64.StdEncoding.DecodeString(resp.Header.Get("Grpc-Metadata-Echo-Bin"))
+	if err != nil || string(got) != "\x00hi!" {
+		t.Errorf("response metadata header = %q (%v), want base64 of %q", resp.Header.Get("Grpc-Metadata-Echo-Bin"), err, "\x00hi!")
+	}
+}
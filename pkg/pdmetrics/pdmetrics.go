@@ -0,0 +1,271 @@
+// Package pdmetrics implements the small subset of Prometheus metrics that the
+// server needs: labelled counters and histograms, and gauges and counters whose
+// values are read from elsewhere when scraped. Registries are served in the
+// Prometheus text exposition format.
+package pdmetrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are latency buckets in seconds, the same as Prometheus' defaults.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type metric interface {
+	write(w io.Writer)
+}
+
+type Registry struct {
+	mu      sync.Mutex
+	metrics []metric
+	names   map[string]bool
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		names: map[string]bool{},
+	}
+}
+
+func (r *Registry) register(name string, m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.names[name] {
+		panic("duplicate metric name: " + name)
+	}
+	r.names[name] = true
+	r.metrics = append(r.metrics, m)
+}
+
+// Write writes all metrics in the Prometheus text exposition format.
+func (r *Registry) Write(w io.Writer) {
+	r.mu.Lock()
+	metrics := append([]metric(nil), r.metrics...)
+	r.mu.Unlock()
+
+	for _, m := range metrics {
+		m.write(w)
+	}
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.Write(w)
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(names, values []string, extra ...string) string {
+	var parts []string
+	for i, name := range names {
+		parts = append(parts, name+`="`+labelValueEscaper.Replace(values[i])+`"`)
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		parts = append(parts, extra[i]+`="`+labelValueEscaper.Replace(extra[i+1])+`"`)
+	}
+
+	if len(parts) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
+
+func writeHeader(w io.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, strings.ReplaceAll(help, "\n", " "), name, kind)
+}
+
+// series is the state of one combination of label values.
+type series[T any] struct {
+	labelValues []string
+	state       T
+}
+
+// vec holds the series of a labelled metric, keyed by their label values.
+type vec[T any] struct {
+	name       string
+	help       string
+	labelNames []string
+
+	mu     sync.Mutex
+	series map[string]*series[T]
+}
+
+func newVec[T any](name, help string, labelNames []string) vec[T] {
+	return vec[T]{
+		name:       name,
+		help:       help,
+		labelNames: labelNames,
+		series:     map[string]*series[T]{},
+	}
+}
+
+// with returns the state for the label values, creating it with init if needed.
+// It must be called with the mutex held.
+func (v *vec[T]) with(labelValues []string, init func() T) *T {
+	if len(labelValues) != len(v.labelNames) {
+		panic(fmt.Sprintf("metric %s has %d labels, got %d values", v.name, len(v.labelNames), len(labelValues)))
+	}
+
+	key := strings.Join(labelValues, "\x00")
+	s, ok := v.series[key]
+	if !ok {
+		s = &series[T]{labelValues: append([]string(nil), labelValues...), state: init()}
+		v.series[key] = s
+	}
+	return &s.state
+}
+
+// sorted returns the series ordered by label values, so that output is stable.
+// It must be called with the mutex held.
+func (v *vec[T]) sorted() []*series[T] {
+	rv := make([]*series[T], 0, len(v.series))
+	for _, s := range v.series {
+		rv = append(rv, s)
+	}
+	sort.Slice(rv, func(i, j int) bool {
+		return strings.Join(rv[i].labelValues, "\x00") < strings.Join(rv[j].labelValues, "\x00")
+	})
+	return rv
+}
+
+type CounterVec struct {
+	vec[float64]
+}
+
+// NewCounter registers a counter with the given label names.
+func (r *Registry) NewCounter(name, help string, labelNames ...string) *CounterVec {
+	rv := &CounterVec{newVec[float64](name, help, labelNames)}
+	r.register(name, rv)
+	return rv
+}
+
+// Add adds delta, which must not be negative, to the series with the label values.
+func (c *CounterVec) Add(delta float64, labelValues ...string) {
+	if delta < 0 {
+		panic("counter " + c.name + " cannot decrease")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	*c.with(labelValues, func() float64 { return 0 }) += delta
+}
+
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *CounterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	writeHeader(w, c.name, c.help, "counter")
+	for _, s := range c.sorted() {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labelNames, s.labelValues), formatValue(s.state))
+	}
+}
+
+type histogramState struct {
+	bucketCounts []uint64
+	sum          float64
+	count        uint64
+}
+
+type HistogramVec struct {
+	vec[histogramState]
+	buckets []float64
+}
+
+// NewHistogram registers a histogram with the given upper bucket bounds, which
+// must be sorted, and label names.
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labelNames ...string) *HistogramVec {
+	rv := &HistogramVec{
+		vec:     newVec[histogramState](name, help, labelNames),
+		buckets: buckets,
+	}
+	r.register(name, rv)
+	return rv
+}
+
+func (h *HistogramVec) Observe(value float64, labelValues ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	state := h.with(labelValues, func() histogramState {
+		return histogramState{bucketCounts: make([]uint64, len(h.buckets))}
+	})
+
+	for i, upperBound := range h.buckets {
+		if value <= upperBound {
+			state.bucketCounts[i]++
+		}
+	}
+	state.sum += value
+	state.count++
+}
+
+func (h *HistogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	writeHeader(w, h.name, h.help, "histogram")
+	for _, s := range h.sorted() {
+		for i, upperBound := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labelNames, s.labelValues, "le", formatValue(upperBound)), s.state.bucketCounts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labelNames, s.labelValues, "le", "+Inf"), s.state.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labelNames, s.labelValues), formatValue(s.state.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labelNames, s.labelValues), s.state.count)
+	}
+}
+
+// EmitFunc reports the value of one series of a func metric.
+type EmitFunc func(value float64, labelValues ...string)
+
+type funcMetric struct {
+	name       string
+	help       string
+	kind       string
+	labelNames []string
+	collect    func(emit EmitFunc)
+}
+
+// NewGaugeFunc registers a gauge whose series are reported by collect on every scrape.
+func (r *Registry) NewGaugeFunc(name, help string, collect func(emit EmitFunc), labelNames ...string) {
+	r.register(name, &funcMetric{name: name, help: help, kind: "gauge", labelNames: labelNames, collect: collect})
+}
+
+// NewCounterFunc is like NewGaugeFunc, but for values that are maintained as
+// monotonic counters elsewhere.
+func (r *Registry) NewCounterFunc(name, help string, collect func(emit EmitFunc), labelNames ...string) {
+	r.register(name, &funcMetric{name: name, help: help, kind: "counter", labelNames: labelNames, collect: collect})
+}
+
+func (f *funcMetric) write(w io.Writer) {
+	writeHeader(w, f.name, f.help, f.kind)
+	f.collect(func(value float64, labelValues ...string) {
+		if len(labelValues) != len(f.labelNames) {
+			panic(fmt.Sprintf("metric %s has %d labels, got %d values", f.name, len(f.labelNames), len(labelValues)))
+		}
+		fmt.Fprintf(w, "%s%s %s\n", f.name, formatLabels(f.labelNames, labelValues), formatValue(value))
+	})
+}
@@ -0,0 +1,61 @@
+package pdmetrics
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestExpositionFormat(t *testing.T) {
+	registry := NewRegistry()
+
+	requests := registry.NewCounter("requests_total", "Requests handled.", "method", "code")
+	requests.Inc("/a.B/C", "OK")
+	requests.Inc("/a.B/C", "OK")
+	requests.Add(3, "/a.B/C", "NotFound")
+
+	latency := registry.NewHistogram("latency_seconds", "Request latency.", []float64{0.1, 1}, "method")
+	latency.Observe(0.05, "/a.B/C")
+	latency.Observe(0.5, "/a.B/C")
+	latency.Observe(5, "/a.B/C")
+
+	registry.NewGaugeFunc("connections", "Open connections.", func(emit EmitFunc) {
+		emit(2, "in_use")
+		emit(1, `quoted "idle"`)
+	}, "state")
+
+	var got strings.Builder
+	registry.Write(&got)
+
+	want := `# HELP requests_total Requests handled.
+# TYPE requests_total counter
+requests_total{method="/a.B/C",code="NotFound"} 3
+requests_total{method="/a.B/C",code="OK"} 2
+# HELP latency_seconds Request latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{method="/a.B/C",le="0.1"} 1
+latency_seconds_bucket{method="/a.B/C",le="1"} 2
+latency_seconds_bucket{method="/a.B/C",le="+Inf"} 3
+latency_seconds_sum{method="/a.B/C"} 5.55
+latency_seconds_count{method="/a.B/C"} 3
+# HELP connections Open connections.
+# TYPE connections gauge
+connections{state="in_use"} 2
+connections{state="quoted \"idle\""} 1
+`
+
+	if got.String() != want {
+		t.Errorf("exposition mismatch:\ngot:\n%s\nwant:\n%s", got.String(), want)
+	}
+}
+
+func TestDuplicateNamesPanic(t *testing.T) {
+	registry := NewRegistry()
+	registry.NewCounter("x_total", "x")
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("registering a duplicate metric name did not panic")
+		}
+	}()
+	registry.NewCounter("x_total", "x again")
+}
@@ -0,0 +1,27 @@
+package pdpeer
+
+import (
+	"context"
+	"net"
+
+	"google.golang.org/grpc/peer"
+)
+
+// ClientIP returns the IP address of the gRPC peer, or "" if it is unknown.
+func ClientIP(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return ""
+	}
+
+	switch addr := p.Addr.(type) {
+	case *net.TCPAddr:
+		return addr.IP.String()
+	default:
+		host, _, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			return ""
+		}
+		return host
+	}
+}
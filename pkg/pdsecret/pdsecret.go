@@ -0,0 +1,54 @@
+// Package pdsecret formats and checks the secret tokens handed out to users, such
+// as API keys, password reset tokens and invite codes.
+//
+// Tokens have the form <prefix>_<uuid>_<secret>. The prefix tells the kinds of
+// token apart, and the UUID identifies the database row, which stores only a hash
+// of the secret.
+package pdsecret
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// Hash returns the hash of a secret to store in place of the secret itself.
+func Hash(secret []byte) []byte {
+	digest := sha256.Sum256(secret)
+	return digest[:]
+}
+
+// Matches reports whether secret hashes to secretHash, in constant time.
+func Matches(secret, secretHash []byte) bool {
+	return subtle.ConstantTimeCompare(Hash(secret), secretHash) == 1
+}
+
+// Format returns the token with the given prefix, UUID and secret.
+func Format(prefix string, id uuid.UUID, secret []byte) string {
+	return fmt.Sprintf("%s_%s_%s", prefix, id.String(), base64.RawURLEncoding.EncodeToString(secret))
+}
+
+// Parse splits a token into its UUID and secret. It returns false if the token
+// is malformed or has a different prefix.
+func Parse(prefix, token string) (uuid.UUID, []byte, bool) {
+	components := strings.SplitN(token, "_", 3)
+	if len(components) != 3 || components[0] != prefix {
+		return uuid.Nil, nil, false
+	}
+
+	id, err := uuid.Parse(components[1])
+	if err != nil {
+		return uuid.Nil, nil, false
+	}
+
+	secret, err := base64.RawURLEncoding.DecodeString(components[2])
+	if err != nil {
+		return uuid.Nil, nil, false
+	}
+
+	return id, secret, true
+}
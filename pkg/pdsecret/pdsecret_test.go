@@ -0,0 +1,43 @@
+package pdsecret
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestFormatRoundTrip(t *testing.T) {
+	id := uuid.New()
+	secret := []byte{0xfb, 0xff, 0x00, 0x5f, 0x3e, 0x3f}
+
+	token := Format("pdk", id, secret)
+
+	gotID, gotSecret, ok := Parse("pdk", token)
+	if !ok {
+		t.Fatalf("Parse(%q) failed", token)
+	}
+	if gotID != id {
+		t.Errorf("Parse(%q) UUID = %v, want %v", token, gotID, id)
+	}
+	if !bytes.Equal(gotSecret, secret) {
+		t.Errorf("Parse(%q) secret = %x, want %x", token, gotSecret, secret)
+	}
+	if !Matches(gotSecret, Hash(secret)) {
+		t.Errorf("parsed secret does not match the hash of the original")
+	}
+}
+
+func TestParseRejectsMalformed(t *testing.T) {
+	for _, token := range []string{
+		"",
+		"pdk",
+		"pdk_not-a-uuid_c2VjcmV0",
+		"xyz_" + uuid.NewString() + "_c2VjcmV0",
+		"pdk_" + uuid.NewString() + "_!!!",
+	} {
+		if _, _, ok := Parse("pdk", token); ok {
+			t.Errorf("Parse(%q) succeeded, want failure", token)
+		}
+	}
+}
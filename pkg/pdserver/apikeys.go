@@ -0,0 +1,170 @@
+package pdserver
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/steinarvk/playdough/pkg/pdauth"
+	"github.com/steinarvk/playdough/pkg/pderr"
+	"github.com/steinarvk/playdough/proto/pdpb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func apiKeyInfoToProto(info *pdauth.APIKeyInfo) *pdpb.ApiKeyInfo {
+	scopes := make([]string, len(info.Scopes))
+	for i, scope := range info.Scopes {
+		scopes[i] = string(scope)
+	}
+
+	return &pdpb.ApiKeyInfo{
+		ApiKeyUuid:     info.KeyUUID.String(),
+		Name:           info.Name,
+		Scopes:         scopes,
+		CreationTime:   timestamppb.New(info.CreationTime),
+		ExpirationTime: timestamppb.New(info.ExpirationTime),
+		Revoked:        info.Revoked,
+	}
+}
+
+// requestedValidity returns the validity requested in seconds, or the default if
+// none was given, and reports whether it is positive and at most the maximum.
+// The bound is checked before converting, so that huge requests cannot overflow.
+func requestedValidity(seconds int64, defaultDuration, maxDuration time.Duration) (time.Duration, bool) {
+	if seconds == 0 {
+		return defaultDuration, defaultDuration > 0 && defaultDuration <= maxDuration
+	}
+	if seconds < 0 || seconds > int64(maxDuration/time.Second) {
+		return 0, false
+	}
+	return time.Duration(seconds) * time.Second, true
+}
+
+// requireSessionAuth returns the caller's auth info, rejecting anonymous callers
+// and callers using API keys, which may not be used for account management.
+// The action describes what was attempted, for the error message.
+func requireSessionAuth(ctx context.Context, action string) (pdauth.AuthInfo, error) {
+	authInfo, err := pdauth.AuthenticatedFromContext(ctx)
+	if err != nil {
+		return authInfo, err
+	}
+	if authInfo.IsAPIKey() {
+		return authInfo, pderr.Error(codes.PermissionDenied, "API keys cannot be used to "+action)
+	}
+	return authInfo, nil
+}
+
+func (s *server) CreateApiKey(ctx context.Context, req *pdpb.CreateApiKeyRequest) (*pdpb.CreateApiKeyResponse, error) {
+	authInfo, err := requireSessionAuth(ctx, "manage API keys")
+	if err != nil {
+		return nil, err
+	}
+
+	var scopes []pdauth.Scope
+	for _, scopeString := range req.Scopes {
+		scope, err := pdauth.ParseScope(scopeString)
+		if err != nil {
+			return nil, err
+		}
+		if !slices.Contains(scopes, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+
+	validDuration, ok := requestedValidity(req.ValidDurationSeconds, s.tokenLifetimes.DefaultAPIKey, s.tokenLifetimes.MaxAPIKey)
+	if !ok {
+		return nil, pderr.BadInput(fmt.Sprintf("API key validity must be positive and at most %v", s.tokenLifetimes.MaxAPIKey), "valid_duration_seconds", fmt.Sprint(req.ValidDurationSeconds))
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, pderr.Unexpectedf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	// Sessions without a verified second factor do not get issuer rights, and
+	// must not be able to mint keys that carry them.
+	if !authInfo.SecondFactorVerified {
+		isIssuer, err := s.auth.UserHasRole(ctx, tx, authInfo.AuthenticatedUsername, pdauth.RoleIssuer)
+		if err != nil {
+			return nil, err
+		}
+		if isIssuer {
+			return nil, pderr.Error(codes.PermissionDenied, "issuers must verify a second factor before creating API keys")
+		}
+	}
+
+	apiKey, info, err := s.auth.CreateAPIKey(ctx, tx, authInfo.AuthenticatedUsername, req.Name, scopes, validDuration)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, pderr.Unexpectedf("failed to commit transaction: %v", err)
+	}
+
+	return &pdpb.CreateApiKeyResponse{
+		ApiKey: apiKey,
+		Info:   apiKeyInfoToProto(info),
+	}, nil
+}
+
+func (s *server) ListApiKeys(ctx context.Context, req *pdpb.ListApiKeysRequest) (*pdpb.ListApiKeysResponse, error) {
+	authInfo, err := requireSessionAuth(ctx, "manage API keys")
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, pderr.Unexpectedf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	infos, err := s.auth.ListAPIKeys(ctx, tx, authInfo.AuthenticatedUsername)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, pderr.Unexpectedf("failed to commit transaction: %v", err)
+	}
+
+	rv := &pdpb.ListApiKeysResponse{}
+	for _, info := range infos {
+		rv.ApiKeys = append(rv.ApiKeys, apiKeyInfoToProto(info))
+	}
+
+	return rv, nil
+}
+
+func (s *server) RevokeApiKey(ctx context.Context, req *pdpb.RevokeApiKeyRequest) (*pdpb.RevokeApiKeyResponse, error) {
+	authInfo, err := requireSessionAuth(ctx, "manage API keys")
+	if err != nil {
+		return nil, err
+	}
+
+	keyUUID, err := uuid.Parse(req.ApiKeyUuid)
+	if err != nil {
+		return nil, pderr.BadInput("invalid API key UUID", "api_key_uuid", req.ApiKeyUuid)
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, pderr.Unexpectedf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	if err := s.auth.RevokeAPIKey(ctx, tx, authInfo.AuthenticatedUsername, keyUUID); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, pderr.Unexpectedf("failed to commit transaction: %v", err)
+	}
+
+	return &pdpb.RevokeApiKeyResponse{}, nil
+}
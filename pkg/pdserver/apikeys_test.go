@@ -0,0 +1,31 @@
+package pdserver
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestRequestedValidity(t *testing.T) {
+	const defaultDuration, maxDuration = time.Hour, 24 * time.Hour
+
+	for _, tc := range []struct {
+		seconds int64
+		want    time.Duration
+		wantOK  bool
+	}{
+		{0, defaultDuration, true},
+		{60, time.Minute, true},
+		{86400, maxDuration, true},
+		{86401, 0, false},
+		{-1, 0, false},
+		{math.MaxInt64, 0, false},
+		{math.MaxInt64 / 1000, 0, false},
+		{math.MinInt64, 0, false},
+	} {
+		got, ok := requestedValidity(tc.seconds, defaultDuration, maxDuration)
+		if got != tc.want || ok != tc.wantOK {
+			t.Errorf("requestedValidity(%d) = %v, %v; want %v, %v", tc.seconds, got, ok, tc.want, tc.wantOK)
+		}
+	}
+}
@@ -2,15 +2,128 @@ package pdserver
 
 import (
 	"database/sql"
+	"fmt"
+	"time"
 
 	"github.com/steinarvk/playdough/pkg/pdauth"
+	"github.com/steinarvk/playdough/pkg/pddb/loginthrottle"
 	"github.com/steinarvk/playdough/pkg/pddb/userdb"
+	"github.com/steinarvk/playdough/pkg/pderr"
 	"github.com/steinarvk/playdough/proto/pdpb"
 )
 
 type Option func(*server) error
 
+// WithLoginThrottle shares a login throttle with the caller, e.g. so that it can run its cleanup.
+func WithLoginThrottle(throttle *loginthrottle.Throttle) Option {
+	return func(s *server) error {
+		s.loginThrottle = throttle
+		return nil
+	}
+}
+
+// WithAuthValidator shares an auth validator with the caller, so that tokens are
+// issued and validated with the same key cache.
+func WithAuthValidator(validator *pdauth.AuthValidator) Option {
+	return func(s *server) error {
+		s.auth = validator
+		return nil
+	}
+}
+
+// WithUserDBOptions configures the user database, e.g. its password hashing parameters.
+func WithUserDBOptions(options ...userdb.Option) Option {
+	return func(s *server) error {
+		s.userdbOptions = append(s.userdbOptions, options...)
+		return nil
+	}
+}
+
+// RegistrationMode controls who may create accounts with CreateAccount.
+type RegistrationMode string
+
+const (
+	// Anyone may register; an invite code is optional.
+	RegistrationOpen RegistrationMode = "open"
+	// Registration requires an invite code from an existing user.
+	RegistrationInviteOnly RegistrationMode = "invite-only"
+)
+
+func WithRegistrationMode(mode RegistrationMode) Option {
+	return func(s *server) error {
+		switch mode {
+		case RegistrationOpen, RegistrationInviteOnly:
+		default:
+			return pderr.BadInput("unknown registration mode (want open or invite-only)", "registration_mode", string(mode))
+		}
+		s.registrationMode = mode
+		return nil
+	}
+}
+
+// TokenLifetimes controls how long issued credentials remain valid. Clients may
+// ask for API keys and password reset tokens valid for up to the maximum.
+type TokenLifetimes struct {
+	Session              time.Duration
+	DefaultAPIKey        time.Duration
+	MaxAPIKey            time.Duration
+	DefaultPasswordReset time.Duration
+	MaxPasswordReset     time.Duration
+}
+
+func DefaultTokenLifetimes() TokenLifetimes {
+	return TokenLifetimes{
+		Session:              24 * time.Hour,
+		DefaultAPIKey:        90 * 24 * time.Hour,
+		MaxAPIKey:            366 * 24 * time.Hour,
+		DefaultPasswordReset: 24 * time.Hour,
+		MaxPasswordReset:     7 * 24 * time.Hour,
+	}
+}
+
+func (l TokenLifetimes) Validate() error {
+	var violations []pderr.FieldViolation
+
+	if l.Session <= 0 {
+		violations = append(violations, pderr.FieldViolation{Field: "session", Description: "session token lifetime must be positive"})
+	}
+	if l.DefaultAPIKey <= 0 || l.MaxAPIKey < l.DefaultAPIKey {
+		violations = append(violations, pderr.FieldViolation{Field: "max_api_key", Description: fmt.Sprintf("API key lifetimes must satisfy 0 < default <= max (got %v and %v)", l.DefaultAPIKey, l.MaxAPIKey)})
+	}
+	if l.DefaultPasswordReset <= 0 || l.MaxPasswordReset < l.DefaultPasswordReset {
+		violations = append(violations, pderr.FieldViolation{Field: "max_password_reset", Description: fmt.Sprintf("password reset token lifetimes must satisfy 0 < default <= max (got %v and %v)", l.DefaultPasswordReset, l.MaxPasswordReset)})
+	}
+
+	if len(violations) > 0 {
+		return pderr.InvalidFields("invalid token lifetimes", violations...)
+	}
+
+	return nil
+}
+
+func WithTokenLifetimes(lifetimes TokenLifetimes) Option {
+	return func(s *server) error {
+		if err := lifetimes.Validate(); err != nil {
+			return err
+		}
+		s.tokenLifetimes = lifetimes
+		return nil
+	}
+}
+
 func (s *server) finalize() error {
+	if s.tokenLifetimes == (TokenLifetimes{}) {
+		s.tokenLifetimes = DefaultTokenLifetimes()
+	}
+	if s.registrationMode == "" {
+		s.registrationMode = RegistrationOpen
+	}
+	if s.loginThrottle == nil {
+		s.loginThrottle = loginthrottle.New(s.db, loginthrottle.DefaultParams())
+	}
+	if s.auth == nil {
+		s.auth = pdauth.NewValidator(s.db)
+	}
 	return nil
 }
 
@@ -28,8 +141,12 @@ func New(db *sql.DB, options ...Option) (pdpb.PlaydoughServiceServer, error) {
 		return nil, err
 	}
 
-	rv.auth = pdauth.NewValidator(db)
-	rv.userdb = userdb.New(db)
+	users, err := userdb.New(db, rv.userdbOptions...)
+	if err != nil {
+		return nil, err
+	}
+
+	rv.userdb = users
 
 	return rv, nil
 }
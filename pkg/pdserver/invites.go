@@ -0,0 +1,123 @@
+package pdserver
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/steinarvk/playdough/pkg/logging"
+	"github.com/steinarvk/playdough/pkg/pddb/userdb"
+	"github.com/steinarvk/playdough/pkg/pderr"
+	"github.com/steinarvk/playdough/proto/pdpb"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	defaultInviteValidDuration = 7 * 24 * time.Hour
+	maxInviteValidDuration     = 30 * 24 * time.Hour
+	maxInviteUses              = 100
+)
+
+func inviteToProto(invite *userdb.Invite) *pdpb.InviteInfo {
+	return &pdpb.InviteInfo{
+		InviteUuid:        invite.InviteUUID.String(),
+		CreatedByUsername: invite.CreatedByUsername,
+		MaxUses:           int32(invite.MaxUses),
+		UseCount:          int32(invite.UseCount),
+		CreationTime:      timestamppb.New(invite.CreationTime),
+		ExpirationTime:    timestamppb.New(invite.ExpirationTime),
+		InvitedUsernames:  invite.InvitedUsernames,
+	}
+}
+
+func invitesToProto(invites []*userdb.Invite) []*pdpb.InviteInfo {
+	rv := make([]*pdpb.InviteInfo, len(invites))
+	for i, invite := range invites {
+		rv[i] = inviteToProto(invite)
+	}
+	return rv
+}
+
+func (s *server) CreateInvite(ctx context.Context, req *pdpb.CreateInviteRequest) (*pdpb.CreateInviteResponse, error) {
+	logger := logging.FromContext(ctx)
+
+	authInfo, err := requireSessionAuth(ctx, "create invites")
+	if err != nil {
+		return nil, err
+	}
+
+	maxUses := 1
+	if req.MaxUses != 0 {
+		maxUses = int(req.MaxUses)
+	}
+	if maxUses <= 0 || maxUses > maxInviteUses {
+		return nil, pderr.BadInput("invite use count must be between 1 and 100", "max_uses", fmt.Sprint(maxUses))
+	}
+
+	validDuration, ok := requestedValidity(req.ValidDurationSeconds, defaultInviteValidDuration, maxInviteValidDuration)
+	if !ok {
+		return nil, pderr.BadInput("invite validity must be positive and at most 30 days", "valid_duration_seconds", fmt.Sprint(req.ValidDurationSeconds))
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, pderr.Unexpectedf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	inviteCode, invite, err := s.userdb.CreateInvite(ctx, tx, authInfo.AuthenticatedUsername, maxUses, validDuration)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, pderr.Unexpectedf("failed to commit transaction: %v", err)
+	}
+
+	logger.Info("created invite", zap.Stringer("invite_uuid", invite.InviteUUID))
+
+	return &pdpb.CreateInviteResponse{
+		InviteCode: inviteCode,
+		Info:       inviteToProto(invite),
+	}, nil
+}
+
+func (s *server) ListInvites(ctx context.Context, req *pdpb.ListInvitesRequest) (*pdpb.ListInvitesResponse, error) {
+	authInfo, err := requireSessionAuth(ctx, "list invites")
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, pderr.Unexpectedf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	invites, err := s.userdb.ListInvites(ctx, tx, authInfo.AuthenticatedUsername)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pdpb.ListInvitesResponse{
+		Invites: invitesToProto(invites),
+	}, nil
+}
+
+func (s *server) AdminListInvites(ctx context.Context, req *pdpb.AdminListInvitesRequest) (*pdpb.AdminListInvitesResponse, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, pderr.Unexpectedf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	invites, err := s.userdb.ListInvites(ctx, tx, req.CreatedByUsername)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pdpb.AdminListInvitesResponse{
+		Invites: invitesToProto(invites),
+	}, nil
+}
@@ -0,0 +1,220 @@
+package pdserver
+
+import (
+	"context"
+	"database/sql"
+	"slices"
+
+	"github.com/steinarvk/playdough/pkg/logging"
+	"github.com/steinarvk/playdough/pkg/pdauth"
+	"github.com/steinarvk/playdough/pkg/pderr"
+	"github.com/steinarvk/playdough/pkg/pdusername"
+	"github.com/steinarvk/playdough/proto/pdpb"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+)
+
+// checkNotLastAdmin refuses to let the last active admin be deactivated or deleted.
+// Users that are not active admins, including deactivated ones, may always be removed.
+func (s *server) checkNotLastAdmin(ctx context.Context, tx *sql.Tx, username string) error {
+	activeAdmins, err := s.auth.LockActiveUsersWithRole(ctx, tx, pdauth.RoleAdmin)
+	if err != nil {
+		return err
+	}
+
+	if !slices.Contains(activeAdmins, pdusername.Canonical(username)) {
+		return nil
+	}
+	if len(activeAdmins) <= 1 {
+		return pderr.Error(codes.FailedPrecondition, "refusing to remove the last admin")
+	}
+
+	return nil
+}
+
+func (s *server) deactivateUser(ctx context.Context, tx *sql.Tx, username string) error {
+	if err := s.checkNotLastAdmin(ctx, tx, username); err != nil {
+		return err
+	}
+
+	if err := s.userdb.DeactivateUser(ctx, tx, username); err != nil {
+		return err
+	}
+
+	// Otherwise old sessions would become valid again on reactivation.
+	return s.auth.RevokeSessions(ctx, tx, username)
+}
+
+func (s *server) deleteUser(ctx context.Context, tx *sql.Tx, username string) (string, error) {
+	if err := s.checkNotLastAdmin(ctx, tx, username); err != nil {
+		return "", err
+	}
+
+	return s.userdb.DeleteUser(ctx, tx, username)
+}
+
+func (s *server) DeactivateAccount(ctx context.Context, req *pdpb.DeactivateAccountRequest) (*pdpb.DeactivateAccountResponse, error) {
+	authInfo, err := requireSessionAuth(ctx, "deactivate accounts")
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, pderr.Unexpectedf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	if err := s.verifyCurrentPassword(ctx, tx, authInfo.AuthenticatedUsername, req.CurrentPassword); err != nil {
+		return nil, err
+	}
+
+	if err := s.deactivateUser(ctx, tx, authInfo.AuthenticatedUsername); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, pderr.Unexpectedf("failed to commit transaction: %v", err)
+	}
+
+	return &pdpb.DeactivateAccountResponse{}, nil
+}
+
+func (s *server) DeleteAccount(ctx context.Context, req *pdpb.DeleteAccountRequest) (*pdpb.DeleteAccountResponse, error) {
+	authInfo, err := requireSessionAuth(ctx, "delete accounts")
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, pderr.Unexpectedf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	if err := s.verifyCurrentPassword(ctx, tx, authInfo.AuthenticatedUsername, req.CurrentPassword); err != nil {
+		return nil, err
+	}
+
+	if _, err := s.deleteUser(ctx, tx, authInfo.AuthenticatedUsername); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, pderr.Unexpectedf("failed to commit transaction: %v", err)
+	}
+
+	return &pdpb.DeleteAccountResponse{}, nil
+}
+
+func (s *server) ExportAccountData(ctx context.Context, req *pdpb.ExportAccountDataRequest) (*pdpb.ExportAccountDataResponse, error) {
+	authInfo, err := requireSessionAuth(ctx, "export account data")
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := s.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, pderr.Unexpectedf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	data, err := s.userdb.ExportUserDataJSON(ctx, tx, authInfo.AuthenticatedUsername)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pdpb.ExportAccountDataResponse{
+		Json: string(data),
+	}, nil
+}
+
+func (s *server) AdminDeactivateUser(ctx context.Context, req *pdpb.AdminDeactivateUserRequest) (*pdpb.AdminDeactivateUserResponse, error) {
+	logger := logging.FromContext(ctx)
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, pderr.Unexpectedf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	if err := s.deactivateUser(ctx, tx, req.Username); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, pderr.Unexpectedf("failed to commit transaction: %v", err)
+	}
+
+	logger.Info("user deactivated by admin", zap.String("username", req.Username))
+
+	return &pdpb.AdminDeactivateUserResponse{}, nil
+}
+
+func (s *server) AdminReactivateUser(ctx context.Context, req *pdpb.AdminReactivateUserRequest) (*pdpb.AdminReactivateUserResponse, error) {
+	logger := logging.FromContext(ctx)
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, pderr.Unexpectedf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	if err := s.userdb.ReactivateUser(ctx, tx, req.Username); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, pderr.Unexpectedf("failed to commit transaction: %v", err)
+	}
+
+	logger.Info("user reactivated by admin", zap.String("username", req.Username))
+
+	return &pdpb.AdminReactivateUserResponse{}, nil
+}
+
+func (s *server) AdminDeleteUser(ctx context.Context, req *pdpb.AdminDeleteUserRequest) (*pdpb.AdminDeleteUserResponse, error) {
+	logger := logging.FromContext(ctx)
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, pderr.Unexpectedf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	pseudonym, err := s.deleteUser(ctx, tx, req.Username)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, pderr.Unexpectedf("failed to commit transaction: %v", err)
+	}
+
+	logger.Info("user deleted by admin", zap.String("username", req.Username), zap.String("pseudonym", pseudonym))
+
+	return &pdpb.AdminDeleteUserResponse{
+		DeletedUsername: pseudonym,
+	}, nil
+}
+
+func (s *server) AdminExportUserData(ctx context.Context, req *pdpb.AdminExportUserDataRequest) (*pdpb.AdminExportUserDataResponse, error) {
+	logger := logging.FromContext(ctx)
+
+	tx, err := s.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, pderr.Unexpectedf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	data, err := s.userdb.ExportUserDataJSON(ctx, tx, req.Username)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Info("user data exported by admin", zap.String("username", req.Username))
+
+	return &pdpb.AdminExportUserDataResponse{
+		Json: string(data),
+	}, nil
+}
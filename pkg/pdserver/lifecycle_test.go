@@ -0,0 +1,57 @@
+package pdserver
+
+import (
+	"context"
+	"testing"
+
+	"github.com/steinarvk/playdough/pkg/pdauth"
+	"github.com/steinarvk/playdough/pkg/pddb/userdb"
+	"github.com/steinarvk/playdough/pkg/pderr"
+	"github.com/steinarvk/playdough/pkg/pdtestutils"
+	"github.com/steinarvk/playdough/proto/pdpb"
+	"google.golang.org/grpc/codes"
+)
+
+func TestSessionOfDeletedUserDoesNotPassToNewOwnerOfName(t *testing.T) {
+	db := pdtestutils.OpenTestDatabase(t)
+	ctx := context.Background()
+
+	auth := pdauth.NewValidator(db)
+	srv, err := New(
+		db,
+		WithAuthValidator(auth),
+		WithUserDBOptions(userdb.WithArgon2Params(userdb.Argon2Params{TimeCost: 1, MemoryCost: 8 * 1024, KeyLength: 16, Parallelism: 1})),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	login := func(password string) string {
+		t.Helper()
+
+		if _, err := srv.CreateAccount(ctx, &pdpb.CreateAccountRequest{Username: "alice", Password: password}); err != nil {
+			t.Fatalf("CreateAccount() = %v", err)
+		}
+		resp, err := srv.Login(ctx, &pdpb.LoginRequest{Username: "alice", Password: password})
+		if err != nil {
+			t.Fatalf("Login() = %v", err)
+		}
+		return resp.SessionToken
+	}
+
+	oldToken := login("correct horse battery staple")
+
+	aliceCtx := pdauth.NewContextWithAuth(ctx, pdauth.AuthInfo{IsAuthenticated: true, AuthenticatedUsername: "alice", Roles: []pdauth.Role{pdauth.RoleUser}})
+	if _, err := srv.DeleteAccount(aliceCtx, &pdpb.DeleteAccountRequest{CurrentPassword: "correct horse battery staple"}); err != nil {
+		t.Fatalf("DeleteAccount() = %v", err)
+	}
+
+	newToken := login("another horse battery staple")
+
+	if _, err := auth.ValidateHeader(ctx, "Bearer "+oldToken); pderr.CodeOf(err) != codes.Unauthenticated {
+		t.Errorf("deleted user's token: ValidateHeader() = %v, want Unauthenticated", err)
+	}
+	if _, err := auth.ValidateHeader(ctx, "Bearer "+newToken); err != nil {
+		t.Errorf("new user's token: ValidateHeader() = %v", err)
+	}
+}
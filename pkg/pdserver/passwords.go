@@ -0,0 +1,142 @@
+package pdserver
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/steinarvk/playdough/pkg/logging"
+	"github.com/steinarvk/playdough/pkg/pdauth"
+	"github.com/steinarvk/playdough/pkg/pderr"
+	"github.com/steinarvk/playdough/pkg/pdpeer"
+	"github.com/steinarvk/playdough/proto/pdpb"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// verifyCurrentPassword re-checks the password of an already authenticated user
+// before a sensitive change. Guessing it this way must be no easier than through
+// Login, so failures count towards the same throttle.
+func (s *server) verifyCurrentPassword(ctx context.Context, tx *sql.Tx, username, password string) error {
+	logger := logging.FromContext(ctx)
+
+	clientIP := pdpeer.ClientIP(ctx)
+
+	if err := s.loginThrottle.Attempt(ctx, username, clientIP); err != nil {
+		return err
+	}
+
+	_, err := s.userdb.AuthenticateByPassword(ctx, tx, username, password)
+	if pderr.CodeOf(err) == codes.Unauthenticated {
+		return pderr.Unauthenticated("current password is incorrect")
+	}
+	if releaseErr := s.loginThrottle.Release(ctx, username, clientIP); releaseErr != nil {
+		logger.Error("failed to release login attempt", zap.Error(releaseErr))
+	}
+
+	return err
+}
+
+func (s *server) ChangePassword(ctx context.Context, req *pdpb.ChangePasswordRequest) (*pdpb.ChangePasswordResponse, error) {
+	logger := logging.FromContext(ctx)
+
+	authInfo, err := requireSessionAuth(ctx, "change passwords")
+	if err != nil {
+		return nil, err
+	}
+
+	username := authInfo.AuthenticatedUsername
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, pderr.Unexpectedf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	if err := s.verifyCurrentPassword(ctx, tx, username, req.CurrentPassword); err != nil {
+		return nil, err
+	}
+
+	if err := s.userdb.SetPassword(ctx, tx, username, req.NewPassword); err != nil {
+		return nil, err
+	}
+
+	if err := s.auth.RevokeSessions(ctx, tx, username); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, pderr.Unexpectedf("failed to commit transaction: %v", err)
+	}
+
+	if err := s.loginThrottle.RecordSuccess(ctx, username); err != nil {
+		logger.Error("failed to clear login failures", zap.Error(err))
+	}
+
+	token, err := s.auth.IssueAuthenticatedToken(ctx, username, s.tokenLifetimes.Session, authInfo.SecondFactorVerified)
+	if err != nil {
+		return nil, pderr.Unexpectedf("failed to issue token: %v", err)
+	}
+
+	return &pdpb.ChangePasswordResponse{
+		SessionToken: token,
+	}, nil
+}
+
+func (s *server) CreatePasswordResetToken(ctx context.Context, req *pdpb.CreatePasswordResetTokenRequest) (*pdpb.CreatePasswordResetTokenResponse, error) {
+	authInfo, err := pdauth.AuthenticatedFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	validDuration, ok := requestedValidity(req.ValidDurationSeconds, s.tokenLifetimes.DefaultPasswordReset, s.tokenLifetimes.MaxPasswordReset)
+	if !ok {
+		return nil, pderr.BadInput(fmt.Sprintf("password reset token validity must be positive and at most %v", s.tokenLifetimes.MaxPasswordReset), "valid_duration_seconds", fmt.Sprint(req.ValidDurationSeconds))
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, pderr.Unexpectedf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	token, expirationTime, err := s.userdb.CreatePasswordResetToken(ctx, tx, req.Username, authInfo.AuthenticatedUsername, validDuration)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, pderr.Unexpectedf("failed to commit transaction: %v", err)
+	}
+
+	return &pdpb.CreatePasswordResetTokenResponse{
+		ResetToken:     token,
+		ExpirationTime: timestamppb.New(expirationTime),
+	}, nil
+}
+
+func (s *server) ResetPassword(ctx context.Context, req *pdpb.ResetPasswordRequest) (*pdpb.ResetPasswordResponse, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, pderr.Unexpectedf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	user, err := s.userdb.ResetPasswordWithToken(ctx, tx, req.ResetToken, req.NewPassword)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.auth.RevokeSessions(ctx, tx, user.Username); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, pderr.Unexpectedf("failed to commit transaction: %v", err)
+	}
+
+	return &pdpb.ResetPasswordResponse{
+		Username: user.Username,
+	}, nil
+}
@@ -2,32 +2,40 @@ package pdserver
 
 import (
 	"context"
-	"time"
+	"database/sql"
 
 	"github.com/steinarvk/playdough/pkg/logging"
+	"github.com/steinarvk/playdough/pkg/pddb"
+	"github.com/steinarvk/playdough/pkg/pddb/userdb"
 	"github.com/steinarvk/playdough/pkg/pderr"
+	"github.com/steinarvk/playdough/pkg/pdpeer"
 	"github.com/steinarvk/playdough/proto/pdpb"
 	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
 )
 
 func (s *server) CreateAccount(ctx context.Context, req *pdpb.CreateAccountRequest) (*pdpb.CreateAccountResponse, error) {
 	logger := logging.FromContext(ctx)
 
-	tx, err := s.db.BeginTx(ctx, nil)
-	if err != nil {
-		return nil, pderr.Unexpectedf("failed to begin transaction: %v", err)
+	if req.InviteCode == "" && s.registrationMode == RegistrationInviteOnly {
+		return nil, pderr.Error(codes.PermissionDenied, "registration requires an invite code")
 	}
-	defer tx.Rollback()
 
-	user, err := s.userdb.RegisterUserWithPassword(ctx, tx, req.Username, req.Password)
-	if err != nil {
+	// Registration locks rows shared with concurrent registrations, such as the
+	// invite code, so retry if it deadlocks.
+	var user *userdb.User
+	if err := pddb.InTx(ctx, s.db, nil, func(tx *sql.Tx) error {
+		var err error
+		if req.InviteCode != "" {
+			user, err = s.userdb.RegisterUserWithInvite(ctx, tx, req.InviteCode, req.Username, req.Password)
+		} else {
+			user, err = s.userdb.RegisterUserWithPassword(ctx, tx, req.Username, req.Password)
+		}
+		return err
+	}); err != nil {
 		return nil, err
 	}
 
-	if err := tx.Commit(); err != nil {
-		return nil, pderr.Unexpectedf("failed to commit transaction: %v", err)
-	}
-
 	logger.Info("created account with password", zap.String("username", user.Username), zap.Stringer("user_uuid", user.UserUUID))
 
 	return &pdpb.CreateAccountResponse{
@@ -48,6 +56,12 @@ func (s *server) Ping(ctx context.Context, req *pdpb.PingRequest) (*pdpb.PingRes
 func (s *server) Login(ctx context.Context, req *pdpb.LoginRequest) (*pdpb.LoginResponse, error) {
 	logger := logging.FromContext(ctx)
 
+	clientIP := pdpeer.ClientIP(ctx)
+
+	if err := s.loginThrottle.Attempt(ctx, req.Username, clientIP); err != nil {
+		return nil, err
+	}
+
 	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
 		return nil, pderr.Unexpectedf("failed to begin transaction: %v", err)
@@ -55,15 +69,48 @@ func (s *server) Login(ctx context.Context, req *pdpb.LoginRequest) (*pdpb.Login
 	defer tx.Rollback()
 
 	user, err := s.userdb.AuthenticateByPassword(ctx, tx, req.Username, req.Password)
+	if pderr.CodeOf(err) != codes.Unauthenticated {
+		if releaseErr := s.loginThrottle.Release(ctx, req.Username, clientIP); releaseErr != nil {
+			logger.Error("failed to release login attempt", zap.Error(releaseErr))
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	hasSecondFactor, err := s.userdb.HasSecondFactor(ctx, tx, user.Username)
 	if err != nil {
 		return nil, err
 	}
 
+	if hasSecondFactor {
+		challenge, err := s.userdb.CreateLoginChallenge(ctx, tx, user.Username)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := tx.Commit(); err != nil {
+			return nil, pderr.Unexpectedf("failed to commit transaction: %v", err)
+		}
+
+		logger.Info("password accepted; second factor required", zap.String("username", user.Username))
+
+		return &pdpb.LoginResponse{
+			UserUuid:              user.UserUUID.String(),
+			SecondFactorRequired:  true,
+			SecondFactorChallenge: challenge,
+		}, nil
+	}
+
 	if err := tx.Commit(); err != nil {
 		return nil, pderr.Unexpectedf("failed to commit transaction: %v", err)
 	}
 
-	token, err := s.auth.IssueAuthenticatedToken(ctx, user.Username, 24*time.Hour)
+	if err := s.loginThrottle.RecordSuccess(ctx, user.Username); err != nil {
+		logger.Error("failed to clear login failures", zap.Error(err))
+	}
+
+	token, err := s.auth.IssueAuthenticatedToken(ctx, user.Username, s.tokenLifetimes.Session, false)
 	if err != nil {
 		return nil, pderr.Unexpectedf("failed to issue token: %v", err)
 	}
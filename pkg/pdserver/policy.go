@@ -0,0 +1,95 @@
+package pdserver
+
+import (
+	"github.com/steinarvk/playdough/pkg/pdauth"
+	"github.com/steinarvk/playdough/proto/pdpb"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+var (
+	public = pdauth.MethodPolicy{
+		Public: true,
+	}
+
+	authenticated = pdauth.MethodPolicy{}
+
+	adminOnly = pdauth.MethodPolicy{
+		AnyOfRoles: []pdauth.Role{pdauth.RoleAdmin},
+	}
+
+	// Every method should be listed here explicitly.
+	methodPolicies = map[string]pdauth.MethodPolicy{
+		pdpb.PlaydoughService_Ping_FullMethodName:              public,
+		pdpb.PlaydoughService_Login_FullMethodName:             public,
+		pdpb.PlaydoughService_LoginSecondFactor_FullMethodName: public,
+		pdpb.PlaydoughService_CreateAccount_FullMethodName:     public,
+		pdpb.PlaydoughService_ResetPassword_FullMethodName:     public,
+
+		healthpb.Health_Check_FullMethodName: public,
+		healthpb.Health_Watch_FullMethodName: public,
+
+		pdpb.PlaydoughService_ChangePassword_FullMethodName: authenticated,
+		pdpb.PlaydoughService_EnrollTotp_FullMethodName:     authenticated,
+		pdpb.PlaydoughService_ConfirmTotp_FullMethodName:    authenticated,
+		pdpb.PlaydoughService_DisableTotp_FullMethodName:    authenticated,
+
+		pdpb.PlaydoughService_GetUser_FullMethodName:       authenticated,
+		pdpb.PlaydoughService_SearchUsers_FullMethodName:   authenticated,
+		pdpb.PlaydoughService_UpdateProfile_FullMethodName: authenticated,
+
+		pdpb.PlaydoughService_DeactivateAccount_FullMethodName: authenticated,
+		pdpb.PlaydoughService_DeleteAccount_FullMethodName:     authenticated,
+		pdpb.PlaydoughService_ExportAccountData_FullMethodName: authenticated,
+
+		pdpb.PlaydoughService_CreateInvite_FullMethodName: authenticated,
+		pdpb.PlaydoughService_ListInvites_FullMethodName:  authenticated,
+
+		pdpb.PlaydoughService_CreateApiKey_FullMethodName: authenticated,
+		pdpb.PlaydoughService_ListApiKeys_FullMethodName:  authenticated,
+		pdpb.PlaydoughService_RevokeApiKey_FullMethodName: authenticated,
+
+		pdpb.PlaydoughService_GrantRole_FullMethodName:  adminOnly,
+		pdpb.PlaydoughService_RevokeRole_FullMethodName: adminOnly,
+
+		pdpb.PlaydoughService_CreatePasswordResetToken_FullMethodName: adminOnly,
+		pdpb.PlaydoughService_AdminDeactivateUser_FullMethodName:      adminOnly,
+		pdpb.PlaydoughService_AdminReactivateUser_FullMethodName:      adminOnly,
+		pdpb.PlaydoughService_AdminDeleteUser_FullMethodName:          adminOnly,
+		pdpb.PlaydoughService_AdminExportUserData_FullMethodName:      adminOnly,
+		pdpb.PlaydoughService_AdminListInvites_FullMethodName:         adminOnly,
+	}
+)
+
+// MethodPolicy returns the authorization policy for a gRPC method, given its full name.
+// Methods without an explicit policy require authentication.
+func MethodPolicy(fullMethod string) pdauth.MethodPolicy {
+	return methodPolicies[fullMethod]
+}
+
+// Rate limiting costs in tokens, where an ordinary request costs one. Methods that
+// hash passwords or scan many rows cost more; health checks are free, so that
+// probes are never limited.
+var defaultMethodCosts = map[string]float64{
+	pdpb.PlaydoughService_Login_FullMethodName:             5,
+	pdpb.PlaydoughService_LoginSecondFactor_FullMethodName: 2,
+	pdpb.PlaydoughService_CreateAccount_FullMethodName:     20,
+	pdpb.PlaydoughService_ResetPassword_FullMethodName:     5,
+	pdpb.PlaydoughService_ChangePassword_FullMethodName:    5,
+	pdpb.PlaydoughService_SearchUsers_FullMethodName:       3,
+	pdpb.PlaydoughService_ExportAccountData_FullMethodName: 10,
+
+	pdpb.PlaydoughService_AdminExportUserData_FullMethodName: 10,
+
+	healthpb.Health_Check_FullMethodName: 0,
+	healthpb.Health_Watch_FullMethodName: 0,
+}
+
+// DefaultMethodCosts returns the default rate limiting cost of methods, by full
+// method name. Methods not listed cost one token.
+func DefaultMethodCosts() map[string]float64 {
+	rv := map[string]float64{}
+	for method, cost := range defaultMethodCosts {
+		rv[method] = cost
+	}
+	return rv
+}
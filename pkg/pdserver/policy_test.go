@@ -0,0 +1,63 @@
+package pdserver
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/steinarvk/playdough/pkg/pdauth"
+	"github.com/steinarvk/playdough/pkg/pderr"
+	"github.com/steinarvk/playdough/proto/pdpb"
+	"google.golang.org/grpc/codes"
+)
+
+func TestEveryMethodHasExplicitPolicy(t *testing.T) {
+	serviceDesc := pdpb.PlaydoughService_ServiceDesc
+
+	for _, method := range serviceDesc.Methods {
+		fullMethod := "/" + serviceDesc.ServiceName + "/" + method.MethodName
+		if _, ok := methodPolicies[fullMethod]; !ok {
+			t.Errorf("no explicit authorization policy for %s", fullMethod)
+		}
+	}
+}
+
+func TestDefaultMethodCostsNameKnownMethods(t *testing.T) {
+	for fullMethod := range DefaultMethodCosts() {
+		if _, ok := methodPolicies[fullMethod]; !ok {
+			t.Errorf("rate limiting cost for unknown method %s", fullMethod)
+		}
+	}
+}
+
+// The interceptor authorizes every request with MethodPolicy, so an admin's API key
+// must be refused on all admin methods, whatever its scopes.
+func TestAdminAPIKeysCannotCallAdminMethods(t *testing.T) {
+	adminKey := pdauth.AuthInfo{
+		IsAuthenticated:       true,
+		AuthenticatedUsername: "root",
+		Roles:                 []pdauth.Role{pdauth.RoleAdmin, pdauth.RoleUser},
+		Scopes:                []pdauth.Scope{pdauth.ScopeReadBalance},
+		APIKeyUUID:            uuid.New(),
+	}
+	adminSession := adminKey
+	adminSession.APIKeyUUID = uuid.Nil
+
+	for _, fullMethod := range []string{
+		pdpb.PlaydoughService_GrantRole_FullMethodName,
+		pdpb.PlaydoughService_AdminDeleteUser_FullMethodName,
+		pdpb.PlaydoughService_CreatePasswordResetToken_FullMethodName,
+	} {
+		if err := MethodPolicy(fullMethod).Authorize(adminSession); err != nil {
+			t.Errorf("%s rejected an admin session: %v", fullMethod, err)
+		}
+	}
+
+	for fullMethod, policy := range methodPolicies {
+		if len(policy.AnyOfRoles) == 0 {
+			continue
+		}
+		if got := pderr.CodeOf(MethodPolicy(fullMethod).Authorize(adminKey)); got != codes.PermissionDenied {
+			t.Errorf("%s with a read-balance API key: got %v, want PermissionDenied", fullMethod, got)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package pdserver
+
+import (
+	"context"
+
+	"github.com/steinarvk/playdough/pkg/logging"
+	"github.com/steinarvk/playdough/pkg/pdauth"
+	"github.com/steinarvk/playdough/pkg/pderr"
+	"github.com/steinarvk/playdough/proto/pdpb"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+)
+
+func (s *server) GrantRole(ctx context.Context, req *pdpb.GrantRoleRequest) (*pdpb.GrantRoleResponse, error) {
+	logger := logging.FromContext(ctx)
+
+	role, err := pdauth.ParseRole(req.Role)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, pderr.Unexpectedf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	if err := s.auth.GrantRole(ctx, tx, req.Username, role); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, pderr.Unexpectedf("failed to commit transaction: %v", err)
+	}
+
+	logger.Info("role granted by admin", zap.String("username", req.Username), zap.String("role", string(role)))
+
+	return &pdpb.GrantRoleResponse{}, nil
+}
+
+func (s *server) RevokeRole(ctx context.Context, req *pdpb.RevokeRoleRequest) (*pdpb.RevokeRoleResponse, error) {
+	logger := logging.FromContext(ctx)
+
+	role, err := pdauth.ParseRole(req.Role)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, pderr.Unexpectedf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	if role == pdauth.RoleAdmin {
+		numAdmins, err := s.auth.CountUsersWithRole(ctx, tx, pdauth.RoleAdmin)
+		if err != nil {
+			return nil, err
+		}
+		if numAdmins <= 1 {
+			return nil, pderr.Error(codes.FailedPrecondition, "refusing to revoke the role of the last admin")
+		}
+	}
+
+	if err := s.auth.RevokeRole(ctx, tx, req.Username, role); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, pderr.Unexpectedf("failed to commit transaction: %v", err)
+	}
+
+	logger.Info("role revoked by admin", zap.String("username", req.Username), zap.String("role", string(role)))
+
+	return &pdpb.RevokeRoleResponse{}, nil
+}
@@ -0,0 +1,179 @@
+package pdserver
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/steinarvk/playdough/pkg/logging"
+	"github.com/steinarvk/playdough/pkg/pderr"
+	"github.com/steinarvk/playdough/pkg/pdpeer"
+	"github.com/steinarvk/playdough/proto/pdpb"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+)
+
+// verifySecondFactor checks a TOTP or recovery code, throttling failures like failed logins.
+func (s *server) verifySecondFactor(ctx context.Context, tx *sql.Tx, username, totpCode, recoveryCode string) error {
+	logger := logging.FromContext(ctx)
+
+	clientIP := pdpeer.ClientIP(ctx)
+
+	if err := s.loginThrottle.Attempt(ctx, username, clientIP); err != nil {
+		return err
+	}
+
+	err := s.userdb.VerifySecondFactor(ctx, tx, username, totpCode, recoveryCode)
+	if pderr.CodeOf(err) != codes.Unauthenticated {
+		if releaseErr := s.loginThrottle.Release(ctx, username, clientIP); releaseErr != nil {
+			logger.Error("failed to release login attempt", zap.Error(releaseErr))
+		}
+	}
+	return err
+}
+
+func (s *server) LoginSecondFactor(ctx context.Context, req *pdpb.LoginSecondFactorRequest) (*pdpb.LoginSecondFactorResponse, error) {
+	logger := logging.FromContext(ctx)
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, pderr.Unexpectedf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	challenge, err := s.userdb.LookupLoginChallenge(ctx, tx, req.Challenge)
+	if err != nil {
+		return nil, err
+	}
+
+	username := challenge.User.Username
+
+	if err := s.verifySecondFactor(ctx, tx, username, req.TotpCode, req.RecoveryCode); err != nil {
+		return nil, err
+	}
+
+	if err := s.userdb.CompleteLoginChallenge(ctx, tx, challenge); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, pderr.Unexpectedf("failed to commit transaction: %v", err)
+	}
+
+	if err := s.loginThrottle.RecordSuccess(ctx, username); err != nil {
+		logger.Error("failed to clear login failures", zap.Error(err))
+	}
+
+	token, err := s.auth.IssueAuthenticatedToken(ctx, username, s.tokenLifetimes.Session, true)
+	if err != nil {
+		return nil, pderr.Unexpectedf("failed to issue token: %v", err)
+	}
+
+	logger.Info("logged in account with password and second factor", zap.String("username", username), zap.Stringer("user_uuid", challenge.User.UserUUID))
+
+	return &pdpb.LoginSecondFactorResponse{
+		SessionToken: token,
+		UserUuid:     challenge.User.UserUUID.String(),
+	}, nil
+}
+
+func (s *server) EnrollTotp(ctx context.Context, req *pdpb.EnrollTotpRequest) (*pdpb.EnrollTotpResponse, error) {
+	authInfo, err := requireSessionAuth(ctx, "manage two-factor authentication")
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, pderr.Unexpectedf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	enrollment, err := s.userdb.EnrollTOTP(ctx, tx, authInfo.AuthenticatedUsername)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, pderr.Unexpectedf("failed to commit transaction: %v", err)
+	}
+
+	return &pdpb.EnrollTotpResponse{
+		OtpauthUri: enrollment.URI,
+		Secret:     enrollment.Secret,
+	}, nil
+}
+
+func (s *server) ConfirmTotp(ctx context.Context, req *pdpb.ConfirmTotpRequest) (*pdpb.ConfirmTotpResponse, error) {
+	logger := logging.FromContext(ctx)
+
+	authInfo, err := requireSessionAuth(ctx, "manage two-factor authentication")
+	if err != nil {
+		return nil, err
+	}
+
+	username := authInfo.AuthenticatedUsername
+	clientIP := pdpeer.ClientIP(ctx)
+
+	// Codes are guessable here just as at login, so failures count towards the same throttle.
+	if err := s.loginThrottle.Attempt(ctx, username, clientIP); err != nil {
+		return nil, err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, pderr.Unexpectedf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	recoveryCodes, err := s.userdb.ConfirmTOTP(ctx, tx, username, req.TotpCode)
+	if pderr.CodeOf(err) != codes.Unauthenticated {
+		if releaseErr := s.loginThrottle.Release(ctx, username, clientIP); releaseErr != nil {
+			logger.Error("failed to release login attempt", zap.Error(releaseErr))
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, pderr.Unexpectedf("failed to commit transaction: %v", err)
+	}
+
+	return &pdpb.ConfirmTotpResponse{
+		RecoveryCodes: recoveryCodes,
+	}, nil
+}
+
+func (s *server) DisableTotp(ctx context.Context, req *pdpb.DisableTotpRequest) (*pdpb.DisableTotpResponse, error) {
+	authInfo, err := requireSessionAuth(ctx, "manage two-factor authentication")
+	if err != nil {
+		return nil, err
+	}
+
+	username := authInfo.AuthenticatedUsername
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, pderr.Unexpectedf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	if err := s.verifySecondFactor(ctx, tx, username, req.TotpCode, req.RecoveryCode); err != nil {
+		return nil, err
+	}
+
+	if err := s.userdb.DisableTOTP(ctx, tx, username); err != nil {
+		return nil, err
+	}
+
+	// Sessions established with the second factor must not keep the rights that came with it.
+	if err := s.auth.RevokeSessions(ctx, tx, username); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, pderr.Unexpectedf("failed to commit transaction: %v", err)
+	}
+
+	return &pdpb.DisableTotpResponse{}, nil
+}
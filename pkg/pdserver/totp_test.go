@@ -0,0 +1,55 @@
+package pdserver
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/steinarvk/playdough/pkg/pdauth"
+	"github.com/steinarvk/playdough/pkg/pddb/loginthrottle"
+	"github.com/steinarvk/playdough/pkg/pddb/userdb"
+	"github.com/steinarvk/playdough/pkg/pderr"
+	"github.com/steinarvk/playdough/pkg/pdtestutils"
+	"github.com/steinarvk/playdough/proto/pdpb"
+	"google.golang.org/grpc/codes"
+)
+
+func TestConfirmTotpFailuresAreThrottled(t *testing.T) {
+	db := pdtestutils.OpenTestDatabase(t)
+	ctx := context.Background()
+
+	params := loginthrottle.DefaultParams()
+	params.PerUsername.FreeAttempts = 2
+	params.PerUsername.BaseDelay = time.Hour
+	params.PerUsername.MaxDelay = time.Hour
+
+	srv, err := New(
+		db,
+		WithLoginThrottle(loginthrottle.New(db, params)),
+		WithUserDBOptions(userdb.WithArgon2Params(userdb.Argon2Params{TimeCost: 1, MemoryCost: 8 * 1024, KeyLength: 16, Parallelism: 1})),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := srv.CreateAccount(ctx, &pdpb.CreateAccountRequest{Username: "alice", Password: "correct horse battery staple"}); err != nil {
+		t.Fatalf("CreateAccount() = %v", err)
+	}
+
+	ctx = pdauth.NewContextWithAuth(ctx, pdauth.AuthInfo{IsAuthenticated: true, AuthenticatedUsername: "alice", Roles: []pdauth.Role{pdauth.RoleUser}})
+
+	if _, err := srv.EnrollTotp(ctx, &pdpb.EnrollTotpRequest{}); err != nil {
+		t.Fatalf("EnrollTotp() = %v", err)
+	}
+
+	// The attempt beyond the free ones is still checked, but blocks any after it.
+	for i := 0; i <= params.PerUsername.FreeAttempts; i++ {
+		if _, err := srv.ConfirmTotp(ctx, &pdpb.ConfirmTotpRequest{TotpCode: "not a code"}); pderr.CodeOf(err) != codes.Unauthenticated {
+			t.Fatalf("attempt %d: ConfirmTotp() = %v, want Unauthenticated", i, err)
+		}
+	}
+
+	if _, err := srv.ConfirmTotp(ctx, &pdpb.ConfirmTotpRequest{TotpCode: "not a code"}); pderr.CodeOf(err) != codes.ResourceExhausted {
+		t.Errorf("ConfirmTotp() after repeated failures = %v, want ResourceExhausted", err)
+	}
+}
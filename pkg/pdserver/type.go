@@ -4,6 +4,7 @@ import (
 	"database/sql"
 
 	"github.com/steinarvk/playdough/pkg/pdauth"
+	"github.com/steinarvk/playdough/pkg/pddb/loginthrottle"
 	"github.com/steinarvk/playdough/pkg/pddb/userdb"
 	"github.com/steinarvk/playdough/proto/pdpb"
 )
@@ -11,7 +12,13 @@ import (
 type server struct {
 	pdpb.UnsafePlaydoughServiceServer
 
-	db     *sql.DB
-	auth   *pdauth.AuthValidator
-	userdb *userdb.UserDB
+	db            *sql.DB
+	auth          *pdauth.AuthValidator
+	userdb        *userdb.UserDB
+	loginThrottle *loginthrottle.Throttle
+
+	registrationMode RegistrationMode
+	tokenLifetimes   TokenLifetimes
+
+	userdbOptions []userdb.Option
 }
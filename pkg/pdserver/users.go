@@ -0,0 +1,108 @@
+package pdserver
+
+import (
+	"context"
+
+	"github.com/google/uuid"
+	"github.com/steinarvk/playdough/pkg/pdauth"
+	"github.com/steinarvk/playdough/pkg/pddb/userdb"
+	"github.com/steinarvk/playdough/pkg/pderr"
+	"github.com/steinarvk/playdough/proto/pdpb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func userToProto(user *userdb.User) *pdpb.UserProfile {
+	return &pdpb.UserProfile{
+		UserUuid:     user.UserUUID.String(),
+		Username:     user.Username,
+		DisplayName:  user.Profile.DisplayName,
+		AvatarUrl:    user.Profile.AvatarURL,
+		Bio:          user.Profile.Bio,
+		CreationTime: timestamppb.New(user.CreationTime),
+		Deactivated:  user.Deactivated,
+		Deleted:      user.Deleted,
+	}
+}
+
+func (s *server) GetUser(ctx context.Context, req *pdpb.GetUserRequest) (*pdpb.GetUserResponse, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, pderr.Unexpectedf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	var user *userdb.User
+
+	switch lookup := req.Lookup.(type) {
+	case *pdpb.GetUserRequest_Username:
+		user, err = s.userdb.FetchUserByUsername(ctx, tx, lookup.Username)
+	case *pdpb.GetUserRequest_UserUuid:
+		userUUID, parseErr := uuid.Parse(lookup.UserUuid)
+		if parseErr != nil {
+			return nil, pderr.BadInput("invalid user UUID", "user_uuid", lookup.UserUuid)
+		}
+		user, err = s.userdb.FetchUserByUUID(ctx, tx, userUUID)
+	default:
+		return nil, pderr.Error(codes.InvalidArgument, "either username or user_uuid is required")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &pdpb.GetUserResponse{
+		User: userToProto(user),
+	}, nil
+}
+
+func (s *server) SearchUsers(ctx context.Context, req *pdpb.SearchUsersRequest) (*pdpb.SearchUsersResponse, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, pderr.Unexpectedf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	users, nextPageToken, err := s.userdb.SearchUsers(ctx, tx, req.UsernamePrefix, int(req.PageSize), req.PageToken)
+	if err != nil {
+		return nil, err
+	}
+
+	rv := &pdpb.SearchUsersResponse{
+		NextPageToken: nextPageToken,
+	}
+	for _, user := range users {
+		rv.Users = append(rv.Users, userToProto(user))
+	}
+
+	return rv, nil
+}
+
+func (s *server) UpdateProfile(ctx context.Context, req *pdpb.UpdateProfileRequest) (*pdpb.UpdateProfileResponse, error) {
+	authInfo, err := pdauth.AuthenticatedFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, pderr.Unexpectedf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	user, err := s.userdb.UpdateProfile(ctx, tx, authInfo.AuthenticatedUsername, userdb.ProfileUpdate{
+		DisplayName: req.DisplayName,
+		AvatarURL:   req.AvatarUrl,
+		Bio:         req.Bio,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, pderr.Unexpectedf("failed to commit transaction: %v", err)
+	}
+
+	return &pdpb.UpdateProfileResponse{
+		User: userToProto(user),
+	}, nil
+}
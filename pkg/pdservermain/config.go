@@ -0,0 +1,435 @@
+package pdservermain
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/spf13/pflag"
+	"github.com/steinarvk/playdough/pkg/pddb/loginthrottle"
+	"github.com/steinarvk/playdough/pkg/pderr"
+	"github.com/steinarvk/playdough/pkg/pdserver"
+	"github.com/steinarvk/playdough/proto/pdpb"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/status"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	envPrefix = "PLAYDOUGH_"
+	// Appended to a setting's name to read its value from a file instead.
+	fileSuffix = "_file"
+
+	configFlagName = "config"
+)
+
+const configHelp = `Every flag can also be set by a PLAYDOUGH_* environment variable, e.g.
+PLAYDOUGH_POSTGRES_DB for --postgres_db, or by a key in the YAML file given by
+--config (or PLAYDOUGH_CONFIG), e.g.
+
+  host: 0.0.0.0
+  port: 5044
+  postgres_db_file: /run/secrets/postgres_db
+  db-max-open-conns: 20
+  reserved-usernames: [admin, root]
+  rate-limit-method-costs: {Login: 10}
+
+Flags take precedence over the environment, which takes precedence over the
+config file. Appending _FILE or _file to a name reads the value from that file
+instead, so that secrets such as the connection string need not appear in the
+process list, the environment, or the config file.`
+
+// settingName is the name of the setting for a flag in the config file, and in
+// upper case, after the prefix, in the environment.
+func settingName(name string) string {
+	return strings.ReplaceAll(strings.ToLower(name), "-", "_")
+}
+
+func envName(name string) string {
+	return envPrefix + strings.ToUpper(settingName(name))
+}
+
+// readSecretFile returns the contents of a file without its trailing newline.
+func readSecretFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// configValueStrings converts a YAML value to flag values: scalars to a single
+// value, sequences to one value per element, and mappings to "key=value" pairs.
+func configValueStrings(value interface{}) ([]string, error) {
+	switch v := value.(type) {
+	case nil:
+		return nil, fmt.Errorf("missing value")
+	case []interface{}:
+		rv := make([]string, len(v))
+		for i, elem := range v {
+			switch elem.(type) {
+			case []interface{}, map[string]interface{}, nil:
+				return nil, fmt.Errorf("list elements must be plain values")
+			}
+			rv[i] = fmt.Sprint(elem)
+		}
+		return rv, nil
+	case map[string]interface{}:
+		var pairs []string
+		for key, elem := range v {
+			pairs = append(pairs, fmt.Sprintf("%s=%v", key, elem))
+		}
+		sort.Strings(pairs)
+		return []string{strings.Join(pairs, ",")}, nil
+	default:
+		return []string{fmt.Sprint(v)}, nil
+	}
+}
+
+// readConfigFile returns the settings in a YAML config file by setting name, and
+// the keys they were given as.
+func readConfigFile(path string) (map[string][]string, map[string]string, []pderr.FieldViolation) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, []pderr.FieldViolation{{Field: configFlagName, Description: fmt.Sprintf("failed to read config file: %v", err)}}
+	}
+
+	var raw map[string]interface{}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, nil, []pderr.FieldViolation{{Field: configFlagName, Description: fmt.Sprintf("failed to parse config file %s: %v", path, err)}}
+	}
+
+	keys := make([]string, 0, len(raw))
+	for key := range raw {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var violations []pderr.FieldViolation
+	rv := map[string][]string{}
+	keysByName := map[string]string{}
+	for _, key := range keys {
+		values, err := configValueStrings(raw[key])
+		if err != nil {
+			violations = append(violations, pderr.FieldViolation{Field: key, Description: fmt.Sprintf("config file setting %s: %v", key, err)})
+			continue
+		}
+		rv[settingName(key)] = values
+		keysByName[settingName(key)] = key
+	}
+
+	return rv, keysByName, violations
+}
+
+// configSource looks up settings by name in the environment or the config file.
+type configSource struct {
+	describe func(name string) string
+	lookup   func(name string) ([]string, bool)
+}
+
+// resolve returns the value of a setting, reading it from a file if the source
+// names one instead.
+func (c configSource) resolve(name string) ([]string, bool, *pderr.FieldViolation) {
+	values, ok := c.lookup(name)
+	pathValues, fromFile := c.lookup(name + fileSuffix)
+
+	switch {
+	case ok && fromFile:
+		return nil, false, &pderr.FieldViolation{Field: c.describe(name), Description: fmt.Sprintf("both %s and %s are set", c.describe(name), c.describe(name+fileSuffix))}
+	case fromFile:
+		if len(pathValues) != 1 {
+			return nil, false, &pderr.FieldViolation{Field: c.describe(name + fileSuffix), Description: fmt.Sprintf("%s must be a single file name", c.describe(name+fileSuffix))}
+		}
+		value, err := readSecretFile(pathValues[0])
+		if err != nil {
+			return nil, false, &pderr.FieldViolation{Field: c.describe(name + fileSuffix), Description: fmt.Sprintf("failed to read %s: %v", c.describe(name+fileSuffix), err)}
+		}
+		return []string{value}, true, nil
+	default:
+		return values, ok, nil
+	}
+}
+
+// applyConfig sets flags not given on the command line from the environment or,
+// failing that, the config file. It returns every problem found, rather than
+// stopping at the first.
+func applyConfig(flags *pflag.FlagSet, lookupEnv func(string) (string, bool)) []pderr.FieldViolation {
+	return applyConfigSettings(flags, lookupEnv, true)
+}
+
+// ApplySharedConfig is applyConfig for commands other than serve, which share the
+// serve config file, e.g. to use the same credential policy. Settings for flags
+// the command does not have are ignored rather than reported.
+func ApplySharedConfig(flags *pflag.FlagSet) error {
+	if violations := applyConfigSettings(flags, os.LookupEnv, false); len(violations) > 0 {
+		return pderr.InvalidFields("invalid configuration", violations...)
+	}
+	return nil
+}
+
+// AddConfigFlag registers the flag naming the config file.
+func AddConfigFlag(flags *pflag.FlagSet) {
+	flags.String(configFlagName, "", "YAML file with settings for any of these flags, which take precedence over it")
+}
+
+func applyConfigSettings(flags *pflag.FlagSet, lookupEnv func(string) (string, bool), rejectUnknown bool) []pderr.FieldViolation {
+	var violations []pderr.FieldViolation
+
+	env := configSource{
+		describe: envName,
+		lookup: func(name string) ([]string, bool) {
+			value, ok := lookupEnv(envName(name))
+			if !ok {
+				return nil, false
+			}
+			return []string{value}, true
+		},
+	}
+
+	var fileSettings map[string][]string
+	var fileKeys map[string]string
+	configFlag := flags.Lookup(configFlagName)
+	if !configFlag.Changed {
+		if values, ok, violation := env.resolve(configFlagName); violation != nil {
+			violations = append(violations, *violation)
+		} else if ok {
+			if err := configFlag.Value.Set(values[0]); err != nil {
+				violations = append(violations, pderr.FieldViolation{Field: envName(configFlagName), Description: err.Error()})
+			}
+		}
+	}
+	if path := configFlag.Value.String(); path != "" {
+		var fileViolations []pderr.FieldViolation
+		fileSettings, fileKeys, fileViolations = readConfigFile(path)
+		violations = append(violations, fileViolations...)
+	}
+
+	file := configSource{
+		describe: func(name string) string {
+			return "config file setting " + name
+		},
+		lookup: func(name string) ([]string, bool) {
+			values, ok := fileSettings[name]
+			return values, ok
+		},
+	}
+
+	known := map[string]bool{}
+	flags.VisitAll(func(f *pflag.Flag) {
+		name := settingName(f.Name)
+		known[name] = true
+		known[name+fileSuffix] = true
+
+		if f.Changed || f.Name == configFlagName {
+			return
+		}
+
+		for _, source := range []configSource{env, file} {
+			values, ok, violation := source.resolve(name)
+			if violation != nil {
+				violations = append(violations, *violation)
+				return
+			}
+			if !ok {
+				continue
+			}
+
+			var err error
+			if sv, isSlice := f.Value.(pflag.SliceValue); isSlice && len(values) != 1 {
+				err = sv.Replace(values)
+			} else if len(values) != 1 {
+				err = fmt.Errorf("expected a single value, not a list")
+			} else {
+				err = f.Value.Set(values[0])
+			}
+			if err != nil {
+				violations = append(violations, pderr.FieldViolation{Field: source.describe(name), Description: fmt.Sprintf("invalid value for %s: %v", source.describe(name), err)})
+				return
+			}
+
+			f.Changed = true
+			return
+		}
+	})
+
+	var unknown []string
+	for name := range fileSettings {
+		if rejectUnknown && !known[name] {
+			unknown = append(unknown, fileKeys[name])
+		}
+	}
+	sort.Strings(unknown)
+	for _, key := range unknown {
+		violations = append(violations, pderr.FieldViolation{Field: key, Description: fmt.Sprintf("unknown config file setting %s", key)})
+	}
+
+	return violations
+}
+
+// applyMethodCostFlags overrides rate limiting costs with those given by short
+// PlaydoughService method name, e.g. "Login=10".
+func applyMethodCostFlags(costs map[string]float64, overrides map[string]int) []pderr.FieldViolation {
+	serviceDesc := pdpb.PlaydoughService_ServiceDesc
+
+	known := map[string]bool{}
+	for _, method := range serviceDesc.Methods {
+		known[method.MethodName] = true
+	}
+
+	var violations []pderr.FieldViolation
+	for name, cost := range overrides {
+		if !known[name] {
+			violations = append(violations, pderr.FieldViolation{Field: "rate-limit-method-costs", Description: fmt.Sprintf("--rate-limit-method-costs: unknown PlaydoughService method %q", name)})
+			continue
+		}
+		if cost < 0 {
+			violations = append(violations, pderr.FieldViolation{Field: "rate-limit-method-costs", Description: fmt.Sprintf("--rate-limit-method-costs: cost of %s must not be negative", name)})
+			continue
+		}
+		costs["/"+serviceDesc.ServiceName+"/"+name] = float64(cost)
+	}
+
+	sort.Slice(violations, func(i, j int) bool {
+		return violations[i].Description < violations[j].Description
+	})
+
+	return violations
+}
+
+// violationsOf returns the field violations in an error from a Validate method,
+// with the fields prefixed to say what was validated.
+func violationsOf(prefix string, err error) []pderr.FieldViolation {
+	if err == nil {
+		return nil
+	}
+
+	var rv []pderr.FieldViolation
+	for _, detail := range status.Convert(err).Details() {
+		if badRequest, ok := detail.(*errdetails.BadRequest); ok {
+			for _, v := range badRequest.FieldViolations {
+				rv = append(rv, pderr.FieldViolation{Field: prefix + "." + v.Field, Description: prefix + ": " + v.Description})
+			}
+		}
+	}
+	if len(rv) == 0 {
+		rv = append(rv, pderr.FieldViolation{Field: prefix, Description: prefix + ": " + err.Error()})
+	}
+	return rv
+}
+
+func checkPort(name string, port int, optional bool) []pderr.FieldViolation {
+	if (optional && port == 0) || (port >= 1 && port <= 65535) {
+		return nil
+	}
+	return []pderr.FieldViolation{{Field: name, Description: fmt.Sprintf("--%s must be a TCP port between 1 and 65535, not %d", name, port)}}
+}
+
+// violations returns everything wrong with the parameters.
+func (p *Params) violations() []pderr.FieldViolation {
+	var rv []pderr.FieldViolation
+	add := func(field, format string, args ...any) {
+		rv = append(rv, pderr.FieldViolation{Field: field, Description: fmt.Sprintf(format, args...)})
+	}
+
+	rv = append(rv, checkPort("port", p.ListenAddress.Port, false)...)
+	rv = append(rv, checkPort("metrics-port", p.MetricsPort, true)...)
+	rv = append(rv, checkPort("gateway-port", p.GatewayPort, true)...)
+
+	portUsers := map[int]string{}
+	for _, port := range []struct {
+		name   string
+		number int
+	}{
+		{"port", p.ListenAddress.Port},
+		{"metrics-port", p.MetricsPort},
+		{"gateway-port", p.GatewayPort},
+	} {
+		if port.number == 0 {
+			continue
+		}
+		if other, ok := portUsers[port.number]; ok {
+			add(port.name, "--%s and --%s are both %d", other, port.name, port.number)
+		}
+		portUsers[port.number] = port.name
+	}
+
+	if (p.TLS.CertFile == "") != (p.TLS.KeyFile == "") {
+		add("tls-key", "--tls-cert and --tls-key must be given together")
+	}
+	if p.TLS.CertFile == "" && (p.TLS.ClientCAFile != "" || p.ClientCertAuth) {
+		add("tls-cert", "--client-ca and --client-cert-auth require --tls-cert")
+	}
+	if p.TLS.RequireClientCert && p.TLS.ClientCAFile == "" {
+		add("client-ca", "--require-client-cert requires --client-ca")
+	}
+
+	if p.DBMaxOpenConns < 0 {
+		add("db-max-open-conns", "--db-max-open-conns must not be negative")
+	}
+	if p.DBMaxIdleConns < 0 {
+		add("db-max-idle-conns", "--db-max-idle-conns must not be negative")
+	}
+	if p.DBMaxOpenConns > 0 && p.DBMaxIdleConns > p.DBMaxOpenConns {
+		add("db-max-idle-conns", "--db-max-idle-conns (%d) must not exceed --db-max-open-conns (%d)", p.DBMaxIdleConns, p.DBMaxOpenConns)
+	}
+
+	if p.DBConnMaxLifetime < 0 || p.DBConnMaxIdleTime < 0 {
+		add("db-conn-max-lifetime", "--db-conn-max-lifetime and --db-conn-max-idle-time must not be negative")
+	}
+	if p.RPCTimeout < 0 {
+		add("rpc-timeout", "--rpc-timeout must not be negative")
+	}
+
+	if p.ShutdownDrainTimeout < 0 {
+		add("shutdown-drain-timeout", "--shutdown-drain-timeout must not be negative")
+	}
+	if p.HealthCheckInterval < 0 {
+		add("health-check-interval", "--health-check-interval must not be negative")
+	}
+	if p.TraceSampleRatio < 0 || p.TraceSampleRatio > 1 {
+		add("trace-sample-ratio", "--trace-sample-ratio must be between 0 and 1")
+	}
+
+	switch pdserver.RegistrationMode(p.RegistrationMode) {
+	case pdserver.RegistrationOpen, pdserver.RegistrationInviteOnly:
+	default:
+		add("registration-mode", "--registration-mode must be open or invite-only, not %q", p.RegistrationMode)
+	}
+
+	for _, policy := range []struct {
+		prefix string
+		policy loginthrottle.Policy
+	}{
+		{"login", p.LoginThrottle.PerUsername},
+		{"login-ip", p.LoginThrottle.PerIP},
+	} {
+		if policy.policy.FreeAttempts < 0 || policy.policy.LockoutThreshold < 0 {
+			add(policy.prefix+"-free-attempts", "--%s-free-attempts and --%s-lockout-threshold must not be negative", policy.prefix, policy.prefix)
+		}
+		if policy.policy.MaxDelay < 0 || policy.policy.LockoutDuration < 0 {
+			add(policy.prefix+"-max-backoff", "--%s-max-backoff and --%s-lockout-duration must not be negative", policy.prefix, policy.prefix)
+		}
+	}
+
+	for _, limit := range []struct {
+		prefix string
+		rate   float64
+		burst  float64
+	}{
+		{"rate-limit-user", p.RateLimit.PerUser.Rate, p.RateLimit.PerUser.Burst},
+		{"rate-limit-ip", p.RateLimit.PerIP.Rate, p.RateLimit.PerIP.Burst},
+	} {
+		if limit.rate < 0 {
+			add(limit.prefix+"-rate", "--%s-rate must not be negative", limit.prefix)
+		}
+		if limit.rate > 0 && limit.burst < 1 {
+			add(limit.prefix+"-burst", "--%s-burst must be at least 1 while rate limiting is enabled", limit.prefix)
+		}
+	}
+
+	rv = append(rv, p.CredentialParams.violations()...)
+	rv = append(rv, violationsOf("token lifetimes", p.TokenLifetimes.Validate())...)
+
+	return rv
+}
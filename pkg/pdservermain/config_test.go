@@ -0,0 +1,168 @@
+package pdservermain
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/spf13/pflag"
+	"github.com/steinarvk/playdough/pkg/pddb/ratelimit"
+	"github.com/steinarvk/playdough/pkg/pdserver"
+)
+
+func writeTestFile(t *testing.T, name, contents string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestApplyConfigPrecedence(t *testing.T) {
+	secretPath := writeTestFile(t, "secret", "postgres://from-file\n")
+	configPath := writeTestFile(t, "config.yaml", `
+host: 0.0.0.0
+port: 1111
+metrics-port: 2222
+health_check_interval: 1m
+reserved-usernames: [alice, bob]
+rate-limit-method-costs: {Login: 9, GetUser: 2}
+`)
+
+	cmd := NewCobraCommand()
+	flags := cmd.Flags()
+	if err := flags.Parse([]string{"--config", configPath, "--port", "3333"}); err != nil {
+		t.Fatal(err)
+	}
+
+	env := map[string]string{
+		"PLAYDOUGH_METRICS_PORT":     "4444",
+		"PLAYDOUGH_POSTGRES_DB_FILE": secretPath,
+	}
+	lookupEnv := func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	}
+
+	if violations := applyConfig(flags, lookupEnv); len(violations) != 0 {
+		t.Fatalf("applyConfig() = %v", violations)
+	}
+
+	for name, want := range map[string]string{
+		"host":                  "0.0.0.0",
+		"port":                  "3333",
+		"metrics-port":          "4444",
+		"postgres_db":           "postgres://from-file",
+		"health-check-interval": "1m0s",
+		"reserved-usernames":    "[alice,bob]",
+	} {
+		if got := flags.Lookup(name).Value.String(); got != want {
+			t.Errorf("--%s = %q, want %q", name, got, want)
+		}
+	}
+
+	costs, err := flags.GetStringToInt("rate-limit-method-costs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]int{"Login": 9, "GetUser": 2}; !reflect.DeepEqual(costs, want) {
+		t.Errorf("--rate-limit-method-costs = %v, want %v", costs, want)
+	}
+}
+
+func TestApplyConfigReportsEveryError(t *testing.T) {
+	configPath := writeTestFile(t, "config.yaml", `
+port: eighty
+no-such-setting: 1
+postgres_db: x
+postgres_db_file: /dev/null
+`)
+
+	cmd := NewCobraCommand()
+	flags := cmd.Flags()
+	if err := flags.Parse([]string{"--config", configPath}); err != nil {
+		t.Fatal(err)
+	}
+
+	env := map[string]string{
+		"PLAYDOUGH_GATEWAY_PORT": "-",
+	}
+	lookupEnv := func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	}
+
+	var fields []string
+	for _, v := range applyConfig(flags, lookupEnv) {
+		fields = append(fields, v.Field)
+	}
+
+	want := []string{
+		"PLAYDOUGH_GATEWAY_PORT",
+		"config file setting port",
+		"config file setting postgres_db",
+		"no-such-setting",
+	}
+	sortedFields := append([]string(nil), fields...)
+	sort.Strings(sortedFields)
+	if !reflect.DeepEqual(sortedFields, want) {
+		t.Errorf("violations for %v, want %v", fields, want)
+	}
+}
+
+func TestParamsViolations(t *testing.T) {
+	params := Params{
+		ListenAddress:    ListenAddress{Port: defaultListenPort},
+		GatewayPort:      defaultListenPort,
+		RegistrationMode: "open",
+		CredentialParams: DefaultCredentialParams(),
+		TokenLifetimes:   pdserver.DefaultTokenLifetimes(),
+		RateLimit:        ratelimit.DefaultParams(),
+	}
+	params.PasswordHashing.Parallelism = 0
+	params.TokenLifetimes.Session = 0
+	params.RateLimit.PerIP.Burst = 0
+
+	var fields []string
+	for _, v := range params.violations() {
+		fields = append(fields, v.Field)
+	}
+
+	want := []string{
+		"gateway-port",
+		"rate-limit-ip-burst",
+		"argon2.parallelism",
+		"token lifetimes.session",
+	}
+	if !reflect.DeepEqual(fields, want) {
+		t.Errorf("violations for %v, want %v", fields, want)
+	}
+}
+
+func TestSharedConfigIgnoresOtherCommandsSettings(t *testing.T) {
+	configPath := writeTestFile(t, "config.yaml", `
+port: 1111
+reserved-usernames: [alice]
+`)
+
+	flags := pflag.NewFlagSet("admin", pflag.ContinueOnError)
+	AddConfigFlag(flags)
+	credentials := DefaultCredentialParams()
+	credentials.AddFlags(flags)
+	if err := flags.Parse([]string{"--config", configPath}); err != nil {
+		t.Fatal(err)
+	}
+
+	noEnv := func(string) (string, bool) { return "", false }
+	if violations := applyConfigSettings(flags, noEnv, false); len(violations) != 0 {
+		t.Fatalf("applyConfigSettings() = %v", violations)
+	}
+
+	if want := []string{"alice"}; !reflect.DeepEqual(credentials.CredentialPolicy.ReservedUsernames, want) {
+		t.Errorf("reserved usernames = %v, want %v", credentials.CredentialPolicy.ReservedUsernames, want)
+	}
+}
@@ -0,0 +1,128 @@
+package pdservermain
+
+import (
+	"fmt"
+
+	"github.com/spf13/pflag"
+	"github.com/steinarvk/playdough/pkg/pddb/userdb"
+	"github.com/steinarvk/playdough/pkg/pderr"
+)
+
+// CredentialParams control how usernames and passwords are validated and hashed.
+// The admin commands that create users take them too, so that those users follow
+// the same rules as users registering through the server.
+type CredentialParams struct {
+	PasswordHashing      userdb.Argon2Params
+	CredentialPolicy     userdb.CredentialPolicy
+	CredentialPolicyFile string
+
+	// The flags that override settings from the policy file.
+	policyFlags []*pflag.Flag
+}
+
+func DefaultCredentialParams() CredentialParams {
+	return CredentialParams{
+		PasswordHashing:  userdb.DefaultArgon2Params(),
+		CredentialPolicy: userdb.DefaultCredentialPolicy(),
+	}
+}
+
+// AddFlags registers the flags for the parameters, with their current values as defaults.
+func (c *CredentialParams) AddFlags(flags *pflag.FlagSet) {
+	flags.Uint32Var(&c.PasswordHashing.TimeCost, "argon2-time-cost", c.PasswordHashing.TimeCost, "argon2 time cost (iterations) for hashing passwords")
+	flags.Uint32Var(&c.PasswordHashing.MemoryCost, "argon2-memory-cost", c.PasswordHashing.MemoryCost, "argon2 memory cost (KiB) for hashing passwords")
+	flags.Uint32Var(&c.PasswordHashing.KeyLength, "argon2-key-length", c.PasswordHashing.KeyLength, "argon2 output length (bytes) for hashing passwords")
+	flags.Uint32Var(&c.PasswordHashing.Parallelism, "argon2-parallelism", c.PasswordHashing.Parallelism, "argon2 parallelism for hashing passwords")
+
+	policy := &c.CredentialPolicy
+	flags.StringVar(&c.CredentialPolicyFile, "credential-policy-file", "", "YAML file with the username and password policy (flags below override it)")
+	flags.IntVar(&policy.MinUsernameLength, "username-min-length", policy.MinUsernameLength, "minimum username length (characters)")
+	flags.IntVar(&policy.MaxUsernameLength, "username-max-length", policy.MaxUsernameLength, "maximum username length (characters)")
+	flags.StringVar((*string)(&policy.UsernameCharset), "username-charset", string(policy.UsernameCharset), "characters allowed in usernames: ascii, ascii-extended or unicode")
+	flags.StringSliceVar(&policy.ReservedUsernames, "reserved-usernames", policy.ReservedUsernames, "usernames that cannot be registered")
+	flags.BoolVar(&policy.NormalizeUsernames, "normalize-usernames", policy.NormalizeUsernames, "apply Unicode NFKC normalization to usernames")
+	flags.IntVar(&policy.MinPasswordLength, "password-min-length", policy.MinPasswordLength, "minimum password length (characters)")
+	flags.IntVar(&policy.MaxPasswordLength, "password-max-length", policy.MaxPasswordLength, "maximum password length (characters)")
+	flags.IntVar(&policy.MinPasswordCharacterClasses, "password-min-character-classes", policy.MinPasswordCharacterClasses, "how many of lowercase, uppercase, digits and other characters passwords must contain")
+	flags.StringVar(&policy.BreachedPasswordsFile, "breached-passwords-file", policy.BreachedPasswordsFile, "file of breached passwords to refuse, in plain text or SHA-1 hex")
+
+	for _, name := range []string{
+		"username-min-length",
+		"username-max-length",
+		"username-charset",
+		"reserved-usernames",
+		"normalize-usernames",
+		"password-min-length",
+		"password-max-length",
+		"password-min-character-classes",
+		"breached-passwords-file",
+	} {
+		c.policyFlags = append(c.policyFlags, flags.Lookup(name))
+	}
+}
+
+// loadPolicyFile replaces the policy with the one from the policy file, if any,
+// except for settings also given explicitly as flags, which take precedence.
+func (c *CredentialParams) loadPolicyFile() []pderr.FieldViolation {
+	if c.CredentialPolicyFile == "" {
+		return nil
+	}
+
+	overrides := map[*pflag.Flag][]string{}
+	for _, f := range c.policyFlags {
+		if !f.Changed {
+			continue
+		}
+		if sv, ok := f.Value.(pflag.SliceValue); ok {
+			overrides[f] = sv.GetSlice()
+		} else {
+			overrides[f] = []string{f.Value.String()}
+		}
+	}
+
+	loaded, err := userdb.LoadCredentialPolicyFile(c.CredentialPolicyFile, userdb.DefaultCredentialPolicy())
+	if err != nil {
+		return violationsOf("credential-policy-file", err)
+	}
+	c.CredentialPolicy = loaded
+
+	for f, value := range overrides {
+		if sv, ok := f.Value.(pflag.SliceValue); ok {
+			err = sv.Replace(value)
+		} else {
+			err = f.Value.Set(value[0])
+		}
+		if err != nil {
+			return violationsOf("credential-policy-file", pderr.Wrap(fmt.Sprintf("failed to reapply flag --%s", f.Name), err))
+		}
+	}
+
+	return nil
+}
+
+func (c *CredentialParams) violations() []pderr.FieldViolation {
+	var rv []pderr.FieldViolation
+	rv = append(rv, violationsOf("argon2", c.PasswordHashing.Validate())...)
+	rv = append(rv, violationsOf("credential policy", c.CredentialPolicy.Validate())...)
+	return rv
+}
+
+// Load reads the credential policy file, if any, and checks the parameters.
+func (c *CredentialParams) Load() error {
+	violations := c.loadPolicyFile()
+	violations = append(violations, c.violations()...)
+
+	if len(violations) > 0 {
+		return pderr.InvalidFields("invalid credential settings", violations...)
+	}
+
+	return nil
+}
+
+// UserDBOptions configures a user database to follow the parameters.
+func (c *CredentialParams) UserDBOptions() []userdb.Option {
+	return []userdb.Option{
+		userdb.WithArgon2Params(c.PasswordHashing),
+		userdb.WithCredentialPolicy(c.CredentialPolicy),
+	}
+}
@@ -0,0 +1,59 @@
+package pdservermain
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// How long a single database ping may take before the server is considered unhealthy.
+const healthCheckPingTimeout = 5 * time.Second
+
+// setServingStatus sets the status of both the server as a whole (the empty
+// service name) and each of the named services.
+func setServingStatus(healthServer *health.Server, services []string, status healthpb.HealthCheckResponse_ServingStatus) {
+	healthServer.SetServingStatus("", status)
+	for _, service := range services {
+		healthServer.SetServingStatus(service, status)
+	}
+}
+
+// runHealthChecks pings the database every interval, reporting NOT_SERVING while
+// the pings fail, until the context is cancelled.
+func runHealthChecks(ctx context.Context, db *sql.DB, healthServer *health.Server, services []string, interval time.Duration, logger *zap.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	serving := true
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		pingCtx, cancel := context.WithTimeout(ctx, healthCheckPingTimeout)
+		err := db.PingContext(pingCtx)
+		cancel()
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		switch {
+		case err != nil && serving:
+			logger.Error("database health check failed; reporting NOT_SERVING", zap.Error(err))
+			setServingStatus(healthServer, services, healthpb.HealthCheckResponse_NOT_SERVING)
+		case err == nil && !serving:
+			logger.Info("database health check succeeded again; reporting SERVING")
+			setServingStatus(healthServer, services, healthpb.HealthCheckResponse_SERVING)
+		}
+
+		serving = err == nil
+	}
+}
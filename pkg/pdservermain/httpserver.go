@@ -0,0 +1,66 @@
+package pdservermain
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/steinarvk/playdough/pkg/pdtls"
+	"go.uber.org/zap"
+)
+
+// httpReadHeaderTimeout bounds how long a client may take to send request
+// headers, so that slow clients cannot tie up connections indefinitely.
+const httpReadHeaderTimeout = 10 * time.Second
+
+// httpServer serves HTTP alongside gRPC, e.g. the JSON gateway or metrics.
+type httpServer struct {
+	server   *http.Server
+	serveErr chan error
+}
+
+// startHTTPServer listens on listenAddr and serves the handler in the background,
+// over TLS if tlsConfig is not nil.
+func startHTTPServer(listenAddr string, handler http.Handler, tlsConfig *tls.Config) (*httpServer, error) {
+	listener, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, pdtls.WithNextProtos(tlsConfig, "http/1.1"))
+	}
+
+	rv := &httpServer{
+		server: &http.Server{
+			Handler:           handler,
+			ReadHeaderTimeout: httpReadHeaderTimeout,
+		},
+		serveErr: make(chan error, 1),
+	}
+
+	go func() {
+		err := rv.server.Serve(listener)
+		if errors.Is(err, http.ErrServerClosed) {
+			err = nil
+		}
+		rv.serveErr <- err
+	}()
+
+	return rv, nil
+}
+
+// stop lets in-flight requests finish, but cancels them if they take longer than
+// the timeout.
+func (g *httpServer) stop(timeout time.Duration, logger *zap.Logger) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := g.server.Shutdown(ctx); err != nil {
+		logger.Warn("drain timeout exceeded; closing remaining HTTP connections", zap.Duration("drain_timeout", timeout))
+		g.server.Close()
+	}
+}
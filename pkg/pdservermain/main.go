@@ -2,26 +2,60 @@ package pdservermain
 
 import (
 	"context"
+	"crypto/tls"
 	"database/sql"
 	"fmt"
 	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/lib/pq"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 	"github.com/steinarvk/playdough/pkg/ezcobra"
 	"github.com/steinarvk/playdough/pkg/logging"
 	"github.com/steinarvk/playdough/pkg/pdauth"
 	"github.com/steinarvk/playdough/pkg/pddb"
+	"github.com/steinarvk/playdough/pkg/pddb/loginthrottle"
+	"github.com/steinarvk/playdough/pkg/pddb/ratelimit"
+	"github.com/steinarvk/playdough/pkg/pddebug"
 	"github.com/steinarvk/playdough/pkg/pderr"
+	"github.com/steinarvk/playdough/pkg/pdgateway"
+	"github.com/steinarvk/playdough/pkg/pdpeer"
 	"github.com/steinarvk/playdough/pkg/pdserver"
+	"github.com/steinarvk/playdough/pkg/pdtls"
+	"github.com/steinarvk/playdough/pkg/pdtrace"
 	"github.com/steinarvk/playdough/proto/pdpb"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
 )
 
 const (
 	defaultListenPort = 5044
+
+	defaultShutdownDrainTimeout = 30 * time.Second
+
+	defaultHealthCheckInterval = 10 * time.Second
+
+	// The database/sql default.
+	defaultDBMaxIdleConns = 2
+
+	defaultRPCTimeout = 30 * time.Second
+
+	loginThrottleCleanupInterval = 10 * time.Minute
+
+	rateLimitCleanupInterval = time.Minute
 )
 
 type ListenAddress struct {
@@ -33,23 +67,114 @@ type Params struct {
 	ListenAddress            ListenAddress
 	PostgresConnectionString string
 	Automigrate              bool
+	LoginThrottle            loginthrottle.Params
+	RateLimit                ratelimit.Params
+	CredentialParams
+	RegistrationMode string
+	TokenLifetimes   pdserver.TokenLifetimes
+	// How long to wait for in-flight requests on shutdown before cancelling them.
+	ShutdownDrainTimeout time.Duration
+	// How often to ping the database to decide what the health service reports.
+	HealthCheckInterval time.Duration
+	TLS                 pdtls.ServerParams
+	// Authenticate requests without an authorization header as the user named by
+	// their verified TLS client certificate.
+	ClientCertAuth bool
+	// If nonzero, serve Prometheus metrics at /metrics on this port.
+	MetricsPort int
+	// The fraction of requests without a sampled traceparent header to trace.
+	TraceSampleRatio float64
+	// If nonzero, serve an HTTP/JSON gateway to PlaydoughService on this port.
+	GatewayPort int
+	// Database connection pool limits; zero open connections means no limit.
+	DBMaxOpenConns int
+	DBMaxIdleConns int
+	// Connections are closed once this old, or idle for this long; zero means never.
+	DBConnMaxLifetime time.Duration
+	DBConnMaxIdleTime time.Duration
+	// The longest any RPC may run, including its database transactions; zero
+	// means no limit beyond the client's deadline.
+	RPCTimeout time.Duration
 }
 
 func NewCobraCommand() *cobra.Command {
-	var params Params
+	params := Params{
+		LoginThrottle:    loginthrottle.DefaultParams(),
+		RateLimit:        ratelimit.DefaultParams(),
+		CredentialParams: DefaultCredentialParams(),
+		TokenLifetimes:   pdserver.DefaultTokenLifetimes(),
+	}
+
+	params.RateLimit.MethodCosts = pdserver.DefaultMethodCosts()
+
+	var flags *pflag.FlagSet
+	var methodCostFlags map[string]int
 
 	rv := &cobra.Command{
 		Use:   "serve",
 		Short: "run a PlayDoughService gRPC server",
-		Run: ezcobra.RunNoArgs(func(ctx context.Context) error {
+		Long:  "Run a PlayDoughService gRPC server.\n\n" + configHelp,
+		Run: ezcobra.RunNoArgsUntilSignalled(func(ctx context.Context) error {
+			violations := applyConfig(flags, os.LookupEnv)
+			violations = append(violations, params.CredentialParams.loadPolicyFile()...)
+			violations = append(violations, applyMethodCostFlags(params.RateLimit.MethodCosts, methodCostFlags)...)
+			violations = append(violations, params.violations()...)
+
+			if len(violations) > 0 {
+				return pderr.InvalidFields("invalid serve configuration", violations...)
+			}
+
 			return Main(ctx, params)
 		}),
 	}
+	flags = rv.Flags()
+
+	AddConfigFlag(rv.Flags())
 
 	rv.Flags().StringVar(&params.ListenAddress.Host, "host", "localhost", "address on which to listen")
 	rv.Flags().StringVar(&params.PostgresConnectionString, "postgres_db", "", "postgres connection string")
 	rv.Flags().BoolVar(&params.Automigrate, "automigrate", true, "run database migrations on startup")
 	rv.Flags().IntVar(&params.ListenAddress.Port, "port", defaultListenPort, "port on which to listen")
+	rv.Flags().IntVar(&params.DBMaxOpenConns, "db-max-open-conns", 0, "maximum number of open database connections (0 for no limit)")
+	rv.Flags().IntVar(&params.DBMaxIdleConns, "db-max-idle-conns", defaultDBMaxIdleConns, "maximum number of idle database connections to keep open")
+	rv.Flags().DurationVar(&params.DBConnMaxLifetime, "db-conn-max-lifetime", 0, "close database connections once they are this old (0 to keep them forever)")
+	rv.Flags().DurationVar(&params.DBConnMaxIdleTime, "db-conn-max-idle-time", 0, "close database connections once they have been idle this long (0 to keep them forever)")
+	rv.Flags().DurationVar(&params.RPCTimeout, "rpc-timeout", defaultRPCTimeout, "longest time any request may run; also bounds postgres statement_timeout and idle_in_transaction_session_timeout for its transactions (0 for no limit beyond the client's deadline)")
+	rv.Flags().IntVar(&params.MetricsPort, "metrics-port", 0, "port on which to serve Prometheus metrics at /metrics, over plain HTTP (0 to disable)")
+	rv.Flags().Float64Var(&params.TraceSampleRatio, "trace-sample-ratio", 0, "fraction of new traces to sample and log spans for; requests with a sampled traceparent header or debugging enabled are always traced")
+	rv.Flags().IntVar(&params.GatewayPort, "gateway-port", 0, "port on which to serve PlaydoughService as JSON over HTTP, with an OpenAPI document at /openapi.json (0 to disable)")
+	rv.Flags().StringVar(&params.TLS.CertFile, "tls-cert", "", "PEM certificate (chain) to serve TLS with; reloaded when it changes")
+	rv.Flags().StringVar(&params.TLS.KeyFile, "tls-key", "", "PEM private key for --tls-cert; reloaded when it changes")
+	rv.Flags().StringVar(&params.TLS.ClientCAFile, "client-ca", "", "PEM CA certificates to verify TLS client certificates with (enables mutual TLS)")
+	rv.Flags().BoolVar(&params.TLS.RequireClientCert, "require-client-cert", false, "reject clients without a certificate signed by --client-ca")
+	rv.Flags().BoolVar(&params.ClientCertAuth, "client-cert-auth", false, "authenticate requests without an authorization header as the user named by the client certificate's common name")
+	rv.Flags().DurationVar(&params.ShutdownDrainTimeout, "shutdown-drain-timeout", defaultShutdownDrainTimeout, "on SIGINT or SIGTERM, how long to let in-flight requests finish before cancelling them")
+	rv.Flags().DurationVar(&params.HealthCheckInterval, "health-check-interval", defaultHealthCheckInterval, "how often to ping the database to decide whether the gRPC health service reports SERVING")
+	rv.Flags().StringVar(&params.RegistrationMode, "registration-mode", string(pdserver.RegistrationOpen), "who may create accounts: open, or invite-only (requires an invite code from an existing user)")
+
+	rv.Flags().IntVar(&params.LoginThrottle.PerUsername.FreeAttempts, "login-free-attempts", params.LoginThrottle.PerUsername.FreeAttempts, "failed logins per username before backoff applies")
+	rv.Flags().DurationVar(&params.LoginThrottle.PerUsername.MaxDelay, "login-max-backoff", params.LoginThrottle.PerUsername.MaxDelay, "maximum backoff between failed logins per username")
+	rv.Flags().IntVar(&params.LoginThrottle.PerUsername.LockoutThreshold, "login-lockout-threshold", params.LoginThrottle.PerUsername.LockoutThreshold, "failed logins per username before temporary lockout (0 to disable)")
+	rv.Flags().DurationVar(&params.LoginThrottle.PerUsername.LockoutDuration, "login-lockout-duration", params.LoginThrottle.PerUsername.LockoutDuration, "duration of temporary lockout per username")
+	rv.Flags().IntVar(&params.LoginThrottle.PerIP.FreeAttempts, "login-ip-free-attempts", params.LoginThrottle.PerIP.FreeAttempts, "failed logins per client IP before backoff applies")
+	rv.Flags().DurationVar(&params.LoginThrottle.PerIP.MaxDelay, "login-ip-max-backoff", params.LoginThrottle.PerIP.MaxDelay, "maximum backoff between failed logins per client IP")
+	rv.Flags().IntVar(&params.LoginThrottle.PerIP.LockoutThreshold, "login-ip-lockout-threshold", params.LoginThrottle.PerIP.LockoutThreshold, "failed logins per client IP before temporary lockout (0 to disable)")
+	rv.Flags().DurationVar(&params.LoginThrottle.PerIP.LockoutDuration, "login-ip-lockout-duration", params.LoginThrottle.PerIP.LockoutDuration, "duration of temporary lockout per client IP")
+
+	rv.Flags().Float64Var(&params.RateLimit.PerUser.Rate, "rate-limit-user-rate", params.RateLimit.PerUser.Rate, "request tokens per second per authenticated user (0 to disable)")
+	rv.Flags().Float64Var(&params.RateLimit.PerUser.Burst, "rate-limit-user-burst", params.RateLimit.PerUser.Burst, "maximum request tokens per authenticated user")
+	rv.Flags().Float64Var(&params.RateLimit.PerIP.Rate, "rate-limit-ip-rate", params.RateLimit.PerIP.Rate, "request tokens per second per client IP, for unauthenticated requests (0 to disable)")
+	rv.Flags().Float64Var(&params.RateLimit.PerIP.Burst, "rate-limit-ip-burst", params.RateLimit.PerIP.Burst, "maximum request tokens per client IP, for unauthenticated requests")
+	rv.Flags().StringToIntVar(&methodCostFlags, "rate-limit-method-costs", nil, "request tokens per call of PlaydoughService methods, overriding the defaults, e.g. Login=10,GetUser=1")
+	rv.Flags().BoolVar(&params.RateLimit.Shared, "rate-limit-shared", false, "keep rate limiting buckets in postgres, shared between all servers using the database")
+
+	rv.Flags().DurationVar(&params.TokenLifetimes.Session, "session-token-lifetime", params.TokenLifetimes.Session, "how long session tokens issued at login are valid")
+	rv.Flags().DurationVar(&params.TokenLifetimes.DefaultAPIKey, "api-key-default-lifetime", params.TokenLifetimes.DefaultAPIKey, "how long API keys are valid unless the client asks otherwise")
+	rv.Flags().DurationVar(&params.TokenLifetimes.MaxAPIKey, "api-key-max-lifetime", params.TokenLifetimes.MaxAPIKey, "the longest validity clients may ask for API keys")
+	rv.Flags().DurationVar(&params.TokenLifetimes.DefaultPasswordReset, "password-reset-default-lifetime", params.TokenLifetimes.DefaultPasswordReset, "how long password reset tokens are valid unless the admin asks otherwise")
+	rv.Flags().DurationVar(&params.TokenLifetimes.MaxPasswordReset, "password-reset-max-lifetime", params.TokenLifetimes.MaxPasswordReset, "the longest validity admins may ask for password reset tokens")
+
+	params.CredentialParams.AddFlags(rv.Flags())
 
 	return rv
 }
@@ -70,68 +195,203 @@ func Main(ctx context.Context, params Params) error {
 		listenPort = defaultListenPort
 	}
 
-	db, err := sql.Open("postgres", params.PostgresConnectionString)
-	if err != nil {
-		return pderr.Wrap("failed to open database connection", err)
-	}
-
-	if err := db.Ping(); err != nil {
-		return pderr.Wrap("failed to ping database", err)
+	shutdownDrainTimeout := params.ShutdownDrainTimeout
+	if shutdownDrainTimeout == 0 {
+		shutdownDrainTimeout = defaultShutdownDrainTimeout
 	}
 
-	if params.Automigrate {
-		if err := pddb.RunMigrations(ctx, db); err != nil {
-			return pderr.Wrap("failed to run migrations", err)
-		}
+	healthCheckInterval := params.HealthCheckInterval
+	if healthCheckInterval == 0 {
+		healthCheckInterval = defaultHealthCheckInterval
 	}
 
-	pdServer, err := pdserver.New(db)
+	connector, err := pq.NewConnector(params.PostgresConnectionString)
 	if err != nil {
-		return err
+		return pderr.Wrap("failed to open database connection", err)
 	}
+	db := sql.OpenDB(pdtrace.WrapConnector(pddb.WithDeadlineTimeouts(connector)))
+	db.SetMaxOpenConns(params.DBMaxOpenConns)
+	db.SetMaxIdleConns(params.DBMaxIdleConns)
+	db.SetConnMaxLifetime(params.DBConnMaxLifetime)
+	db.SetConnMaxIdleTime(params.DBConnMaxIdleTime)
+
+	defer func() {
+		if err := db.Close(); err != nil {
+			logger.Warn("failed to close database", zap.Error(err))
+		}
+	}()
+
+	// Background workers are stopped, and waited for, before the database is closed.
+	workerCtx, stopWorkers := context.WithCancel(ctx)
+	var workers sync.WaitGroup
+	defer func() {
+		stopWorkers()
+		workers.Wait()
+	}()
+
+	loginThrottle := loginthrottle.New(db, params.LoginThrottle)
+	rateLimiter := ratelimit.New(db, params.RateLimit)
+	authValidator := pdauth.NewValidator(db)
 
-	listenAddr := fmt.Sprintf("%s:%d", listenHost, listenPort)
-
-	listener, err := net.Listen("tcp", listenAddr)
+	pdServer, err := pdserver.New(
+		db,
+		pdserver.WithLoginThrottle(loginThrottle),
+		pdserver.WithAuthValidator(authValidator),
+		pdserver.WithRegistrationMode(pdserver.RegistrationMode(params.RegistrationMode)),
+		pdserver.WithTokenLifetimes(params.TokenLifetimes),
+		pdserver.WithUserDBOptions(params.CredentialParams.UserDBOptions()...),
+	)
 	if err != nil {
 		return err
 	}
 
-	authValidator := pdauth.NewValidator(db)
+	metrics := newServerMetrics(db, authValidator)
+	tracer := pdtrace.NewTracer(pdtrace.LogExporter(logger), params.TraceSampleRatio)
 
 	var opts []grpc.ServerOption
+	var tlsConfig *tls.Config
 
-	opts = append(opts, grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if params.TLS.CertFile != "" || params.TLS.KeyFile != "" {
+		tlsConfig, err = pdtls.ServerConfig(ctx, params.TLS)
+		if err != nil {
+			return err
+		}
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	} else if params.TLS.ClientCAFile != "" || params.ClientCertAuth {
+		return pderr.MissingRequiredFlag("--tls-cert")
+	} else {
+		logger.Warn("serving without TLS; don't do this in production")
+	}
+
+	// Until the database has been checked and migrated, only the health service is available.
+	var ready atomic.Bool
+
+	// Traces, times and counts every request, and sets its deadline.
+	observeInterceptor := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
 		t0 := time.Now()
 
+		md, _ := metadata.FromIncomingContext(ctx)
+		debugSettings := pddebug.SettingsFromMetadata(md)
+
+		var traceparent string
+		if values := md.Get(pdtrace.TraceparentHeader); len(values) > 0 {
+			traceparent = values[0]
+		}
+		ctx, span := tracer.StartRemote(ctx, info.FullMethod, traceparent, debugSettings.EnableDebug)
+		traceID := span.Context().TraceID
+
+		// The deadline also bounds the database transactions the request runs.
+		if params.RPCTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, params.RPCTimeout)
+			defer cancel()
+		}
+
+		completed := false
+		defer func() {
+			// A panic is recorded as the error the recovery interceptor turns it into.
+			if !completed {
+				resp, err = nil, errPanic
+			}
+
+			duration := time.Since(t0)
+
+			metrics.observe(info.FullMethod, resp, err, duration)
+
+			span.SetAttributes(zap.String("rpc.method", info.FullMethod), zap.Stringer("rpc.code", status.Code(err)))
+			if err != nil {
+				span.SetError(err)
+			}
+			span.End()
+
+			if debugSettings.EnableDebug {
+				debugInfo, marshalErr := pddebug.InfoMetadata(&pdpb.ResponseDebugInfo{
+					TraceId:              traceID.String(),
+					ServerProcessingTime: duration.Seconds(),
+				})
+				if marshalErr == nil {
+					marshalErr = grpc.SetHeader(ctx, debugInfo)
+				}
+				if marshalErr != nil {
+					logger.Warn("failed to send debug info", zap.Stringer("trace_id", traceID), zap.Error(marshalErr))
+				}
+			}
+		}()
+
 		sublogger := logger.With(
 			zap.String("method", info.FullMethod),
+			zap.Stringer("trace_id", traceID),
 		)
+		ctx = logging.NewContextWithLogger(ctx, sublogger, debugSettings.EnableDebug)
+
+		resp, err = handler(ctx, req)
+		completed = true
+
+		return resp, err
+	}
+
+	// Authenticates, rate limits and authorizes every request, and logs its outcome.
+	authInterceptor := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		t0 := time.Now()
+
+		md, _ := metadata.FromIncomingContext(ctx)
+		loggingData := logging.DataFromContext(ctx)
+		sublogger := loggingData.Logger
+
+		if !ready.Load() && !strings.HasPrefix(info.FullMethod, "/"+healthpb.Health_ServiceDesc.ServiceName+"/") {
+			return nil, pderr.Error(codes.Unavailable, "server is starting up")
+		}
 
 		var authHeader string
-		md, ok := metadata.FromIncomingContext(ctx)
-		if ok {
-			authHeaderValue, ok := md["authorization"]
-			if ok && len(authHeaderValue) > 0 {
-				authHeader = authHeaderValue[0]
+		if authHeaderValue := md.Get("authorization"); len(authHeaderValue) > 0 {
+			authHeader = authHeaderValue[0]
+		}
+		// Requests that fail authentication are charged to the client IP, since
+		// otherwise a stream of bogus credentials would never be rate limited.
+		rejectAuth := func(message string) error {
+			if err := rateLimiter.Allow(ctx, info.FullMethod, "", pdpeer.ClientIP(ctx)); err != nil {
+				return err
 			}
+			return pderr.Unauthenticated(message)
 		}
+
 		authInfo, err := authValidator.ValidateHeader(ctx, authHeader)
 		if err != nil {
 			sublogger.Warn("token validation failed", zap.Error(err))
-			return nil, pderr.Unauthenticated("bad token")
+			return nil, rejectAuth("bad token")
+		}
+		if authHeader == "" && params.ClientCertAuth {
+			if certificateName, ok := pdtls.VerifiedClientName(ctx); ok {
+				authInfo, err = authValidator.ValidateClientCertificate(ctx, certificateName)
+				if err != nil {
+					sublogger.Warn("client certificate authentication failed", zap.String("certificate_name", certificateName), zap.Error(err))
+					return nil, rejectAuth("bad client certificate")
+				}
+			}
 		}
 		ctx = pdauth.NewContextWithAuth(ctx, authInfo)
 
-		// TODO metadata for debug settings
-
 		sublogger = sublogger.With(
 			zap.Bool("authenticated", authInfo.IsAuthenticated),
 			zap.String("auth_username", authInfo.AuthenticatedUsername),
+			zap.Bool("auth_api_key", authInfo.IsAPIKey()),
+			zap.Bool("auth_client_cert", authInfo.ClientCertificate),
+			zap.Any("auth_roles", authInfo.Roles),
 		)
-		debugMode := false
+		ctx = logging.NewContextWithLogger(ctx, sublogger, loggingData.Debug)
 
-		ctx = logging.NewContextWithLogger(ctx, sublogger, debugMode)
+		var rateLimitUsername string
+		if authInfo.IsAuthenticated {
+			rateLimitUsername = authInfo.AuthenticatedUsername
+		}
+		if err := rateLimiter.Allow(ctx, info.FullMethod, rateLimitUsername, pdpeer.ClientIP(ctx)); err != nil {
+			return nil, err
+		}
+
+		if err := pdserver.MethodPolicy(info.FullMethod).Authorize(authInfo); err != nil {
+			sublogger.Warn("gRPC request rejected by authorization policy", zap.Stringer("code", pderr.CodeOf(err)), zap.Error(err))
+			return nil, err
+		}
 
 		sublogger.Info("incoming gRPC request")
 
@@ -147,18 +407,181 @@ func Main(ctx context.Context, params Params) error {
 		}
 
 		return resp, err
-	}))
+	}
+
+	// Shared by gRPC and the JSON gateway, so that both authenticate, authorize and
+	// log alike. Recovery comes first, so that it also catches panics in the others.
+	unaryInterceptors := []grpc.UnaryServerInterceptor{
+		metrics.unaryRecoveryInterceptor(logger),
+		observeInterceptor,
+		authInterceptor,
+	}
+
+	// The streaming methods, those of the health and reflection services, need
+	// neither authentication nor logging, but a panic must not bring down the server.
+	opts = append(opts, grpc.ChainUnaryInterceptor(unaryInterceptors...), grpc.ChainStreamInterceptor(metrics.streamRecoveryInterceptor(logger)))
 
 	grpcServer := grpc.NewServer(opts...)
 	pdpb.RegisterPlaydoughServiceServer(grpcServer, pdServer)
 
+	healthServer := health.NewServer()
+	healthpb.RegisterHealthServer(grpcServer, healthServer)
+	reflection.Register(grpcServer)
+
+	healthCheckedServices := []string{pdpb.PlaydoughService_ServiceDesc.ServiceName}
+	setServingStatus(healthServer, healthCheckedServices, healthpb.HealthCheckResponse_NOT_SERVING)
+
+	if params.MetricsPort != 0 {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics.registry)
+
+		metricsListenAddr := fmt.Sprintf("%s:%d", listenHost, params.MetricsPort)
+		metricsServer, err := startHTTPServer(metricsListenAddr, mux, nil)
+		if err != nil {
+			return err
+		}
+		defer metricsServer.server.Close()
+
+		go func() {
+			if err := <-metricsServer.serveErr; err != nil {
+				logger.Error("metrics server failed", zap.Error(err))
+			}
+		}()
+
+		logger.Info("serving Prometheus metrics", zap.String("listen_addr", metricsListenAddr))
+	}
+
+	listenAddr := fmt.Sprintf("%s:%d", listenHost, listenPort)
+
+	listener, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		return err
+	}
+
+	var gateway *httpServer
+	var gatewayErr <-chan error
+	var gatewayListenAddr string
+
+	if params.GatewayPort != 0 {
+		handler, err := pdgateway.New(&pdpb.PlaydoughService_ServiceDesc, pdServer, chainUnaryInterceptors(unaryInterceptors...))
+		if err != nil {
+			listener.Close()
+			return err
+		}
+
+		gatewayListenAddr = fmt.Sprintf("%s:%d", listenHost, params.GatewayPort)
+		gateway, err = startHTTPServer(gatewayListenAddr, handler, tlsConfig)
+		if err != nil {
+			listener.Close()
+			return err
+		}
+		gatewayErr = gateway.serveErr
+	}
+
+	// Serve the health service, reporting NOT_SERVING, while the database is checked and migrated.
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- grpcServer.Serve(listener)
+	}()
+
+	if err := prepareDatabase(ctx, db, params.Automigrate); err != nil {
+		if gateway != nil {
+			gateway.server.Close()
+		}
+		grpcServer.Stop()
+		<-serveErr
+		return err
+	}
+
+	workers.Add(3)
+	go func() {
+		defer workers.Done()
+		loginThrottle.RunCleanup(workerCtx, loginThrottleCleanupInterval)
+	}()
+	go func() {
+		defer workers.Done()
+		rateLimiter.RunCleanup(workerCtx, rateLimitCleanupInterval)
+	}()
+	go func() {
+		defer workers.Done()
+		runHealthChecks(workerCtx, db, healthServer, healthCheckedServices, healthCheckInterval, logger)
+	}()
+
+	ready.Store(true)
+	setServingStatus(healthServer, healthCheckedServices, healthpb.HealthCheckResponse_SERVING)
+
 	logger.Info("ready to serve gRPC (PlaydoughService)", zap.String("listen_addr", listenAddr))
+	if gateway != nil {
+		logger.Info("ready to serve HTTP/JSON gateway (PlaydoughService)", zap.String("listen_addr", gatewayListenAddr))
+	}
 
-	if err := grpcServer.Serve(listener); err != nil {
-		return pderr.Wrap("gRPC Serve() error", err)
+	select {
+	case err := <-serveErr:
+		if gateway != nil {
+			gateway.server.Close()
+		}
+		if err != nil {
+			return pderr.Wrap("gRPC Serve() error", err)
+		}
+	case err := <-gatewayErr:
+		grpcServer.Stop()
+		<-serveErr
+		return pderr.Wrap("HTTP/JSON gateway Serve() error", err)
+	case <-ctx.Done():
+		logger.Info("shutting down; draining in-flight requests", zap.Duration("drain_timeout", shutdownDrainTimeout))
+		healthServer.Shutdown()
+		var drained sync.WaitGroup
+		if gateway != nil {
+			drained.Add(1)
+			go func() {
+				defer drained.Done()
+				gateway.stop(shutdownDrainTimeout, logger)
+			}()
+		}
+		stopGracefully(grpcServer, shutdownDrainTimeout, logger)
+		drained.Wait()
+		if err := <-serveErr; err != nil {
+			return pderr.Wrap("gRPC Serve() error", err)
+		}
 	}
 
 	logger.Info("finished serving gRPC (PlaydoughService)", zap.String("listen_addr", listenAddr))
 
 	return nil
 }
+
+func prepareDatabase(ctx context.Context, db *sql.DB, automigrate bool) error {
+	if err := db.PingContext(ctx); err != nil {
+		return pderr.Wrap("failed to ping database", err)
+	}
+
+	if automigrate {
+		if err := pddb.RunMigrations(ctx, db); err != nil {
+			return pderr.Wrap("failed to run migrations", err)
+		}
+	}
+
+	return nil
+}
+
+// stopGracefully lets in-flight requests finish, but cancels them if they take
+// longer than the timeout.
+func stopGracefully(grpcServer *grpc.Server, timeout time.Duration, logger *zap.Logger) {
+	stopped := make(chan struct{})
+	go func() {
+		grpcServer.GracefulStop()
+		close(stopped)
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-stopped:
+		logger.Info("drained in-flight requests")
+	case <-timer.C:
+		logger.Warn("drain timeout exceeded; cancelling remaining requests", zap.Duration("drain_timeout", timeout))
+		grpcServer.Stop()
+		<-stopped
+	}
+}
@@ -0,0 +1,94 @@
+package pdservermain
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/steinarvk/playdough/pkg/pdauth"
+	"github.com/steinarvk/playdough/pkg/pdmetrics"
+	"github.com/steinarvk/playdough/proto/pdpb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// serverMetrics holds the metrics recorded by the interceptor. Database pool and
+// key cache metrics are read from their sources when scraped.
+type serverMetrics struct {
+	registry        *pdmetrics.Registry
+	requests        *pdmetrics.CounterVec
+	requestDuration *pdmetrics.HistogramVec
+	logins          *pdmetrics.CounterVec
+	panics          *pdmetrics.CounterVec
+}
+
+func newServerMetrics(db *sql.DB, authValidator *pdauth.AuthValidator) *serverMetrics {
+	registry := pdmetrics.NewRegistry()
+
+	rv := &serverMetrics{
+		registry:        registry,
+		requests:        registry.NewCounter("playdough_requests_total", "Requests handled, over gRPC or the JSON gateway, by method and status code.", "method", "code"),
+		requestDuration: registry.NewHistogram("playdough_request_duration_seconds", "Time taken to handle requests, by method.", pdmetrics.DefaultBuckets, "method"),
+		logins:          registry.NewCounter("playdough_logins_total", "Login attempts by step (password or second_factor) and result.", "step", "result"),
+		panics:          registry.NewCounter("playdough_panics_total", "Panics recovered from while handling requests, by method.", "method"),
+	}
+
+	registry.NewGaugeFunc("playdough_db_connections", "Database connections by state (in_use or idle).", func(emit pdmetrics.EmitFunc) {
+		stats := db.Stats()
+		emit(float64(stats.InUse), "in_use")
+		emit(float64(stats.Idle), "idle")
+	}, "state")
+	registry.NewGaugeFunc("playdough_db_max_open_connections", "Maximum number of open database connections (0 for unlimited).", func(emit pdmetrics.EmitFunc) {
+		emit(float64(db.Stats().MaxOpenConnections))
+	})
+	registry.NewCounterFunc("playdough_db_waits_total", "Times a database connection had to be waited for.", func(emit pdmetrics.EmitFunc) {
+		emit(float64(db.Stats().WaitCount))
+	})
+	registry.NewCounterFunc("playdough_db_wait_seconds_total", "Total time spent waiting for database connections.", func(emit pdmetrics.EmitFunc) {
+		emit(db.Stats().WaitDuration.Seconds())
+	})
+	registry.NewCounterFunc("playdough_db_connections_closed_total", "Database connections closed by the pool, by reason.", func(emit pdmetrics.EmitFunc) {
+		stats := db.Stats()
+		emit(float64(stats.MaxIdleClosed), "max_idle")
+		emit(float64(stats.MaxIdleTimeClosed), "max_idle_time")
+		emit(float64(stats.MaxLifetimeClosed), "max_lifetime")
+	}, "reason")
+
+	registry.NewCounterFunc("playdough_key_cache_lookups_total", "Lookups of JWT signing and validation keys, by whether they were cached.", func(emit pdmetrics.EmitFunc) {
+		stats := authValidator.KeyCacheStats()
+		emit(float64(stats.Hits), "hit")
+		emit(float64(stats.Misses), "miss")
+	}, "result")
+
+	return rv
+}
+
+// loginResult classifies the outcome of a login step for metrics.
+func loginResult(resp any, err error) string {
+	switch status.Code(err) {
+	case codes.OK:
+	case codes.Unauthenticated:
+		return "failure"
+	case codes.ResourceExhausted:
+		return "throttled"
+	default:
+		return "error"
+	}
+
+	if loginResp, ok := resp.(*pdpb.LoginResponse); ok && loginResp.SecondFactorRequired {
+		return "second_factor_required"
+	}
+	return "success"
+}
+
+// observe records a finished request.
+func (m *serverMetrics) observe(method string, resp any, err error, duration time.Duration) {
+	m.requests.Inc(method, status.Code(err).String())
+	m.requestDuration.Observe(duration.Seconds(), method)
+
+	switch method {
+	case pdpb.PlaydoughService_Login_FullMethodName:
+		m.logins.Inc("password", loginResult(resp, err))
+	case pdpb.PlaydoughService_LoginSecondFactor_FullMethodName:
+		m.logins.Inc("second_factor", loginResult(resp, err))
+	}
+}
@@ -0,0 +1,70 @@
+package pdservermain
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/steinarvk/playdough/pkg/pderr"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// errPanic is returned in place of whatever a panicking request would have returned.
+// The caller learns nothing about the panic, which may reveal internals.
+var errPanic = pderr.Error(codes.Internal, "internal error")
+
+// recoveredPanic logs and counts a panic recovered from while handling a request,
+// and returns the error to send instead. It must be called from the deferred
+// function that recovered, so that the logged stack still shows where the panic happened.
+func (m *serverMetrics) recoveredPanic(logger *zap.Logger, method string, recovered any) error {
+	m.panics.Inc(method)
+
+	logger.Error("recovered from panic while handling request",
+		zap.String("method", method),
+		zap.String("panic", fmt.Sprint(recovered)),
+		zap.StackSkip("stack", 1),
+	)
+
+	return errPanic
+}
+
+// unaryRecoveryInterceptor turns panics in the interceptors after it, and in the
+// handler, into Internal errors. It must come first.
+func (m *serverMetrics) unaryRecoveryInterceptor(logger *zap.Logger) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				resp, err = nil, m.recoveredPanic(logger, info.FullMethod, recovered)
+			}
+		}()
+		return handler(ctx, req)
+	}
+}
+
+// streamRecoveryInterceptor is unaryRecoveryInterceptor for streaming methods.
+func (m *serverMetrics) streamRecoveryInterceptor(logger *zap.Logger) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				err = m.recoveredPanic(logger, info.FullMethod, recovered)
+			}
+		}()
+		return handler(srv, ss)
+	}
+}
+
+// chainUnaryInterceptors combines interceptors into one, the first outermost, as
+// grpc.ChainUnaryInterceptor does for a gRPC server.
+func chainUnaryInterceptors(interceptors ...grpc.UnaryServerInterceptor) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		next := handler
+		for i := len(interceptors) - 1; i >= 0; i-- {
+			interceptor, inner := interceptors[i], next
+			next = func(ctx context.Context, req interface{}) (interface{}, error) {
+				return interceptor(ctx, req, info, inner)
+			}
+		}
+		return next(ctx, req)
+	}
+}
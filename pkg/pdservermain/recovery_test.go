@@ -0,0 +1,73 @@
+package pdservermain
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"testing"
+
+	"github.com/steinarvk/playdough/pkg/pdauth"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestRecoveredPanicHidesDetails(t *testing.T) {
+	// Opening does not connect; the pool metrics only need the handle.
+	db, err := sql.Open("postgres", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	metrics := newServerMetrics(db, pdauth.NewValidator(db))
+
+	handle := func() (err error) {
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				err = metrics.recoveredPanic(zap.NewNop(), "/test/Method", recovered)
+			}
+		}()
+		panic("secret internals")
+	}
+
+	err = handle()
+	if st := status.Convert(err); st.Code() != codes.Internal || strings.Contains(st.Message(), "secret") {
+		t.Errorf("recovered panic returned %v, want an Internal error without details", err)
+	}
+
+	var out strings.Builder
+	metrics.registry.Write(&out)
+	if !strings.Contains(out.String(), `playdough_panics_total{method="/test/Method"} 1`) {
+		t.Errorf("panic was not counted:\n%s", out.String())
+	}
+}
+
+func TestRecoveryInterceptorCatchesPanicsInLaterInterceptors(t *testing.T) {
+	db, err := sql.Open("postgres", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	metrics := newServerMetrics(db, pdauth.NewValidator(db))
+
+	panicking := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		panic("before the handler")
+	}
+	handlerCalled := false
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		handlerCalled = true
+		return "response", nil
+	}
+
+	interceptor := chainUnaryInterceptors(metrics.unaryRecoveryInterceptor(zap.NewNop()), panicking)
+	resp, err := interceptor(context.Background(), "request", &grpc.UnaryServerInfo{FullMethod: "/test/Method"}, handler)
+	if resp != nil || status.Code(err) != codes.Internal {
+		t.Errorf("got (%v, %v), want an Internal error", resp, err)
+	}
+	if handlerCalled {
+		t.Errorf("handler was called after an interceptor panicked")
+	}
+}
@@ -0,0 +1,81 @@
+package pdtestutils
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/steinarvk/playdough/pkg/pddb"
+)
+
+const (
+	TestDatabaseEnvVar = "PLAYDOUGH_TEST_POSTGRES_DB"
+)
+
+func withSearchPath(connectionString, schema string) (string, error) {
+	if strings.HasPrefix(connectionString, "postgres://") || strings.HasPrefix(connectionString, "postgresql://") {
+		u, err := url.Parse(connectionString)
+		if err != nil {
+			return "", err
+		}
+		q := u.Query()
+		q.Set("search_path", schema)
+		u.RawQuery = q.Encode()
+		return u.String(), nil
+	}
+
+	return fmt.Sprintf("%s search_path=%s", connectionString, schema), nil
+}
+
+// OpenTestDatabase connects to the postgres database given by the
+// PLAYDOUGH_TEST_POSTGRES_DB environment variable, skipping the test if it is unset.
+// Each call gets a fresh, fully migrated schema which is dropped when the test finishes.
+func OpenTestDatabase(t testing.TB) *sql.DB {
+	t.Helper()
+
+	connectionString := os.Getenv(TestDatabaseEnvVar)
+	if connectionString == "" {
+		t.Skipf("skipping test requiring postgres (%s not set)", TestDatabaseEnvVar)
+	}
+
+	ctx := context.Background()
+
+	adminDB, err := sql.Open("postgres", connectionString)
+	if err != nil {
+		t.Fatalf("failed to open test database: %v", err)
+	}
+	t.Cleanup(func() { adminDB.Close() })
+
+	schema := "playdough_test_" + strings.ReplaceAll(uuid.NewString(), "-", "")
+
+	if _, err := adminDB.ExecContext(ctx, fmt.Sprintf("CREATE SCHEMA %s", schema)); err != nil {
+		t.Fatalf("failed to create test schema: %v", err)
+	}
+	t.Cleanup(func() {
+		if _, err := adminDB.ExecContext(ctx, fmt.Sprintf("DROP SCHEMA %s CASCADE", schema)); err != nil {
+			t.Errorf("failed to drop test schema %q: %v", schema, err)
+		}
+	})
+
+	schemaConnectionString, err := withSearchPath(connectionString, schema)
+	if err != nil {
+		t.Fatalf("failed to construct test connection string: %v", err)
+	}
+
+	db, err := sql.Open("postgres", schemaConnectionString)
+	if err != nil {
+		t.Fatalf("failed to open test database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	if err := pddb.RunMigrations(ctx, db); err != nil {
+		t.Fatalf("failed to migrate test database: %v", err)
+	}
+
+	return db
+}
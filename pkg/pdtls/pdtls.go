@@ -0,0 +1,270 @@
+// Package pdtls builds TLS configurations for the gRPC server and client from PEM
+// files, reloading the files when they change so that certificates can be rotated
+// without a restart.
+package pdtls
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/steinarvk/playdough/pkg/logging"
+	"github.com/steinarvk/playdough/pkg/pderr"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+)
+
+// How often to check whether the files have changed. Checks happen lazily, on
+// handshakes, so an idle server does not touch the files at all.
+var reloadCheckInterval = time.Second
+
+type ServerParams struct {
+	CertFile string
+	KeyFile  string
+	// If set, client certificates signed by these CAs are verified.
+	ClientCAFile string
+	// Reject clients without a valid certificate. Requires ClientCAFile.
+	RequireClientCert bool
+}
+
+type ClientParams struct {
+	// If unset, the system's root CAs are used.
+	CACertFile string
+	// If set, presented to servers that ask for a client certificate.
+	CertFile string
+	// Defaults to CertFile, for PEM files holding both the certificate and the key.
+	KeyFile string
+}
+
+func modTime(path string) (time.Time, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.ModTime(), nil
+}
+
+// reloadingFiles holds a value loaded from files, reloading it when any of the
+// files' modification times change. If reloading fails, e.g. because a new
+// certificate has been written but its key has not, the old value is kept.
+type reloadingFiles[T any] struct {
+	paths  []string
+	load   func() (T, error)
+	logger *zap.Logger
+
+	mu        sync.Mutex
+	value     T
+	modTimes  []time.Time
+	lastCheck time.Time
+}
+
+func newReloadingFiles[T any](ctx context.Context, load func() (T, error), paths ...string) (*reloadingFiles[T], error) {
+	rv := &reloadingFiles[T]{
+		paths:  paths,
+		load:   load,
+		logger: logging.FromContext(ctx),
+	}
+
+	if err := rv.reload(); err != nil {
+		return nil, err
+	}
+
+	return rv, nil
+}
+
+func (r *reloadingFiles[T]) reload() error {
+	modTimes := make([]time.Time, len(r.paths))
+	for i, path := range r.paths {
+		t, err := modTime(path)
+		if err != nil {
+			return pderr.Wrap("failed to stat "+path, err)
+		}
+		modTimes[i] = t
+	}
+
+	value, err := r.load()
+	if err != nil {
+		return err
+	}
+
+	r.value = value
+	r.modTimes = modTimes
+	return nil
+}
+
+func (r *reloadingFiles[T]) changed() bool {
+	for i, path := range r.paths {
+		t, err := modTime(path)
+		if err != nil || !t.Equal(r.modTimes[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *reloadingFiles[T]) get() T {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if time.Since(r.lastCheck) < reloadCheckInterval {
+		return r.value
+	}
+	r.lastCheck = time.Now()
+
+	if !r.changed() {
+		return r.value
+	}
+
+	if err := r.reload(); err != nil {
+		r.logger.Warn("failed to reload TLS files; keeping the old ones", zap.Strings("paths", r.paths), zap.Error(err))
+		return r.value
+	}
+
+	r.logger.Info("reloaded TLS files", zap.Strings("paths", r.paths))
+
+	return r.value
+}
+
+func loadKeyPair(certFile, keyFile string) func() (*tls.Certificate, error) {
+	return func() (*tls.Certificate, error) {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, pderr.Wrap("failed to load TLS key pair", err)
+		}
+		return &cert, nil
+	}
+}
+
+func loadCertPool(path string) func() (*x509.CertPool, error) {
+	return func() (*x509.CertPool, error) {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, pderr.Wrap("failed to read CA certificates", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, pderr.BadInput("no PEM certificates found", "ca_file", path)
+		}
+		return pool, nil
+	}
+}
+
+// ServerConfig returns a TLS configuration for the server. The files are loaded
+// once immediately, so that configuration errors are reported at startup.
+func ServerConfig(ctx context.Context, params ServerParams) (*tls.Config, error) {
+	if params.CertFile == "" {
+		return nil, pderr.MissingRequiredFlag("--tls-cert")
+	}
+	if params.KeyFile == "" {
+		return nil, pderr.MissingRequiredFlag("--tls-key")
+	}
+	if params.RequireClientCert && params.ClientCAFile == "" {
+		return nil, pderr.MissingRequiredFlag("--client-ca")
+	}
+
+	keyPair, err := newReloadingFiles(ctx, loadKeyPair(params.CertFile, params.KeyFile), params.CertFile, params.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var clientCAs *reloadingFiles[*x509.CertPool]
+	if params.ClientCAFile != "" {
+		clientCAs, err = newReloadingFiles(ctx, loadCertPool(params.ClientCAFile), params.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			rv := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*keyPair.get()},
+				NextProtos:   []string{"h2"},
+			}
+
+			if clientCAs != nil {
+				rv.ClientCAs = clientCAs.get()
+				rv.ClientAuth = tls.VerifyClientCertIfGiven
+				if params.RequireClientCert {
+					rv.ClientAuth = tls.RequireAndVerifyClientCert
+				}
+			}
+
+			return rv, nil
+		},
+	}, nil
+}
+
+// ClientConfig returns a TLS configuration for the client.
+func ClientConfig(ctx context.Context, params ClientParams) (*tls.Config, error) {
+	rv := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if params.CACertFile != "" {
+		pool, err := loadCertPool(params.CACertFile)()
+		if err != nil {
+			return nil, err
+		}
+		rv.RootCAs = pool
+	}
+
+	if params.CertFile != "" {
+		keyFile := params.KeyFile
+		if keyFile == "" {
+			keyFile = params.CertFile
+		}
+
+		keyPair, err := newReloadingFiles(ctx, loadKeyPair(params.CertFile, keyFile), params.CertFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+
+		rv.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return keyPair.get(), nil
+		}
+	}
+
+	return rv, nil
+}
+
+// VerifiedClientName returns the common name of the client certificate of the
+// gRPC request in the context, if the client presented one that was verified.
+func VerifiedClientName(ctx context.Context) (string, bool) {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return "", false
+	}
+
+	tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(tlsInfo.State.VerifiedChains) == 0 || len(tlsInfo.State.VerifiedChains[0]) == 0 {
+		return "", false
+	}
+
+	name := tlsInfo.State.VerifiedChains[0][0].Subject.CommonName
+	return name, name != ""
+}
+
+// WithNextProtos returns a copy of a configuration from ServerConfig that
+// negotiates the given application protocols rather than only HTTP/2, which is
+// what gRPC requires.
+func WithNextProtos(config *tls.Config, protos ...string) *tls.Config {
+	rv := config.Clone()
+	rv.NextProtos = protos
+	rv.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		perClient, err := config.GetConfigForClient(hello)
+		if err != nil {
+			return nil, err
+		}
+		perClient.NextProtos = protos
+		return perClient, nil
+	}
+	return rv
+}
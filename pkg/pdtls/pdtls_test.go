@@ -0,0 +1,219 @@
+package pdtls
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	cryptorand "crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func makeTestCert(t *testing.T, commonName string, parent *testCert) *testCert {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), cryptorand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serial, err := cryptorand.Int(cryptorand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{commonName},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(cryptorand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testCert{cert: cert, key: key}
+}
+
+// write writes the certificate and key as PEM files, returning their paths.
+func (c *testCert) write(t *testing.T, dir, name string) (string, string) {
+	t.Helper()
+
+	keyDER, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile := filepath.Join(dir, name+".crt")
+	keyFile := filepath.Join(dir, name+".key")
+
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	return certFile, keyFile
+}
+
+func handshake(t *testing.T, serverConfig, clientConfig *tls.Config) (tls.ConnectionState, error) {
+	t.Helper()
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	type result struct {
+		state tls.ConnectionState
+		err   error
+	}
+	serverResult := make(chan result, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			serverResult <- result{err: err}
+			return
+		}
+		defer conn.Close()
+
+		tlsConn := conn.(*tls.Conn)
+		err = tlsConn.Handshake()
+		serverResult <- result{state: tlsConn.ConnectionState(), err: err}
+	}()
+
+	conn, err := tls.Dial("tcp", listener.Addr().String(), clientConfig)
+	if err == nil {
+		defer conn.Close()
+	}
+
+	got := <-serverResult
+	return got.state, got.err
+}
+
+func TestMutualTLS(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	ca := makeTestCert(t, "test CA", nil)
+	caFile, _ := ca.write(t, dir, "ca")
+	serverCertFile, serverKeyFile := makeTestCert(t, "localhost", ca).write(t, dir, "server")
+	clientCertFile, clientKeyFile := makeTestCert(t, "alice", ca).write(t, dir, "client")
+
+	serverConfig, err := ServerConfig(ctx, ServerParams{
+		CertFile:          serverCertFile,
+		KeyFile:           serverKeyFile,
+		ClientCAFile:      caFile,
+		RequireClientCert: true,
+	})
+	if err != nil {
+		t.Fatalf("ServerConfig() failed: %v", err)
+	}
+
+	clientConfig, err := ClientConfig(ctx, ClientParams{
+		CACertFile: caFile,
+		CertFile:   clientCertFile,
+		KeyFile:    clientKeyFile,
+	})
+	if err != nil {
+		t.Fatalf("ClientConfig() failed: %v", err)
+	}
+	clientConfig.ServerName = "localhost"
+
+	state, err := handshake(t, serverConfig, clientConfig)
+	if err != nil {
+		t.Fatalf("handshake failed: %v", err)
+	}
+	if len(state.VerifiedChains) == 0 || state.VerifiedChains[0][0].Subject.CommonName != "alice" {
+		t.Errorf("server did not verify the client certificate for alice: %+v", state.VerifiedChains)
+	}
+
+	anonymousConfig, err := ClientConfig(ctx, ClientParams{CACertFile: caFile})
+	if err != nil {
+		t.Fatalf("ClientConfig() failed: %v", err)
+	}
+	anonymousConfig.ServerName = "localhost"
+
+	if _, err := handshake(t, serverConfig, anonymousConfig); err == nil {
+		t.Errorf("handshake without a client certificate succeeded despite RequireClientCert")
+	}
+}
+
+func TestKeyPairIsReloadedWhenChanged(t *testing.T) {
+	oldInterval := reloadCheckInterval
+	reloadCheckInterval = 0
+	defer func() { reloadCheckInterval = oldInterval }()
+
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	ca := makeTestCert(t, "test CA", nil)
+	certFile, keyFile := makeTestCert(t, "localhost", ca).write(t, dir, "server")
+
+	keyPair, err := newReloadingFiles(ctx, loadKeyPair(certFile, keyFile), certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	original := keyPair.get()
+
+	if got := keyPair.get(); got != original {
+		t.Errorf("key pair was reloaded although the files did not change")
+	}
+
+	makeTestCert(t, "localhost", ca).write(t, dir, "server")
+	future := time.Now().Add(time.Minute)
+	for _, path := range []string{certFile, keyFile} {
+		if err := os.Chtimes(path, future, future); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rotated := keyPair.get()
+	if rotated == original {
+		t.Fatalf("key pair was not reloaded after the files changed")
+	}
+
+	if err := os.WriteFile(keyFile, []byte("not a key"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	later := future.Add(time.Minute)
+	if err := os.Chtimes(keyFile, later, later); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := keyPair.get(); got != rotated {
+		t.Errorf("a broken key pair replaced the working one")
+	}
+}
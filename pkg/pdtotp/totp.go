@@ -0,0 +1,100 @@
+// Package pdtotp implements time-based one-time passwords (RFC 6238) as used by
+// common authenticator apps: HMAC-SHA1, six digits and a 30 second period.
+package pdtotp
+
+import (
+	"crypto/hmac"
+	cryptorand "crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"time"
+)
+
+const (
+	Digits = 6
+	Period = 30 * time.Second
+
+	secretSize = 20
+)
+
+var secretEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func GenerateSecret() ([]byte, error) {
+	secret := make([]byte, secretSize)
+	if _, err := cryptorand.Read(secret); err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
+
+// EncodeSecret returns the secret in the base32 form that users type into authenticator apps.
+func EncodeSecret(secret []byte) string {
+	return secretEncoding.EncodeToString(secret)
+}
+
+// URI returns an otpauth:// URI for the secret, suitable for rendering as a QR code.
+func URI(issuer, accountName string, secret []byte) string {
+	label := url.PathEscape(issuer + ":" + accountName)
+
+	query := url.Values{}
+	query.Set("secret", EncodeSecret(secret))
+	query.Set("issuer", issuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprint(Digits))
+	query.Set("period", fmt.Sprint(int(Period/time.Second)))
+
+	return "otpauth://totp/" + label + "?" + query.Encode()
+}
+
+// Counter returns the time step that t falls in.
+func Counter(t time.Time) int64 {
+	return t.Unix() / int64(Period/time.Second)
+}
+
+func codeForCounter(secret []byte, counter int64) string {
+	var message [8]byte
+	binary.BigEndian.PutUint64(message[:], uint64(counter))
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(message[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	modulus := uint32(1)
+	for i := 0; i < Digits; i++ {
+		modulus *= 10
+	}
+
+	return fmt.Sprintf("%0*d", Digits, value%modulus)
+}
+
+// Code returns the code valid at time t.
+func Code(secret []byte, t time.Time) string {
+	return codeForCounter(secret, Counter(t))
+}
+
+// Validate checks a code against the time steps within skew steps of t, to allow
+// for clock drift and slow typing. On success it returns the matching time step,
+// which callers should remember in order to reject replays of the same code.
+func Validate(secret []byte, code string, t time.Time, skew int) (int64, bool) {
+	if len(code) != Digits {
+		return 0, false
+	}
+
+	current := Counter(t)
+
+	for delta := -skew; delta <= skew; delta++ {
+		counter := current + int64(delta)
+		if subtle.ConstantTimeCompare([]byte(codeForCounter(secret, counter)), []byte(code)) == 1 {
+			return counter, true
+		}
+	}
+
+	return 0, false
+}
@@ -0,0 +1,67 @@
+package pdtotp
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// Test vectors from RFC 6238 appendix B (SHA1), truncated to six digits.
+var rfcSecret = []byte("12345678901234567890")
+
+func TestCodeMatchesRFCVectors(t *testing.T) {
+	for _, tc := range []struct {
+		unixTime int64
+		want     string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	} {
+		if got := Code(rfcSecret, time.Unix(tc.unixTime, 0)); got != tc.want {
+			t.Errorf("Code(t=%d) = %q, want %q", tc.unixTime, got, tc.want)
+		}
+	}
+}
+
+func TestValidateAllowsSkew(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	code := Code(rfcSecret, now)
+
+	for _, tc := range []struct {
+		name string
+		at   time.Time
+		want bool
+	}{
+		{"same step", now, true},
+		{"one step later", now.Add(Period), true},
+		{"one step earlier", now.Add(-Period), true},
+		{"two steps later", now.Add(2 * Period), false},
+	} {
+		counter, ok := Validate(rfcSecret, code, tc.at, 1)
+		if ok != tc.want {
+			t.Errorf("%s: Validate() = %v, want %v", tc.name, ok, tc.want)
+		}
+		if ok && counter != Counter(now) {
+			t.Errorf("%s: Validate() matched step %d, want %d", tc.name, counter, Counter(now))
+		}
+	}
+
+	if _, ok := Validate(rfcSecret, "12345", now, 1); ok {
+		t.Errorf("Validate() accepted a code of the wrong length")
+	}
+}
+
+func TestURI(t *testing.T) {
+	uri := URI("playdough", "alice", rfcSecret)
+
+	if !strings.HasPrefix(uri, "otpauth://totp/playdough:alice?") {
+		t.Errorf("URI() = %q, want otpauth://totp/playdough:alice?...", uri)
+	}
+	if !strings.Contains(uri, "secret="+EncodeSecret(rfcSecret)) {
+		t.Errorf("URI() = %q, missing secret", uri)
+	}
+}
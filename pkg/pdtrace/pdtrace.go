@@ -0,0 +1,266 @@
+// Package pdtrace implements request-scoped tracing: spans with trace and span
+// IDs, parent/child relationships and attributes, propagated between processes
+// with W3C trace context (traceparent) headers.
+//
+// The model follows OpenTelemetry's, but finished spans are handed to an
+// Exporter rather than to an OpenTelemetry SDK; LogExporter writes them to zap.
+package pdtrace
+
+import (
+	"context"
+	cryptorand "crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"math/rand/v2"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// TraceparentHeader is the W3C trace context header, also used as gRPC metadata.
+const TraceparentHeader = "traceparent"
+
+type TraceID [16]byte
+
+func (t TraceID) String() string { return hex.EncodeToString(t[:]) }
+func (t TraceID) IsValid() bool  { return t != TraceID{} }
+
+type SpanID [8]byte
+
+func (s SpanID) String() string { return hex.EncodeToString(s[:]) }
+func (s SpanID) IsValid() bool  { return s != SpanID{} }
+
+// SpanContext identifies a span, possibly in another process.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+}
+
+// Traceparent formats the span context as a version 00 traceparent header.
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return "00-" + sc.TraceID.String() + "-" + sc.SpanID.String() + "-" + flags
+}
+
+// ParseTraceparent parses a traceparent header. Unknown future versions are
+// accepted as long as they start with the version 00 fields, as the spec requires.
+func ParseTraceparent(header string) (SpanContext, bool) {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return SpanContext{}, false
+	}
+
+	var rv SpanContext
+	var flags [1]byte
+	if len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return SpanContext{}, false
+	}
+	if _, err := hex.Decode(rv.TraceID[:], []byte(parts[1])); err != nil {
+		return SpanContext{}, false
+	}
+	if _, err := hex.Decode(rv.SpanID[:], []byte(parts[2])); err != nil {
+		return SpanContext{}, false
+	}
+	if _, err := hex.Decode(flags[:], []byte(parts[3])); err != nil {
+		return SpanContext{}, false
+	}
+	if !rv.TraceID.IsValid() || !rv.SpanID.IsValid() {
+		return SpanContext{}, false
+	}
+
+	rv.Sampled = flags[0]&1 == 1
+	return rv, true
+}
+
+// FinishedSpan is what an Exporter receives when a span ends.
+type FinishedSpan struct {
+	Name       string
+	Context    SpanContext
+	ParentID   SpanID
+	StartTime  time.Time
+	EndTime    time.Time
+	Attributes []zap.Field
+	Err        error
+}
+
+// An Exporter receives sampled spans as they end. It must be safe for concurrent use.
+type Exporter func(*FinishedSpan)
+
+// LogExporter logs each finished span.
+func LogExporter(logger *zap.Logger) Exporter {
+	return func(span *FinishedSpan) {
+		fields := []zap.Field{
+			zap.String("span_name", span.Name),
+			zap.Stringer("trace_id", span.Context.TraceID),
+			zap.Stringer("span_id", span.Context.SpanID),
+			zap.Duration("duration", span.EndTime.Sub(span.StartTime)),
+		}
+		if span.ParentID.IsValid() {
+			fields = append(fields, zap.Stringer("parent_span_id", span.ParentID))
+		}
+		if span.Err != nil {
+			fields = append(fields, zap.Error(span.Err))
+		}
+		fields = append(fields, span.Attributes...)
+
+		logger.Info("span finished", fields...)
+	}
+}
+
+type Tracer struct {
+	exporter Exporter
+	// The fraction of new traces to sample. Traces continued from a traceparent
+	// header keep the caller's sampling decision.
+	sampleRatio float64
+}
+
+func NewTracer(exporter Exporter, sampleRatio float64) *Tracer {
+	return &Tracer{
+		exporter:    exporter,
+		sampleRatio: sampleRatio,
+	}
+}
+
+type Span struct {
+	tracer    *Tracer
+	name      string
+	context   SpanContext
+	parentID  SpanID
+	startTime time.Time
+
+	mu         sync.Mutex
+	attributes []zap.Field
+	err        error
+	ended      bool
+}
+
+type contextKey struct{}
+
+// FromContext returns the current span, or nil if there is none.
+func FromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(contextKey{}).(*Span)
+	return span
+}
+
+func newSpanID() SpanID {
+	var rv SpanID
+	for !rv.IsValid() {
+		if _, err := cryptorand.Read(rv[:]); err != nil {
+			panic(fmt.Sprintf("failed to generate span ID: %v", err))
+		}
+	}
+	return rv
+}
+
+func newTraceID() TraceID {
+	var rv TraceID
+	for !rv.IsValid() {
+		if _, err := cryptorand.Read(rv[:]); err != nil {
+			panic(fmt.Sprintf("failed to generate trace ID: %v", err))
+		}
+	}
+	return rv
+}
+
+func (t *Tracer) start(ctx context.Context, name string, traceID TraceID, parentID SpanID, sampled bool) (context.Context, *Span) {
+	span := &Span{
+		tracer: t,
+		name:   name,
+		context: SpanContext{
+			TraceID: traceID,
+			SpanID:  newSpanID(),
+			Sampled: sampled,
+		},
+		parentID:  parentID,
+		startTime: time.Now(),
+	}
+	return context.WithValue(ctx, contextKey{}, span), span
+}
+
+// StartRemote starts the server-side span of a request, continuing the trace of
+// the traceparent header if it is valid. forceSample samples the span regardless
+// of the caller's decision or the sample ratio, e.g. when debugging a request.
+func (t *Tracer) StartRemote(ctx context.Context, name, traceparent string, forceSample bool) (context.Context, *Span) {
+	if parent, ok := ParseTraceparent(traceparent); ok {
+		return t.start(ctx, name, parent.TraceID, parent.SpanID, parent.Sampled || forceSample)
+	}
+
+	sampled := forceSample || (t.sampleRatio > 0 && rand.Float64() < t.sampleRatio)
+	return t.start(ctx, name, newTraceID(), SpanID{}, sampled)
+}
+
+// StartChild starts a child of the current span. If there is no current span,
+// the context is returned as is, along with a nil span, which is safe to use.
+func StartChild(ctx context.Context, name string) (context.Context, *Span) {
+	parent := FromContext(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+
+	return parent.tracer.start(ctx, name, parent.context.TraceID, parent.context.SpanID, parent.context.Sampled)
+}
+
+// Context returns the span's context, or the zero value for a nil span.
+func (s *Span) Context() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.context
+}
+
+func (s *Span) SetAttributes(fields ...zap.Field) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.attributes = append(s.attributes, fields...)
+}
+
+// SetError records that the operation failed.
+func (s *Span) SetError(err error) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.err = err
+}
+
+// End finishes the span and, if it is sampled, exports it. Only the first call has any effect.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	finished := &FinishedSpan{
+		Name:       s.name,
+		Context:    s.context,
+		ParentID:   s.parentID,
+		StartTime:  s.startTime,
+		EndTime:    time.Now(),
+		Attributes: s.attributes,
+		Err:        s.err,
+	}
+	s.mu.Unlock()
+
+	if s.context.Sampled && s.tracer.exporter != nil {
+		s.tracer.exporter(finished)
+	}
+}
@@ -0,0 +1,99 @@
+package pdtrace
+
+import (
+	"context"
+	"sync"
+	"testing"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	const valid = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+	sc, ok := ParseTraceparent(valid)
+	if !ok {
+		t.Fatalf("ParseTraceparent(%q) failed", valid)
+	}
+	if !sc.Sampled || sc.TraceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" || sc.SpanID.String() != "00f067aa0ba902b7" {
+		t.Errorf("ParseTraceparent(%q) = %+v", valid, sc)
+	}
+	if got := sc.Traceparent(); got != valid {
+		t.Errorf("Traceparent() = %q, want %q", got, valid)
+	}
+
+	for _, header := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473x-00f067aa0ba902b7-01",
+	} {
+		if _, ok := ParseTraceparent(header); ok {
+			t.Errorf("ParseTraceparent(%q) succeeded, want failure", header)
+		}
+	}
+
+	if _, ok := ParseTraceparent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-future"); !ok {
+		t.Errorf("ParseTraceparent() rejected a future version with extra fields")
+	}
+}
+
+type recordingExporter struct {
+	mu    sync.Mutex
+	spans []*FinishedSpan
+}
+
+func (r *recordingExporter) export(span *FinishedSpan) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.spans = append(r.spans, span)
+}
+
+func TestSpansContinueRemoteTrace(t *testing.T) {
+	exporter := &recordingExporter{}
+	tracer := NewTracer(exporter.export, 0)
+
+	const traceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+	ctx, root := tracer.StartRemote(context.Background(), "rpc", traceparent, false)
+	_, child := StartChild(ctx, "query")
+	child.End()
+	root.End()
+	root.End()
+
+	if len(exporter.spans) != 2 {
+		t.Fatalf("exported %d spans, want 2", len(exporter.spans))
+	}
+
+	exportedChild, exportedRoot := exporter.spans[0], exporter.spans[1]
+	if exportedRoot.Context.TraceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" || exportedRoot.ParentID.String() != "00f067aa0ba902b7" {
+		t.Errorf("root span did not continue the remote trace: %+v", exportedRoot)
+	}
+	if exportedChild.Context.TraceID != exportedRoot.Context.TraceID || exportedChild.ParentID != exportedRoot.Context.SpanID {
+		t.Errorf("child span is not a child of the root span: %+v", exportedChild)
+	}
+}
+
+func TestUnsampledSpansAreNotExported(t *testing.T) {
+	exporter := &recordingExporter{}
+	tracer := NewTracer(exporter.export, 0)
+
+	_, span := tracer.StartRemote(context.Background(), "rpc", "", false)
+	if !span.Context().TraceID.IsValid() {
+		t.Errorf("unsampled span has no trace ID")
+	}
+	span.End()
+
+	_, forced := tracer.StartRemote(context.Background(), "rpc", "", true)
+	forced.End()
+
+	if len(exporter.spans) != 1 || exporter.spans[0].Context != forced.Context() {
+		t.Errorf("exported %d spans, want only the force-sampled one", len(exporter.spans))
+	}
+
+	// Without a current span, children are nil but safe to use.
+	_, orphan := StartChild(context.Background(), "query")
+	orphan.SetAttributes()
+	orphan.End()
+}
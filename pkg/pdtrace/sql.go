@@ -0,0 +1,122 @@
+package pdtrace
+
+import (
+	"context"
+	"database/sql/driver"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// Statements are recorded without their arguments, which may be secret, and
+// shortened to keep spans small.
+const maxStatementLength = 200
+
+func summarizeStatement(query string) string {
+	query = strings.Join(strings.Fields(query), " ")
+	if len(query) > maxStatementLength {
+		query = query[:maxStatementLength] + "..."
+	}
+	return query
+}
+
+// WrapConnector returns a connector whose connections record a span for each
+// query and statement executed within a traced context, e.g.
+//
+//	db := sql.OpenDB(pdtrace.WrapConnector(connector))
+//
+// The wrapped driver's connections must implement the context-aware driver
+// interfaces, as lib/pq's do. Errors are returned unchanged, so that callers can
+// still inspect driver-specific errors.
+func WrapConnector(connector driver.Connector) driver.Connector {
+	return tracedConnector{connector}
+}
+
+type tracedConnector struct {
+	driver.Connector
+}
+
+func (c tracedConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return tracedConn{conn}, nil
+}
+
+type tracedConn struct {
+	driver.Conn
+}
+
+// startQuerySpan starts a span for a statement, if the context is traced.
+func startQuerySpan(ctx context.Context, name, query string) *Span {
+	_, span := StartChild(ctx, name)
+	span.SetAttributes(zap.String("db.statement", summarizeStatement(query)))
+	return span
+}
+
+func endQuerySpan(span *Span, err error) {
+	if err != nil && err != driver.ErrSkip {
+		span.SetError(err)
+	}
+	span.End()
+}
+
+func (c tracedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	queryer, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+
+	span := startQuerySpan(ctx, "sql.query", query)
+	rows, err := queryer.QueryContext(ctx, query, args)
+	endQuerySpan(span, err)
+	return rows, err
+}
+
+func (c tracedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	execer, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+
+	span := startQuerySpan(ctx, "sql.exec", query)
+	result, err := execer.ExecContext(ctx, query, args)
+	endQuerySpan(span, err)
+	return result, err
+}
+
+func (c tracedConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	if preparer, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		return preparer.PrepareContext(ctx, query)
+	}
+	return c.Conn.Prepare(query)
+}
+
+func (c tracedConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if beginner, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return beginner.BeginTx(ctx, opts)
+	}
+	return c.Conn.Begin()
+}
+
+func (c tracedConn) Ping(ctx context.Context) error {
+	if pinger, ok := c.Conn.(driver.Pinger); ok {
+		return pinger.Ping(ctx)
+	}
+	return nil
+}
+
+func (c tracedConn) ResetSession(ctx context.Context) error {
+	if resetter, ok := c.Conn.(driver.SessionResetter); ok {
+		return resetter.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c tracedConn) IsValid() bool {
+	if validator, ok := c.Conn.(driver.Validator); ok {
+		return validator.IsValid()
+	}
+	return true
+}
@@ -0,0 +1,64 @@
+package pdtrace
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"testing"
+)
+
+type fakeConnector struct{}
+
+func (fakeConnector) Connect(context.Context) (driver.Conn, error) { return fakeConn{}, nil }
+func (fakeConnector) Driver() driver.Driver                        { return nil }
+
+type fakeConn struct{}
+
+func (fakeConn) Prepare(string) (driver.Stmt, error) { return nil, errors.New("not supported") }
+func (fakeConn) Close() error                        { return nil }
+func (fakeConn) Begin() (driver.Tx, error)           { return nil, errors.New("not supported") }
+
+func (fakeConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if query == "FAIL" {
+		return nil, errors.New("query failed")
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func TestQueriesAreTraced(t *testing.T) {
+	exporter := &recordingExporter{}
+	tracer := NewTracer(exporter.export, 1)
+
+	db := sql.OpenDB(WrapConnector(fakeConnector{}))
+	defer db.Close()
+
+	// Queries outside of a trace are not recorded.
+	if _, err := db.ExecContext(context.Background(), "UPDATE things SET x = 1"); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, root := tracer.StartRemote(context.Background(), "rpc", "", false)
+	if _, err := db.ExecContext(ctx, "UPDATE things\n\t\tSET x = $1", 2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.ExecContext(ctx, "FAIL"); err == nil {
+		t.Fatal("expected the query to fail")
+	}
+	root.End()
+
+	if len(exporter.spans) != 3 {
+		t.Fatalf("exported %d spans, want 3", len(exporter.spans))
+	}
+
+	query, failed := exporter.spans[0], exporter.spans[1]
+	if query.Name != "sql.exec" || query.ParentID != root.Context().SpanID {
+		t.Errorf("query span is not a child of the request: %+v", query)
+	}
+	if len(query.Attributes) != 1 || query.Attributes[0].String != "UPDATE things SET x = $1" {
+		t.Errorf("query span attributes = %+v, want the normalized statement", query.Attributes)
+	}
+	if query.Err != nil || failed.Err == nil {
+		t.Errorf("span errors = %v and %v, want only the second query to fail", query.Err, failed.Err)
+	}
+}
@@ -0,0 +1,14 @@
+// Package pdusername defines when two usernames refer to the same account.
+package pdusername
+
+import (
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Canonical returns the form used to look up and deduplicate usernames: Unicode
+// case folded and NFKC-normalized, so that e.g. "Alice", "ALICE" and "ａｌｉｃｅ"
+// are all the same account. Users still see the username as they registered it.
+func Canonical(username string) string {
+	return norm.NFKC.String(cases.Fold().String(norm.NFKC.String(username)))
+}
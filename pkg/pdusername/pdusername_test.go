@@ -0,0 +1,26 @@
+package pdusername
+
+import "testing"
+
+func TestCanonical(t *testing.T) {
+	for _, tc := range []struct {
+		username string
+		want     string
+	}{
+		{"alice", "alice"},
+		{"Alice", "alice"},
+		{"ALICE_99", "alice_99"},
+		{"ａｌｉｃｅ", "alice"},
+		{"Straße", "strasse"},
+		{"ΣΊΣΥΦΟΣ", "σίσυφοσ"},
+		{"Ǆemal", "džemal"},
+	} {
+		if got := Canonical(tc.username); got != tc.want {
+			t.Errorf("Canonical(%q) = %q, want %q", tc.username, got, tc.want)
+		}
+	}
+
+	if Canonical("Straße") != Canonical("STRASSE") {
+		t.Errorf("Canonical() should identify Straße and STRASSE")
+	}
+}